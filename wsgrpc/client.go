@@ -0,0 +1,1085 @@
+package wsgrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ClientOption configures client behavior
+type ClientOption struct {
+	// HTTPHeader is sent with the WebSocket handshake request (e.g. cookies or an Origin
+	// header required by the server's AllowedOrigins)
+	HTTPHeader http.Header
+	// HTTPClient is used to perform the WebSocket handshake (default http.DefaultClient)
+	HTTPClient *http.Client
+	// MaxPayloadSize sets the maximum frame payload size accepted from the server (default 4MB)
+	MaxPayloadSize uint32
+	// MaxMessageSize sets the maximum size of a response message, which v3 servers may
+	// fragment across several frames (default 4MB or MaxPayloadSize, whichever is larger)
+	MaxMessageSize uint32
+	// InitialWindowSize sets the per-stream receive window advertised to the server (default 64KB)
+	InitialWindowSize uint32
+	// InitialConnWindowSize sets the connection-level receive window advertised to the server (default 1MB)
+	InitialConnWindowSize uint32
+	// CompressionThreshold is the message size in bytes below which requests are sent
+	// uncompressed when a compressor is selected with grpc.UseCompressor (default 1KB)
+	CompressionThreshold int
+	// FramePacking writes frames that are queued at the same time as one WebSocket
+	// message when the server announces support for it in its SETTINGS (default: false)
+	FramePacking bool
+	// TextMetadata limits the client to protocol v1, which sends HEADERS in the legacy
+	// "key: value" text format instead of binary metadata blocks. Text metadata cannot
+	// carry line breaks, and -bin values are base64 encoded. Servers that do not
+	// negotiate a subprotocol are always spoken to in v1.
+	TextMetadata bool
+	// AdvertisementTimeout bounds how long Dial waits for the server's flow control
+	// window advertisement. Servers that do not answer in time are assumed to predate
+	// flow control, and the connection runs without windows even if the advertisement
+	// arrives later (default 1s)
+	AdvertisementTimeout time.Duration
+	// SessionID and SessionSecret resume the session of an earlier connection, as
+	// announced in its ServerSettings (PROTOCOL.md Section 5.6). ServerSettings of the
+	// new connection report whether the server resumed it.
+	SessionID     string
+	SessionSecret string
+	// EnableLogging enables debug logging (default: false)
+	EnableLogging bool
+}
+
+// ClientConn is a Go client for the NgGoRPC protocol. It multiplexes RPCs over a
+// single WebSocket connection using odd, client-initiated stream IDs.
+//
+// ClientConn implements grpc.ClientConnInterface, so stubs generated by
+// protoc-gen-go-grpc work unchanged:
+//
+//	conn, err := wsgrpc.Dial(ctx, "ws://localhost:8080/")
+//	client := pb.NewGreeterClient(conn)
+type ClientConn struct {
+	conn         *websocket.Conn
+	version      ProtocolVersion // Negotiated with the WebSocket subprotocol
+	ctx          context.Context
+	cancel       context.CancelFunc
+	options      ClientOption
+	sendQueue    *sendQueue // Frames waiting for the writer loop, control frames first
+	mu           sync.Mutex
+	streams      map[uint32]*clientStream
+	nextStreamID uint32
+	closed       bool  // Set once the read loop has exited
+	closeErr     error // Reason the connection ended
+	draining     bool  // GOAWAY received; no new streams may be opened
+	flow         *connFlowControl
+	// Limits announced by the server's SETTINGS frame (guarded by mu)
+	settings         Settings
+	settingsReceived bool
+	streamsChanged   chan struct{} // Closed and replaced when a stream ends or SETTINGS arrive (guarded by mu)
+}
+
+// Compile-time check that ClientConn can back generated gRPC stubs.
+var _ grpc.ClientConnInterface = (*ClientConn)(nil)
+
+// ProtocolVersion returns the protocol revision negotiated with the server.
+func (cc *ClientConn) ProtocolVersion() ProtocolVersion {
+	return cc.version
+}
+
+// ServerSettings returns the limits the server announced in its SETTINGS frame. It
+// reports false if the server did not send SETTINGS.
+func (cc *ClientConn) ServerSettings() (Settings, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.settings, cc.settingsReceived
+}
+
+// unaryStreamDesc describes a unary call when it is driven through a clientStream.
+var unaryStreamDesc = &grpc.StreamDesc{ServerStreams: false, ClientStreams: false}
+
+// Dial opens a WebSocket connection to an NgGoRPC server (e.g. "ws://localhost:8080/").
+// It returns once the flow control windows have been exchanged with the server, by which
+// time the server's SETTINGS (sent first) have been applied too. The context only bounds
+// this handshake; use Close to tear the connection down.
+func Dial(ctx context.Context, url string, opts ...ClientOption) (*ClientConn, error) {
+	// Default options
+	merged := ClientOption{
+		MaxPayloadSize:        4 * 1024 * 1024, // 4MB default
+		CompressionThreshold:  defaultCompressionThreshold,
+		InitialWindowSize:     defaultInitialWindowSize,
+		InitialConnWindowSize: defaultInitialConnWindowSize,
+		AdvertisementTimeout:  defaultAdvertisementTimeout,
+	}
+
+	// Merge provided options
+	for _, o := range opts {
+		if o.HTTPHeader != nil {
+			merged.HTTPHeader = o.HTTPHeader
+		}
+		if o.HTTPClient != nil {
+			merged.HTTPClient = o.HTTPClient
+		}
+		if o.MaxPayloadSize != 0 {
+			merged.MaxPayloadSize = o.MaxPayloadSize
+		}
+		if o.MaxMessageSize != 0 {
+			merged.MaxMessageSize = o.MaxMessageSize
+		}
+		if o.InitialWindowSize != 0 {
+			merged.InitialWindowSize = o.InitialWindowSize
+		}
+		if o.InitialConnWindowSize != 0 {
+			merged.InitialConnWindowSize = o.InitialConnWindowSize
+		}
+		if o.CompressionThreshold != 0 {
+			merged.CompressionThreshold = o.CompressionThreshold
+		}
+		if o.AdvertisementTimeout != 0 {
+			merged.AdvertisementTimeout = o.AdvertisementTimeout
+		}
+		if o.TextMetadata {
+			merged.TextMetadata = true
+		}
+		if o.FramePacking {
+			merged.FramePacking = true
+		}
+		if o.SessionID != "" {
+			merged.SessionID = o.SessionID
+			merged.SessionSecret = o.SessionSecret
+		}
+		if o.EnableLogging {
+			merged.EnableLogging = true
+		}
+	}
+
+	merged.MaxMessageSize = maxMessageSizeFor(merged.MaxMessageSize, merged.MaxPayloadSize)
+
+	subprotocols := supportedSubprotocols
+	if merged.TextMetadata {
+		subprotocols = []string{SubprotocolV1}
+	}
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader:   merged.HTTPHeader,
+		HTTPClient:   merged.HTTPClient,
+		Subprotocols: subprotocols,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", url, err)
+	}
+
+	// Match the server: allow a full payload plus frame header overhead
+	conn.SetReadLimit(int64(merged.MaxPayloadSize) + 1024)
+
+	connCtx, cancel := context.WithCancel(context.Background())
+	cc := &ClientConn{
+		conn:           conn,
+		version:        protocolVersionFor(conn.Subprotocol()),
+		ctx:            connCtx,
+		cancel:         cancel,
+		options:        merged,
+		sendQueue:      newSendQueue(),
+		streams:        make(map[uint32]*clientStream),
+		nextStreamID:   1, // Client-initiated streams use odd numbers
+		flow:           newConnFlowControl(merged.InitialWindowSize, merged.InitialConnWindowSize),
+		streamsChanged: make(chan struct{}),
+	}
+
+	go cc.writerLoop()
+	go cc.readLoop()
+
+	// v3 servers fragment their responses to fit the payload limit announced here. The
+	// server answers a session with SETTINGS of its own, which arrive before the window
+	// advertisement awaited below.
+	if cc.version.fragmentation() || merged.SessionID != "" {
+		settings := Settings{
+			MaxPayloadSize:        merged.MaxPayloadSize,
+			MaxMessageSize:        merged.MaxMessageSize,
+			InitialWindowSize:     merged.InitialWindowSize,
+			InitialConnWindowSize: merged.InitialConnWindowSize,
+			FramePacking:          cc.version.framePacking(),
+			SessionID:             merged.SessionID,
+			SessionSecret:         merged.SessionSecret,
+		}
+		if err := cc.send(encodeSettings(settings, cc.version.binaryMetadata())); err != nil {
+			_ = cc.Close()
+			return nil, fmt.Errorf("failed to send SETTINGS: %w", err)
+		}
+	}
+
+	// Opt into flow control and wait for the server's advertisement, so no DATA frame
+	// is ever sent without knowing the server's windows. Servers without flow control
+	// never answer; after AdvertisementTimeout streams go out without windows.
+	if err := cc.send(cc.flow.advertisement()); err != nil {
+		_ = cc.Close()
+		return nil, fmt.Errorf("failed to send window advertisement: %w", err)
+	}
+	timer := time.NewTimer(merged.AdvertisementTimeout)
+	defer timer.Stop()
+	select {
+	case <-cc.flow.ready:
+	case <-timer.C:
+		// A server that was merely slow has enabled flow control; the withdrawal turns
+		// it off again before the first stream
+		if cc.flow.settleWithoutAdvertisement() {
+			if err := cc.send(withdrawal); err != nil {
+				_ = cc.Close()
+				return nil, fmt.Errorf("failed to withdraw from flow control: %w", err)
+			}
+		}
+		if merged.EnableLogging {
+			log.Printf("[wsgrpc] No window advertisement from %s, flow control disabled", url)
+		}
+	case <-cc.ctx.Done():
+		_ = cc.Close()
+		return nil, fmt.Errorf("connection closed during handshake")
+	case <-ctx.Done():
+		_ = cc.Close()
+		return nil, fmt.Errorf("waiting for window advertisement: %w", ctx.Err())
+	}
+
+	if merged.EnableLogging {
+		log.Printf("[wsgrpc] Client connected to %s", url)
+	}
+	return cc, nil
+}
+
+// Close closes the connection. All in-flight RPCs fail with codes.Unavailable.
+func (cc *ClientConn) Close() error {
+	err := cc.conn.Close(websocket.StatusNormalClosure, "goodbye")
+	cc.cancel()
+	return err
+}
+
+// Invoke implements grpc.ClientConnInterface for unary RPCs.
+func (cc *ClientConn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	cs, err := cc.newStream(ctx, unaryStreamDesc, method, opts)
+	if err != nil {
+		return err
+	}
+
+	// io.EOF means the server already ended the stream; RecvMsg reports the status.
+	if err := cs.SendMsg(args); err != nil && err != io.EOF {
+		return err
+	}
+	return cs.RecvMsg(reply)
+}
+
+// NewStream implements grpc.ClientConnInterface for streaming RPCs.
+func (cc *ClientConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return cc.newStream(ctx, desc, method, opts)
+}
+
+// newStream allocates a stream ID, registers the stream and sends its HEADERS frame.
+func (cc *ClientConn) newStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts []grpc.CallOption) (*clientStream, error) {
+	codec, err := codecFromCallOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	sendCompressor, err := compressorFromCallOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	streamCtx, streamCancel := context.WithCancel(ctx)
+	cs := &clientStream{
+		ctx:            streamCtx,
+		cancel:         streamCancel,
+		cc:             cc,
+		desc:           desc,
+		method:         method,
+		callOpts:       opts,
+		codec:          codec,
+		sendCompressor: sendCompressor,
+		recvChan:       make(chan recvMessage, 10),
+		headerReady:    make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+
+	cc.mu.Lock()
+	for {
+		if cc.closed {
+			closeErr := cc.closeErr
+			cc.mu.Unlock()
+			streamCancel()
+			return nil, status.Errorf(codes.Unavailable, "connection closed: %v", closeErr)
+		}
+		if cc.draining {
+			cc.mu.Unlock()
+			streamCancel()
+			return nil, status.Error(codes.Unavailable, "connection is draining (GOAWAY received)")
+		}
+		limit := cc.settings.MaxConcurrentStreams
+		if limit == 0 || uint32(len(cc.streams)) < limit {
+			break
+		}
+
+		// Queue the call until a stream ends instead of having the server reject it
+		changed := cc.streamsChanged
+		cc.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			streamCancel()
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-cc.ctx.Done():
+			streamCancel()
+			return nil, status.Error(codes.Unavailable, "connection closed")
+		}
+		cc.mu.Lock()
+	}
+	if cc.nextStreamID > math.MaxUint32-2 {
+		// PROTOCOL.md: "Stream IDs MUST NOT be reused within the lifespan of a single WebSocket connection"
+		cc.mu.Unlock()
+		streamCancel()
+		return nil, status.Error(codes.Unavailable, "stream ID exhaustion")
+	}
+	cs.streamID = cc.nextStreamID
+	cc.nextStreamID += 2 // Increment by 2 to keep odd numbers
+	cs.sendWindow, cs.recvFlow = cc.flow.newStreamWindows()
+	cc.streams[cs.streamID] = cs
+	cc.mu.Unlock()
+
+	// Build HEADERS frame with method path and outgoing metadata
+	md, _ := metadata.FromOutgoingContext(ctx)
+	headers := metadata.Join(metadata.Pairs("path", method), md)
+	headers.Set("content-type", contentTypeFor(codec))
+	headers.Set("grpc-accept-encoding", acceptEncodingFor(sendCompressor))
+	if sendCompressor != nil {
+		headers.Set("grpc-encoding", sendCompressor.Name())
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// Propagate the caller's remaining budget so the handler sees the same deadline
+		headers.Set("grpc-timeout", encodeTimeout(time.Until(deadline)))
+	}
+	block, err := encodeMetadataBlock(headers, cc.version.binaryMetadata())
+	if err != nil {
+		cs.finish(status.New(codes.Internal, err.Error()), nil)
+		return nil, cs.status.Err()
+	}
+	if err := cc.send(encodeFrame(cs.streamID, FlagHEADERS, block)); err != nil {
+		cs.finish(status.New(codes.Unavailable, "connection closed"), nil)
+		return nil, cs.status.Err()
+	}
+
+	// Cancellation of the caller's context resets the stream on the server
+	cs.stopWatch = context.AfterFunc(streamCtx, func() {
+		if cs.finish(status.FromContextError(ctx.Err()), nil) {
+			_ = cc.send(encodeRSTStream(cs.streamID, ErrCodeCancel))
+		}
+	})
+
+	if cc.options.EnableLogging {
+		log.Printf("[wsgrpc] Client opened stream %d for method: %s", cs.streamID, truncateForLog(method))
+	}
+	return cs, nil
+}
+
+// codecFromCallOptions selects the message codec from grpc.ForceCodec /
+// grpc.ForceCodecV2 / grpc.CallContentSubtype call options, defaulting to protobuf.
+func codecFromCallOptions(opts []grpc.CallOption) (encoding.Codec, error) {
+	subtype := "proto"
+	for _, o := range opts {
+		switch o := o.(type) {
+		case grpc.ForceCodecCallOption:
+			return o.Codec, nil
+		case grpc.ForceCodecV2CallOption:
+			return codecV2Bridge{codec: o.CodecV2}, nil
+		case grpc.ContentSubtypeCallOption:
+			subtype = o.ContentSubtype
+		}
+	}
+	codec := lookupCodec(subtype)
+	if codec == nil {
+		return nil, status.Errorf(codes.Internal, "no codec registered for content-subtype %s", subtype)
+	}
+	return codec, nil
+}
+
+// compressorFromCallOptions returns the compressor selected with grpc.UseCompressor,
+// or nil to send uncompressed requests.
+func compressorFromCallOptions(opts []grpc.CallOption) (encoding.Compressor, error) {
+	var c encoding.Compressor
+	for _, o := range opts {
+		if o, ok := o.(grpc.CompressorCallOption); ok {
+			var found bool
+			if c, found = lookupCompressor(o.CompressorType); !found {
+				return nil, status.Errorf(codes.Internal, "grpc: Compressor is not installed for requested grpc-encoding %q", o.CompressorType)
+			}
+		}
+	}
+	return c, nil
+}
+
+// acceptEncodingFor lists the encodings the client can decompress: gzip, which this
+// package registers, and the request compressor.
+func acceptEncodingFor(c encoding.Compressor) string {
+	if c == nil || c.Name() == "gzip" {
+		return "gzip"
+	}
+	return "gzip," + c.Name()
+}
+
+// send queues a frame for the writer loop, which owns it from then on. PONGs,
+// RST_STREAM and WINDOW_UPDATE overtake queued DATA; see sendQueue.
+func (cc *ClientConn) send(frame []byte) error {
+	return cc.sendQueue.push(cc.ctx, frame)
+}
+
+// sendBuffer is send for a frame in a pooled buffer.
+func (cc *ClientConn) sendBuffer(buf *[]byte) error {
+	return cc.sendQueue.pushBuffer(cc.ctx, buf)
+}
+
+// writerLoop is the actor goroutine that serializes all writes to the WebSocket
+func (cc *ClientConn) writerLoop() {
+	for {
+		frame, err := cc.sendQueue.nextMessage(cc.ctx, cc.packLimit())
+		if err != nil {
+			return
+		}
+		err = cc.conn.Write(cc.ctx, websocket.MessageBinary, *frame)
+		putFrameBuffer(frame)
+		if err != nil {
+			if cc.options.EnableLogging {
+				log.Printf("[wsgrpc] Client write error: %v, cancelling connection", err)
+			}
+			cc.cancel()
+			return
+		}
+	}
+}
+
+// readLoop decodes incoming frames and routes them to their streams until the
+// connection fails, then fails every stream that is still open.
+func (cc *ClientConn) readLoop() {
+	var err error
+	malformed := false
+	for {
+		var msgType websocket.MessageType
+		var data []byte
+		msgType, data, err = cc.conn.Read(cc.ctx)
+		if err != nil {
+			break
+		}
+
+		if msgType != websocket.MessageBinary {
+			continue
+		}
+
+		// v3 servers may pack several frames into one message (PROTOCOL.md Section 2.3)
+		for len(data) > 0 {
+			var raw []byte
+			if cc.version.framePacking() {
+				raw, data = nextPackedFrame(data)
+			} else {
+				raw, data = data, nil
+			}
+
+			frame, decodeErr := decodeFrame(raw, cc.options.MaxPayloadSize)
+			if decodeErr != nil {
+				// Frame boundaries cannot be trusted after a malformed frame
+				err = fmt.Errorf("malformed frame: %w", decodeErr)
+				malformed = true
+				break
+			}
+
+			cc.handleFrame(frame)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if cc.options.EnableLogging {
+		log.Printf("[wsgrpc] Client connection closed: %v", err)
+	}
+
+	cc.mu.Lock()
+	cc.closed = true
+	cc.closeErr = err
+	streams := make([]*clientStream, 0, len(cc.streams))
+	for _, cs := range cc.streams {
+		streams = append(streams, cs)
+	}
+	cc.mu.Unlock()
+
+	if malformed {
+		_ = cc.conn.Close(websocket.StatusProtocolError, "malformed frame")
+	}
+
+	for _, cs := range streams {
+		cs.finish(status.New(codes.Unavailable, "connection closed"), nil)
+	}
+
+	cc.cancel()
+	cc.sendQueue.close()
+}
+
+// packLimit returns the size up to which the writer loop packs frames into one
+// WebSocket message, or 0 when frames are written one per message.
+func (cc *ClientConn) packLimit() int {
+	if !cc.options.FramePacking || !cc.version.framePacking() {
+		return 0
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.settings.FramePacking {
+		return 0
+	}
+	return packLimitFor(cc.settings.MaxPayloadSize)
+}
+
+// handleFrame routes a single decoded frame.
+func (cc *ClientConn) handleFrame(frame *Frame) {
+	// Connection-level control frames
+	if frame.StreamID == 0 {
+		if frame.Flags&FlagPING != 0 {
+			if err := cc.send(encodeFrame(0, FlagPONG, []byte{})); err != nil && cc.options.EnableLogging {
+				log.Printf("[wsgrpc] Client failed to send PONG: %v", err)
+			}
+		} else if frame.Flags&FlagWINDOW_UPDATE != 0 {
+			if len(frame.Payload) == 8 {
+				// The server's answer to our advertisement
+				cc.flow.enable(binary.BigEndian.Uint32(frame.Payload[0:4]), binary.BigEndian.Uint32(frame.Payload[4:8]))
+			} else if w := cc.flow.connSendWindow(); w != nil && len(frame.Payload) == 4 {
+				w.add(int64(binary.BigEndian.Uint32(frame.Payload)))
+			}
+		} else if frame.Flags&FlagRST_STREAM != 0 && len(frame.Payload) >= 8 {
+			cc.handleGoAway(binary.BigEndian.Uint32(frame.Payload[0:4]))
+		} else if frame.Flags == FlagHEADERS {
+			cc.handleSettings(frame.Payload)
+		}
+		return
+	}
+
+	// Servers with flow control answer the advertisement before any stream frame
+	cc.flow.settleWithoutAdvertisement()
+
+	// Every DATA frame counts against the connection window, even for finished streams
+	if frame.Flags&FlagDATA != 0 {
+		if connRecv := cc.flow.connRecv(); connRecv != nil {
+			if !connRecv.onReceive(len(frame.Payload)) && cc.options.EnableLogging {
+				log.Printf("[wsgrpc] Server exceeded the connection flow control window")
+			}
+			if increment := connRecv.onRelease(len(frame.Payload)); increment > 0 {
+				_ = cc.send(encodeWindowUpdate(0, increment))
+			}
+		}
+	}
+
+	cc.mu.Lock()
+	cs, ok := cc.streams[frame.StreamID]
+	cc.mu.Unlock()
+
+	if !ok {
+		if cc.options.EnableLogging {
+			log.Printf("[wsgrpc] Client received frame for unknown stream %d (flags 0x%02x)", frame.StreamID, frame.Flags)
+		}
+		return
+	}
+
+	if frame.Flags&FlagRST_STREAM != 0 {
+		code := decodeErrorCode(frame.Payload)
+		cs.finish(status.Newf(rstStatusCode(code), "stream reset by server with error code %d", code), nil)
+	} else if frame.Flags&FlagWINDOW_UPDATE != 0 {
+		if cs.sendWindow != nil && len(frame.Payload) == 4 {
+			cs.sendWindow.add(int64(binary.BigEndian.Uint32(frame.Payload)))
+		}
+	} else if frame.Flags&FlagHEADERS != 0 {
+		header, _, err := decodeMetadataBlock(frame.Payload)
+		if err != nil {
+			_ = cc.send(encodeRSTStream(cs.streamID, ErrCodeProtocolError))
+			cs.finish(status.Newf(codes.Internal, "malformed response headers: %v", err), nil)
+			return
+		}
+		cs.setHeader(header)
+	} else if frame.Flags&FlagDATA != 0 {
+		// Only the first fragment of a message needs credit
+		if cs.recvFlow != nil {
+			if cs.reassembly.pending {
+				cs.recvFlow.onReceiveFragment(len(frame.Payload))
+			} else if !cs.recvFlow.onReceive(len(frame.Payload)) {
+				_ = cc.send(encodeRSTStream(cs.streamID, ErrCodeFlowControlError))
+				cs.finish(status.New(codes.Internal, "server exceeded the stream flow control window"), nil)
+				return
+			}
+		}
+		msg, complete, err := cs.reassembly.add(frame, cc.options.MaxMessageSize)
+		if err != nil {
+			_ = cc.send(encodeRSTStream(cs.streamID, ErrCodeResourceExhausted))
+			cs.finish(status.Newf(codes.ResourceExhausted, "grpc: received message larger than max: %v", err), nil)
+			return
+		}
+		if !complete {
+			// The credit of the whole message is returned once it is consumed
+			return
+		}
+		cs.deliver(msg)
+	} else if frame.Flags&FlagTRAILERS != 0 {
+		trailer, _, err := decodeMetadataBlock(frame.Payload)
+		if err != nil {
+			cs.finish(status.Newf(codes.Internal, "malformed response trailers: %v", err), nil)
+			return
+		}
+		cs.finish(statusFromTrailer(trailer), trailer)
+	}
+}
+
+// handleSettings applies the server's SETTINGS and acknowledges them. Malformed
+// SETTINGS are ignored, leaving the previous limits in place.
+func (cc *ClientConn) handleSettings(payload []byte) {
+	settings, err := decodeSettings(payload)
+	if err != nil {
+		if cc.options.EnableLogging {
+			log.Printf("[wsgrpc] Client ignoring malformed SETTINGS: %v", err)
+		}
+		return
+	}
+
+	cc.mu.Lock()
+	cc.settings = settings
+	cc.settingsReceived = true
+	cc.signalStreamsChangedLocked() // The stream limit may have grown
+	cc.mu.Unlock()
+
+	if cc.options.EnableLogging {
+		log.Printf("[wsgrpc] Client received SETTINGS: %+v", settings)
+	}
+	if err := cc.send(encodeSettingsAck()); err != nil && cc.options.EnableLogging {
+		log.Printf("[wsgrpc] Client failed to acknowledge SETTINGS: %v", err)
+	}
+}
+
+// signalStreamsChangedLocked wakes up calls queued on MaxConcurrentStreams. cc.mu must
+// be held.
+func (cc *ClientConn) signalStreamsChangedLocked() {
+	close(cc.streamsChanged)
+	cc.streamsChanged = make(chan struct{})
+}
+
+// handleGoAway stops new calls on a draining connection and fails the streams the
+// server did not accept with Unavailable, so callers can retry them elsewhere. Streams
+// up to lastStreamID are completed by the server before it closes the connection.
+func (cc *ClientConn) handleGoAway(lastStreamID uint32) {
+	cc.mu.Lock()
+	cc.draining = true
+	var refused []*clientStream
+	for id, cs := range cc.streams {
+		if id > lastStreamID {
+			refused = append(refused, cs)
+		}
+	}
+	cc.mu.Unlock()
+
+	if cc.options.EnableLogging {
+		log.Printf("[wsgrpc] Client received GOAWAY (last stream %d)", lastStreamID)
+	}
+	for _, cs := range refused {
+		cs.finish(status.New(codes.Unavailable, "stream refused by server (GOAWAY)"), nil)
+	}
+}
+
+// rstStatusCode maps a RST_STREAM error code onto the gRPC status code reported to the caller.
+func rstStatusCode(errCode uint32) codes.Code {
+	switch errCode {
+	case ErrCodeCancel:
+		return codes.Canceled
+	case ErrCodeNoError, ErrCodeRefusedStream, ErrCodeUnavailable:
+		return codes.Unavailable
+	case ErrCodeResourceExhausted:
+		return codes.ResourceExhausted
+	default:
+		return codes.Internal
+	}
+}
+
+// statusFromTrailer builds the RPC status from the grpc-status / grpc-message trailer
+// keys and removes them from the trailer metadata handed to the application.
+func statusFromTrailer(trailer metadata.MD) *status.Status {
+	code := codes.Unknown
+	if v := trailer.Get("grpc-status"); len(v) > 0 {
+		if n, err := strconv.Atoi(v[0]); err == nil {
+			code = codes.Code(n)
+		}
+	}
+	var msg string
+	if v := trailer.Get("grpc-message"); len(v) > 0 {
+		msg = v[0]
+	}
+	delete(trailer, "grpc-status")
+	delete(trailer, "grpc-message")
+
+	// grpc-status-details-bin carries the full google.rpc.Status, including details;
+	// it is only trusted when it agrees with grpc-status
+	if v := trailer.Get(statusDetailsKey); len(v) > 0 {
+		delete(trailer, statusDetailsKey)
+		st := &spb.Status{}
+		if err := proto.Unmarshal([]byte(v[0]), st); err == nil && codes.Code(st.GetCode()) == code {
+			return status.FromProto(st)
+		}
+	}
+	return status.New(code, msg)
+}
+
+// clientStream implements grpc.ClientStream for a single multiplexed RPC
+type clientStream struct {
+	ctx            context.Context
+	cancel         context.CancelFunc
+	stopWatch      func() bool // Stops the context.AfterFunc cancellation watcher
+	cc             *ClientConn
+	streamID       uint32
+	desc           *grpc.StreamDesc
+	method         string
+	callOpts       []grpc.CallOption
+	codec          encoding.Codec
+	sendCompressor encoding.Compressor // nil sends uncompressed requests
+	recvChan       chan recvMessage
+	headerReady    chan struct{} // Closed once headers arrived or can no longer arrive
+	headerOnce     sync.Once
+	done           chan struct{} // Closed once the stream has ended
+	finishOnce     sync.Once
+	mu             sync.Mutex
+	header         metadata.MD
+	trailer        metadata.MD
+	status         *status.Status // Final status; valid once done is closed
+	sendClosed     bool
+	received       bool // A response message was received (calls without server streaming)
+	// Flow control windows; nil unless flow control was active when the stream opened
+	sendWindow   *flowWindow
+	recvFlow     *recvFlow
+	recvOverflow []recvMessage // Payloads queued while recvChan is full (guarded by mu)
+	reassembly   reassembler   // Fragments of the current response message (read loop only)
+}
+
+// setHeader records the response headers and wakes up Header callers.
+func (cs *clientStream) setHeader(md metadata.MD) {
+	cs.mu.Lock()
+	if cs.header == nil {
+		cs.header = md
+	}
+	cs.mu.Unlock()
+	cs.headerOnce.Do(func() { close(cs.headerReady) })
+}
+
+// deliver hands a DATA payload to RecvMsg. Like the server's read pump it never blocks
+// past the end of the stream, so an abandoned stream cannot wedge the connection, and
+// on flow-controlled streams it never blocks at all.
+func (cs *clientStream) deliver(msg recvMessage) {
+	// Response headers are optional; the first message implies there are none.
+	cs.headerOnce.Do(func() { close(cs.headerReady) })
+
+	if cs.recvFlow != nil {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		if len(cs.recvOverflow) == 0 {
+			select {
+			case cs.recvChan <- msg:
+				return
+			default:
+			}
+		}
+		cs.recvOverflow = append(cs.recvOverflow, msg)
+		return
+	}
+
+	select {
+	case cs.recvChan <- msg:
+	case <-cs.done:
+	}
+}
+
+// finish ends the stream with the given status exactly once. It reports whether this
+// call was the one that ended the stream.
+func (cs *clientStream) finish(st *status.Status, trailer metadata.MD) bool {
+	finished := false
+	cs.finishOnce.Do(func() {
+		finished = true
+
+		cs.mu.Lock()
+		cs.status = st
+		cs.trailer = trailer
+		header := cs.header
+		cs.mu.Unlock()
+
+		for _, o := range cs.callOpts {
+			switch opt := o.(type) {
+			case grpc.HeaderCallOption:
+				*opt.HeaderAddr = header
+			case grpc.TrailerCallOption:
+				*opt.TrailerAddr = trailer
+			}
+		}
+
+		close(cs.done)
+		cs.headerOnce.Do(func() { close(cs.headerReady) })
+
+		cs.cc.mu.Lock()
+		delete(cs.cc.streams, cs.streamID)
+		cs.cc.signalStreamsChangedLocked()
+		cs.cc.mu.Unlock()
+
+		// Release the stream context without triggering the cancellation watcher
+		if cs.stopWatch != nil {
+			cs.stopWatch()
+		}
+		cs.cancel()
+	})
+	return finished
+}
+
+// release moves queued payloads into the slot RecvMsg just freed and returns the
+// consumed bytes to the server's window.
+func (cs *clientStream) release(n int) {
+	if cs.recvFlow == nil {
+		return
+	}
+
+	cs.mu.Lock()
+refill:
+	for len(cs.recvOverflow) > 0 {
+		select {
+		case cs.recvChan <- cs.recvOverflow[0]:
+			cs.recvOverflow[0] = recvMessage{}
+			cs.recvOverflow = cs.recvOverflow[1:]
+		default:
+			break refill
+		}
+	}
+	cs.mu.Unlock()
+
+	select {
+	case <-cs.done:
+		// No more credit is needed once the stream has ended
+		return
+	default:
+	}
+	if increment := cs.recvFlow.onRelease(n); increment > 0 {
+		_ = cs.cc.send(encodeWindowUpdate(cs.streamID, increment))
+	}
+}
+
+// Header implements grpc.ClientStream. It blocks until the server's headers arrive.
+func (cs *clientStream) Header() (metadata.MD, error) {
+	<-cs.headerReady
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.header == nil && cs.status != nil && cs.status.Code() != codes.OK {
+		return nil, cs.status.Err()
+	}
+	return cs.header, nil
+}
+
+// Trailer implements grpc.ClientStream. It is only valid once RecvMsg has returned a
+// non-nil error.
+func (cs *clientStream) Trailer() metadata.MD {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.trailer
+}
+
+// CloseSend implements grpc.ClientStream by sending a bare EOS frame (half-close).
+func (cs *clientStream) CloseSend() error {
+	cs.mu.Lock()
+	if cs.sendClosed {
+		cs.mu.Unlock()
+		return nil
+	}
+	cs.sendClosed = true
+	cs.mu.Unlock()
+
+	select {
+	case <-cs.done:
+		return nil
+	default:
+	}
+	return cs.cc.send(encodeFrame(cs.streamID, FlagEOS, []byte{}))
+}
+
+// Context implements grpc.ClientStream
+func (cs *clientStream) Context() context.Context {
+	return cs.ctx
+}
+
+// SendMsg implements grpc.ClientStream. For calls without client streaming the single
+// request is sent as DATA|EOS, matching the Angular client.
+func (cs *clientStream) SendMsg(m interface{}) error {
+	select {
+	case <-cs.done:
+		// The stream is over; the caller learns the status from RecvMsg
+		return io.EOF
+	default:
+	}
+
+	// Marshal straight into a pooled frame buffer, which is sent as it is unless the
+	// message needs fragmenting
+	buf, err := marshalFrameBuffer(cs.codec, m)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to marshal message: %v", err)
+	}
+	compressed, err := compressFrameBuffer(cs.sendCompressor, buf, cs.cc.options.CompressionThreshold)
+	if err != nil {
+		putFrameBuffer(buf)
+		return status.Errorf(codes.Internal, "failed to compress message: %v", err)
+	}
+	data := (*buf)[frameHeaderSize:]
+
+	settings, _ := cs.cc.ServerSettings()
+	if settings.MaxMessageSize != 0 && uint64(len(data)) > uint64(settings.MaxMessageSize) {
+		putFrameBuffer(buf)
+		return status.Errorf(codes.ResourceExhausted, "trying to send message larger than max (%d vs. %d)", len(data), settings.MaxMessageSize)
+	}
+
+	cs.mu.Lock()
+	if cs.sendClosed {
+		cs.mu.Unlock()
+		putFrameBuffer(buf)
+		return status.Error(codes.Internal, "SendMsg called after CloseSend")
+	}
+	flags := uint8(FlagDATA)
+	if compressed {
+		flags |= FlagCOMPRESSED
+	}
+	endStream := !cs.desc.ClientStreams
+	if endStream {
+		cs.sendClosed = true
+	}
+	cs.mu.Unlock()
+
+	// Messages above the server's frame limit are fragmented on v3 connections; EOS
+	// goes on the last fragment
+	maxFragment := 0
+	if cs.cc.version.fragmentation() {
+		maxFragment = int(settings.MaxPayloadSize)
+	}
+	fragments := splitMessage(data, maxFragment)
+	if len(fragments) > 1 {
+		defer putFrameBuffer(buf)
+	}
+	for i, fragment := range fragments {
+		fragmentFlags := flags
+		if i < len(fragments)-1 {
+			fragmentFlags |= FlagCONTINUED
+		} else if endStream {
+			fragmentFlags |= FlagEOS
+		}
+
+		frame := buf
+		if len(fragments) > 1 {
+			frame = encodeFrameBuffer(cs.streamID, fragmentFlags, fragment)
+		} else {
+			putFrameHeader(*frame, cs.streamID, fragmentFlags)
+		}
+
+		// Block only this stream while the server's window is used up. Credit is
+		// needed to start a message, not for each fragment
+		if cs.sendWindow != nil {
+			connWindow := cs.cc.flow.connSendWindow()
+			if i == 0 {
+				if err := waitForWindows(cs.ctx, cs.sendWindow, connWindow); err != nil {
+					putFrameBuffer(frame)
+					return io.EOF
+				}
+			}
+			cs.sendWindow.consume(int64(len(fragment)))
+			connWindow.consume(int64(len(fragment)))
+		}
+
+		if err := cs.cc.sendBuffer(frame); err != nil {
+			return io.EOF
+		}
+	}
+	return nil
+}
+
+// RecvMsg implements grpc.ClientStream. It returns io.EOF once the server ended the
+// stream with an OK status, or the status error otherwise.
+func (cs *clientStream) RecvMsg(m interface{}) error {
+	data, err := cs.recv()
+	if err != nil {
+		return err
+	}
+
+	if err := cs.codec.Unmarshal(data, m); err != nil {
+		return status.Errorf(codes.Internal, "failed to unmarshal message: %v", err)
+	}
+
+	if !cs.desc.ServerStreams {
+		// Single response: wait for the trailers so the caller sees the final status
+		<-cs.done
+		cs.mu.Lock()
+		cs.received = true
+		st := cs.status
+		cs.mu.Unlock()
+		if st.Code() != codes.OK {
+			return st.Err()
+		}
+	}
+	return nil
+}
+
+// decompress returns the payload of msg, decompressed with the grpc-encoding announced
+// in the response headers.
+func (cs *clientStream) decompress(msg recvMessage) ([]byte, error) {
+	if !msg.compressed {
+		return msg.data, nil
+	}
+
+	// Headers precede the first COMPRESSED frame
+	cs.mu.Lock()
+	var name string
+	if v := cs.header.Get("grpc-encoding"); len(v) > 0 {
+		name = v[0]
+	}
+	cs.mu.Unlock()
+
+	c, ok := lookupCompressor(name)
+	if !ok || c == nil {
+		return nil, status.Errorf(codes.Internal, "compressed message received with unsupported grpc-encoding %q", name)
+	}
+	data, err := decompressMessage(c, msg.data, int64(cs.cc.options.MaxMessageSize))
+	if err != nil {
+		return nil, status.Errorf(codes.ResourceExhausted, "failed to decompress message: %v", err)
+	}
+	return data, nil
+}
+
+// recv returns the next DATA payload, or the terminal error once the stream is over.
+func (cs *clientStream) recv() ([]byte, error) {
+	select {
+	case msg := <-cs.recvChan:
+		cs.release(len(msg.data))
+		return cs.decompress(msg)
+	case <-cs.done:
+		// Messages delivered before the trailers are still buffered
+		select {
+		case msg := <-cs.recvChan:
+			cs.release(len(msg.data))
+			return cs.decompress(msg)
+		default:
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.status.Code() != codes.OK {
+		return nil, cs.status.Err()
+	}
+	if !cs.desc.ServerStreams && !cs.received {
+		return nil, status.Error(codes.Internal, "server ended the stream without a response message")
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,534 @@
+package wsgrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// testGreeter implements every RPC kind of the Greeter service for client tests
+type testGreeter struct {
+	pb.UnimplementedGreeterServer
+}
+
+func (g *testGreeter) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	if req.GetName() == "fail" {
+		return nil, status.Error(codes.InvalidArgument, "name must not be fail")
+	}
+	if req.GetName() == "block" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	greeting := "Hello " + req.GetName()
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-greeting")) > 0 {
+		greeting = md.Get("x-greeting")[0] + " " + req.GetName()
+	}
+	return &pb.HelloResponse{Message: greeting}, nil
+}
+
+func (g *testGreeter) SayHelloStream(req *pb.HelloRequest, stream grpc.ServerStreamingServer[pb.HelloResponse]) error {
+	if err := stream.SendHeader(metadata.Pairs("x-stream", "server")); err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.Send(&pb.HelloResponse{Message: fmt.Sprintf("Hello %s #%d", req.GetName(), i)}); err != nil {
+			return err
+		}
+	}
+	stream.SetTrailer(metadata.Pairs("x-count", "3"))
+	return nil
+}
+
+func (g *testGreeter) SayHelloClientStream(stream grpc.ClientStreamingServer[pb.HelloRequest, pb.HelloResponse]) error {
+	var names []string
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&pb.HelloResponse{Message: "Hello " + strings.Join(names, ", ")})
+		}
+		if err != nil {
+			return err
+		}
+		names = append(names, req.GetName())
+	}
+}
+
+func (g *testGreeter) SayHelloBidirectional(stream grpc.BidiStreamingServer[pb.HelloRequest, pb.HelloResponse]) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.HelloResponse{Message: "Echo " + req.GetName()}); err != nil {
+			return err
+		}
+	}
+}
+
+// newTestClient starts a wsgrpc server hosting testGreeter and dials it with a ClientConn
+func newTestClient(t *testing.T, opts ...ServerOption) (*Server, pb.GreeterClient, *ClientConn) {
+	t.Helper()
+	return newTestClientWith(t, &testGreeter{}, opts, ClientOption{})
+}
+
+// newTestClientWith starts a wsgrpc server hosting impl and dials it with the given
+// client options
+func newTestClientWith(t *testing.T, impl pb.GreeterServer, serverOpts []ServerOption, clientOpt ClientOption) (*Server, pb.GreeterClient, *ClientConn) {
+	t.Helper()
+
+	server := NewServer(append([]ServerOption{{InsecureSkipVerify: true}}, serverOpts...)...)
+	pb.RegisterGreeterServer(server, impl)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	t.Cleanup(httpServer.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, "ws"+httpServer.URL[4:], clientOpt)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return server, pb.NewGreeterClient(conn), conn
+}
+
+// TestClientUnary verifies a unary round trip through generated stubs, including
+// outgoing metadata and error statuses
+func TestClientUnary(t *testing.T) {
+	_, client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: "Go"})
+	if err != nil {
+		t.Fatalf("SayHello failed: %v", err)
+	}
+	if resp.GetMessage() != "Hello Go" {
+		t.Errorf("Expected 'Hello Go', got %q", resp.GetMessage())
+	}
+
+	mdCtx := metadata.AppendToOutgoingContext(ctx, "x-greeting", "Howdy")
+	resp, err = client.SayHello(mdCtx, &pb.HelloRequest{Name: "Go"})
+	if err != nil {
+		t.Fatalf("SayHello with metadata failed: %v", err)
+	}
+	if resp.GetMessage() != "Howdy Go" {
+		t.Errorf("Expected outgoing metadata to reach the handler, got %q", resp.GetMessage())
+	}
+
+	_, err = client.SayHello(ctx, &pb.HelloRequest{Name: "fail"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got %v", err)
+	}
+	if status.Convert(err).Message() != "name must not be fail" {
+		t.Errorf("Expected status message to be preserved, got %q", status.Convert(err).Message())
+	}
+}
+
+// TestClientServerStreaming verifies server streaming with headers and trailers
+func TestClientServerStreaming(t *testing.T) {
+	_, client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.SayHelloStream(ctx, &pb.HelloRequest{Name: "Go"})
+	if err != nil {
+		t.Fatalf("SayHelloStream failed: %v", err)
+	}
+
+	header, err := stream.Header()
+	if err != nil {
+		t.Fatalf("Header failed: %v", err)
+	}
+	if got := header.Get("x-stream"); len(got) != 1 || got[0] != "server" {
+		t.Errorf("Expected x-stream header, got %v", header)
+	}
+
+	var messages []string
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		messages = append(messages, resp.GetMessage())
+	}
+
+	if len(messages) != 3 || messages[2] != "Hello Go #2" {
+		t.Errorf("Unexpected messages: %v", messages)
+	}
+	if got := stream.Trailer().Get("x-count"); len(got) != 1 || got[0] != "3" {
+		t.Errorf("Expected x-count trailer, got %v", stream.Trailer())
+	}
+}
+
+// TestClientClientStreaming verifies client streaming terminated by CloseSend
+func TestClientClientStreaming(t *testing.T) {
+	_, client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.SayHelloClientStream(ctx)
+	if err != nil {
+		t.Fatalf("SayHelloClientStream failed: %v", err)
+	}
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv failed: %v", err)
+	}
+	if resp.GetMessage() != "Hello Alice, Bob, Carol" {
+		t.Errorf("Unexpected response: %q", resp.GetMessage())
+	}
+}
+
+// TestClientBidiStreaming verifies interleaved sends and receives on one stream
+func TestClientBidiStreaming(t *testing.T) {
+	_, client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.SayHelloBidirectional(ctx)
+	if err != nil {
+		t.Fatalf("SayHelloBidirectional failed: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("n%d", i)
+		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if resp.GetMessage() != "Echo "+name {
+			t.Errorf("Expected 'Echo %s', got %q", name, resp.GetMessage())
+		}
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend failed: %v", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Expected io.EOF after CloseSend, got %v", err)
+	}
+}
+
+// TestClientCancellation verifies that cancelling the call context resets the stream
+// on the server and returns codes.Canceled
+func TestClientCancellation(t *testing.T) {
+	server, client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "block"})
+		errCh <- err
+	}()
+
+	// Wait until the server has registered the stream, then cancel
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && activeStreamCount(server) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if status.Code(err) != codes.Canceled {
+			t.Errorf("Expected Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Cancelled call did not return")
+	}
+
+	// The RST_STREAM must release the handler on the server
+	deadline = time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && activeStreamCount(server) != 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := activeStreamCount(server); n != 0 {
+		t.Errorf("Expected server stream to be reset, %d still active", n)
+	}
+}
+
+// TestClientConnectionClosed verifies that calls on a closed connection fail with Unavailable
+func TestClientConnectionClosed(t *testing.T) {
+	_, client, conn := newTestClient(t)
+
+	if err := conn.Close(); err != nil {
+		t.Logf("Close returned: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "Go"})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable after Close, got %v", err)
+	}
+}
+
+// TestClientUnknownMethod verifies that a refused stream surfaces as a gRPC error
+func TestClientUnknownMethod(t *testing.T) {
+	_, _, conn := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := conn.Invoke(ctx, "/greeter.Greeter/DoesNotExist", &pb.HelloRequest{}, &pb.HelloResponse{})
+	if err == nil {
+		t.Fatal("Expected error for unknown method")
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		t.Errorf("Expected a gRPC status error, got %v", err)
+	}
+}
+
+// activeStreamCount returns the number of streams registered across all connections
+func activeStreamCount(server *Server) int {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	count := 0
+	for c := range server.connections {
+		c.mu.Lock()
+		count += len(c.streamMap)
+		c.mu.Unlock()
+	}
+	return count
+}
+
+// TestUnaryInterceptorReceivesDecodedRequest verifies that interceptors around generated
+// handlers see the decoded request, so validation interceptors can reject it
+func TestUnaryInterceptorReceivesDecodedRequest(t *testing.T) {
+	validate := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		hello, ok := req.(*pb.HelloRequest)
+		if !ok {
+			return nil, status.Errorf(codes.Internal, "interceptor got %T", req)
+		}
+		if hello.GetName() == "" {
+			return nil, status.Error(codes.InvalidArgument, "name is required")
+		}
+		return handler(ctx, req)
+	}
+	_, client, _ := newTestClient(t, WithUnaryInterceptor(validate))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.SayHello(ctx, &pb.HelloRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument from validating interceptor, got %v", err)
+	}
+	resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: "valid"})
+	if err != nil {
+		t.Fatalf("SayHello failed: %v", err)
+	}
+	if resp.GetMessage() != "Hello valid" {
+		t.Errorf("Unexpected response %q", resp.GetMessage())
+	}
+}
+
+// headerGreeter sets response metadata from a unary handler through the grpc package
+// helpers, the way handlers written for grpc-go do
+type headerGreeter struct {
+	testGreeter
+}
+
+func (g *headerGreeter) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	if req.GetName() == "early" {
+		if err := grpc.SendHeader(ctx, metadata.Pairs("x-sent", "early")); err != nil {
+			return nil, err
+		}
+		if err := grpc.SetHeader(ctx, metadata.Pairs("x-late", "true")); err == nil {
+			return nil, status.Error(codes.Internal, "SetHeader succeeded after SendHeader")
+		}
+		return &pb.HelloResponse{Message: "early"}, nil
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs("cache-control", "max-age=60")); err != nil {
+		return nil, err
+	}
+	if err := grpc.SetTrailer(ctx, metadata.Pairs("x-next-page", "2")); err != nil {
+		return nil, err
+	}
+	if req.GetName() == "fail" {
+		return nil, status.Error(codes.NotFound, "no such page")
+	}
+	return &pb.HelloResponse{Message: "Hello " + req.GetName()}, nil
+}
+
+// TestUnaryHandlerSetsHeaderAndTrailer verifies grpc.SetHeader / SendHeader / SetTrailer
+// in unary handlers, including the error path where no DATA frame is sent
+func TestUnaryHandlerSetsHeaderAndTrailer(t *testing.T) {
+	_, client, _ := newTestClientWith(t, &headerGreeter{}, nil, ClientOption{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var header, trailer metadata.MD
+	if _, err := client.SayHello(ctx, &pb.HelloRequest{Name: "page"}, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+		t.Fatalf("SayHello failed: %v", err)
+	}
+	if got := header.Get("cache-control"); len(got) != 1 || got[0] != "max-age=60" {
+		t.Errorf("Expected cache-control header, got %v", header)
+	}
+	if got := trailer.Get("x-next-page"); len(got) != 1 || got[0] != "2" {
+		t.Errorf("Expected x-next-page trailer, got %v", trailer)
+	}
+
+	header, trailer = nil, nil
+	_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "fail"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound, got %v", err)
+	}
+	if len(header.Get("cache-control")) != 1 || len(trailer.Get("x-next-page")) != 1 {
+		t.Errorf("Expected header and trailer on the error path, got header=%v trailer=%v", header, trailer)
+	}
+
+	header = nil
+	if _, err := client.SayHello(ctx, &pb.HelloRequest{Name: "early"}, grpc.Header(&header)); err != nil {
+		t.Fatalf("SayHello with SendHeader failed: %v", err)
+	}
+	if got := header.Get("x-sent"); len(got) != 1 || got[0] != "early" {
+		t.Errorf("Expected x-sent header, got %v", header)
+	}
+}
+
+// TestPendingHeadersPrecedeFirstData verifies on the wire that headers set with
+// SetHeader are flushed in a HEADERS frame before the first DATA frame
+func TestPendingHeadersPrecedeFirstData(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &headerGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(1, FlagHEADERS, []byte("path: /greeter.Greeter/SayHello\n"))); err != nil {
+		t.Fatalf("Failed to send HEADERS: %v", err)
+	}
+	payload, _ := proto.Marshal(&pb.HelloRequest{Name: "page"})
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(1, FlagDATA|FlagEOS, payload)); err != nil {
+		t.Fatalf("Failed to send DATA: %v", err)
+	}
+
+	frames := readResponseFrames(t, ctx, conn, 1)
+	if len(frames) != 3 || frames[0].Flags != FlagHEADERS || frames[1].Flags&FlagDATA == 0 {
+		t.Fatalf("Expected HEADERS, DATA, TRAILERS; got %d frames", len(frames))
+	}
+	if md := parseHeaderBlock(frames[0].Payload); len(md.Get("cache-control")) != 1 {
+		t.Errorf("Expected cache-control in HEADERS, got %v", md)
+	}
+}
+
+// newRawTestServer returns the ws:// URL of a server that hands every accepted
+// WebSocket to handle
+func newRawTestServer(t *testing.T, handle func(ctx context.Context, conn *websocket.Conn)) string {
+	t.Helper()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{SubprotocolV1}})
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.CloseNow() }()
+		handle(r.Context(), conn)
+	}))
+	t.Cleanup(httpServer.Close)
+	return "ws" + strings.TrimPrefix(httpServer.URL, "http")
+}
+
+// TestDialWithoutFlowControl verifies that Dial gives up waiting for the window
+// advertisement of a server that predates flow control
+func TestDialWithoutFlowControl(t *testing.T) {
+	url := newRawTestServer(t, func(ctx context.Context, conn *websocket.Conn) {
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := Dial(ctx, url, ClientOption{AdvertisementTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	t.Logf("Dial returned after %v", time.Since(start))
+	if conn.flow.isEnabled() {
+		t.Error("Expected flow control to be off")
+	}
+}
+
+// TestClientFailsOnMalformedFrame verifies that a frame that cannot be decoded ends the
+// connection instead of being skipped
+func TestClientFailsOnMalformedFrame(t *testing.T) {
+	url := newRawTestServer(t, func(ctx context.Context, conn *websocket.Conn) {
+		_ = conn.Write(ctx, websocket.MessageBinary, encodeWindowAdvertisement(defaultInitialWindowSize, defaultInitialConnWindowSize))
+		_ = conn.Write(ctx, websocket.MessageBinary, []byte{0, 0, 1})
+		_, _, _ = conn.Read(ctx)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, url)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	select {
+	case <-conn.ctx.Done():
+	case <-ctx.Done():
+		t.Fatal("Connection survived a malformed frame")
+	}
+	conn.mu.Lock()
+	closeErr := conn.closeErr
+	conn.mu.Unlock()
+	t.Logf("Connection closed: %v", closeErr)
+	if closeErr == nil || !strings.Contains(closeErr.Error(), "malformed frame") {
+		t.Errorf("Expected a malformed frame error, got %v", closeErr)
+	}
+}
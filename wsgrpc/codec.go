@@ -0,0 +1,207 @@
+package wsgrpc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// errNotProtoMessage is returned by the built-in codecs for values that are not
+// protobuf messages.
+var errNotProtoMessage = errors.New("message does not implement proto.Message")
+
+// contentTypePrefix is the content-type of every gRPC request; a codec other than
+// proto is selected with a "+name" suffix (e.g. application/grpc+json).
+const contentTypePrefix = "application/grpc"
+
+// protoCodec is the fallback protobuf codec, used when no "proto" codec is registered
+// with grpc/encoding.
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, errNotProtoMessage
+	}
+	return proto.Marshal(msg)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return errNotProtoMessage
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) marshalAppend(b []byte, v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, errNotProtoMessage
+	}
+	return proto.MarshalOptions{}.MarshalAppend(b, msg)
+}
+
+// jsonCodec encodes protobuf messages with protojson, for application/grpc+json.
+// Unknown fields are ignored on input, matching the binary codec's tolerance.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, errNotProtoMessage
+	}
+	return protojson.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return errNotProtoMessage
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, msg)
+}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) marshalAppend(b []byte, v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, errNotProtoMessage
+	}
+	return protojson.MarshalOptions{}.MarshalAppend(b, msg)
+}
+
+// codecV2Bridge adapts an encoding.CodecV2 (such as grpc's own proto codec) to the
+// byte-slice based encoding.Codec used by the frame layer.
+type codecV2Bridge struct {
+	codec     encoding.CodecV2
+	grpcProto bool // codec is grpc's own proto codec (see isGRPCProtoCodec)
+}
+
+func (b codecV2Bridge) Marshal(v interface{}) ([]byte, error) {
+	data, err := b.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Free()
+	return data.Materialize(), nil
+}
+
+func (b codecV2Bridge) Unmarshal(data []byte, v interface{}) error {
+	return b.codec.Unmarshal(mem.BufferSlice{mem.SliceBuffer(data)}, v)
+}
+
+func (b codecV2Bridge) Name() string { return b.codec.Name() }
+
+func (b codecV2Bridge) marshalAppend(dst []byte, v interface{}) ([]byte, error) {
+	if msg, ok := v.(proto.Message); ok && b.grpcProto {
+		return proto.MarshalOptions{}.MarshalAppend(dst, msg)
+	}
+	data, err := b.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Free()
+	for _, buf := range data {
+		dst = append(dst, buf.ReadOnlyData()...)
+	}
+	return dst, nil
+}
+
+// appendMarshaler is implemented by the codecs above, which marshal straight into a
+// frame buffer instead of returning newly allocated bytes.
+type appendMarshaler interface {
+	marshalAppend(b []byte, v interface{}) ([]byte, error)
+}
+
+// marshalAppend appends the encoding of v to b.
+func marshalAppend(codec encoding.Codec, b []byte, v interface{}) ([]byte, error) {
+	if m, ok := codec.(appendMarshaler); ok {
+		return m.marshalAppend(b, v)
+	}
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, data...), nil
+}
+
+// isGRPCProtoCodec reports whether c is grpc's built-in protobuf codec, whose output
+// for protobuf messages proto.MarshalAppend reproduces without an intermediate buffer.
+// Codecs registered by the application under "proto" are always called.
+func isGRPCProtoCodec(c encoding.CodecV2) bool {
+	t := reflect.TypeOf(c)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.PkgPath() == "google.golang.org/grpc/encoding/proto"
+}
+
+// lookupCodec returns the codec for a content-subtype. Codecs registered with
+// grpc/encoding take precedence, so an application can replace "proto" (e.g. with a
+// vtprotobuf codec) or add its own; "proto" and "json" are always available.
+func lookupCodec(name string) encoding.Codec {
+	name = strings.ToLower(name)
+	if c := encoding.GetCodec(name); c != nil {
+		return c
+	}
+	if c := encoding.GetCodecV2(name); c != nil {
+		return codecV2Bridge{codec: c, grpcProto: isGRPCProtoCodec(c)}
+	}
+	switch name {
+	case "proto":
+		return protoCodec{}
+	case "json":
+		return jsonCodec{}
+	}
+	return nil
+}
+
+// codecForContentType selects the codec for a stream from its content-type header.
+// A missing content-type (e.g. the Angular client) and plain application/grpc both
+// mean protobuf.
+func codecForContentType(contentType string) (encoding.Codec, error) {
+	subtype, err := contentSubtype(contentType)
+	if err != nil {
+		return nil, err
+	}
+	codec := lookupCodec(subtype)
+	if codec == nil {
+		return nil, fmt.Errorf("no codec registered for content-subtype %q", subtype)
+	}
+	return codec, nil
+}
+
+// contentSubtype returns the content-subtype of a content-type header, "proto" when
+// there is none. Parameters such as charset are ignored.
+func contentSubtype(contentType string) (string, error) {
+	subtype := "proto"
+	if contentType != "" {
+		mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+		rest, ok := strings.CutPrefix(strings.TrimSpace(mediaType), contentTypePrefix)
+		if !ok || (rest != "" && rest[0] != '+') {
+			return "", fmt.Errorf("unsupported content-type %q", contentType)
+		}
+		if len(rest) > 1 {
+			subtype = rest[1:]
+		}
+	}
+	return subtype, nil
+}
+
+// contentTypeFor returns the content-type header announcing codec.
+func contentTypeFor(codec encoding.Codec) string {
+	if codec.Name() == "proto" {
+		return contentTypePrefix
+	}
+	return contentTypePrefix + "+" + strings.ToLower(codec.Name())
+}
@@ -0,0 +1,215 @@
+package wsgrpc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// countingCodec is a custom codec registered under its own content-subtype; it
+// delegates to protobuf and counts its calls
+type countingCodec struct {
+	name  string
+	calls atomic.Int64
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	c.calls.Add(1)
+	return protoCodec{}.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.calls.Add(1)
+	return protoCodec{}.Unmarshal(data, v)
+}
+
+func (c *countingCodec) Name() string { return c.name }
+
+var registeredTestCodec = &countingCodec{name: "wsgrpc-test"}
+
+func init() {
+	encoding.RegisterCodec(registeredTestCodec)
+}
+
+// TestCodecForContentType verifies content-type parsing and codec lookup
+func TestCodecForContentType(t *testing.T) {
+	valid := map[string]string{
+		"":                                     "proto",
+		"application/grpc":                     "proto",
+		"application/grpc+proto":               "proto",
+		"application/grpc;proto":               "proto",
+		"application/grpc;charset=utf-8":       "proto",
+		"application/grpc+json; charset=utf-8": "json",
+		" application/grpc+json ;q=1":          "json",
+		"application/grpc+json":                "json",
+		"Application/GRPC+JSON":                "json",
+		"application/grpc+wsgrpc-test":         "wsgrpc-test",
+	}
+	for contentType, want := range valid {
+		codec, err := codecForContentType(contentType)
+		if err != nil {
+			t.Errorf("codecForContentType(%q) failed: %v", contentType, err)
+			continue
+		}
+		if codec.Name() != want {
+			t.Errorf("codecForContentType(%q) = %s, want %s", contentType, codec.Name(), want)
+		}
+	}
+
+	for _, contentType := range []string{"application/json", "application/grpcx", "application/grpc+unknown", "application/grpc+unknown; charset=utf-8"} {
+		if _, err := codecForContentType(contentType); err == nil {
+			t.Errorf("codecForContentType(%q) succeeded; want error", contentType)
+		}
+	}
+}
+
+// TestClientJSONCodec verifies that a call made with the json content-subtype is
+// handled by the same generated service
+func TestClientJSONCodec(t *testing.T) {
+	_, client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: "JSON"}, grpc.CallContentSubtype("json"))
+	if err != nil {
+		t.Fatalf("SayHello with json codec failed: %v", err)
+	}
+	if resp.GetMessage() != "Hello JSON" {
+		t.Errorf("Expected 'Hello JSON', got %q", resp.GetMessage())
+	}
+
+	stream, err := client.SayHelloBidirectional(ctx, grpc.CallContentSubtype("json"))
+	if err != nil {
+		t.Fatalf("SayHelloBidirectional failed: %v", err)
+	}
+	if err := stream.Send(&pb.HelloRequest{Name: "devtools"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	echo, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if echo.GetMessage() != "Echo devtools" {
+		t.Errorf("Expected 'Echo devtools', got %q", echo.GetMessage())
+	}
+	_ = stream.CloseSend()
+}
+
+// TestJSONPayloadOnTheWire verifies that application/grpc+json streams carry protojson
+// in their DATA frames in both directions
+func TestJSONPayloadOnTheWire(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	streamID := uint32(1)
+	headers := "path: /greeter.Greeter/SayHello\ncontent-type: application/grpc+json\n"
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagHEADERS, []byte(headers))); err != nil {
+		t.Fatalf("Failed to send HEADERS: %v", err)
+	}
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagDATA|FlagEOS, []byte(`{"name":"Browser"}`))); err != nil {
+		t.Fatalf("Failed to send DATA: %v", err)
+	}
+
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		frame, err := decodeFrame(data, 4*1024*1024)
+		if err != nil {
+			continue
+		}
+		if frame.Flags&FlagTRAILERS != 0 {
+			t.Fatalf("Stream ended without a DATA frame: %q", frame.Payload)
+		}
+		if frame.Flags&FlagDATA != 0 {
+			payload := strings.ReplaceAll(string(frame.Payload), " ", "")
+			if payload != `{"message":"HelloBrowser"}` {
+				t.Errorf("Expected protojson response, got %q", frame.Payload)
+			}
+			return
+		}
+	}
+}
+
+// TestRegisteredCodec verifies that codecs registered with grpc/encoding are selected
+// by their content-subtype on both ends of the connection
+func TestRegisteredCodec(t *testing.T) {
+	_, client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	before := registeredTestCodec.calls.Load()
+	resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: "Custom"}, grpc.CallContentSubtype("wsgrpc-test"))
+	if err != nil {
+		t.Fatalf("SayHello with registered codec failed: %v", err)
+	}
+	if resp.GetMessage() != "Hello Custom" {
+		t.Errorf("Expected 'Hello Custom', got %q", resp.GetMessage())
+	}
+	// Client marshal + server unmarshal + server marshal + client unmarshal
+	if calls := registeredTestCodec.calls.Load() - before; calls != 4 {
+		t.Errorf("Expected the registered codec to be used 4 times, got %d", calls)
+	}
+}
+
+// TestUnknownCodecIsRejected verifies that a content-subtype the server cannot decode
+// fails the call with Internal instead of misinterpreting the payload
+func TestUnknownCodecIsRejected(t *testing.T) {
+	_, client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "Go"}, grpc.ForceCodec(&countingCodec{name: "unregistered"}))
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("Expected Internal for unknown codec, got %v", err)
+	}
+	if !strings.Contains(status.Convert(err).Message(), "unregistered") {
+		t.Errorf("Expected the unknown content-subtype in the message, got %q", status.Convert(err).Message())
+	}
+
+	// Unknown codec on the client side is reported before anything is sent
+	_, err = client.SayHello(ctx, &pb.HelloRequest{Name: "Go"}, grpc.CallContentSubtype("unregistered"))
+	if status.Code(err) != codes.Internal {
+		t.Errorf("Expected Internal for unknown client codec, got %v", err)
+	}
+}
+
+// TestJSONCodecRejectsNonProtoMessage verifies the built-in codec type check
+func TestJSONCodecRejectsNonProtoMessage(t *testing.T) {
+	if _, err := (jsonCodec{}).Marshal("not a proto message"); err != errNotProtoMessage {
+		t.Errorf("Expected errNotProtoMessage, got %v", err)
+	}
+	var msg proto.Message = &pb.HelloRequest{}
+	if err := (jsonCodec{}).Unmarshal([]byte(`{"name":"x","unknownField":1}`), msg); err != nil {
+		t.Errorf("Expected unknown JSON fields to be ignored, got %v", err)
+	}
+}
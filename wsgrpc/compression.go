@@ -0,0 +1,84 @@
+package wsgrpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // Registers the gzip compressor
+)
+
+// defaultCompressionThreshold is the message size below which messages are sent
+// uncompressed, used when ServerOption / ClientOption leave it unset.
+const defaultCompressionThreshold = 1024
+
+// identityEncoding is the grpc-encoding value for uncompressed messages.
+const identityEncoding = "identity"
+
+// compressMessage compresses data with c when it is at least threshold bytes long.
+// It reports whether the returned payload is compressed; messages that do not shrink
+// are sent as they are.
+func compressMessage(c encoding.Compressor, data []byte, threshold int) ([]byte, bool, error) {
+	if c == nil || len(data) < threshold {
+		return data, false, nil
+	}
+
+	var buf bytes.Buffer
+	w, err := c.Compress(&buf)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, false, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+
+	if buf.Len() >= len(data) {
+		return data, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+// decompressMessage decompresses data with c, refusing to inflate it beyond maxSize
+// bytes so a small compressed frame cannot exhaust memory.
+func decompressMessage(c encoding.Compressor, data []byte, maxSize int64) ([]byte, error) {
+	r, err := c.Decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > maxSize {
+		return nil, fmt.Errorf("decompressed message larger than %d bytes", maxSize)
+	}
+	return out, nil
+}
+
+// acceptsEncoding reports whether a grpc-accept-encoding header (a comma-separated
+// list, possibly split across several values) contains name.
+func acceptsEncoding(values []string, name string) bool {
+	for _, v := range values {
+		for _, enc := range strings.Split(v, ",") {
+			if strings.TrimSpace(enc) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookupCompressor returns the registered compressor for a grpc-encoding value, or nil
+// for identity. ok is false if the encoding is not registered.
+func lookupCompressor(name string) (c encoding.Compressor, ok bool) {
+	if name == "" || name == identityEncoding {
+		return nil, true
+	}
+	c = encoding.GetCompressor(name)
+	return c, c != nil
+}
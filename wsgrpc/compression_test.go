@@ -0,0 +1,233 @@
+package wsgrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// TestCompressMessageThreshold verifies that only messages above the threshold that
+// actually shrink are compressed
+func TestCompressMessageThreshold(t *testing.T) {
+	gzip := encoding.GetCompressor("gzip")
+	compressible := bytes.Repeat([]byte("row,"), 1024)
+
+	if _, compressed, _ := compressMessage(gzip, compressible[:100], 1024); compressed {
+		t.Error("Expected message below the threshold to be sent uncompressed")
+	}
+	if _, compressed, _ := compressMessage(nil, compressible, 1024); compressed {
+		t.Error("Expected no compression without a compressor")
+	}
+
+	out, compressed, err := compressMessage(gzip, compressible, 1024)
+	if err != nil || !compressed {
+		t.Fatalf("Expected compressible message to be compressed (err=%v)", err)
+	}
+	if len(out) >= len(compressible) {
+		t.Errorf("Compressed size %d not smaller than %d", len(out), len(compressible))
+	}
+	roundTrip, err := decompressMessage(gzip, out, int64(len(compressible)))
+	if err != nil || !bytes.Equal(roundTrip, compressible) {
+		t.Errorf("Round trip failed (err=%v)", err)
+	}
+
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+	if _, compressed, _ := compressMessage(gzip, random, 1024); compressed {
+		t.Error("Expected incompressible message to be sent as is")
+	}
+}
+
+// TestDecompressMessageLimit verifies that decompression stops at the size limit
+func TestDecompressMessageLimit(t *testing.T) {
+	gzip := encoding.GetCompressor("gzip")
+	bomb, compressed, err := compressMessage(gzip, make([]byte, 1<<20), 0)
+	if err != nil || !compressed {
+		t.Fatalf("Failed to build compressed payload (err=%v)", err)
+	}
+	if _, err := decompressMessage(gzip, bomb, 64*1024); err == nil {
+		t.Error("Expected decompression beyond the limit to fail")
+	}
+}
+
+// TestAcceptsEncoding verifies grpc-accept-encoding list parsing
+func TestAcceptsEncoding(t *testing.T) {
+	if !acceptsEncoding([]string{"identity, gzip"}, "gzip") {
+		t.Error("Expected gzip in comma-separated list")
+	}
+	if !acceptsEncoding([]string{"deflate", "gzip"}, "gzip") {
+		t.Error("Expected gzip in second value")
+	}
+	if acceptsEncoding([]string{"gzipx"}, "gzip") || acceptsEncoding(nil, "gzip") {
+		t.Error("Expected no match")
+	}
+}
+
+// readResponseFrames collects the frames of streamID up to and including its TRAILERS
+func readResponseFrames(t *testing.T, ctx context.Context, conn *websocket.Conn, streamID uint32) []*Frame {
+	t.Helper()
+	var frames []*Frame
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		frame, err := decodeFrame(data, 4*1024*1024)
+		if err != nil || frame.StreamID != streamID {
+			continue
+		}
+		frames = append(frames, frame)
+		if frame.Flags&FlagTRAILERS != 0 {
+			return frames
+		}
+	}
+}
+
+// TestServerCompressesLargeResponses verifies negotiation on the wire: responses above
+// the threshold are COMPRESSED only for clients that accept the encoding, and the
+// encoding is announced in HEADERS first
+func TestServerCompressesLargeResponses(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true, Compressor: "gzip", CompressionThreshold: 256})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	call := func(streamID uint32, headers string, name string) []*Frame {
+		if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagHEADERS, []byte(headers))); err != nil {
+			t.Fatalf("Failed to send HEADERS: %v", err)
+		}
+		payload, _ := proto.Marshal(&pb.HelloRequest{Name: name})
+		if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagDATA|FlagEOS, payload)); err != nil {
+			t.Fatalf("Failed to send DATA: %v", err)
+		}
+		return readResponseFrames(t, ctx, conn, streamID)
+	}
+
+	large := strings.Repeat("snapshot,", 200)
+	frames := call(1, "path: /greeter.Greeter/SayHello\ngrpc-accept-encoding: gzip\n", large)
+	if len(frames) != 3 || frames[0].Flags&FlagHEADERS == 0 {
+		t.Fatalf("Expected HEADERS, DATA, TRAILERS; got %d frames", len(frames))
+	}
+	if md := parseHeaderBlock(frames[0].Payload); len(md.Get("grpc-encoding")) == 0 || md.Get("grpc-encoding")[0] != "gzip" {
+		t.Errorf("Expected grpc-encoding: gzip header, got %v", md)
+	}
+	data := frames[1]
+	if data.Flags&FlagCOMPRESSED == 0 {
+		t.Fatalf("Expected COMPRESSED DATA frame, got flags 0x%02x", data.Flags)
+	}
+	raw, err := decompressMessage(encoding.GetCompressor("gzip"), data.Payload, 1<<20)
+	if err != nil {
+		t.Fatalf("Failed to decompress response: %v", err)
+	}
+	resp := &pb.HelloResponse{}
+	if err := proto.Unmarshal(raw, resp); err != nil || resp.GetMessage() != "Hello "+large {
+		t.Errorf("Unexpected decompressed response (err=%v)", err)
+	}
+	t.Logf("Response compressed from %d to %d bytes", len(raw), len(data.Payload))
+
+	// Small responses go out uncompressed
+	frames = call(3, "path: /greeter.Greeter/SayHello\ngrpc-accept-encoding: gzip\n", "tiny")
+	for _, f := range frames {
+		if f.Flags&FlagDATA != 0 && f.Flags&FlagCOMPRESSED != 0 {
+			t.Error("Expected response below the threshold to be uncompressed")
+		}
+	}
+
+	// Clients that do not accept gzip (e.g. the Angular client) never see COMPRESSED
+	frames = call(5, "path: /greeter.Greeter/SayHello\n", large)
+	for _, f := range frames {
+		if f.Flags&FlagDATA != 0 && f.Flags&FlagCOMPRESSED != 0 {
+			t.Error("Expected uncompressed response for a client without grpc-accept-encoding")
+		}
+	}
+}
+
+// TestClientCompressionRoundTrip verifies compressed requests and responses through
+// the Go client with grpc.UseCompressor
+func TestClientCompressionRoundTrip(t *testing.T) {
+	_, client, _ := newTestClientWith(t, &testGreeter{}, nil, ClientOption{CompressionThreshold: 64})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	large := strings.Repeat("cell,", 500)
+	resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: large}, grpc.UseCompressor("gzip"))
+	if err != nil {
+		t.Fatalf("SayHello with gzip failed: %v", err)
+	}
+	if resp.GetMessage() != "Hello "+large {
+		t.Errorf("Unexpected response of %d bytes", len(resp.GetMessage()))
+	}
+
+	stream, err := client.SayHelloBidirectional(ctx, grpc.UseCompressor("gzip"))
+	if err != nil {
+		t.Fatalf("SayHelloBidirectional failed: %v", err)
+	}
+	for _, name := range []string{"small", large} {
+		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		echo, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if echo.GetMessage() != "Echo "+name {
+			t.Errorf("Unexpected echo of %d bytes", len(echo.GetMessage()))
+		}
+	}
+	_ = stream.CloseSend()
+}
+
+// TestUnsupportedEncodingIsRejected verifies that a request encoding the server cannot
+// decompress ends the stream with UNIMPLEMENTED
+func TestUnsupportedEncodingIsRejected(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	headers := "path: /greeter.Greeter/SayHello\ngrpc-encoding: br\n"
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(1, FlagHEADERS, []byte(headers))); err != nil {
+		t.Fatalf("Failed to send HEADERS: %v", err)
+	}
+	statusCode, _, ok := readUntilTrailers(t, ctx, conn)
+	if !ok {
+		t.Fatal("Did not receive TRAILERS")
+	}
+	if statusCode != intToStr(int(codes.Unimplemented)) {
+		t.Errorf("Expected grpc-status %d, got %s", codes.Unimplemented, statusCode)
+	}
+}
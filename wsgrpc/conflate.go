@@ -0,0 +1,214 @@
+package wsgrpc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// conflatedLaneLimit is the number of frames a conflated stream keeps in the send
+// queue. Together with the message waiting in the conflater, a slow client is at most
+// two messages behind the handler.
+const conflatedLaneLimit = 1
+
+// EnableConflation switches the stream of a handler context to latest-value delivery,
+// like listing its method in ServerOption.ConflatedMethods: when the client cannot keep
+// up, a message that is still waiting to be sent is replaced by the next one instead of
+// blocking SendMsg. It must be called before the first SendMsg and reports whether ctx
+// belongs to a wsgrpc server stream.
+func EnableConflation(ctx context.Context) bool {
+	t, ok := grpc.ServerTransportStreamFromContext(ctx).(*serverTransportStream)
+	if !ok {
+		return false
+	}
+	t.stream.conflateMu.Lock()
+	t.stream.conflate = true
+	t.stream.conflateMu.Unlock()
+	return true
+}
+
+// ConflatedMessages returns the number of messages of the stream of a handler context
+// that were replaced by newer ones before they could be sent.
+func ConflatedMessages(ctx context.Context) uint64 {
+	t, ok := grpc.ServerTransportStreamFromContext(ctx).(*serverTransportStream)
+	if !ok {
+		return 0
+	}
+	t.stream.conflateMu.Lock()
+	c := t.stream.conflater
+	t.stream.conflateMu.Unlock()
+	if c == nil {
+		return 0
+	}
+	return c.dropped.Load()
+}
+
+// ConflatedMessages returns the number of messages replaced on conflated streams of
+// all connections since the server was created.
+func (s *Server) ConflatedMessages() uint64 {
+	return s.conflated.Load()
+}
+
+// conflater holds the latest message of a conflated stream until its flusher goroutine
+// can send it. Handlers never wait for the client: a message that cannot be queued
+// right away becomes pending, replacing an older pending one, and only the flusher
+// blocks on flow control and the send queue.
+type conflater struct {
+	stream  *WebSocketServerStream
+	mu      sync.Mutex
+	pending *[]byte // Latest unsent message, from marshalFrameBuffer
+	flags   uint8   // DATA flags of pending
+	sending bool    // The flusher is sending a message it took
+	err     error   // Set once the flusher stopped; returned by later offers
+	dropped atomic.Uint64
+
+	signal  chan struct{} // Capacity 1: a message is pending
+	closing chan struct{} // Closed by stop: send what is pending, then exit
+	done    chan struct{} // Closed when the flusher exits
+}
+
+// getConflater returns the stream's conflater, starting its flusher on first use, or
+// nil if the stream is not conflated.
+func (s *WebSocketServerStream) getConflater() *conflater {
+	s.conflateMu.Lock()
+	defer s.conflateMu.Unlock()
+	if !s.conflate {
+		return nil
+	}
+	if s.conflater == nil {
+		s.conflater = &conflater{
+			stream:  s,
+			signal:  make(chan struct{}, 1),
+			closing: make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		go s.conflater.run()
+	}
+	return s.conflater
+}
+
+// stopConflater sends the latest pending message, if any, and waits for the flusher to
+// exit. Called once the handler has returned, before the trailers.
+func (s *WebSocketServerStream) stopConflater() {
+	s.conflateMu.Lock()
+	c := s.conflater
+	s.conflateMu.Unlock()
+	if c != nil {
+		c.stop()
+	}
+}
+
+// offer queues buf if the stream can take it without waiting and the flusher is idle,
+// and otherwise makes it the pending message, replacing (and counting) an older one.
+// It takes ownership of buf and returns the error that stopped the flusher.
+func (c *conflater) offer(buf *[]byte, flags uint8) error {
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		putFrameBuffer(buf)
+		return err
+	}
+	if c.pending == nil && !c.sending && c.stream.trySendMessage(buf, flags, conflatedLaneLimit) {
+		c.mu.Unlock()
+		return nil
+	}
+	replaced := c.pending != nil
+	if replaced {
+		putFrameBuffer(c.pending)
+	}
+	c.pending, c.flags = buf, flags
+	c.mu.Unlock()
+
+	if replaced {
+		c.dropped.Add(1)
+		server := c.stream.conn.server
+		server.conflated.Add(1)
+		if server.options.EnableLogging {
+			log.Printf("[wsgrpc] Replaced an unsent message on conflated stream %d", c.stream.streamID)
+		}
+	}
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// take removes the pending message for the flusher to send.
+func (c *conflater) take() (*[]byte, uint8) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf := c.pending
+	c.pending = nil
+	c.sending = buf != nil
+	return buf, c.flags
+}
+
+// sent marks the end of a send by the flusher.
+func (c *conflater) sent() {
+	c.mu.Lock()
+	c.sending = false
+	c.mu.Unlock()
+}
+
+// fail stops accepting messages with err and releases the pending one.
+func (c *conflater) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	if c.pending != nil {
+		putFrameBuffer(c.pending)
+		c.pending = nil
+	}
+}
+
+// run is the flusher goroutine. It sends one message at a time and keeps at most
+// conflatedLaneLimit frames of the stream in the send queue, so that newer messages
+// replace the pending one while the client or the connection is behind.
+func (c *conflater) run() {
+	defer close(c.done)
+	for {
+		closing := false
+		select {
+		case <-c.signal:
+		case <-c.closing:
+			closing = true
+		case <-c.stream.ctx.Done():
+			c.fail(status.FromContextError(c.stream.ctx.Err()).Err())
+			return
+		}
+		if buf, flags := c.take(); buf != nil {
+			err := c.stream.sendMessage(c.stream.ctx, buf, flags, conflatedLaneLimit)
+			c.sent()
+			if err != nil {
+				c.fail(err)
+				return
+			}
+		}
+		if closing {
+			return
+		}
+	}
+}
+
+// stop flushes the pending message and waits for the flusher to exit. Later offers
+// fail.
+func (c *conflater) stop() {
+	c.mu.Lock()
+	select {
+	case <-c.closing:
+	default:
+		close(c.closing)
+	}
+	c.mu.Unlock()
+	<-c.done
+	c.fail(status.Error(codes.Unavailable, "stream already finished"))
+}
@@ -0,0 +1,134 @@
+package wsgrpc
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// tickerGreeter streams ticks as fast as it can and reports how many were conflated
+type tickerGreeter struct {
+	pb.UnimplementedGreeterServer
+	ticks   int64
+	enable  bool // Opt in with EnableConflation instead of ServerOption
+	dropped chan uint64
+}
+
+func (g *tickerGreeter) InfiniteTicker(_ *pb.Empty, stream grpc.ServerStreamingServer[pb.Tick]) error {
+	if g.enable && !EnableConflation(stream.Context()) {
+		return io.ErrUnexpectedEOF
+	}
+	for i := int64(0); i < g.ticks; i++ {
+		if err := stream.Send(&pb.Tick{Count: i}); err != nil {
+			return err
+		}
+	}
+	g.dropped <- ConflatedMessages(stream.Context())
+	return nil
+}
+
+// TestConflation verifies that a conflated stream never blocks its handler on a client
+// that does not read, that the latest value is delivered, and that every message is
+// either received or counted as dropped
+func TestConflation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  ServerOption
+	}{
+		{name: "ServerOption", opt: ServerOption{ConflatedMethods: []string{pb.Greeter_InfiniteTicker_FullMethodName}}},
+		{name: "EnableConflation"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const ticks = 1000
+			greeter := &tickerGreeter{ticks: ticks, enable: tc.opt.ConflatedMethods == nil, dropped: make(chan uint64, 1)}
+			// A tiny window makes the client fall behind after a few ticks
+			server, client, _ := newTestClientWith(t, greeter, []ServerOption{tc.opt}, ClientOption{InitialWindowSize: 32})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			stream, err := client.InfiniteTicker(ctx, &pb.Empty{})
+			if err != nil {
+				t.Fatalf("InfiniteTicker failed: %v", err)
+			}
+
+			// The handler sends every tick without the client reading any
+			var dropped uint64
+			select {
+			case dropped = <-greeter.dropped:
+			case <-ctx.Done():
+				t.Fatal("Handler blocked on the slow client")
+			}
+
+			var received []int64
+			for {
+				tick, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Recv failed after %d ticks: %v", len(received), err)
+				}
+				received = append(received, tick.GetCount())
+			}
+			t.Logf("Received %d ticks, %d conflated", len(received), dropped)
+
+			if len(received) == 0 || received[len(received)-1] != ticks-1 {
+				t.Fatalf("Expected the latest tick %d last, got %v", ticks-1, received)
+			}
+			for i := 1; i < len(received); i++ {
+				if received[i] <= received[i-1] {
+					t.Fatalf("Ticks out of order: %v", received)
+				}
+			}
+			if dropped == 0 || uint64(len(received))+dropped != ticks {
+				t.Errorf("Received %d + dropped %d ticks, want %d in total with some dropped", len(received), dropped, ticks)
+			}
+			if got := server.ConflatedMessages(); got != dropped {
+				t.Errorf("Server counted %d conflated messages, stream %d", got, dropped)
+			}
+		})
+	}
+}
+
+// TestConflationIsOptIn verifies that other methods keep every message
+func TestConflationIsOptIn(t *testing.T) {
+	greeter := &tickerGreeter{ticks: 200, dropped: make(chan uint64, 1)}
+	server, client, _ := newTestClientWith(t, greeter,
+		[]ServerOption{{ConflatedMethods: []string{pb.Greeter_SayHelloStream_FullMethodName}}},
+		ClientOption{InitialWindowSize: 32})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.InfiniteTicker(ctx, &pb.Empty{})
+	if err != nil {
+		t.Fatalf("InfiniteTicker failed: %v", err)
+	}
+	count := 0
+	for ; ; count++ {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Recv failed after %d ticks: %v", count, err)
+		}
+	}
+	if count != 200 || <-greeter.dropped != 0 || server.ConflatedMessages() != 0 {
+		t.Errorf("Expected all 200 ticks without conflation, got %d", count)
+	}
+}
+
+// TestEnableConflationOutsideStream verifies the helpers on a context without a stream
+func TestEnableConflationOutsideStream(t *testing.T) {
+	if EnableConflation(context.Background()) {
+		t.Error("Expected EnableConflation to fail without a wsgrpc stream")
+	}
+	if n := ConflatedMessages(context.Background()); n != 0 {
+		t.Errorf("Expected no conflated messages without a stream, got %d", n)
+	}
+}
@@ -0,0 +1,239 @@
+package wsgrpc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+// connectStreamContentType is the content-type prefix of Connect streaming calls; unary
+// calls use application/<codec> (e.g. application/json).
+const connectStreamContentType = "application/connect+"
+
+// connectMaxTimeoutDigits bounds the Connect-Timeout-Ms header, as the protocol does.
+const connectMaxTimeoutDigits = 10
+
+// connectCodes are the Connect names of the gRPC status codes.
+var connectCodes = [...]string{
+	codes.Canceled:           "canceled",
+	codes.Unknown:            "unknown",
+	codes.InvalidArgument:    "invalid_argument",
+	codes.DeadlineExceeded:   "deadline_exceeded",
+	codes.NotFound:           "not_found",
+	codes.AlreadyExists:      "already_exists",
+	codes.PermissionDenied:   "permission_denied",
+	codes.ResourceExhausted:  "resource_exhausted",
+	codes.FailedPrecondition: "failed_precondition",
+	codes.Aborted:            "aborted",
+	codes.OutOfRange:         "out_of_range",
+	codes.Unimplemented:      "unimplemented",
+	codes.Internal:           "internal",
+	codes.Unavailable:        "unavailable",
+	codes.DataLoss:           "data_loss",
+	codes.Unauthenticated:    "unauthenticated",
+}
+
+// connectHTTPStatus is the HTTP status of a Connect unary error with the given code.
+func connectHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// connectError is the JSON error of the Connect protocol.
+type connectError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Details []connectDetail `json:"details,omitempty"`
+}
+
+// connectDetail is an error detail: the message's full name and its serialization in
+// unpadded base64.
+type connectDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// connectEndStream is the last message of a Connect streaming response.
+type connectEndStream struct {
+	Error    *connectError       `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+// newConnectError returns the Connect error for a status, or nil for OK. statusDetails
+// is the serialized google.rpc.Status of errors with details.
+func newConnectError(statusCode int, statusMsg string, statusDetails []byte) *connectError {
+	code := codes.Code(statusCode)
+	if code == codes.OK {
+		return nil
+	}
+	e := &connectError{Code: "unknown", Message: statusMsg}
+	if int(code) < len(connectCodes) && connectCodes[code] != "" {
+		e.Code = connectCodes[code]
+	}
+	if statusDetails != nil {
+		st := &spb.Status{}
+		if err := proto.Unmarshal(statusDetails, st); err == nil {
+			for _, detail := range st.GetDetails() {
+				name := detail.GetTypeUrl()
+				if i := strings.LastIndexByte(name, '/'); i >= 0 {
+					name = name[i+1:]
+				}
+				e.Details = append(e.Details, connectDetail{Type: name, Value: base64.RawStdEncoding.EncodeToString(detail.GetValue())})
+			}
+		}
+	}
+	return e
+}
+
+// parseConnectContentType returns the content-subtype of a Connect content-type and
+// whether the call uses the streaming protocol. ok is false for other content-types.
+func parseConnectContentType(contentType string) (subtype string, streaming bool, ok bool) {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if rest, found := strings.CutPrefix(mediaType, connectStreamContentType); found && rest != "" {
+		return rest, true, true
+	}
+	switch mediaType {
+	case "application/proto", "application/json":
+		return strings.TrimPrefix(mediaType, "application/"), false, true
+	}
+	return "", false, false
+}
+
+// HandleConnect serves a call of a registered method over the Connect protocol: unary
+// calls are POSTs of a single message (application/proto or application/json) that get
+// the response or a JSON error back, streaming calls exchange enveloped messages
+// (application/connect+proto or application/connect+json). The method is the end of
+// the request path. Calls go through the same interceptors as WebSocket streams and get the same
+// scrubbed error statuses. ServeHTTP routes Connect requests here.
+func (s *Server) HandleConnect(w http.ResponseWriter, r *http.Request) {
+	subtype, streaming, ok := parseConnectContentType(r.Header.Get("Content-Type"))
+	if !ok {
+		http.Error(w, "unsupported content-type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Connect calls must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stream := &httpServerStream{
+		ctx:         r.Context(),
+		server:      s,
+		w:           w,
+		body:        r.Body,
+		method:      methodFromPath(r.URL.Path),
+		protocol:    protocolConnectUnary,
+		contentType: "application/" + subtype,
+	}
+	encodingHeader, acceptHeader := "Content-Encoding", "Accept-Encoding"
+	if streaming {
+		stream.protocol = protocolConnectStream
+		stream.contentType = connectStreamContentType + subtype
+		encodingHeader, acceptHeader = "Connect-Content-Encoding", "Connect-Accept-Encoding"
+	}
+
+	var timeout time.Duration
+	if value := r.Header.Get("Connect-Timeout-Ms"); value != "" {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms < 0 || len(value) > connectMaxTimeoutDigits {
+			stream.finish(int(codes.InvalidArgument), fmt.Sprintf("malformed Connect-Timeout-Ms %q", value), nil)
+			return
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+		if timeout == 0 {
+			stream.finish(int(codes.DeadlineExceeded), "context deadline exceeded", nil)
+			return
+		}
+	}
+	encodingName := r.Header.Get(encodingHeader)
+	recvCompressor, ok := lookupCompressor(encodingName)
+	if !ok {
+		stream.finish(int(codes.Unimplemented), fmt.Sprintf("unsupported %s %q", encodingHeader, encodingName), nil)
+		return
+	}
+	stream.recvCompressor = recvCompressor
+	stream.sendCompressor = s.responseCompressor(recvCompressor, r.Header.Values(acceptHeader))
+
+	s.serveHTTPCall(r, stream, subtype, metadataFromHTTPHeader(r.Header), timeout)
+}
+
+// finishConnectUnaryLocked writes the response of a Connect unary call: the message
+// with the headers and "trailer-" prefixed trailers, or the JSON error.
+func (s *httpServerStream) finishConnectUnaryLocked(statusCode int, statusMsg string, statusDetails []byte) error {
+	h := s.w.Header()
+	addMetadataHeaders(h, s.header, "")
+	addMetadataHeaders(h, s.trailer, "trailer-")
+
+	if e := newConnectError(statusCode, statusMsg, statusDetails); e != nil {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		h.Set("Content-Type", "application/json")
+		s.w.WriteHeader(connectHTTPStatus(codes.Code(statusCode)))
+		_, err = s.w.Write(body)
+		return err
+	}
+
+	h.Set("Content-Type", s.contentType)
+	if s.responseCompressed {
+		h.Set("Content-Encoding", s.sendCompressor.Name())
+	}
+	s.w.WriteHeader(http.StatusOK)
+	_, err := s.w.Write(s.response)
+	return err
+}
+
+// finishConnectStreamLocked ends a Connect streaming response with the end-of-stream
+// message carrying the error, if any, and the trailers. Headers that were not sent yet
+// go out first.
+func (s *httpServerStream) finishConnectStreamLocked(statusCode int, statusMsg string, statusDetails []byte) error {
+	if !s.headerSent {
+		s.writeHeaderLocked()
+	}
+	end := connectEndStream{Error: newConnectError(statusCode, statusMsg, statusDetails)}
+	if len(s.trailer) > 0 {
+		end.Metadata = make(map[string][]string, len(s.trailer))
+		for k, values := range s.trailer {
+			for _, v := range values {
+				end.Metadata[k] = append(end.Metadata[k], encodeTextValue(k, v))
+			}
+		}
+	}
+	body, err := json.Marshal(end)
+	if err != nil {
+		return err
+	}
+	return s.writeEnvelopeLocked(envelopeEndStream, body)
+}
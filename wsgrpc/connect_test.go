@@ -0,0 +1,144 @@
+package wsgrpc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// TestConnectUnary verifies Connect unary calls with both codecs through ServeHTTP
+// and the Server's interceptors
+func TestConnectUnary(t *testing.T) {
+	calls := &callLog{}
+	unary, _ := loggingInterceptors(calls, "wsgrpc")
+	server := NewServer(ServerOption{UnaryInterceptors: []grpc.UnaryServerInterceptor{unary}})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	req, _ := proto.Marshal(&pb.HelloRequest{Name: "proto"})
+	resp := postHTTPCall(t, httpServer, pb.Greeter_SayHello_FullMethodName, "application/proto", req, nil)
+	body, _ := io.ReadAll(resp.Body)
+	got := &pb.HelloResponse{}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/proto" {
+		t.Fatalf("Unexpected response %d %q: %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	if err := proto.Unmarshal(body, got); err != nil || got.GetMessage() != "Hello proto" {
+		t.Errorf("Unexpected response %q, %v", got.GetMessage(), err)
+	}
+
+	resp = postHTTPCall(t, httpServer, pb.Greeter_SayHello_FullMethodName, "application/json; charset=utf-8", []byte(`{"name":"json"}`),
+		http.Header{"Connect-Protocol-Version": {"1"}, "X-Greeting": {"Hi"}})
+	body, _ = io.ReadAll(resp.Body)
+	t.Logf("JSON response: %d %s", resp.StatusCode, body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"Hi json"`) {
+		t.Errorf("Unexpected JSON response %d %s", resp.StatusCode, body)
+	}
+
+	if logged := calls.take(); len(logged) != 2 {
+		t.Errorf("Expected both calls to go through the interceptor, got %v", logged)
+	}
+}
+
+// TestConnectUnaryErrors verifies the JSON errors and HTTP statuses of failed Connect
+// unary calls, and that panics are scrubbed as on WebSocket streams
+func TestConnectUnaryErrors(t *testing.T) {
+	server := NewServer(ServerOption{})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Panicker",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Panic",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				panic(sensitivePanicDetail)
+			},
+		}},
+	}, nil)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tests := []struct {
+		method, body string
+		wantHTTP     int
+		wantCode     string
+		wantMessage  string
+	}{
+		{pb.Greeter_SayHello_FullMethodName, `{"name":"fail"}`, http.StatusBadRequest, "invalid_argument", "name must not be fail"},
+		{"/test.Panicker/Panic", `{}`, http.StatusInternalServerError, "internal", genericInternalMessage},
+		{"/greeter.Missing/SayHello", `{}`, http.StatusNotImplemented, "unimplemented", "unknown service greeter.Missing"},
+		{pb.Greeter_SayHelloStream_FullMethodName, `{}`, http.StatusNotImplemented, "unimplemented", ""},
+	}
+	for _, tt := range tests {
+		resp := postHTTPCall(t, httpServer, tt.method, "application/json", []byte(tt.body), nil)
+		var got connectError
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: failed to decode error: %v", tt.method, err)
+		}
+		t.Logf("%s: %d %+v", tt.method, resp.StatusCode, got)
+		if resp.StatusCode != tt.wantHTTP || got.Code != tt.wantCode {
+			t.Errorf("%s: got %d %q, want %d %q", tt.method, resp.StatusCode, got.Code, tt.wantHTTP, tt.wantCode)
+		}
+		if tt.wantMessage != "" && got.Message != tt.wantMessage {
+			t.Errorf("%s: got message %q, want %q", tt.method, got.Message, tt.wantMessage)
+		}
+		if strings.Contains(got.Message, "SECRET") {
+			t.Errorf("%s: error leaked the panic detail: %q", tt.method, got.Message)
+		}
+	}
+}
+
+// TestConnectStreaming verifies Connect streaming calls: enveloped messages in both
+// directions and the end-of-stream message with the trailers
+func TestConnectStreaming(t *testing.T) {
+	server := NewServer(ServerOption{})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	resp := postHTTPCall(t, httpServer, pb.Greeter_SayHelloStream_FullMethodName, "application/connect+json",
+		envelope(0, []byte(`{"name":"stream"}`)), nil)
+	if resp.Header.Get("Content-Type") != "application/connect+json" || resp.Header.Get("X-Stream") != "server" {
+		t.Errorf("Unexpected headers %v", resp.Header)
+	}
+	envelopes := readEnvelopes(t, resp.Body)
+	if len(envelopes) != 4 {
+		t.Fatalf("Expected 3 messages and the end of the stream, got %d envelopes", len(envelopes))
+	}
+	for i, e := range envelopes[:3] {
+		t.Logf("Message %d: %s", i, e.payload)
+	}
+	var end connectEndStream
+	if envelopes[3].flags != envelopeEndStream || json.Unmarshal(envelopes[3].payload, &end) != nil {
+		t.Fatalf("Unexpected end of stream 0x%02x %s", envelopes[3].flags, envelopes[3].payload)
+	}
+	if end.Error != nil || len(end.Metadata["x-count"]) != 1 || end.Metadata["x-count"][0] != "3" {
+		t.Errorf("Unexpected end of stream %s", envelopes[3].payload)
+	}
+
+	// A client stream, and an error in the end-of-stream message
+	var body []byte
+	for _, name := range []string{"a", "b"} {
+		body = append(body, envelope(0, []byte(`{"name":"`+name+`"}`))...)
+	}
+	resp = postHTTPCall(t, httpServer, pb.Greeter_SayHelloClientStream_FullMethodName, "application/connect+json", body, nil)
+	envelopes = readEnvelopes(t, resp.Body)
+	if len(envelopes) != 2 || !strings.Contains(string(envelopes[0].payload), "Hello a, b") {
+		t.Fatalf("Unexpected client stream response %v", envelopes)
+	}
+
+	resp = postHTTPCall(t, httpServer, "/greeter.Greeter/Missing", "application/connect+proto", nil, nil)
+	envelopes = readEnvelopes(t, resp.Body)
+	if len(envelopes) != 1 || json.Unmarshal(envelopes[0].payload, &end) != nil || end.Error == nil || end.Error.Code != "unimplemented" {
+		t.Errorf("Unexpected response for an unknown method %v", envelopes)
+	}
+}
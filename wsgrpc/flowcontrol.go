@@ -0,0 +1,279 @@
+package wsgrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Default flow control windows, used when ServerOption / ClientOption leave them unset.
+const (
+	defaultInitialWindowSize     = 64 * 1024   // 64KB per stream
+	defaultInitialConnWindowSize = 1024 * 1024 // 1MB per connection
+	defaultAdvertisementTimeout  = time.Second // Client wait for the server's advertisement
+)
+
+// encodeWindowUpdate encodes a WINDOW_UPDATE frame granting increment more bytes of
+// credit. Stream ID 0 addresses the connection-level window.
+func encodeWindowUpdate(streamID uint32, increment uint32) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, increment)
+	return encodeFrame(streamID, FlagWINDOW_UPDATE, payload)
+}
+
+// encodeWindowAdvertisement encodes the WINDOW_UPDATE frame exchanged on stream 0 at
+// connection start. Its 8-byte payload carries the initial per-stream window and the
+// initial connection window the sender is willing to receive.
+func encodeWindowAdvertisement(streamWindow, connWindow uint32) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload[0:4], streamWindow)
+	binary.BigEndian.PutUint32(payload[4:8], connWindow)
+	return encodeFrame(0, FlagWINDOW_UPDATE, payload)
+}
+
+// flowWindow is the send-side credit granted by the peer. Senders block while the
+// window is exhausted and are woken up when WINDOW_UPDATE frames add credit.
+//
+// Messages are never split to fit the window: a message may be sent whenever the
+// window is positive and its full length is then debited, so the window can briefly
+// go negative by at most one message. Fragments of a message that was started are sent
+// without waiting for credit.
+type flowWindow struct {
+	mu     sync.Mutex
+	size   int64
+	signal chan struct{} // Closed and replaced whenever credit is added
+}
+
+func newFlowWindow(size int64) *flowWindow {
+	return &flowWindow{size: size, signal: make(chan struct{})}
+}
+
+// add grants n bytes of credit and wakes up blocked senders.
+func (w *flowWindow) add(n int64) {
+	w.mu.Lock()
+	w.size += n
+	close(w.signal)
+	w.signal = make(chan struct{})
+	w.mu.Unlock()
+}
+
+// consume debits n bytes of credit.
+func (w *flowWindow) consume(n int64) {
+	w.mu.Lock()
+	w.size -= n
+	w.mu.Unlock()
+}
+
+// tryConsume debits n bytes of credit if the window has credit left, reporting whether
+// it did.
+func (w *flowWindow) tryConsume(n int64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size <= 0 {
+		return false
+	}
+	w.size -= n
+	return true
+}
+
+// available reports whether the window has credit left, and otherwise returns the
+// channel that is closed on the next update.
+func (w *flowWindow) available() (bool, <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size > 0, w.signal
+}
+
+// waitForWindows blocks until every window has credit or ctx is done. Nil windows
+// (flow control not active) are skipped.
+func waitForWindows(ctx context.Context, windows ...*flowWindow) error {
+	for {
+		var wait <-chan struct{}
+		for _, w := range windows {
+			if w == nil {
+				continue
+			}
+			if ok, signal := w.available(); !ok {
+				wait = signal
+				break
+			}
+		}
+		if wait == nil {
+			return nil
+		}
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// recvFlow tracks the receive window granted to the peer, for one stream or for the
+// whole connection.
+type recvFlow struct {
+	mu      sync.Mutex
+	limit   int64 // Advertised window size
+	window  int64 // Credit the peer has left
+	unacked int64 // Bytes released but not yet returned to the peer via WINDOW_UPDATE
+}
+
+func newRecvFlow(limit int64) *recvFlow {
+	return &recvFlow{limit: limit, window: limit}
+}
+
+// onReceive debits n bytes received from the peer. It returns false if the peer had no
+// credit left, which is a flow control violation.
+func (f *recvFlow) onReceive(n int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.window <= 0 {
+		return false
+	}
+	f.window -= int64(n)
+	return true
+}
+
+// onReceiveFragment debits n bytes of a fragment that continues a message. Credit is
+// only needed to start a message, so the window may go negative by the rest of it.
+func (f *recvFlow) onReceiveFragment(n int) {
+	f.mu.Lock()
+	f.window -= int64(n)
+	f.mu.Unlock()
+}
+
+// onRelease returns n bytes of credit once they have been consumed. It reports the
+// increment to announce with WINDOW_UPDATE, or 0 while the pending credit is below a
+// quarter of the window (to avoid a WINDOW_UPDATE per message).
+func (f *recvFlow) onRelease(n int) uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unacked += int64(n)
+	if f.unacked < f.limit/4 && f.window > 0 {
+		return 0
+	}
+	increment := f.unacked
+	f.window += increment
+	f.unacked = 0
+	return uint32(increment)
+}
+
+// connFlowControl holds a connection's flow control state. Flow control only becomes
+// active once both sides exchanged window advertisements, so peers that predate it
+// (e.g. older Angular bundles) keep the v1.0 TCP backpressure behavior.
+type connFlowControl struct {
+	mu               sync.Mutex
+	enabled          bool
+	disabled         bool          // Settled without flow control; later advertisements are ignored
+	settled          bool          // The exchange completed, or the peer is known not to answer
+	ready            chan struct{} // Closed once settled
+	streamWindow     int64         // Our initial per-stream receive window
+	connWindow       int64         // Our initial connection receive window
+	peerStreamWindow int64         // Initial per-stream send window granted by the peer
+	sendWindow       *flowWindow   // Connection-level send credit granted by the peer
+	recv             *recvFlow     // Connection-level receive credit granted to the peer
+}
+
+func newConnFlowControl(streamWindow, connWindow uint32) *connFlowControl {
+	return &connFlowControl{
+		ready:        make(chan struct{}),
+		streamWindow: int64(streamWindow),
+		connWindow:   int64(connWindow),
+	}
+}
+
+// enable activates flow control with the windows advertised by the peer. It reports
+// false if flow control was already active, or settled without it.
+func (f *connFlowControl) enable(peerStreamWindow, peerConnWindow uint32) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.enabled || f.disabled {
+		return false
+	}
+	f.enabled = true
+	f.peerStreamWindow = int64(peerStreamWindow)
+	f.sendWindow = newFlowWindow(int64(peerConnWindow))
+	f.recv = newRecvFlow(f.connWindow)
+	f.settleLocked()
+	return true
+}
+
+// settleWithoutAdvertisement gives up waiting for the peer's advertisement, leaving flow
+// control off for the whole connection: an advertisement that still arrives is ignored.
+// It reports whether this turned flow control off, in which case the peer must be told
+// with a withdrawal (PROTOCOL.md Section 7.2).
+func (f *connFlowControl) settleWithoutAdvertisement() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.settled {
+		return false
+	}
+	f.disabled = true
+	f.settleLocked()
+	return true
+}
+
+// withdraw turns flow control off for the whole connection after the peer gave up
+// waiting for our advertisement. Streams must not exist yet: the peer withdraws before
+// opening any.
+func (f *connFlowControl) withdraw() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.enabled = false
+	f.disabled = true
+	f.sendWindow = nil
+	f.recv = nil
+	f.settleLocked()
+}
+
+func (f *connFlowControl) settleLocked() {
+	if !f.settled {
+		f.settled = true
+		close(f.ready)
+	}
+}
+
+// isEnabled reports whether the advertisement exchange has completed.
+func (f *connFlowControl) isEnabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enabled
+}
+
+// connSendWindow returns the connection-level send window, or nil before flow
+// control is active.
+func (f *connFlowControl) connSendWindow() *flowWindow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sendWindow
+}
+
+// connRecv returns the connection-level receive window, or nil before flow control
+// is active.
+func (f *connFlowControl) connRecv() *recvFlow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.recv
+}
+
+// newStreamWindows returns the send and receive windows for a new stream, or nil
+// windows when flow control is not active on the connection.
+func (f *connFlowControl) newStreamWindows() (*flowWindow, *recvFlow) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled {
+		return nil, nil
+	}
+	return newFlowWindow(f.peerStreamWindow), newRecvFlow(f.streamWindow)
+}
+
+// withdrawal is the advertisement of zero windows with which a client that gave up
+// waiting for the server's advertisement turns flow control off.
+var withdrawal = encodeWindowAdvertisement(0, 0)
+
+// advertisement encodes our own window advertisement.
+func (f *connFlowControl) advertisement() []byte {
+	return encodeWindowAdvertisement(uint32(f.streamWindow), uint32(f.connWindow))
+}
@@ -0,0 +1,305 @@
+package wsgrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// stalledGreeter holds client-streaming handlers until release is closed and counts
+// the messages sent by server-streaming handlers
+type stalledGreeter struct {
+	testGreeter
+	release chan struct{}
+	sent    atomic.Int64
+}
+
+func (g *stalledGreeter) SayHelloClientStream(stream grpc.ClientStreamingServer[pb.HelloRequest, pb.HelloResponse]) error {
+	<-g.release
+	return g.testGreeter.SayHelloClientStream(stream)
+}
+
+func (g *stalledGreeter) SayHelloStream(req *pb.HelloRequest, stream grpc.ServerStreamingServer[pb.HelloResponse]) error {
+	for i := 0; i < 200; i++ {
+		if err := stream.Send(&pb.HelloResponse{Message: fmt.Sprintf("%s %03d %s", req.GetName(), i, strings.Repeat("x", 90))}); err != nil {
+			return err
+		}
+		g.sent.Add(1)
+	}
+	return nil
+}
+
+// TestFlowControlSlowHandlerDoesNotStallOtherStreams pins the head-of-line blocking
+// that flow control removes: a client-streaming handler that is not reading used to
+// park the connection's read pump on its full recvChan, freezing every other stream.
+// With flow control the uploader blocks on its own window and unary calls keep working.
+func TestFlowControlSlowHandlerDoesNotStallOtherStreams(t *testing.T) {
+	impl := &stalledGreeter{release: make(chan struct{})}
+	_, client, _ := newTestClientWith(t, impl, []ServerOption{{InitialWindowSize: 1024}}, ClientOption{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	upload, err := client.SayHelloClientStream(ctx)
+	if err != nil {
+		t.Fatalf("SayHelloClientStream failed: %v", err)
+	}
+
+	// Push far more than recvChan's 10 slots and the 1KB window
+	const chunks = 100
+	uploadDone := make(chan error, 1)
+	go func() {
+		for i := 0; i < chunks; i++ {
+			if err := upload.Send(&pb.HelloRequest{Name: strings.Repeat("u", 100)}); err != nil {
+				uploadDone <- err
+				return
+			}
+		}
+		resp, err := upload.CloseAndRecv()
+		if err == nil && strings.Count(resp.GetMessage(), "u, ") != chunks-1 {
+			err = fmt.Errorf("unexpected upload response of %d bytes", len(resp.GetMessage()))
+		}
+		uploadDone <- err
+	}()
+
+	// Give the uploader time to exhaust its window
+	time.Sleep(200 * time.Millisecond)
+
+	unaryCtx, unaryCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer unaryCancel()
+	resp, err := client.SayHello(unaryCtx, &pb.HelloRequest{Name: "Unary"})
+	if err != nil {
+		t.Fatalf("Unary call stalled behind the blocked upload: %v", err)
+	}
+	if resp.GetMessage() != "Hello Unary" {
+		t.Errorf("Unexpected unary response: %q", resp.GetMessage())
+	}
+
+	select {
+	case err := <-uploadDone:
+		t.Fatalf("Upload finished before the handler read anything (err=%v); the window did not block it", err)
+	default:
+	}
+
+	// Release the handler; WINDOW_UPDATEs must let the upload complete
+	close(impl.release)
+	select {
+	case err := <-uploadDone:
+		if err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload did not complete after the handler started reading")
+	}
+}
+
+// TestFlowControlServerSendBlocksOnlyItsStream verifies that SendMsg blocks once the
+// client's window is used up while other streams on the same socket keep working
+func TestFlowControlServerSendBlocksOnlyItsStream(t *testing.T) {
+	impl := &stalledGreeter{release: make(chan struct{})}
+	close(impl.release)
+	_, client, _ := newTestClientWith(t, impl, nil, ClientOption{InitialWindowSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.SayHelloStream(ctx, &pb.HelloRequest{Name: "tick"})
+	if err != nil {
+		t.Fatalf("SayHelloStream failed: %v", err)
+	}
+
+	// Do not read: the handler must stall once ~1KB is outstanding
+	time.Sleep(300 * time.Millisecond)
+	if sent := impl.sent.Load(); sent > 20 {
+		t.Fatalf("Handler sent %d messages without the client reading; window not enforced", sent)
+	}
+
+	// Another stream on the same connection is unaffected
+	unaryCtx, unaryCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer unaryCancel()
+	if _, err := client.SayHello(unaryCtx, &pb.HelloRequest{Name: "Unary"}); err != nil {
+		t.Fatalf("Unary call stalled behind the blocked stream: %v", err)
+	}
+
+	// Reading releases credit until the whole stream is delivered in order
+	for i := 0; i < 200; i++ {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+		if want := fmt.Sprintf("tick %03d ", i); !strings.HasPrefix(resp.GetMessage(), want) {
+			t.Fatalf("Message %d out of order: %q", i, resp.GetMessage()[:12])
+		}
+	}
+}
+
+// TestFlowControlViolationResetsStream verifies that a client that opted into flow
+// control and then ignores the server's stream window gets RST_STREAM FLOW_CONTROL_ERROR
+func TestFlowControlViolationResetsStream(t *testing.T) {
+	impl := &stalledGreeter{release: make(chan struct{})}
+	defer close(impl.release)
+
+	server := NewServer(ServerOption{InsecureSkipVerify: true, InitialWindowSize: 256})
+	pb.RegisterGreeterServer(server, impl)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	readSettings(t, ctx, conn)
+
+	// Opt into flow control and read the server's advertisement
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeWindowAdvertisement(65536, 1<<20)); err != nil {
+		t.Fatalf("Failed to send advertisement: %v", err)
+	}
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read advertisement: %v", err)
+	}
+	frame, err := decodeFrame(data, 4*1024*1024)
+	if err != nil || frame.Flags != FlagWINDOW_UPDATE || len(frame.Payload) != 8 {
+		t.Fatalf("Expected window advertisement, got %+v (err=%v)", frame, err)
+	}
+	if w := binary.BigEndian.Uint32(frame.Payload[0:4]); w != 256 {
+		t.Errorf("Expected advertised stream window 256, got %d", w)
+	}
+
+	streamID := uint32(1)
+	headers := "path: /greeter.Greeter/SayHelloClientStream\n"
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagHEADERS, []byte(headers))); err != nil {
+		t.Fatalf("Failed to send HEADERS: %v", err)
+	}
+
+	payload, _ := proto.Marshal(&pb.HelloRequest{Name: strings.Repeat("v", 200)})
+	for i := 0; i < 3; i++ {
+		if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagDATA, payload)); err != nil {
+			t.Fatalf("Failed to send DATA: %v", err)
+		}
+	}
+
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Expected RST_STREAM, connection ended: %v", err)
+		}
+		frame, err := decodeFrame(data, 4*1024*1024)
+		if err != nil {
+			continue
+		}
+		if frame.StreamID == streamID && frame.Flags&FlagRST_STREAM != 0 {
+			if code := decodeErrorCode(frame.Payload); code != ErrCodeFlowControlError {
+				t.Errorf("Expected FLOW_CONTROL_ERROR, got code %d", code)
+			}
+			return
+		}
+	}
+}
+
+// TestFlowControlLateAdvertisement verifies that a client whose server answers the
+// advertisement only after AdvertisementTimeout keeps flow control off on both ends, so
+// that streams of more than a window flow in both directions
+func TestFlowControlLateAdvertisement(t *testing.T) {
+	impl := &stalledGreeter{release: make(chan struct{})}
+	close(impl.release)
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	server.testAdvertisementDelay = 200 * time.Millisecond
+	pb.RegisterGreeterServer(server, impl)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, "ws"+httpServer.URL[4:], ClientOption{AdvertisementTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	client := pb.NewGreeterClient(conn)
+
+	// About 100 KB per direction, beyond the default 64 KB stream window
+	name := strings.Repeat("n", 400)
+	stream, err := client.SayHelloStream(ctx, &pb.HelloRequest{Name: name})
+	if err != nil {
+		t.Fatalf("SayHelloStream failed: %v", err)
+	}
+	received := 0
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if err != io.EOF {
+				t.Fatalf("Recv %d failed: %v", received, err)
+			}
+			break
+		}
+		received++
+	}
+	t.Logf("Received %d messages", received)
+	if received != 200 {
+		t.Errorf("Expected 200 messages, got %d", received)
+	}
+
+	upload, err := client.SayHelloClientStream(ctx)
+	if err != nil {
+		t.Fatalf("SayHelloClientStream failed: %v", err)
+	}
+	for i := 0; i < 250; i++ {
+		if err := upload.Send(&pb.HelloRequest{Name: name}); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if _, err := upload.CloseAndRecv(); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	if conn.flow.isEnabled() {
+		t.Error("Expected the late advertisement to be ignored by the client")
+	}
+}
+
+// TestRecvFlowBatchesWindowUpdates verifies that released credit is only announced
+// once a quarter of the window is pending, or immediately when the peer is blocked
+func TestRecvFlowBatchesWindowUpdates(t *testing.T) {
+	f := newRecvFlow(1000)
+
+	if !f.onReceive(100) {
+		t.Fatal("Expected receive within the window to succeed")
+	}
+	if inc := f.onRelease(100); inc != 0 {
+		t.Errorf("Expected no update below the threshold, got %d", inc)
+	}
+	f.onReceive(200)
+	if inc := f.onRelease(200); inc != 300 {
+		t.Errorf("Expected batched update of 300, got %d", inc)
+	}
+
+	// Exhaust the window (overdraft by one message is allowed)
+	f.onReceive(1200)
+	if f.onReceive(1) {
+		t.Error("Expected receive on an exhausted window to be a violation")
+	}
+	if inc := f.onRelease(10); inc != 10 {
+		t.Errorf("Expected immediate update while the peer is blocked, got %d", inc)
+	}
+}
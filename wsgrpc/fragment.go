@@ -0,0 +1,79 @@
+package wsgrpc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// defaultMaxMessageSize bounds reassembled messages when ServerOption / ClientOption
+// leave MaxMessageSize unset and MaxPayloadSize is smaller.
+const defaultMaxMessageSize = 4 * 1024 * 1024
+
+// errMessageTooLarge is returned by reassembler.add for messages above the maximum size.
+var errMessageTooLarge = errors.New("message too large")
+
+// splitMessage cuts a message into fragments of at most maxFragment bytes. A
+// maxFragment of 0 (fragmentation not negotiated) or a message that fits returns the
+// message as its only fragment.
+func splitMessage(data []byte, maxFragment int) [][]byte {
+	if maxFragment <= 0 || len(data) <= maxFragment {
+		return [][]byte{data}
+	}
+	fragments := make([][]byte, 0, (len(data)+maxFragment-1)/maxFragment)
+	for len(data) > maxFragment {
+		fragments = append(fragments, data[:maxFragment])
+		data = data[maxFragment:]
+	}
+	return append(fragments, data)
+}
+
+// maxMessageSizeFor returns the configured maximum message size, defaulting to the
+// larger of 4MB and the frame payload limit so that every unfragmented message fits.
+func maxMessageSizeFor(configured, maxPayloadSize uint32) uint32 {
+	if configured != 0 {
+		return configured
+	}
+	if maxPayloadSize > defaultMaxMessageSize {
+		return maxPayloadSize
+	}
+	return defaultMaxMessageSize
+}
+
+// reassembler collects the DATA fragments of one message on a stream (PROTOCOL.md
+// Section 6.5). Frames of other streams may arrive between fragments; each stream has
+// its own reassembler, used only by the goroutine that reads the connection.
+type reassembler struct {
+	buf        []byte
+	compressed bool // From the first fragment
+	pending    bool // A fragment with CONTINUED has been received
+}
+
+// add processes a DATA frame. It reports the message once its last fragment (the first
+// frame without CONTINUED) has arrived; complete is false while fragments are missing.
+func (r *reassembler) add(frame *Frame, maxSize uint32) (msg recvMessage, complete bool, err error) {
+	more := frame.Flags&FlagCONTINUED != 0
+	if !r.pending && !more {
+		if uint64(len(frame.Payload)) > uint64(maxSize) {
+			return recvMessage{}, false, fmt.Errorf("%w: %d bytes exceeds maximum of %d bytes", errMessageTooLarge, len(frame.Payload), maxSize)
+		}
+		return recvMessage{data: frame.Payload, compressed: frame.Flags&FlagCOMPRESSED != 0}, true, nil
+	}
+
+	if !r.pending {
+		r.pending = true
+		r.compressed = frame.Flags&FlagCOMPRESSED != 0
+	}
+	if uint64(len(r.buf))+uint64(len(frame.Payload)) > uint64(maxSize) {
+		size := len(r.buf) + len(frame.Payload)
+		*r = reassembler{}
+		return recvMessage{}, false, fmt.Errorf("%w: at least %d bytes exceeds maximum of %d bytes", errMessageTooLarge, size, maxSize)
+	}
+	r.buf = append(r.buf, frame.Payload...)
+	if more {
+		return recvMessage{}, false, nil
+	}
+
+	msg = recvMessage{data: r.buf, compressed: r.compressed}
+	*r = reassembler{}
+	return msg, true, nil
+}
@@ -0,0 +1,312 @@
+package wsgrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// TestSplitMessage verifies fragment boundaries
+func TestSplitMessage(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 10)
+	for _, tc := range []struct {
+		maxFragment int
+		want        []int
+	}{
+		{maxFragment: 0, want: []int{10}},
+		{maxFragment: 10, want: []int{10}},
+		{maxFragment: 4, want: []int{4, 4, 2}},
+		{maxFragment: 5, want: []int{5, 5}},
+	} {
+		fragments := splitMessage(data, tc.maxFragment)
+		var got []int
+		for _, f := range fragments {
+			got = append(got, len(f))
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("splitMessage(10 bytes, %d) = %v, want %v", tc.maxFragment, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("splitMessage(10 bytes, %d) = %v, want %v", tc.maxFragment, got, tc.want)
+				break
+			}
+		}
+	}
+	if fragments := splitMessage(nil, 4); len(fragments) != 1 || len(fragments[0]) != 0 {
+		t.Errorf("Expected an empty message to be a single empty fragment, got %v", fragments)
+	}
+}
+
+// TestReassembler verifies reassembly, the size bound and the credit bookkeeping
+func TestReassembler(t *testing.T) {
+	var r reassembler
+
+	if _, complete, err := r.add(&Frame{Flags: FlagDATA | FlagCOMPRESSED | FlagCONTINUED, Payload: []byte("abc")}, 8); complete || err != nil {
+		t.Fatalf("Expected an incomplete message, got complete=%v err=%v", complete, err)
+	}
+	msg, complete, err := r.add(&Frame{Flags: FlagDATA | FlagCOMPRESSED, Payload: []byte("de")}, 8)
+	if !complete || err != nil {
+		t.Fatalf("Expected a complete message, got complete=%v err=%v", complete, err)
+	}
+	if string(msg.data) != "abcde" || !msg.compressed {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+
+	// Unfragmented messages pass through, still bounded by the maximum
+	if msg, complete, _ := r.add(&Frame{Flags: FlagDATA, Payload: []byte("xy")}, 8); !complete || string(msg.data) != "xy" {
+		t.Errorf("Unexpected unfragmented message %+v", msg)
+	}
+	if _, _, err := r.add(&Frame{Flags: FlagDATA, Payload: make([]byte, 9)}, 8); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("Expected errMessageTooLarge for a single frame, got %v", err)
+	}
+
+	_, _, _ = r.add(&Frame{Flags: FlagDATA | FlagCONTINUED, Payload: make([]byte, 5)}, 8)
+	if _, _, err := r.add(&Frame{Flags: FlagDATA | FlagCONTINUED, Payload: make([]byte, 5)}, 8); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("Expected errMessageTooLarge, got %v", err)
+	}
+	if r.pending || len(r.buf) != 0 {
+		t.Error("Expected the reassembler to be reset after an error")
+	}
+}
+
+// TestMaxFragmentSize verifies that only v3 connections fragment, using the client's
+// announced payload limit when there is one
+func TestMaxFragmentSize(t *testing.T) {
+	server := NewServer(ServerOption{MaxPayloadSize: 1024})
+	for _, version := range []ProtocolVersion{ProtocolV1, ProtocolV2} {
+		c := &wsConnection{version: version, server: server}
+		if got := c.maxFragmentSize(); got != 0 {
+			t.Errorf("Expected no fragmentation on %v, got %d", version, got)
+		}
+	}
+	v3 := &wsConnection{version: ProtocolV3, server: server}
+	if got := v3.maxFragmentSize(); got != 1024 {
+		t.Errorf("Expected the server's own limit without client SETTINGS, got %d", got)
+	}
+	v3.peerSettings.MaxPayloadSize = 512
+	if got := v3.maxFragmentSize(); got != 512 {
+		t.Errorf("Expected the client's announced limit, got %d", got)
+	}
+	if server.options.MaxMessageSize != defaultMaxMessageSize {
+		t.Errorf("Expected default MaxMessageSize %d, got %d", defaultMaxMessageSize, server.options.MaxMessageSize)
+	}
+}
+
+// TestFragmentedMessagesEndToEnd verifies that requests and responses larger than the
+// frame limit are fragmented and reassembled in both directions, under flow control
+func TestFragmentedMessagesEndToEnd(t *testing.T) {
+	const payloadLimit = 16 * 1024
+	_, client, _ := newTestClientWith(t, &testGreeter{},
+		[]ServerOption{{MaxPayloadSize: payloadLimit, InitialWindowSize: payloadLimit}},
+		ClientOption{MaxPayloadSize: payloadLimit, InitialWindowSize: payloadLimit})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := strings.Repeat("x", 20*payloadLimit+123)
+	resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: name})
+	if err != nil {
+		t.Fatalf("SayHello with a fragmented request failed: %v", err)
+	}
+	if resp.GetMessage() != "Hello "+name {
+		t.Errorf("Response of %d bytes does not match the request", len(resp.GetMessage()))
+	}
+
+	// Client-streaming: several fragmented messages on one stream, then EOS
+	stream, err := client.SayHelloClientStream(ctx)
+	if err != nil {
+		t.Fatalf("SayHelloClientStream failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	streamResp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv failed: %v", err)
+	}
+	if len(streamResp.GetMessage()) != len("Hello ")+3*len(name)+2*len(", ") {
+		t.Errorf("Unexpected response length %d", len(streamResp.GetMessage()))
+	}
+}
+
+// TestMessageSizeLimits verifies that MaxMessageSize is announced and enforced on both
+// sides
+func TestMessageSizeLimits(t *testing.T) {
+	const payloadLimit = 16 * 1024
+	_, client, conn := newTestClientWith(t, &testGreeter{},
+		[]ServerOption{{MaxPayloadSize: payloadLimit, MaxMessageSize: 64 * 1024}},
+		ClientOption{MaxPayloadSize: payloadLimit, MaxMessageSize: 128 * 1024})
+
+	if settings, _ := conn.ServerSettings(); settings.MaxMessageSize != 64*1024 {
+		t.Fatalf("Expected max-message-size in SETTINGS, got %+v", settings)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Too large for the server: rejected before anything is sent
+	_, err := client.SayHello(ctx, &pb.HelloRequest{Name: strings.Repeat("x", 100*1024)})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted for an oversized request, got %v", err)
+	}
+
+	// Too large for the client: the server's response is refused during reassembly
+	stream, err := client.SayHelloClientStream(ctx)
+	if err != nil {
+		t.Fatalf("SayHelloClientStream failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.Send(&pb.HelloRequest{Name: strings.Repeat("y", 60*1024)}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted for an oversized response, got %v", err)
+	}
+}
+
+// TestFragmentsInterleaveAcrossStreams verifies on the wire that other streams may use
+// the connection between the fragments of a message, and that fragment violations only
+// reset their own stream
+func TestFragmentsInterleaveAcrossStreams(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true, MaxMessageSize: 1024})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], &websocket.DialOptions{Subprotocols: []string{SubprotocolV3}})
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+	readSettings(t, ctx, conn)
+
+	headers := mustEncodeMetadataBlock(t, metadata.Pairs("path", "/greeter.Greeter/SayHello"), true)
+	request, _ := proto.Marshal(&pb.HelloRequest{Name: "fragmented"})
+	other, _ := proto.Marshal(&pb.HelloRequest{Name: "other"})
+
+	// Stream 1 sends half of its message, stream 3 a complete one, then stream 1 the rest
+	writeFrame(t, ctx, conn, encodeFrame(1, FlagHEADERS, headers))
+	writeFrame(t, ctx, conn, encodeFrame(1, FlagDATA|FlagCONTINUED, request[:5]))
+	writeFrame(t, ctx, conn, encodeFrame(3, FlagHEADERS, headers))
+	writeFrame(t, ctx, conn, encodeFrame(3, FlagDATA|FlagEOS, other))
+	writeFrame(t, ctx, conn, encodeFrame(1, FlagDATA|FlagEOS, request[5:]))
+
+	// Both streams complete, in whichever order their handlers finish
+	responses := map[uint32]string{}
+	for len(responses) < 2 {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		frame, err := decodeFrame(data, 4*1024*1024)
+		if err != nil || frame.Flags&FlagDATA == 0 {
+			continue
+		}
+		resp := &pb.HelloResponse{}
+		if err := proto.Unmarshal(frame.Payload, resp); err != nil {
+			t.Fatalf("Failed to unmarshal response on stream %d: %v", frame.StreamID, err)
+		}
+		responses[frame.StreamID] = resp.GetMessage()
+	}
+	if responses[1] != "Hello fragmented" || responses[3] != "Hello other" {
+		t.Errorf("Unexpected responses %v", responses)
+	}
+
+	// The stream cannot end in the middle of a message
+	writeFrame(t, ctx, conn, encodeFrame(5, FlagHEADERS, headers))
+	writeFrame(t, ctx, conn, encodeFrame(5, FlagDATA|FlagCONTINUED|FlagEOS, request))
+	expectRST(t, ctx, conn, 5, ErrCodeProtocolError)
+
+	// Fragments beyond MaxMessageSize reset the stream
+	writeFrame(t, ctx, conn, encodeFrame(7, FlagHEADERS, headers))
+	writeFrame(t, ctx, conn, encodeFrame(7, FlagDATA|FlagCONTINUED, make([]byte, 600)))
+	writeFrame(t, ctx, conn, encodeFrame(7, FlagDATA|FlagCONTINUED, make([]byte, 600)))
+	expectRST(t, ctx, conn, 7, ErrCodeResourceExhausted)
+	expectAlive(t, ctx, conn)
+
+	// v2 as first defined has no fragments
+	v2, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], &websocket.DialOptions{Subprotocols: []string{SubprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = v2.Close(websocket.StatusNormalClosure, "test complete") }()
+	readSettings(t, ctx, v2)
+	writeFrame(t, ctx, v2, encodeFrame(1, FlagHEADERS, headers))
+	writeFrame(t, ctx, v2, encodeFrame(1, FlagDATA|FlagCONTINUED, request[:5]))
+	expectRST(t, ctx, v2, 1, ErrCodeProtocolError)
+}
+
+// TestFragmentCreditHeldUntilConsumed verifies that the stream window covers whole
+// messages: a client that ends every message with a tiny fragment while the handler
+// is not reading gets no credit back for the rest and is reset once the window is used
+// up, instead of growing the server's receive queue without bound
+func TestFragmentCreditHeldUntilConsumed(t *testing.T) {
+	impl := &stalledGreeter{release: make(chan struct{})}
+	defer close(impl.release)
+
+	server := NewServer(ServerOption{InsecureSkipVerify: true, InitialWindowSize: 1024})
+	pb.RegisterGreeterServer(server, impl)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], &websocket.DialOptions{Subprotocols: []string{SubprotocolV3}})
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+	readSettings(t, ctx, conn)
+	writeFrame(t, ctx, conn, encodeWindowAdvertisement(65536, 1<<20))
+
+	writeFrame(t, ctx, conn, encodeFrame(1, FlagHEADERS, mustEncodeMetadataBlock(t, metadata.Pairs("path", "/greeter.Greeter/SayHelloClientStream"), true)))
+	for i := 0; i < 20; i++ {
+		writeFrame(t, ctx, conn, encodeFrame(1, FlagDATA|FlagCONTINUED, make([]byte, 600)))
+		writeFrame(t, ctx, conn, encodeFrame(1, FlagDATA, []byte{0}))
+	}
+
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Expected RST_STREAM: %v", err)
+		}
+		frame, err := decodeFrame(data, 4*1024*1024)
+		if err != nil || frame.StreamID != 1 {
+			continue
+		}
+		if frame.Flags&FlagWINDOW_UPDATE != 0 {
+			t.Fatalf("Unexpected WINDOW_UPDATE of %d bytes before the handler read anything", binary.BigEndian.Uint32(frame.Payload))
+		}
+		if frame.Flags&FlagRST_STREAM != 0 {
+			if code := decodeErrorCode(frame.Payload); code != ErrCodeFlowControlError {
+				t.Errorf("Expected FLOW_CONTROL_ERROR, got code %d", code)
+			}
+			return
+		}
+	}
+}
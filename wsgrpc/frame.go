@@ -2,6 +2,7 @@ package wsgrpc
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
@@ -14,8 +15,40 @@ const (
 	FlagEOS        = 0x10 // End of Stream - no further frames on this stream
 	FlagPING       = 0x20 // Keep-alive ping frame
 	FlagPONG       = 0x40 // Keep-alive pong response frame
+
+	FlagWINDOW_UPDATE = 0x80 // Grants flow control credit (stream 0 = connection window)
+
+	// FlagCOMPRESSED marks a DATA payload compressed with the stream's grpc-encoding.
+	// It shares its bit with PING, which is only valid on frames without DATA.
+	FlagCOMPRESSED = 0x20
+
+	// FlagCONTINUED marks a DATA frame whose message continues in the next DATA frame of
+	// the stream. It shares its bit with PONG, which is only valid on frames without DATA.
+	FlagCONTINUED = 0x40
+
+	// FlagACK marks the acknowledgement of a SETTINGS frame (HEADERS on stream 0). It
+	// shares its bit with EOS, which has no meaning on stream 0.
+	FlagACK = 0x10
 )
 
+// RST_STREAM error codes (PROTOCOL.md Section 5.1)
+const (
+	ErrCodeNoError           uint32 = 0 // Graceful shutdown (not an error)
+	ErrCodeProtocolError     uint32 = 1 // Malformed frame or invalid protocol usage
+	ErrCodeInternalError     uint32 = 2 // Internal server error
+	ErrCodeFlowControlError  uint32 = 3 // Flow control protocol violated
+	ErrCodeStreamClosed      uint32 = 4 // Frame received for a closed stream
+	ErrCodeFrameSizeError    uint32 = 5 // Frame size exceeds allowed maximum
+	ErrCodeRefusedStream     uint32 = 6 // Stream rejected before processing
+	ErrCodeCancel            uint32 = 7 // Stream cancelled by client
+	ErrCodeResourceExhausted uint32 = 8 // Maximum concurrent streams exceeded
+	ErrCodeUnavailable       uint32 = 9 // Service temporarily unavailable
+)
+
+// errFrameTooLarge is wrapped by decodeFrame errors for payloads above the maximum size,
+// which are answered with FRAME_SIZE_ERROR rather than PROTOCOL_ERROR.
+var errFrameTooLarge = errors.New("payload too large")
+
 // Frame represents a decoded NgGoRPC protocol frame
 type Frame struct {
 	Flags    uint8
@@ -23,6 +56,13 @@ type Frame struct {
 	Payload  []byte
 }
 
+// recvMessage is a DATA payload queued for RecvMsg. Compressed payloads are only
+// decompressed by the consumer, so flow control credit is returned for the wire size.
+type recvMessage struct {
+	data       []byte
+	compressed bool
+}
+
 // encodeFrame encodes a frame into binary format according to NgGoRPC protocol.
 //
 // Frame Layout (9-byte header + payload):
@@ -50,6 +90,32 @@ func encodeFrame(streamID uint32, flags uint8, payload []byte) []byte {
 	return frame
 }
 
+// encodeRSTStream encodes a RST_STREAM frame carrying the given error code.
+func encodeRSTStream(streamID uint32, errCode uint32) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, errCode)
+	return encodeFrame(streamID, FlagRST_STREAM, payload)
+}
+
+// encodeGoAway encodes a GOAWAY frame: RST_STREAM on stream 0 whose 8-byte payload
+// carries the highest stream ID the sender accepted and an error code. Streams above
+// that ID were not processed and may be retried on a new connection.
+func encodeGoAway(lastStreamID uint32, errCode uint32) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload[0:4], lastStreamID)
+	binary.BigEndian.PutUint32(payload[4:8], errCode)
+	return encodeFrame(0, FlagRST_STREAM, payload)
+}
+
+// decodeErrorCode extracts the uint32 error code from a RST_STREAM payload.
+// A missing or short payload is treated as PROTOCOL_ERROR.
+func decodeErrorCode(payload []byte) uint32 {
+	if len(payload) < 4 {
+		return ErrCodeProtocolError
+	}
+	return binary.BigEndian.Uint32(payload[:4])
+}
+
 // decodeFrame decodes a binary frame into its components.
 //
 // Returns a Frame struct with parsed Flags, StreamID, and Payload.
@@ -73,7 +139,8 @@ func decodeFrame(data []byte, maxPayloadSize uint32) (*Frame, error) {
 	// Enforce maximum payload size per server configuration
 	if length > maxPayloadSize {
 		return nil, fmt.Errorf(
-			"payload too large: %d bytes exceeds maximum of %d bytes",
+			"%w: %d bytes exceeds maximum of %d bytes",
+			errFrameTooLarge,
 			length,
 			maxPayloadSize,
 		)
@@ -0,0 +1,116 @@
+package wsgrpc
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// frameHeaderSize is the length of the header preceding every frame payload
+// (PROTOCOL.md Section 2.1).
+const frameHeaderSize = 9
+
+// Frame buffers are recycled once the writer loop has written them, so that streams
+// sending many small messages do not allocate per message. Buffers that grew beyond
+// maxPooledFrameSize (large messages) are left to the garbage collector.
+const (
+	initialFrameBufferSize = 1024
+	maxPooledFrameSize     = 64 * 1024
+)
+
+// maxPackedMessageSize bounds a WebSocket message packing several frames (PROTOCOL.md
+// Section 2.3); the peer's max-payload-size bounds it further.
+const maxPackedMessageSize = maxPooledFrameSize
+
+// packLimitFor bounds packed messages by the receiver's announced max-payload-size,
+// which also sizes its WebSocket read limit.
+func packLimitFor(peerMaxPayloadSize uint32) int {
+	if peerMaxPayloadSize != 0 && peerMaxPayloadSize < maxPackedMessageSize {
+		return int(peerMaxPayloadSize)
+	}
+	return maxPackedMessageSize
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, initialFrameBufferSize)
+		return &b
+	},
+}
+
+// getFrameBuffer returns an empty pooled buffer with room for at least size bytes.
+func getFrameBuffer(size int) *[]byte {
+	buf := framePool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, 0, size)
+	}
+	return buf
+}
+
+// putFrameBuffer recycles a buffer. The caller must not use it afterwards.
+func putFrameBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledFrameSize {
+		return
+	}
+	*buf = (*buf)[:0]
+	framePool.Put(buf)
+}
+
+// putFrameHeader fills in the reserved header of a frame whose payload starts at
+// frame[frameHeaderSize:].
+func putFrameHeader(frame []byte, streamID uint32, flags uint8) {
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:5], streamID)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(frame)-frameHeaderSize))
+}
+
+// encodeFrameBuffer is encodeFrame into a pooled buffer.
+func encodeFrameBuffer(streamID uint32, flags uint8, payload []byte) *[]byte {
+	buf := getFrameBuffer(frameHeaderSize + len(payload))
+	frame := append((*buf)[:frameHeaderSize], payload...)
+	putFrameHeader(frame, streamID, flags)
+	*buf = frame
+	return buf
+}
+
+// marshalFrameBuffer marshals v with codec into a pooled buffer, after room reserved
+// for the frame header. The message is (*buf)[frameHeaderSize:].
+func marshalFrameBuffer(codec encoding.Codec, v interface{}) (*[]byte, error) {
+	buf := getFrameBuffer(0)
+	frame, err := marshalAppend(codec, (*buf)[:frameHeaderSize], v)
+	if err != nil {
+		putFrameBuffer(buf)
+		return nil, err
+	}
+	*buf = frame
+	return buf, nil
+}
+
+// compressFrameBuffer compresses the message in a buffer from marshalFrameBuffer in
+// place, with the rules of compressMessage.
+func compressFrameBuffer(c encoding.Compressor, buf *[]byte, threshold int) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	data, compressed, err := compressMessage(c, (*buf)[frameHeaderSize:], threshold)
+	if err != nil || !compressed {
+		return false, err
+	}
+	*buf = append((*buf)[:frameHeaderSize], data...)
+	return true, nil
+}
+
+// nextPackedFrame splits the first frame off a WebSocket message that may pack several
+// frames back to back. A frame whose length runs past the end of the message is
+// returned whole, for decodeFrame to reject.
+func nextPackedFrame(data []byte) (frame, rest []byte) {
+	if len(data) < frameHeaderSize {
+		return data, nil
+	}
+	size := uint64(frameHeaderSize) + uint64(binary.BigEndian.Uint32(data[5:9]))
+	if size >= uint64(len(data)) {
+		return data, nil
+	}
+	return data[:size], data[size:]
+}
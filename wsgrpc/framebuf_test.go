@@ -0,0 +1,309 @@
+package wsgrpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// TestMarshalFrameBuffer verifies that marshalling into a frame buffer produces the
+// same frame as marshalling and encoding separately, for every built-in codec
+func TestMarshalFrameBuffer(t *testing.T) {
+	msg := &pb.HelloRequest{Name: "pooled"}
+	for _, name := range []string{"proto", "json"} {
+		codec := lookupCodec(name)
+		data, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Marshal (%s) failed: %v", name, err)
+		}
+
+		buf, err := marshalFrameBuffer(codec, msg)
+		if err != nil {
+			t.Fatalf("marshalFrameBuffer (%s) failed: %v", name, err)
+		}
+		putFrameHeader(*buf, 7, FlagDATA)
+		if want := encodeFrame(7, FlagDATA, data); !bytes.Equal(*buf, want) {
+			t.Errorf("Frame (%s) = %x, want %x", name, *buf, want)
+		}
+		putFrameBuffer(buf)
+	}
+
+	if _, err := marshalFrameBuffer(protoCodec{}, "not a message"); err != errNotProtoMessage {
+		t.Errorf("Expected errNotProtoMessage, got %v", err)
+	}
+
+	// Compression replaces the message in place
+	large := &pb.HelloRequest{Name: strings.Repeat("z", 4096)}
+	buf, _ := marshalFrameBuffer(protoCodec{}, large)
+	compressed, err := compressFrameBuffer(encoding.GetCompressor("gzip"), buf, 1024)
+	if err != nil || !compressed {
+		t.Fatalf("Expected the message to be compressed, got %v (err=%v)", compressed, err)
+	}
+	if len(*buf)-frameHeaderSize >= 4096 {
+		t.Errorf("Compressed message of %d bytes did not shrink", len(*buf)-frameHeaderSize)
+	}
+}
+
+// TestNextPackedFrame verifies splitting a WebSocket message into its frames
+func TestNextPackedFrame(t *testing.T) {
+	first := encodeFrame(1, FlagHEADERS, []byte("abc"))
+	second := encodeFrame(1, FlagDATA|FlagEOS, []byte("defg"))
+
+	frame, rest := nextPackedFrame(append(append([]byte{}, first...), second...))
+	if !bytes.Equal(frame, first) || !bytes.Equal(rest, second) {
+		t.Errorf("Unexpected split: %x | %x", frame, rest)
+	}
+	frame, rest = nextPackedFrame(rest)
+	if !bytes.Equal(frame, second) || len(rest) != 0 {
+		t.Errorf("Unexpected split of the last frame: %x | %x", frame, rest)
+	}
+
+	// A truncated frame is returned whole for decodeFrame to reject
+	frame, rest = nextPackedFrame(second[:10])
+	if len(frame) != 10 || rest != nil {
+		t.Errorf("Expected a truncated frame to be returned whole, got %x | %x", frame, rest)
+	}
+}
+
+// TestSendQueuePacking verifies that frames queued together are packed in scheduling
+// order up to the limit
+func TestSendQueuePacking(t *testing.T) {
+	ctx := context.Background()
+	q := newSendQueue()
+	frames := [][]byte{
+		encodeFrame(1, FlagDATA, []byte("one")),
+		encodeFrame(3, FlagDATA, []byte("two")),
+		encodeFrame(0, FlagPONG, nil),
+		encodeFrame(1, FlagDATA, bytes.Repeat([]byte{1}, 100)),
+	}
+	for _, f := range frames {
+		_ = q.push(ctx, append([]byte{}, f...))
+	}
+
+	// PONG first, then the streams in turn; the large frame does not fit
+	msg, err := q.nextMessage(ctx, 50)
+	if err != nil {
+		t.Fatalf("nextMessage failed: %v", err)
+	}
+	want := append(append(append([]byte{}, frames[2]...), frames[0]...), frames[1]...)
+	if !bytes.Equal(*msg, want) {
+		t.Errorf("Packed message = %x, want %x", *msg, want)
+	}
+	msg, _ = q.nextMessage(ctx, 50)
+	if !bytes.Equal(*msg, frames[3]) {
+		t.Errorf("Expected the frame above the limit on its own, got %d bytes", len(*msg))
+	}
+
+	// Without a limit every frame is its own message
+	_ = q.push(ctx, append([]byte{}, frames[0]...))
+	_ = q.push(ctx, append([]byte{}, frames[1]...))
+	if msg, _ := q.nextMessage(ctx, 0); !bytes.Equal(*msg, frames[0]) {
+		t.Errorf("Expected a single frame without packing, got %x", *msg)
+	}
+}
+
+// TestFramePackingIsNegotiated verifies that packing is announced on v3 connections
+// only, and that packed messages from a v3 client are processed frame by frame
+func TestFramePackingIsNegotiated(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true, FramePacking: true})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	v1, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = v1.Close(websocket.StatusNormalClosure, "test complete") }()
+	if settings := readSettings(t, ctx, v1); settings.FramePacking {
+		t.Error("Expected no frame-packing on a v1 connection")
+	}
+
+	v2, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], &websocket.DialOptions{Subprotocols: []string{SubprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = v2.Close(websocket.StatusNormalClosure, "test complete") }()
+	if settings := readSettings(t, ctx, v2); settings.FramePacking {
+		t.Error("Expected no frame-packing on a v2 connection")
+	}
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], &websocket.DialOptions{Subprotocols: []string{SubprotocolV3}})
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+	if settings := readSettings(t, ctx, conn); !settings.FramePacking {
+		t.Fatal("Expected frame-packing on a v3 connection")
+	}
+	writeFrame(t, ctx, conn, encodeSettings(Settings{FramePacking: true}, true))
+
+	// HEADERS and DATA|EOS of a call in a single WebSocket message
+	request, _ := proto.Marshal(&pb.HelloRequest{Name: "packed"})
+	packed := append(
+		encodeFrame(1, FlagHEADERS, mustEncodeMetadataBlock(t, metadata.Pairs("path", "/greeter.Greeter/SayHelloStream"), true)),
+		encodeFrame(1, FlagDATA|FlagEOS, request)...)
+	writeFrame(t, ctx, conn, packed)
+
+	var responses []string
+	for done := false; !done; {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		for len(data) > 0 {
+			var raw []byte
+			raw, data = nextPackedFrame(data)
+			frame, err := decodeFrame(raw, 4*1024*1024)
+			if err != nil {
+				t.Fatalf("Malformed frame in a packed message: %v", err)
+			}
+			if frame.StreamID != 1 {
+				continue
+			}
+			switch {
+			case frame.Flags&FlagDATA != 0:
+				resp := &pb.HelloResponse{}
+				if err := proto.Unmarshal(frame.Payload, resp); err != nil {
+					t.Fatalf("Failed to unmarshal response: %v", err)
+				}
+				responses = append(responses, resp.GetMessage())
+			case frame.Flags&FlagTRAILERS != 0:
+				done = true
+			}
+		}
+	}
+	t.Logf("Responses: %v", responses)
+	if len(responses) != 3 || responses[0] != "Hello packed #0" {
+		t.Errorf("Unexpected responses %v", responses)
+	}
+}
+
+// TestFramePackingEndToEnd verifies a bidirectional stream of many small messages with
+// packing enabled on both sides
+func TestFramePackingEndToEnd(t *testing.T) {
+	_, client, conn := newTestClientWith(t, &testGreeter{},
+		[]ServerOption{{FramePacking: true}}, ClientOption{FramePacking: true})
+	if settings, _ := conn.ServerSettings(); !settings.FramePacking {
+		t.Fatal("Expected the server to announce frame-packing")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.SayHelloBidirectional(ctx)
+	if err != nil {
+		t.Fatalf("SayHelloBidirectional failed: %v", err)
+	}
+	const count = 500
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := stream.Send(&pb.HelloRequest{Name: fmt.Sprint(i)}); err != nil {
+				return
+			}
+		}
+		_ = stream.CloseSend()
+	}()
+	for i := 0; ; i++ {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			if i != count {
+				t.Errorf("Received %d responses, want %d", i, count)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv failed after %d responses: %v", i, err)
+		}
+		if want := fmt.Sprintf("Echo %d", i); resp.GetMessage() != want {
+			t.Fatalf("Response %d = %q, want %q", i, resp.GetMessage(), want)
+		}
+	}
+}
+
+// TestPooledDataFrameAllocations verifies that building a DATA frame in a pooled buffer
+// allocates less than marshalling and encoding separately
+func TestPooledDataFrameAllocations(t *testing.T) {
+	codec := lookupCodec("proto")
+	msg := &pb.HelloResponse{Message: "tick 1234.5678"}
+
+	legacy := testing.AllocsPerRun(100, func() {
+		data, _ := codec.Marshal(msg)
+		_ = encodeFrame(1, FlagDATA, data)
+	})
+	pooled := testing.AllocsPerRun(100, func() {
+		buf, _ := marshalFrameBuffer(codec, msg)
+		putFrameHeader(*buf, 1, FlagDATA)
+		putFrameBuffer(buf)
+	})
+	t.Logf("Allocations per DATA frame: %.2f separately, %.2f pooled", legacy, pooled)
+	if pooled >= legacy {
+		t.Errorf("Expected fewer allocations in pooled buffers, got %.2f vs. %.2f", pooled, legacy)
+	}
+}
+
+// BenchmarkDataFrame compares building a small DATA frame the original way (marshal,
+// then copy into a new frame) with marshalling into a pooled buffer
+func BenchmarkDataFrame(b *testing.B) {
+	codec := lookupCodec("proto")
+	msg := &pb.HelloResponse{Message: "tick 1234.5678"}
+
+	b.Run("encodeFrame", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, _ := codec.Marshal(msg)
+			_ = encodeFrame(1, FlagDATA, data)
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, _ := marshalFrameBuffer(codec, msg)
+			putFrameHeader(*buf, 1, FlagDATA)
+			putFrameBuffer(buf)
+		}
+	})
+}
+
+// BenchmarkSendQueue measures queueing and writing many small frames of a few streams,
+// one frame per WebSocket message versus packed messages
+func BenchmarkSendQueue(b *testing.B) {
+	frame := encodeFrame(1, FlagDATA, make([]byte, 32))
+	for _, packLimit := range []int{0, maxPackedMessageSize} {
+		b.Run(fmt.Sprintf("packLimit=%d", packLimit), func(b *testing.B) {
+			ctx := context.Background()
+			q := newSendQueue()
+			b.ReportAllocs()
+			messages := 0
+			for i := 0; i < b.N; i++ {
+				buf := encodeFrameBuffer(uint32(1+2*(i%4)), FlagDATA, frame[frameHeaderSize:])
+				_ = q.pushBuffer(ctx, buf)
+				if i%16 == 15 {
+					for taken := 0; taken < 16; messages++ {
+						msg, _ := q.nextMessage(ctx, packLimit)
+						taken += len(*msg) / len(frame)
+						putFrameBuffer(msg)
+					}
+				}
+			}
+			b.ReportMetric(float64(messages)/float64(b.N), "msgs/frame")
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package wsgrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
+)
+
+// errGRPCNotEnabled is returned by ServeGRPC when the Server has no grpc.Server.
+var errGRPCNotEnabled = errors.New("wsgrpc: native gRPC is not enabled (ServerOption.EnableGRPC)")
+
+// GRPCServer returns the grpc.Server that registered services are mirrored to, the one
+// of ServerOption.GRPCServer or the internal one of EnableGRPC, or nil.
+func (s *Server) GRPCServer() *grpc.Server {
+	return s.grpcServer
+}
+
+// ServeGRPC serves native gRPC (HTTP/2) clients on l with the services registered on
+// the Server, for backends on a port of their own. Serve and ListenAndServeTLS also
+// accept them next to WebSocket clients on a single port.
+func (s *Server) ServeGRPC(l net.Listener) error {
+	if s.grpcServer == nil {
+		_ = l.Close()
+		return errGRPCNotEnabled
+	}
+	return s.grpcServer.Serve(l)
+}
+
+// registerGRPCService mirrors a RegisterService call onto the grpc.Server. The
+// handlers are wrapped in the Server's interceptors, so that both transports share
+// them; interceptors of a user-supplied grpc.Server run first.
+func (s *Server) registerGRPCService(sd *grpc.ServiceDesc, ss interface{}) {
+	bridged := *sd
+	bridged.Methods = make([]grpc.MethodDesc, len(sd.Methods))
+	for i, method := range sd.Methods {
+		method.Handler = s.bridgeUnaryHandler(method.Handler)
+		bridged.Methods[i] = method
+	}
+	bridged.Streams = make([]grpc.StreamDesc, len(sd.Streams))
+	for i, stream := range sd.Streams {
+		stream.Handler = s.bridgeStreamHandler(stream)
+		bridged.Streams[i] = stream
+	}
+	s.grpcServer.RegisterService(&bridged, ss)
+}
+
+// bridgeUnaryHandler runs the unary interceptors inside the grpc.Server's own.
+func (s *Server) bridgeUnaryHandler(handler grpc.MethodHandler) grpc.MethodHandler {
+	if len(s.options.UnaryInterceptors) == 0 {
+		return handler
+	}
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		interceptors := s.options.UnaryInterceptors
+		if interceptor != nil {
+			interceptors = append([]grpc.UnaryServerInterceptor{interceptor}, interceptors...)
+		}
+		return handler(srv, ctx, dec, chainUnaryInterceptors(interceptors))
+	}
+}
+
+// bridgeStreamHandler runs the stream interceptors around a streaming handler. The
+// grpc.Server applies its own interceptors outside of it.
+func (s *Server) bridgeStreamHandler(desc grpc.StreamDesc) grpc.StreamHandler {
+	if len(s.options.StreamInterceptors) == 0 {
+		return desc.Handler
+	}
+	return func(srv interface{}, ss grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(ss)
+		info := &grpc.StreamServerInfo{
+			FullMethod:     method,
+			IsClientStream: desc.ClientStreams,
+			IsServerStream: desc.ServerStreams,
+		}
+		return chainStreamInterceptors(s.options.StreamInterceptors, info, desc.Handler)(srv, ss)
+	}
+}
+
+// isGRPCRequest reports whether r is a native gRPC call, which arrives over HTTP/2
+// with an application/grpc content-type (not application/grpc-web).
+func isGRPCRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost || contentType == "" {
+		return false
+	}
+	_, err := contentSubtype(contentType)
+	return err == nil
+}
@@ -0,0 +1,233 @@
+package wsgrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// callLog records the calls interceptors saw, in order
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(call string) {
+	l.mu.Lock()
+	l.calls = append(l.calls, call)
+	l.mu.Unlock()
+}
+
+func (l *callLog) take() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	calls := l.calls
+	l.calls = nil
+	return calls
+}
+
+// loggingInterceptors returns interceptors that log "name method" for every call, and
+// "name stream/kind" with the kind of streaming calls
+func loggingInterceptors(log *callLog, name string) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		log.add(name + " " + info.FullMethod)
+		return handler(ctx, req)
+	}
+	stream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		kind := "bidi"
+		if !info.IsClientStream {
+			kind = "server"
+		} else if !info.IsServerStream {
+			kind = "client"
+		}
+		log.add(name + " " + info.FullMethod + "/" + kind)
+		return handler(srv, ss)
+	}
+	return unary, stream
+}
+
+// dialGRPC returns a native gRPC client of addr
+func dialGRPC(t *testing.T, addr string) pb.GreeterClient {
+	t.Helper()
+	cc, err := grpc.NewClient("passthrough:///"+addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create the gRPC client: %v", err)
+	}
+	t.Cleanup(func() { _ = cc.Close() })
+	return pb.NewGreeterClient(cc)
+}
+
+// TestNativeGRPC verifies that registered services are served over native gRPC as
+// well, through the same interceptors
+func TestNativeGRPC(t *testing.T) {
+	calls := &callLog{}
+	unary, stream := loggingInterceptors(calls, "wsgrpc")
+	server := NewServer(ServerOption{
+		InsecureSkipVerify: true,
+		EnableGRPC:         true,
+		UnaryInterceptors:  []grpc.UnaryServerInterceptor{unary},
+		StreamInterceptors: []grpc.StreamServerInterceptor{stream},
+	})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() { _ = server.ServeGRPC(l) }()
+	wsConn := dialTestServer(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for name, client := range map[string]pb.GreeterClient{"native": dialGRPC(t, l.Addr().String()), "websocket": pb.NewGreeterClient(wsConn)} {
+		resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: name})
+		if err != nil || resp.GetMessage() != "Hello "+name {
+			t.Errorf("%s: SayHello returned %q, %v", name, resp.GetMessage(), err)
+		}
+		stream, err := client.SayHelloStream(ctx, &pb.HelloRequest{Name: name})
+		if err != nil {
+			t.Fatalf("%s: SayHelloStream failed: %v", name, err)
+		}
+		for err == nil {
+			_, err = stream.Recv()
+		}
+		if err != io.EOF {
+			t.Errorf("%s: stream ended with %v", name, err)
+		}
+
+		got := calls.take()
+		t.Logf("%s: %v", name, got)
+		want := []string{"wsgrpc " + pb.Greeter_SayHello_FullMethodName, "wsgrpc " + pb.Greeter_SayHelloStream_FullMethodName + "/server"}
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("%s: interceptors saw %v, want %v", name, got, want)
+		}
+	}
+}
+
+// TestNativeGRPCServerSupplied verifies that a user-supplied grpc.Server gets the
+// services, runs its own interceptors first, and is stopped with the Server
+func TestNativeGRPCServerSupplied(t *testing.T) {
+	calls := &callLog{}
+	ownUnary, ownStream := loggingInterceptors(calls, "own")
+	unary, stream := loggingInterceptors(calls, "wsgrpc")
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(ownUnary), grpc.StreamInterceptor(ownStream))
+	server := NewServer(ServerOption{
+		GRPCServer:         grpcServer,
+		UnaryInterceptors:  []grpc.UnaryServerInterceptor{unary},
+		StreamInterceptors: []grpc.StreamServerInterceptor{stream},
+	})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	if server.GRPCServer() != grpcServer {
+		t.Fatal("Expected GRPCServer to return the supplied server")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.ServeGRPC(l) }()
+	client := dialGRPC(t, l.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.SayHello(ctx, &pb.HelloRequest{Name: "own"}); err != nil {
+		t.Fatalf("SayHello failed: %v", err)
+	}
+	bidi, err := client.SayHelloBidirectional(ctx)
+	if err != nil {
+		t.Fatalf("SayHelloBidirectional failed: %v", err)
+	}
+	_ = bidi.CloseSend()
+	if _, err := bidi.Recv(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+
+	got := calls.take()
+	want := []string{
+		"own " + pb.Greeter_SayHello_FullMethodName,
+		"wsgrpc " + pb.Greeter_SayHello_FullMethodName,
+		"own " + pb.Greeter_SayHelloBidirectional_FullMethodName + "/bidi",
+		"wsgrpc " + pb.Greeter_SayHelloBidirectional_FullMethodName + "/bidi",
+	}
+	t.Logf("Interceptors saw %v", got)
+	if len(got) != len(want) {
+		t.Fatalf("Interceptors saw %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Call %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	select {
+	case err := <-served:
+		t.Logf("ServeGRPC returned %v", err)
+	case <-ctx.Done():
+		t.Fatal("ServeGRPC did not return after Shutdown")
+	}
+}
+
+// TestNativeGRPCOnePort verifies that Serve accepts native gRPC clients over HTTP/2
+// without TLS next to WebSocket clients
+func TestNativeGRPCOnePort(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true, EnableGRPC: true})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+	defer server.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := dialGRPC(t, l.Addr().String()).SayHello(ctx, &pb.HelloRequest{Name: "h2c"}); err != nil {
+		t.Errorf("Native SayHello failed: %v", err)
+	}
+	conn, err := Dial(ctx, "ws://"+l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "ws"}); err != nil {
+		t.Errorf("WebSocket SayHello failed: %v", err)
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected http.ErrServerClosed, got %v", err)
+	}
+}
+
+// TestServeGRPCNotEnabled verifies that ServeGRPC fails without a grpc.Server
+func TestServeGRPCNotEnabled(t *testing.T) {
+	server := NewServer(ServerOption{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if err := server.ServeGRPC(l); !errors.Is(err, errGRPCNotEnabled) {
+		t.Errorf("Expected errGRPCNotEnabled, got %v", err)
+	}
+	if server.GRPCServer() != nil {
+		t.Error("Expected no grpc.Server")
+	}
+}
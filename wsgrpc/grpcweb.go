@@ -0,0 +1,133 @@
+package wsgrpc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// grpcWebContentType is the content-type of gRPC-Web calls, with "-text" for base64
+// encoded bodies and an optional "+codec" suffix as for gRPC.
+const grpcWebContentType = "application/grpc-web"
+
+// parseGRPCWebContentType returns the content-subtype of a gRPC-Web content-type and
+// whether the bodies are base64 encoded. ok is false for other content-types.
+func parseGRPCWebContentType(contentType string) (subtype string, text bool, ok bool) {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	rest, ok := strings.CutPrefix(strings.TrimSpace(mediaType), grpcWebContentType)
+	if !ok {
+		return "", false, false
+	}
+	rest, text = strings.CutPrefix(rest, "-text")
+	switch {
+	case rest == "":
+		return "proto", text, true
+	case rest[0] == '+' && len(rest) > 1:
+		return rest[1:], text, true
+	}
+	return "", false, false
+}
+
+// HandleGRPCWeb serves a call of a registered method over the gRPC-Web protocol, for
+// clients that cannot open a WebSocket, e.g. grpc-web or Connect-Web in its gRPC-Web
+// mode. Request bodies are binary (application/grpc-web) or base64 encoded
+// (application/grpc-web-text); the method is the end of the request path. Calls go
+// through the same interceptors as WebSocket streams and get the same scrubbed error
+// statuses. ServeHTTP routes gRPC-Web requests here.
+func (s *Server) HandleGRPCWeb(w http.ResponseWriter, r *http.Request) {
+	subtype, text, ok := parseGRPCWebContentType(r.Header.Get("Content-Type"))
+	if !ok {
+		http.Error(w, "unsupported content-type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "gRPC-Web calls must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stream := &httpServerStream{
+		ctx:         r.Context(),
+		server:      s,
+		w:           w,
+		body:        r.Body,
+		method:      methodFromPath(r.URL.Path),
+		protocol:    protocolGRPCWeb,
+		contentType: grpcWebContentType + "+" + subtype,
+	}
+	if text {
+		stream.body = newBase64Reader(r.Body)
+		stream.protocol = protocolGRPCWebText
+		stream.contentType = grpcWebContentType + "-text+" + subtype
+	}
+
+	var timeout time.Duration
+	if value := r.Header.Get("Grpc-Timeout"); value != "" {
+		var err error
+		if timeout, err = decodeTimeout(value); err != nil {
+			stream.finish(int(codes.Internal), fmt.Sprintf("malformed grpc-timeout: %v", err), nil)
+			return
+		}
+	}
+	encodingName := r.Header.Get("Grpc-Encoding")
+	recvCompressor, ok := lookupCompressor(encodingName)
+	if !ok {
+		stream.finish(int(codes.Unimplemented), fmt.Sprintf("grpc: Decompressor is not installed for grpc-encoding %q", encodingName), nil)
+		return
+	}
+	stream.recvCompressor = recvCompressor
+	stream.sendCompressor = s.responseCompressor(recvCompressor, r.Header.Values("Grpc-Accept-Encoding"))
+
+	s.serveHTTPCall(r, stream, subtype, metadataFromHTTPHeader(r.Header), timeout)
+}
+
+// finishGRPCWebLocked ends a gRPC-Web response with the trailers message. Headers that
+// were not sent yet go out first.
+func (s *httpServerStream) finishGRPCWebLocked(statusCode int, statusMsg string, statusDetails []byte) error {
+	if !s.headerSent {
+		s.writeHeaderLocked()
+	}
+
+	lines := []string{
+		"grpc-status: " + strconv.Itoa(statusCode),
+		"grpc-message: " + encodeGRPCMessage(statusMsg),
+	}
+	if statusDetails != nil {
+		lines = append(lines, "grpc-status-details-bin: "+base64.RawStdEncoding.EncodeToString(statusDetails))
+	}
+	lines = append(lines, trailerLines(s.trailer)...)
+	return s.writeEnvelopeLocked(envelopeTrailers, []byte(strings.Join(lines, "\r\n")+"\r\n"))
+}
+
+// trailerLines returns trailer metadata as sorted "key: value" lines.
+func trailerLines(md metadata.MD) []string {
+	var lines []string
+	for k, values := range md {
+		for _, v := range values {
+			lines = append(lines, encodeTextValue("", k)+": "+encodeTextValue(k, v))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// encodeGRPCMessage percent-encodes a grpc-message value as the gRPC HTTP/2 protocol
+// requires for header values: bytes outside printable ASCII, and '%'.
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,212 @@
+package wsgrpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// envelopeMsg is a message envelope of a gRPC-Web or Connect streaming body
+type envelopeMsg struct {
+	flags   byte
+	payload []byte
+}
+
+// envelope returns a message envelope
+func envelope(flags byte, payload []byte) []byte {
+	b := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(payload))
+	b[0] = flags
+	binary.BigEndian.PutUint32(b[1:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+// readEnvelopes splits a response body into its envelopes
+func readEnvelopes(t *testing.T, body io.Reader) []envelopeMsg {
+	t.Helper()
+	var envelopes []envelopeMsg
+	for {
+		var header [envelopeHeaderSize]byte
+		if _, err := io.ReadFull(body, header[:]); err == io.EOF {
+			return envelopes
+		} else if err != nil {
+			t.Fatalf("Failed to read envelope header: %v", err)
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(body, payload); err != nil {
+			t.Fatalf("Failed to read envelope payload: %v", err)
+		}
+		envelopes = append(envelopes, envelopeMsg{flags: header[0], payload: payload})
+	}
+}
+
+// postHTTPCall posts an HTTP call of method to the server and returns the response
+func postHTTPCall(t *testing.T, server *httptest.Server, method, contentType string, body []byte, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, server.URL+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	for k, values := range header {
+		req.Header[k] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+// parseGRPCWebTrailers parses the trailers message of a gRPC-Web response
+func parseGRPCWebTrailers(t *testing.T, e envelopeMsg) map[string]string {
+	t.Helper()
+	if e.flags&envelopeTrailers == 0 {
+		t.Fatalf("Expected a trailers message, got flags 0x%02x", e.flags)
+	}
+	trailers := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(e.payload)), "\r\n") {
+		k, v, _ := strings.Cut(line, ": ")
+		trailers[k] = v
+	}
+	return trailers
+}
+
+// TestGRPCWebUnary verifies a binary gRPC-Web unary call through ServeHTTP and the
+// Server's interceptors
+func TestGRPCWebUnary(t *testing.T) {
+	calls := &callLog{}
+	unary, stream := loggingInterceptors(calls, "wsgrpc")
+	server := NewServer(ServerOption{
+		UnaryInterceptors:  []grpc.UnaryServerInterceptor{unary},
+		StreamInterceptors: []grpc.StreamServerInterceptor{stream},
+	})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	req, _ := proto.Marshal(&pb.HelloRequest{Name: "web"})
+	resp := postHTTPCall(t, httpServer, pb.Greeter_SayHello_FullMethodName, "application/grpc-web+proto", envelope(0, req),
+		http.Header{"X-Greeting": {"Hi"}})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc-web+proto" {
+		t.Fatalf("Unexpected response %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	envelopes := readEnvelopes(t, resp.Body)
+	if len(envelopes) != 2 {
+		t.Fatalf("Expected a message and the trailers, got %d envelopes", len(envelopes))
+	}
+	got := &pb.HelloResponse{}
+	if err := proto.Unmarshal(envelopes[0].payload, got); err != nil || got.GetMessage() != "Hi web" {
+		t.Errorf("Unexpected response %q, %v", got.GetMessage(), err)
+	}
+	trailers := parseGRPCWebTrailers(t, envelopes[1])
+	t.Logf("Trailers: %v", trailers)
+	if trailers["grpc-status"] != "0" {
+		t.Errorf("Expected grpc-status 0, got %q", trailers["grpc-status"])
+	}
+	if logged := calls.take(); len(logged) != 1 || logged[0] != "wsgrpc "+pb.Greeter_SayHello_FullMethodName {
+		t.Errorf("Interceptors saw %v", logged)
+	}
+}
+
+// TestGRPCWebTextServerStream verifies a base64 encoded gRPC-Web server stream with
+// its header and trailer metadata
+func TestGRPCWebTextServerStream(t *testing.T) {
+	server := NewServer(ServerOption{})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	req, _ := proto.Marshal(&pb.HelloRequest{Name: "text"})
+	body := []byte(base64.StdEncoding.EncodeToString(envelope(0, req)))
+	resp := postHTTPCall(t, httpServer, pb.Greeter_SayHelloStream_FullMethodName, "application/grpc-web-text", body, nil)
+	if resp.Header.Get("Content-Type") != "application/grpc-web-text+proto" || resp.Header.Get("X-Stream") != "server" {
+		t.Errorf("Unexpected headers %v", resp.Header)
+	}
+
+	// Every message is a padded base64 chunk of its own
+	envelopes := readEnvelopes(t, newBase64Reader(resp.Body))
+	if len(envelopes) != 4 {
+		t.Fatalf("Expected 3 messages and the trailers, got %d envelopes", len(envelopes))
+	}
+	for i, e := range envelopes[:3] {
+		got := &pb.HelloResponse{}
+		if err := proto.Unmarshal(e.payload, got); err != nil {
+			t.Fatalf("Message %d: %v", i, err)
+		}
+		t.Logf("Message %d: %s", i, got.GetMessage())
+	}
+	trailers := parseGRPCWebTrailers(t, envelopes[3])
+	if trailers["grpc-status"] != "0" || trailers["x-count"] != "3" {
+		t.Errorf("Unexpected trailers %v", trailers)
+	}
+}
+
+// TestGRPCWebErrors verifies that handler errors and unknown methods end gRPC-Web
+// calls with their status in the trailers message
+func TestGRPCWebErrors(t *testing.T) {
+	server := NewServer(ServerOption{})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tests := []struct {
+		method, name string
+		wantStatus   string
+		wantMessage  string
+	}{
+		{pb.Greeter_SayHello_FullMethodName, "fail", "3", "name must not be fail"},
+		{"/greeter.Greeter/Missing", "", "12", "unknown method Missing for service greeter.Greeter"},
+	}
+	for _, tt := range tests {
+		req, _ := proto.Marshal(&pb.HelloRequest{Name: tt.name})
+		resp := postHTTPCall(t, httpServer, tt.method, "application/grpc-web", envelope(0, req), nil)
+		envelopes := readEnvelopes(t, resp.Body)
+		if len(envelopes) != 1 {
+			t.Fatalf("%s: expected only the trailers, got %d envelopes", tt.method, len(envelopes))
+		}
+		trailers := parseGRPCWebTrailers(t, envelopes[0])
+		t.Logf("%s: %v", tt.method, trailers)
+		if trailers["grpc-status"] != tt.wantStatus || trailers["grpc-message"] != tt.wantMessage {
+			t.Errorf("%s: got status %q %q, want %q %q", tt.method, trailers["grpc-status"], trailers["grpc-message"], tt.wantStatus, tt.wantMessage)
+		}
+	}
+}
+
+// TestHTTPCallsMounted verifies that gRPC-Web and Connect calls find their method when
+// the Server is mounted under a prefix
+func TestHTTPCallsMounted(t *testing.T) {
+	server := NewServer(ServerOption{})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	mux := http.NewServeMux()
+	mux.Handle("/rpc/", server)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	req, _ := proto.Marshal(&pb.HelloRequest{Name: "mounted"})
+	resp := postHTTPCall(t, httpServer, "/rpc"+pb.Greeter_SayHello_FullMethodName, "application/grpc-web+proto", envelope(0, req), nil)
+	envelopes := readEnvelopes(t, resp.Body)
+	if len(envelopes) != 2 {
+		t.Fatalf("Expected a message and the trailers, got %d envelopes", len(envelopes))
+	}
+	if trailers := parseGRPCWebTrailers(t, envelopes[1]); trailers["grpc-status"] != "0" {
+		t.Errorf("Unexpected gRPC-Web trailers %v", trailers)
+	}
+
+	resp = postHTTPCall(t, httpServer, "/rpc"+pb.Greeter_SayHello_FullMethodName, "application/json", []byte(`{"name":"mounted"}`), nil)
+	body, _ := io.ReadAll(resp.Body)
+	t.Logf("Connect response: %d %s", resp.StatusCode, body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"Hello mounted"`) {
+		t.Errorf("Unexpected Connect response %d %s", resp.StatusCode, body)
+	}
+}
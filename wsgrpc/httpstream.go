@@ -0,0 +1,450 @@
+package wsgrpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// httpProtocol is the wire protocol of a call served over plain HTTP requests instead
+// of a WebSocket (HandleGRPCWeb, HandleConnect).
+type httpProtocol int
+
+const (
+	protocolGRPCWeb       httpProtocol = iota // application/grpc-web
+	protocolGRPCWebText                       // application/grpc-web-text: base64 encoded bodies
+	protocolConnectUnary                      // application/proto, application/json
+	protocolConnectStream                     // application/connect+proto, application/connect+json
+)
+
+// String names the protocol in the server-side log.
+func (p httpProtocol) String() string {
+	switch p {
+	case protocolGRPCWeb, protocolGRPCWebText:
+		return "gRPC-Web"
+	default:
+		return "Connect"
+	}
+}
+
+// Flags of the 5-byte message envelopes of gRPC-Web and Connect streaming bodies
+const (
+	envelopeHeaderSize = 5
+	envelopeCompressed = 0x01 // The message is compressed
+	envelopeEndStream  = 0x02 // Connect: the JSON end-of-stream message
+	envelopeTrailers   = 0x80 // gRPC-Web: the trailers, as HTTP/1 header lines
+)
+
+// httpCallHeaders are request headers that describe the HTTP exchange rather than the
+// call. They do not become incoming metadata.
+var httpCallHeaders = map[string]bool{
+	"connection":               true,
+	"keep-alive":               true,
+	"content-length":           true,
+	"transfer-encoding":        true,
+	"upgrade":                  true,
+	"te":                       true,
+	"grpc-timeout":             true,
+	"grpc-encoding":            true,
+	"grpc-accept-encoding":     true,
+	"content-encoding":         true,
+	"accept-encoding":          true,
+	"connect-protocol-version": true,
+	"connect-timeout-ms":       true,
+	"connect-content-encoding": true,
+	"connect-accept-encoding":  true,
+}
+
+// httpServerStream implements grpc.ServerStream for a call over plain HTTP: request
+// messages are read from the request body and responses written to w as the protocol
+// prescribes.
+type httpServerStream struct {
+	ctx      context.Context
+	server   *Server
+	w        http.ResponseWriter
+	body     io.Reader // Envelopes, or the whole message of a Connect unary call
+	method   string
+	protocol httpProtocol
+	// contentType of the response; errors of Connect unary calls are JSON instead
+	contentType    string
+	codec          encoding.Codec
+	recvCompressor encoding.Compressor
+	sendCompressor encoding.Compressor
+	recvDone       bool // The single request of a Connect unary call was read
+
+	mu         sync.Mutex
+	header     metadata.MD
+	headerSent bool
+	trailer    metadata.MD
+	finished   bool
+	// The response of a Connect unary call, written with the status by finish
+	response           []byte
+	responseCompressed bool
+}
+
+// Context implements grpc.ServerStream
+func (s *httpServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// SetHeader implements grpc.ServerStream
+func (s *httpServerStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.headerSent {
+		return fmt.Errorf("headers already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+// SendHeader implements grpc.ServerStream
+func (s *httpServerStream) SendHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.headerSent {
+		return fmt.Errorf("headers already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	s.writeHeaderLocked()
+	return nil
+}
+
+// SetTrailer implements grpc.ServerStream
+func (s *httpServerStream) SetTrailer(md metadata.MD) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+// getCodec returns the codec of the call's content-subtype
+func (s *httpServerStream) getCodec() encoding.Codec { return s.codec }
+
+// SendMsg implements grpc.ServerStream
+func (s *httpServerStream) SendMsg(m interface{}) error {
+	data, err := marshalAppend(s.codec, nil, m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	data, compressed, err := compressMessage(s.sendCompressor, data, s.server.options.CompressionThreshold)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to compress message: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return status.Error(codes.Internal, "call already finished")
+	}
+	if s.protocol == protocolConnectUnary {
+		if s.response != nil {
+			return status.Error(codes.Internal, "unary call sent more than one response")
+		}
+		s.response, s.responseCompressed = data, compressed
+		return nil
+	}
+
+	var flags byte
+	if compressed {
+		flags = envelopeCompressed
+	}
+	if !s.headerSent {
+		s.writeHeaderLocked()
+	}
+	return s.writeEnvelopeLocked(flags, data)
+}
+
+// RecvMsg implements grpc.ServerStream
+func (s *httpServerStream) RecvMsg(m interface{}) error {
+	maxSize := int64(s.server.options.MaxMessageSize)
+	var data []byte
+	var compressed bool
+	if s.protocol == protocolConnectUnary {
+		if s.recvDone {
+			return io.EOF
+		}
+		s.recvDone = true
+		body, err := io.ReadAll(io.LimitReader(s.body, maxSize+1))
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "failed to read request: %v", err)
+		}
+		if int64(len(body)) > maxSize {
+			return status.Errorf(codes.ResourceExhausted, "request larger than %d bytes", maxSize)
+		}
+		data, compressed = body, s.recvCompressor != nil
+	} else {
+		var header [envelopeHeaderSize]byte
+		if _, err := io.ReadFull(s.body, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.EOF
+			}
+			return status.Errorf(codes.InvalidArgument, "failed to read request: %v", err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[1:]))
+		if size > maxSize {
+			return status.Errorf(codes.ResourceExhausted, "received message larger than max (%d vs. %d)", size, maxSize)
+		}
+		data = make([]byte, size)
+		if _, err := io.ReadFull(s.body, data); err != nil {
+			return status.Errorf(codes.InvalidArgument, "failed to read request: %v", err)
+		}
+		compressed = header[0]&envelopeCompressed != 0
+	}
+
+	if compressed {
+		if s.recvCompressor == nil {
+			return status.Error(codes.Internal, "compressed message received without an encoding")
+		}
+		var err error
+		if data, err = decompressMessage(s.recvCompressor, data, maxSize); err != nil {
+			return status.Errorf(codes.ResourceExhausted, "failed to decompress message: %v", err)
+		}
+	}
+	if err := s.codec.Unmarshal(data, m); err != nil {
+		if errors.Is(err, errNotProtoMessage) {
+			return err
+		}
+		return fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	return nil
+}
+
+// writeHeaderLocked writes the response headers: the content-type, the response
+// encoding, and the header metadata. Those of a Connect unary call go out with its
+// status in finish.
+func (s *httpServerStream) writeHeaderLocked() {
+	s.headerSent = true
+	if s.protocol == protocolConnectUnary {
+		return
+	}
+	h := s.w.Header()
+	h.Set("Content-Type", s.contentType)
+	if s.sendCompressor != nil {
+		if s.protocol == protocolConnectStream {
+			h.Set("Connect-Content-Encoding", s.sendCompressor.Name())
+		} else {
+			h.Set("Grpc-Encoding", s.sendCompressor.Name())
+		}
+	}
+	addMetadataHeaders(h, s.header, "")
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// writeEnvelopeLocked writes a message envelope and flushes it to the client.
+func (s *httpServerStream) writeEnvelopeLocked(flags byte, payload []byte) error {
+	envelope := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(payload))
+	envelope[0] = flags
+	binary.BigEndian.PutUint32(envelope[1:], uint32(len(payload)))
+	envelope = append(envelope, payload...)
+	if s.protocol == protocolGRPCWebText {
+		envelope = []byte(base64.StdEncoding.EncodeToString(envelope))
+	}
+	if _, err := s.w.Write(envelope); err != nil {
+		return status.Errorf(codes.Unavailable, "failed to write response: %v", err)
+	}
+	_ = http.NewResponseController(s.w).Flush()
+	return nil
+}
+
+// finish ends the call with its status. Only the first call has any effect.
+func (s *httpServerStream) finish(statusCode int, statusMsg string, statusDetails []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	s.finished = true
+
+	var err error
+	switch s.protocol {
+	case protocolGRPCWeb, protocolGRPCWebText:
+		err = s.finishGRPCWebLocked(statusCode, statusMsg, statusDetails)
+	case protocolConnectUnary:
+		err = s.finishConnectUnaryLocked(statusCode, statusMsg, statusDetails)
+	case protocolConnectStream:
+		err = s.finishConnectStreamLocked(statusCode, statusMsg, statusDetails)
+	}
+	if err != nil && s.server.options.EnableLogging {
+		log.Printf("[wsgrpc] Failed to finish %s call %s: %v", s.protocol, truncateForLog(s.method), err)
+	}
+}
+
+// httpTransportStream exposes an httpServerStream to grpc.SetHeader, grpc.SendHeader
+// and grpc.SetTrailer.
+type httpTransportStream struct {
+	stream *httpServerStream
+}
+
+// Method implements grpc.ServerTransportStream
+func (t *httpTransportStream) Method() string {
+	return t.stream.method
+}
+
+// SetHeader implements grpc.ServerTransportStream
+func (t *httpTransportStream) SetHeader(md metadata.MD) error {
+	return t.stream.SetHeader(md)
+}
+
+// SendHeader implements grpc.ServerTransportStream
+func (t *httpTransportStream) SendHeader(md metadata.MD) error {
+	return t.stream.SendHeader(md)
+}
+
+// SetTrailer implements grpc.ServerTransportStream
+func (t *httpTransportStream) SetTrailer(md metadata.MD) error {
+	t.stream.mu.Lock()
+	finished := t.stream.finished
+	t.stream.mu.Unlock()
+	if finished {
+		return fmt.Errorf("trailers already sent")
+	}
+	t.stream.SetTrailer(md)
+	return nil
+}
+
+// serveHTTPCall runs the handler of an HTTP call and finishes it with the handler's
+// status. subtype is the content-subtype that selects the codec; the request
+// metadata, deadline and encodings were read from the request by the protocol's
+// handler.
+func (s *Server) serveHTTPCall(r *http.Request, stream *httpServerStream, subtype string, md metadata.MD, timeout time.Duration) {
+	s.mu.RLock()
+	shutdown := s.shutdown
+	s.mu.RUnlock()
+	if shutdown {
+		stream.finish(int(codes.Unavailable), "server is shutting down", nil)
+		return
+	}
+
+	methodInfo, ok := s.lookupMethod(stream.method)
+	if !ok {
+		if s.options.EnableLogging {
+			log.Printf("[wsgrpc] Method not found: %s", truncateForLog(stream.method))
+		}
+		stream.finish(int(codes.Unimplemented), s.unimplementedMessage(stream.method), nil)
+		return
+	}
+	if methodInfo.raw {
+		stream.codec = rawCodec{name: subtype}
+	} else if stream.codec = lookupCodec(subtype); stream.codec == nil {
+		stream.finish(int(codes.Internal), fmt.Sprintf("no codec registered for content-subtype %q", subtype), nil)
+		return
+	}
+	if stream.protocol == protocolConnectUnary && methodInfo.streamHandler != nil && !methodInfo.raw {
+		stream.finish(int(codes.Unimplemented), "streaming method called with the Connect unary protocol", nil)
+		return
+	}
+
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	stream.ctx = grpc.NewContextWithServerTransportStream(ctx, &httpTransportStream{stream: stream})
+
+	if methodInfo.streamHandler != nil && methodInfo.streamHandler.ClientStreams {
+		// Read request messages while responses are written, over HTTP/1.1 too
+		_ = http.NewResponseController(stream.w).EnableFullDuplex()
+	}
+	if s.options.EnableLogging {
+		log.Printf("[wsgrpc] New %s call for method: %s", stream.protocol, truncateForLog(stream.method))
+	}
+
+	statusCode, statusMsg, statusDetails := s.runHandler(stream.ctx, stream.method, stream, methodInfo,
+		fmt.Sprintf("%s call %s", stream.protocol, truncateForLog(stream.method)))
+	// As on WebSocket streams, an expired deadline is reported as such
+	if ctx.Err() == context.DeadlineExceeded {
+		statusCode, statusMsg, statusDetails = int(codes.DeadlineExceeded), "context deadline exceeded", nil
+	}
+	stream.finish(statusCode, statusMsg, statusDetails)
+}
+
+// methodFromPath returns the full method name, /package.Service/Method, at the end of
+// a request path, so that calls resolve wherever the Server is mounted, e.g. under
+// /rpc/ on a mux without http.StripPrefix.
+func methodFromPath(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		return path
+	}
+	if j := strings.LastIndexByte(path[:i], '/'); j >= 0 {
+		return path[j:]
+	}
+	return path
+}
+
+// metadataFromHTTPHeader returns the incoming metadata of an HTTP call: the request
+// headers with lowercase keys, -bin values base64 decoded, without those describing
+// the HTTP exchange.
+func metadataFromHTTPHeader(h http.Header) metadata.MD {
+	md := metadata.MD{}
+	for k, values := range h {
+		key := strings.ToLower(k)
+		if httpCallHeaders[key] {
+			continue
+		}
+		for _, v := range values {
+			md[key] = append(md[key], decodeTextValue(key, v))
+		}
+	}
+	return md
+}
+
+// addMetadataHeaders adds metadata to HTTP response headers, with keys prefixed by
+// prefix and -bin values base64 encoded.
+func addMetadataHeaders(h http.Header, md metadata.MD, prefix string) {
+	for k, values := range md {
+		for _, v := range values {
+			h.Add(prefix+k, encodeTextValue(k, v))
+		}
+	}
+}
+
+// base64Reader decodes a gRPC-Web text body, which may be a concatenation of padded
+// base64 chunks, one 4-byte quantum at a time.
+type base64Reader struct {
+	r       *bufio.Reader
+	quantum [4]byte
+	buf     [3]byte
+	out     []byte
+}
+
+func newBase64Reader(r io.Reader) *base64Reader {
+	return &base64Reader{r: bufio.NewReader(r)}
+}
+
+func (b *base64Reader) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if _, err := io.ReadFull(b.r, b.quantum[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, errors.New("truncated base64 body")
+			}
+			return 0, err
+		}
+		n, err := base64.StdEncoding.Decode(b.buf[:], b.quantum[:])
+		if err != nil {
+			return 0, err
+		}
+		b.out = b.buf[:n]
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
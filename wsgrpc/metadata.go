@@ -0,0 +1,109 @@
+package wsgrpc
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// binaryMetadataMarker is the first byte of a binary metadata block. Text blocks start
+// with a printable key character, so the two formats can be told apart per frame.
+const binaryMetadataMarker = 0x00
+
+// binarySuffix marks metadata keys whose values are arbitrary bytes (gRPC convention).
+const binarySuffix = "-bin"
+
+// encodeMetadataBlock serializes metadata into a HEADERS/TRAILERS payload, using the
+// binary block format or the legacy "key: value" text format.
+//
+// Binary block layout (PROTOCOL.md Section 5.4):
+// - Byte 0: 0x00 marker
+// - Per value: key length (uint16, Big Endian), key, value length (uint32, Big Endian), value
+//
+// Multi-valued keys repeat the entry once per value. Values are sent verbatim, including
+// those of -bin keys. Keys and values too long for their length fields are an error.
+func encodeMetadataBlock(md metadata.MD, binaryFormat bool) ([]byte, error) {
+	if !binaryFormat {
+		return encodeHeaderBlock(md), nil
+	}
+
+	size := 1
+	for k, values := range md {
+		if len(k) > math.MaxUint16 {
+			return nil, fmt.Errorf("metadata key %q is longer than %d bytes", truncateForLog(k), math.MaxUint16)
+		}
+		for _, v := range values {
+			if uint64(len(v)) > math.MaxUint32 {
+				return nil, fmt.Errorf("value of metadata key %q is longer than %d bytes", truncateForLog(k), uint64(math.MaxUint32))
+			}
+			size += 2 + len(k) + 4 + len(v)
+		}
+	}
+	block := make([]byte, 1, size)
+	block[0] = binaryMetadataMarker
+	for k, values := range md {
+		for _, v := range values {
+			block = binary.BigEndian.AppendUint16(block, uint16(len(k)))
+			block = append(block, k...)
+			block = binary.BigEndian.AppendUint32(block, uint32(len(v)))
+			block = append(block, v...)
+		}
+	}
+	return block, nil
+}
+
+// decodeMetadataBlock parses a HEADERS/TRAILERS payload in either format and reports
+// which one was used, so a response can be encoded the way the peer understands.
+func decodeMetadataBlock(payload []byte) (md metadata.MD, binaryFormat bool, err error) {
+	if len(payload) == 0 || payload[0] != binaryMetadataMarker {
+		return parseHeaderBlock(payload), false, nil
+	}
+
+	md = metadata.MD{}
+	rest := payload[1:]
+	for len(rest) > 0 {
+		if len(rest) < 2 {
+			return nil, true, fmt.Errorf("truncated metadata key length")
+		}
+		keyLen := int(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+		if keyLen == 0 || len(rest) < keyLen+4 {
+			return nil, true, fmt.Errorf("truncated or empty metadata key")
+		}
+		key := strings.ToLower(string(rest[:keyLen]))
+		rest = rest[keyLen:]
+		valueLen := binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+		if uint64(len(rest)) < uint64(valueLen) {
+			return nil, true, fmt.Errorf("truncated value for metadata key %q", truncateForLog(key))
+		}
+		md[key] = append(md[key], string(rest[:valueLen]))
+		rest = rest[valueLen:]
+	}
+	return md, true, nil
+}
+
+// encodeTextValue prepares a value for the text format: -bin values are base64 encoded,
+// and line breaks are replaced so a value cannot inject additional keys.
+func encodeTextValue(key, value string) string {
+	if strings.HasSuffix(key, binarySuffix) {
+		return base64.RawStdEncoding.EncodeToString([]byte(value))
+	}
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// decodeTextValue reverses encodeTextValue. -bin values are accepted with or without
+// base64 padding, as in gRPC over HTTP/2; a value that is not valid base64 is kept as is.
+func decodeTextValue(key, value string) string {
+	if !strings.HasSuffix(key, binarySuffix) {
+		return value
+	}
+	if decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "=")); err == nil {
+		return string(decoded)
+	}
+	return value
+}
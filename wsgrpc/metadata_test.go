@@ -0,0 +1,246 @@
+package wsgrpc
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// traceContext is a binary value that the text format could not carry verbatim
+var traceContext = string([]byte{0x00, 0x01, '\n', 0xff, ':', 0x7f})
+
+// mustEncodeMetadataBlock encodes md as a HEADERS/TRAILERS payload or fails the test
+func mustEncodeMetadataBlock(t *testing.T, md metadata.MD, binaryFormat bool) []byte {
+	t.Helper()
+	block, err := encodeMetadataBlock(md, binaryFormat)
+	if err != nil {
+		t.Fatalf("encodeMetadataBlock failed: %v", err)
+	}
+	return block
+}
+
+// TestMetadataBlockRejectsLongKey verifies that a key too long for its uint16 length is
+// an error instead of a block the peer misparses, and that such a trailer turns the
+// status into INTERNAL
+func TestMetadataBlockRejectsLongKey(t *testing.T) {
+	long := strings.Repeat("k", math.MaxUint16+1)
+	md := metadata.MD{long: {"value"}, "x-ok": {"fine"}}
+	if _, err := encodeMetadataBlock(md, true); err == nil {
+		t.Fatal("Expected an error for a key longer than 65535 bytes")
+	} else {
+		t.Logf("Rejected: %v", err)
+	}
+	if _, err := encodeMetadataBlock(metadata.MD{long[1:]: {"value"}}, true); err != nil {
+		t.Errorf("Expected a key of 65535 bytes to be encoded, got %v", err)
+	}
+
+	decoded, _, err := decodeMetadataBlock(encodeTrailerBlock(0, "", md, true))
+	if err != nil {
+		t.Fatalf("decodeMetadataBlock failed: %v", err)
+	}
+	if got := decoded.Get("grpc-status"); len(got) != 1 || got[0] != "13" || len(decoded.Get("x-ok")) != 0 {
+		t.Errorf("Expected INTERNAL without the custom trailers, got %v", decoded)
+	}
+}
+
+// TestMetadataBlockRoundTrip verifies that the binary block preserves multi-valued
+// keys, line breaks, colons and arbitrary bytes
+func TestMetadataBlockRoundTrip(t *testing.T) {
+	md := metadata.MD{
+		"x-multi":       {"a", "b", "c"},
+		"x-multiline":   {"line1\nline2: injected"},
+		"trace-bin":     {traceContext},
+		"authorization": {"Bearer sig=abc:def"},
+	}
+
+	block := mustEncodeMetadataBlock(t, md, true)
+	if block[0] != binaryMetadataMarker {
+		t.Fatalf("Expected binary marker, got 0x%02x", block[0])
+	}
+	decoded, binaryFormat, err := decodeMetadataBlock(block)
+	if err != nil || !binaryFormat {
+		t.Fatalf("decodeMetadataBlock failed: binary=%v err=%v", binaryFormat, err)
+	}
+	for k, want := range md {
+		got := decoded.Get(k)
+		if len(got) != len(want) {
+			t.Errorf("Key %s: got %q, want %q", k, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Key %s value %d: got %q, want %q", k, i, got[i], want[i])
+			}
+		}
+	}
+	if len(decoded) != len(md) {
+		t.Errorf("Expected %d keys, got %v", len(md), decoded)
+	}
+}
+
+// TestDecodeMetadataBlockMalformed verifies that truncated binary blocks are rejected
+func TestDecodeMetadataBlockMalformed(t *testing.T) {
+	valid := mustEncodeMetadataBlock(t, metadata.Pairs("key", "value"), true)
+	for n := 2; n < len(valid); n++ {
+		if _, _, err := decodeMetadataBlock(valid[:n]); err == nil {
+			t.Errorf("Expected error for block truncated to %d bytes", n)
+		}
+	}
+	if _, _, err := decodeMetadataBlock([]byte{binaryMetadataMarker, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Error("Expected error for an empty key")
+	}
+	if md, _, err := decodeMetadataBlock([]byte{binaryMetadataMarker}); err != nil || len(md) != 0 {
+		t.Errorf("Expected empty metadata for a bare marker, got %v (err=%v)", md, err)
+	}
+}
+
+// TestTextMetadataEscaping verifies the text format: values cannot inject keys and
+// -bin values survive as base64
+func TestTextMetadataEscaping(t *testing.T) {
+	md := metadata.MD{
+		"x-value":   {"ok\ninjected: yes"},
+		"trace-bin": {traceContext},
+	}
+	block := mustEncodeMetadataBlock(t, md, false)
+	decoded, binaryFormat, err := decodeMetadataBlock(block)
+	if err != nil || binaryFormat {
+		t.Fatalf("Expected text block, got binary=%v err=%v", binaryFormat, err)
+	}
+	if len(decoded.Get("injected")) != 0 {
+		t.Errorf("Value injected an extra key: %v", decoded)
+	}
+	if got := decoded.Get("x-value"); len(got) != 1 || got[0] != "ok injected: yes" {
+		t.Errorf("Unexpected x-value %q", got)
+	}
+	if got := decoded.Get("trace-bin"); len(got) != 1 || got[0] != traceContext {
+		t.Errorf("Unexpected trace-bin %q", got)
+	}
+
+	// Padded base64 from other gRPC implementations is accepted too
+	decoded = parseHeaderBlock([]byte("token-bin: AAE=\n"))
+	if got := decoded.Get("token-bin"); len(got) != 1 || got[0] != "\x00\x01" {
+		t.Errorf("Unexpected padded token-bin %q", got)
+	}
+}
+
+// metadataEchoGreeter returns the incoming trace-bin and x-note values in its response
+// headers and trailers
+type metadataEchoGreeter struct {
+	testGreeter
+}
+
+func (g *metadataEchoGreeter) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	echo := metadata.MD{"trace-bin": md.Get("trace-bin"), "x-note": md.Get("x-note")}
+	if err := grpc.SetHeader(ctx, echo); err != nil {
+		return nil, err
+	}
+	if err := grpc.SetTrailer(ctx, echo); err != nil {
+		return nil, err
+	}
+	return &pb.HelloResponse{Message: "Hello " + req.GetName()}, nil
+}
+
+// TestBinaryMetadataEndToEnd verifies binary values in both directions through the Go
+// client, with the binary block and with the legacy text format
+func TestBinaryMetadataEndToEnd(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		text     bool
+		wantNote string
+	}{
+		{name: "binary", wantNote: "two\nlines"},
+		{name: "text", text: true, wantNote: "two lines"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, client, _ := newTestClientWith(t, &metadataEchoGreeter{}, nil, ClientOption{TextMetadata: tc.text})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ctx = metadata.AppendToOutgoingContext(ctx, "trace-bin", traceContext, "x-note", "two\nlines")
+
+			var header, trailer metadata.MD
+			if _, err := client.SayHello(ctx, &pb.HelloRequest{Name: "md"}, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+				t.Fatalf("SayHello failed: %v", err)
+			}
+			for name, md := range map[string]metadata.MD{"header": header, "trailer": trailer} {
+				if got := md.Get("trace-bin"); len(got) != 1 || got[0] != traceContext {
+					t.Errorf("Unexpected trace-bin in %s: %q", name, got)
+				}
+				if got := md.Get("x-note"); len(got) != 1 || got[0] != tc.wantNote {
+					t.Errorf("Unexpected x-note in %s: %q", name, got)
+				}
+			}
+		})
+	}
+}
+
+// TestServerAnswersInRequestMetadataFormat verifies on the wire that a binary HEADERS
+// block is answered with binary blocks, and that malformed blocks reset the stream
+func TestServerAnswersInRequestMetadataFormat(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &metadataEchoGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	headers := mustEncodeMetadataBlock(t, metadata.Pairs("path", "/greeter.Greeter/SayHello", "x-note", "a:b\nc"), true)
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(1, FlagHEADERS, headers)); err != nil {
+		t.Fatalf("Failed to send HEADERS: %v", err)
+	}
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(1, FlagDATA|FlagEOS, nil)); err != nil {
+		t.Fatalf("Failed to send DATA: %v", err)
+	}
+
+	for _, frame := range readResponseFrames(t, ctx, conn, 1) {
+		if frame.Flags&(FlagHEADERS|FlagTRAILERS) == 0 {
+			continue
+		}
+		md, binaryFormat, err := decodeMetadataBlock(frame.Payload)
+		if err != nil || !binaryFormat {
+			t.Fatalf("Expected binary metadata block in frame 0x%02x (err=%v)", frame.Flags, err)
+		}
+		if got := md.Get("x-note"); len(got) != 1 || got[0] != "a:b\nc" {
+			t.Errorf("Unexpected x-note %q", got)
+		}
+	}
+
+	truncated := headers[:len(headers)-3]
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(3, FlagHEADERS, truncated)); err != nil {
+		t.Fatalf("Failed to send HEADERS: %v", err)
+	}
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Expected RST_STREAM: %v", err)
+		}
+		frame, err := decodeFrame(data, 4*1024*1024)
+		if err != nil || frame.StreamID != 3 {
+			continue
+		}
+		if frame.Flags&FlagRST_STREAM == 0 || !bytes.Equal(frame.Payload, encodeRSTStream(3, ErrCodeProtocolError)[9:]) {
+			t.Errorf("Expected RST_STREAM PROTOCOL_ERROR, got flags 0x%02x payload %v", frame.Flags, frame.Payload)
+		}
+		break
+	}
+}
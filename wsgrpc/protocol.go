@@ -0,0 +1,82 @@
+package wsgrpc
+
+import (
+	"context"
+	"strings"
+)
+
+// WebSocket subprotocols naming the NgGoRPC protocol revisions (PROTOCOL.md Section 1.1)
+const (
+	SubprotocolV1 = "nggorpc.v1"
+	SubprotocolV2 = "nggorpc.v2"
+	SubprotocolV3 = "nggorpc.v3"
+)
+
+// ProtocolVersion is the NgGoRPC protocol revision negotiated for a connection.
+type ProtocolVersion int
+
+const (
+	// ProtocolV1 is the original wire format. It is also used when the client does not
+	// offer a subprotocol, as deployed Angular bundles do.
+	ProtocolV1 ProtocolVersion = 1
+	// ProtocolV2 requires binary metadata blocks in HEADERS and TRAILERS frames.
+	ProtocolV2 ProtocolVersion = 2
+	// ProtocolV3 adds messages fragmented across DATA frames and WebSocket messages
+	// packing several frames to v2.
+	ProtocolV3 ProtocolVersion = 3
+)
+
+// supportedSubprotocols lists the subprotocols in order of preference; the first one
+// offered by the peer is selected.
+var supportedSubprotocols = []string{SubprotocolV3, SubprotocolV2, SubprotocolV1}
+
+func (v ProtocolVersion) String() string {
+	switch v {
+	case ProtocolV3:
+		return SubprotocolV3
+	case ProtocolV2:
+		return SubprotocolV2
+	default:
+		return SubprotocolV1
+	}
+}
+
+// binaryMetadata reports whether all metadata blocks use the binary format.
+func (v ProtocolVersion) binaryMetadata() bool {
+	return v >= ProtocolV2
+}
+
+// fragmentation reports whether messages may be split into CONTINUED DATA frames.
+// v1 clients would mistake the CONTINUED bit for PONG, v2 peers do not reassemble.
+func (v ProtocolVersion) fragmentation() bool {
+	return v >= ProtocolV3
+}
+
+// framePacking reports whether the peer can read WebSocket messages packing several
+// frames; it is only used when the peer also announces it in SETTINGS. v1 and v2
+// receivers ignore everything after the first frame of a message.
+func (v ProtocolVersion) framePacking() bool {
+	return v >= ProtocolV3
+}
+
+// protocolVersionFor maps a negotiated subprotocol onto its protocol revision. An empty
+// or unknown subprotocol means the peer predates negotiation, i.e. ProtocolV1.
+func protocolVersionFor(subprotocol string) ProtocolVersion {
+	switch {
+	case strings.EqualFold(subprotocol, SubprotocolV3):
+		return ProtocolV3
+	case strings.EqualFold(subprotocol, SubprotocolV2):
+		return ProtocolV2
+	}
+	return ProtocolV1
+}
+
+// protocolVersionKey is the context key under which connections store their version
+type protocolVersionKey struct{}
+
+// ProtocolVersionFromContext returns the protocol revision of the connection serving
+// the RPC whose handler context is ctx. It reports false outside of wsgrpc handlers.
+func ProtocolVersionFromContext(ctx context.Context) (ProtocolVersion, bool) {
+	v, ok := ctx.Value(protocolVersionKey{}).(ProtocolVersion)
+	return v, ok
+}
@@ -0,0 +1,122 @@
+package wsgrpc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// versionGreeter answers with the protocol revision seen by the handler
+type versionGreeter struct {
+	testGreeter
+}
+
+func (g *versionGreeter) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	version, ok := ProtocolVersionFromContext(ctx)
+	if !ok {
+		return &pb.HelloResponse{Message: "unknown"}, nil
+	}
+	return &pb.HelloResponse{Message: version.String()}, nil
+}
+
+// TestProtocolVersionFor verifies the mapping of negotiated subprotocols
+func TestProtocolVersionFor(t *testing.T) {
+	tests := map[string]ProtocolVersion{
+		"":           ProtocolV1,
+		"nggorpc.v1": ProtocolV1,
+		"nggorpc.v2": ProtocolV2,
+		"NgGoRPC.V2": ProtocolV2,
+		"nggorpc.v3": ProtocolV3,
+		"nggorpc.v9": ProtocolV1,
+	}
+	for subprotocol, want := range tests {
+		if got := protocolVersionFor(subprotocol); got != want {
+			t.Errorf("protocolVersionFor(%q) = %v, want %v", subprotocol, got, want)
+		}
+	}
+	if _, ok := ProtocolVersionFromContext(context.Background()); ok {
+		t.Error("Expected no protocol version outside of a handler")
+	}
+}
+
+// TestGoClientNegotiatesProtocolVersion verifies that the Go client and the server agree
+// on the newest revision, and that TextMetadata pins the client to v1
+func TestGoClientNegotiatesProtocolVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  ClientOption
+		want ProtocolVersion
+	}{
+		{name: "default", want: ProtocolV3},
+		{name: "text metadata", opt: ClientOption{TextMetadata: true}, want: ProtocolV1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, client, conn := newTestClientWith(t, &versionGreeter{}, nil, tc.opt)
+			if conn.ProtocolVersion() != tc.want {
+				t.Errorf("Client negotiated %v, want %v", conn.ProtocolVersion(), tc.want)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: "version"})
+			if err != nil {
+				t.Fatalf("SayHello failed: %v", err)
+			}
+			if resp.GetMessage() != tc.want.String() {
+				t.Errorf("Handler saw %s, want %s", resp.GetMessage(), tc.want)
+			}
+		})
+	}
+}
+
+// TestLegacyClientsUseV1 verifies the handshake with clients that offer no or only
+// unknown subprotocols (e.g. cached Angular bundles), and that v2 requires binary
+// metadata
+func TestLegacyClientsUseV1(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &versionGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dial := func(subprotocols ...string) *websocket.Conn {
+		conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], &websocket.DialOptions{Subprotocols: subprotocols})
+		if err != nil {
+			t.Fatalf("Failed to dial WebSocket: %v", err)
+		}
+		t.Cleanup(func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") })
+		return conn
+	}
+
+	for _, offered := range [][]string{nil, {"nggorpc.v9"}} {
+		conn := dial(offered...)
+		if conn.Subprotocol() != "" {
+			t.Errorf("Expected no subprotocol for offer %v, got %q", offered, conn.Subprotocol())
+		}
+		writeFrame(t, ctx, conn, encodeFrame(1, FlagHEADERS, []byte("path: /greeter.Greeter/SayHello\n")))
+		writeFrame(t, ctx, conn, encodeFrame(1, FlagDATA|FlagEOS, nil))
+		statusCode, _, ok := readUntilTrailers(t, ctx, conn)
+		if !ok || statusCode != "0" {
+			t.Errorf("Expected OK over v1 for offer %v, got %q", offered, statusCode)
+		}
+	}
+
+	if conn := dial(SubprotocolV1, SubprotocolV2, SubprotocolV3); conn.Subprotocol() != SubprotocolV3 {
+		t.Errorf("Expected the server to prefer %s, got %q", SubprotocolV3, conn.Subprotocol())
+	}
+	conn := dial(SubprotocolV1, SubprotocolV2)
+	if conn.Subprotocol() != SubprotocolV2 {
+		t.Fatalf("Expected the server to prefer %s, got %q", SubprotocolV2, conn.Subprotocol())
+	}
+	writeFrame(t, ctx, conn, encodeFrame(1, FlagHEADERS, []byte("path: /greeter.Greeter/SayHello\n")))
+	expectRST(t, ctx, conn, 1, ErrCodeProtocolError)
+}
@@ -0,0 +1,140 @@
+package wsgrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// rawCodec passes messages through as the bytes of DATA frames. Streams of methods that
+// are not registered (ServerOption.UnknownServiceHandler and ProxyUpstream) use it in
+// place of the content-type's codec, and so does the proxy's upstream call under the
+// same content-subtype, so that payloads reach the upstream server exactly as the
+// client encoded them.
+type rawCodec struct {
+	name string // Content-subtype, e.g. "proto"
+}
+
+// Marshal returns the payload of a []byte or *[]byte.
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case *[]byte:
+		return *b, nil
+	}
+	return nil, fmt.Errorf("raw codec cannot marshal %T", v)
+}
+
+// Unmarshal stores a copy of data in a *[]byte; data may be reused after the call.
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw codec cannot unmarshal into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (c rawCodec) Name() string { return c.name }
+
+// codecStream is a server stream that tells the codec of its messages, such as
+// WebSocketServerStream and the streams of gRPC-Web and Connect calls.
+type codecStream interface {
+	getCodec() encoding.Codec
+}
+
+// proxyStreamDesc describes forwarded calls: the upstream server knows whether a method
+// streams, so every call is proxied as a bidirectional stream.
+var proxyStreamDesc = &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+
+// NewProxyHandler returns a handler that forwards calls to upstream, typically a
+// grpc.ClientConn of an existing gRPC server, so that browsers can reach services that
+// are not registered with the Server. Install it as ServerOption.UnknownServiceHandler,
+// or set ServerOption.ProxyUpstream.
+//
+// The request metadata goes upstream, the response headers and trailers and the status
+// come back, and messages are forwarded as raw payloads without being decoded, so the
+// proxy needs no generated code and supports all four kinds of calls. The call's
+// deadline and cancellation apply to the upstream call. The handler expects a stream
+// whose messages are raw bytes: RecvMsg into a *[]byte, SendMsg with a []byte.
+func NewProxyHandler(upstream grpc.ClientConnInterface) grpc.StreamHandler {
+	return func(_ interface{}, stream grpc.ServerStream) error {
+		method, ok := grpc.MethodFromServerStream(stream)
+		if !ok {
+			return status.Error(codes.Internal, "proxy: no method in the stream context")
+		}
+		codec := rawCodec{name: "proto"}
+		if s, ok := stream.(codecStream); ok {
+			if c, ok := s.getCodec().(rawCodec); ok {
+				codec = c
+			}
+		}
+
+		// Cancelling ctx resets the upstream call, e.g. when the client's messages fail
+		ctx, cancel := context.WithCancel(stream.Context())
+		defer cancel()
+		md, _ := metadata.FromIncomingContext(ctx)
+		md = md.Copy()
+		delete(md, "content-type")
+		ctx = metadata.NewOutgoingContext(ctx, md)
+
+		up, err := upstream.NewStream(ctx, proxyStreamDesc, method,
+			grpc.CallContentSubtype(codec.name), grpc.ForceCodec(codec))
+		if err != nil {
+			return err
+		}
+
+		// Client to upstream. SendMsg fails once the upstream call ended; its status is
+		// reported by RecvMsg below.
+		go func() {
+			for {
+				var msg []byte
+				if err := stream.RecvMsg(&msg); err != nil {
+					if errors.Is(err, io.EOF) {
+						_ = up.CloseSend()
+					} else {
+						cancel()
+					}
+					return
+				}
+				if err := up.SendMsg(msg); err != nil {
+					return
+				}
+			}
+		}()
+
+		// Upstream to client. The headers are sent as soon as they arrive, so that a
+		// server stream that has not sent a message yet still shows them.
+		if header, err := up.Header(); err == nil && header != nil {
+			header = header.Copy()
+			delete(header, "content-type")
+			delete(header, "grpc-encoding")
+			if len(header) > 0 {
+				if err := stream.SendHeader(header); err != nil {
+					return err
+				}
+			}
+		}
+		for {
+			var msg []byte
+			if err := up.RecvMsg(&msg); err != nil {
+				stream.SetTrailer(up.Trailer())
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return err
+			}
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
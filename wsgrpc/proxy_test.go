@@ -0,0 +1,291 @@
+package wsgrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// proxyResult is how a unary call ended on the upstream server
+type proxyResult struct {
+	err         error
+	hasDeadline bool
+}
+
+// newProxyTestServer starts a plain gRPC server hosting testGreeter and a wsgrpc server
+// without services that forwards to it. It returns a wsgrpc client and the results of
+// the upstream's unary handlers.
+func newProxyTestServer(t *testing.T) (*ClientConn, <-chan proxyResult) {
+	t.Helper()
+	results := make(chan proxyResult, 10)
+	upstream := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		_, hasDeadline := ctx.Deadline()
+		resp, err := handler(ctx, req)
+		results <- proxyResult{err: err, hasDeadline: hasDeadline}
+		return resp, err
+	}))
+	pb.RegisterGreeterServer(upstream, &testGreeter{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() { _ = upstream.Serve(l) }()
+	t.Cleanup(upstream.Stop)
+
+	cc, err := grpc.NewClient("passthrough:///"+l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create the upstream client: %v", err)
+	}
+	t.Cleanup(func() { _ = cc.Close() })
+
+	server := NewServer(ServerOption{InsecureSkipVerify: true, ProxyUpstream: cc})
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	t.Cleanup(server.Stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, "ws"+httpServer.URL[4:])
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn, results
+}
+
+// TestProxyCallKinds verifies that unary, server-streaming, client-streaming and
+// bidirectional calls reach the upstream server with their metadata, and that its
+// headers and trailers come back
+func TestProxyCallKinds(t *testing.T) {
+	conn, _ := newProxyTestServer(t)
+	client := pb.NewGreeterClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("unary", func(t *testing.T) {
+		resp, err := client.SayHello(metadata.AppendToOutgoingContext(ctx, "x-greeting", "Hi"), &pb.HelloRequest{Name: "proxy"})
+		if err != nil {
+			t.Fatalf("SayHello failed: %v", err)
+		}
+		if resp.GetMessage() != "Hi proxy" {
+			t.Errorf("Expected \"Hi proxy\", got %q", resp.GetMessage())
+		}
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		stream, err := client.SayHelloStream(ctx, &pb.HelloRequest{Name: "proxy"})
+		if err != nil {
+			t.Fatalf("SayHelloStream failed: %v", err)
+		}
+		header, err := stream.Header()
+		if err != nil || len(header.Get("x-stream")) == 0 {
+			t.Errorf("Expected the upstream header x-stream, got %v (err=%v)", header, err)
+		}
+		var messages []string
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			messages = append(messages, resp.GetMessage())
+		}
+		t.Logf("Messages %q, trailer %v", messages, stream.Trailer())
+		if len(messages) != 3 || messages[2] != "Hello proxy #2" {
+			t.Errorf("Expected 3 greetings, got %q", messages)
+		}
+		if count := stream.Trailer().Get("x-count"); len(count) == 0 || count[0] != "3" {
+			t.Errorf("Expected the upstream trailer x-count 3, got %v", stream.Trailer())
+		}
+	})
+
+	t.Run("client streaming", func(t *testing.T) {
+		stream, err := client.SayHelloClientStream(ctx)
+		if err != nil {
+			t.Fatalf("SayHelloClientStream failed: %v", err)
+		}
+		for _, name := range []string{"a", "b", "c"} {
+			if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		resp, err := stream.CloseAndRecv()
+		if err != nil {
+			t.Fatalf("CloseAndRecv failed: %v", err)
+		}
+		if resp.GetMessage() != "Hello a, b, c" {
+			t.Errorf("Expected \"Hello a, b, c\", got %q", resp.GetMessage())
+		}
+	})
+
+	t.Run("bidirectional", func(t *testing.T) {
+		stream, err := client.SayHelloBidirectional(ctx)
+		if err != nil {
+			t.Fatalf("SayHelloBidirectional failed: %v", err)
+		}
+		for _, name := range []string{"ping", "pong"} {
+			if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+			resp, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			if resp.GetMessage() != "Echo "+name {
+				t.Errorf("Expected \"Echo %s\", got %q", name, resp.GetMessage())
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatalf("CloseSend failed: %v", err)
+		}
+		if _, err := stream.Recv(); err != io.EOF {
+			t.Errorf("Expected io.EOF after CloseSend, got %v", err)
+		}
+	})
+}
+
+// TestProxyStatusAndDeadline verifies that upstream errors reach the client unchanged
+// and that the client's deadline and cancellation end the upstream call
+func TestProxyStatusAndDeadline(t *testing.T) {
+	conn, results := newProxyTestServer(t)
+	client := pb.NewGreeterClient(conn)
+
+	_, err := client.SayHello(context.Background(), &pb.HelloRequest{Name: "fail"})
+	if st := status.Convert(err); st.Code() != codes.InvalidArgument || st.Message() != "name must not be fail" {
+		t.Errorf("Expected the upstream InvalidArgument, got %v", err)
+	}
+	<-results
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = client.SayHello(ctx, &pb.HelloRequest{Name: "block"})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	select {
+	case result := <-results:
+		// The proxy resets the upstream call when its own deadline expires, which may
+		// arrive before the upstream deadline does
+		t.Logf("Upstream handler ended with %v", result.err)
+		if !result.hasDeadline {
+			t.Error("Expected the deadline to apply upstream")
+		}
+		if !errors.Is(result.err, context.DeadlineExceeded) && !errors.Is(result.err, context.Canceled) {
+			t.Errorf("Expected the upstream call to end, got %v", result.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upstream handler did not see the deadline")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	_, err = client.SayHello(ctx, &pb.HelloRequest{Name: "block"})
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("Expected Canceled, got %v", err)
+	}
+	select {
+	case result := <-results:
+		if !errors.Is(result.err, context.Canceled) {
+			t.Errorf("Expected the upstream call to be cancelled, got %v", result.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upstream handler was not cancelled")
+	}
+}
+
+// TestRegisteredMethodsAreNotProxied verifies that the proxy only gets unregistered
+// methods
+func TestRegisteredMethodsAreNotProxied(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true, ProxyUpstream: unreachableUpstream{}})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, "ws"+httpServer.URL[4:])
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "local"}); err != nil {
+		t.Errorf("Registered SayHello failed: %v", err)
+	}
+	err = conn.Invoke(ctx, "/helloworld.Other/Call", &pb.HelloRequest{}, &pb.HelloResponse{})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the proxy's Unavailable for an unregistered method, got %v", err)
+	}
+}
+
+// unreachableUpstream is an upstream whose calls all fail with Unavailable
+type unreachableUpstream struct{}
+
+func (unreachableUpstream) Invoke(context.Context, string, interface{}, interface{}, ...grpc.CallOption) error {
+	return status.Error(codes.Unavailable, "upstream unreachable")
+}
+
+func (unreachableUpstream) NewStream(context.Context, *grpc.StreamDesc, string, ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, status.Error(codes.Unavailable, "upstream unreachable")
+}
+
+// TestProxyConnectJSON verifies that a Connect JSON call is forwarded with its JSON
+// payload under the json content-subtype
+func TestProxyConnectJSON(t *testing.T) {
+	contentTypes := make(chan string, 1)
+	upstream := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}), grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		contentTypes <- strings.Join(md.Get("content-type"), ",")
+		return handler(ctx, req)
+	}))
+	pb.RegisterGreeterServer(upstream, &testGreeter{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() { _ = upstream.Serve(l) }()
+	defer upstream.Stop()
+
+	cc, err := grpc.NewClient("passthrough:///"+l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create the upstream client: %v", err)
+	}
+	defer func() { _ = cc.Close() }()
+	server := NewServer(ServerOption{ProxyUpstream: cc})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	resp := postHTTPCall(t, httpServer, pb.Greeter_SayHello_FullMethodName, "application/json", []byte(`{"name":"json"}`), nil)
+	body, _ := io.ReadAll(resp.Body)
+	t.Logf("Proxied JSON response: %d %s", resp.StatusCode, body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"Hello json"`) {
+		t.Errorf("Unexpected response %d %s", resp.StatusCode, body)
+	}
+	select {
+	case contentType := <-contentTypes:
+		if contentType != "application/grpc+json" {
+			t.Errorf("Expected the upstream call as application/grpc+json, got %q", contentType)
+		}
+	default:
+		t.Error("The call did not reach the upstream server")
+	}
+}
@@ -0,0 +1,489 @@
+package wsgrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys of resumable streams (PROTOCOL.md Section 6.6). They are transport-level
+// and never reach handlers.
+const (
+	resumableKey   = "nggorpc-resumable"    // Client request: 1 to make the stream resumable
+	resumeTokenKey = "nggorpc-resume-token" // Server HEADERS: the token; client HEADERS: resume that stream
+	resumeSeqKey   = "nggorpc-resume-seq"   // Client HEADERS: the last sequence number received
+)
+
+// Defaults of resumable streams, used when ServerOption leaves them unset.
+const (
+	defaultResumeGracePeriod = 30 * time.Second
+	defaultResumeBufferSize  = 256
+)
+
+// resumeSeqSize is the length of the sequence number that precedes every message of a
+// resumable stream.
+const resumeSeqSize = 8
+
+// resumeEntry is a message kept for replay: marshalled, uncompressed, without sequence
+// number.
+type resumeEntry struct {
+	seq  uint64
+	data []byte
+}
+
+// resumableStream keeps a server-streaming handler running across reconnects of its
+// client. The handler sends through the stream it was started with; every message is
+// numbered and kept in a bounded replay buffer, and delivered to whichever stream is
+// attached: the original one, or the one that resumed it on a new connection. While no
+// stream is attached the handler keeps running for ResumeGracePeriod and its messages
+// are buffered; it blocks once the buffer is full of messages no client has seen.
+type resumableStream struct {
+	server  *Server
+	token   string
+	handler *WebSocketServerStream // The stream the handler was started with
+	cancel  context.CancelFunc     // Cancels the handler and the attached stream
+	// session is the Session the stream was opened in, if any: only that session can
+	// resume it, and it ends with the session
+	session     *Session
+	stopSession func() bool
+
+	// sendMu serializes deliveries with replays, so that a resumed client receives
+	// every message exactly once and in order
+	sendMu sync.Mutex
+
+	mu           sync.Mutex
+	buffer       []resumeEntry // Oldest first, at most ResumeBufferSize
+	nextSeq      uint64
+	sent         uint64                 // Highest sequence number handed to an attached stream
+	changed      chan struct{}          // Closed and replaced when sent advances
+	attached     *WebSocketServerStream // Delivers messages to the client; nil while it is away
+	attachCtx    context.Context
+	attachCancel context.CancelFunc
+	timer        *time.Timer // Grace period while detached, or retention once done
+	done         bool        // The handler returned with the status below
+	statusCode   int
+	statusMsg    string
+	details      []byte
+}
+
+// newResumableStream makes stream resumable. The handler context must not end with
+// the connection; handlerCancel cancels it. attachCtx and attachCancel scope the
+// delivery of messages over the stream's own connection.
+func (s *Server) newResumableStream(stream *WebSocketServerStream, handlerCancel context.CancelFunc, attachCtx context.Context, attachCancel context.CancelFunc) (*resumableStream, error) {
+	token, err := randomHex(16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate resume token: %w", err)
+	}
+	r := &resumableStream{
+		server:       s,
+		token:        token,
+		handler:      stream,
+		nextSeq:      1,
+		changed:      make(chan struct{}),
+		attached:     stream,
+		attachCtx:    attachCtx,
+		attachCancel: attachCancel,
+	}
+	r.cancel = func() {
+		handlerCancel()
+		r.mu.Lock()
+		if r.attachCancel != nil {
+			r.attachCancel()
+		}
+		r.mu.Unlock()
+	}
+	stream.resume = r
+	stream.cancel = r.cancel
+	if stream.header == nil {
+		stream.header = metadata.MD{}
+	}
+	stream.header.Set(resumeTokenKey, r.token)
+	return r, nil
+}
+
+// register makes the stream resumable by its token until it expires.
+func (r *resumableStream) register() {
+	r.server.resumeMu.Lock()
+	if r.server.resumables == nil {
+		r.server.resumables = make(map[string]*resumableStream)
+	}
+	r.server.resumables[r.token] = r
+	r.server.resumeMu.Unlock()
+
+	if r.session = SessionFromContext(r.handler.ctx); r.session != nil {
+		r.stopSession = context.AfterFunc(r.session.ctx, r.cancel)
+	}
+
+	context.AfterFunc(r.attachCtx, func() { r.detach(r.handler) })
+}
+
+// lookupResumable returns the stream of a resume token, or nil.
+func (s *Server) lookupResumable(token string) *resumableStream {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+	return s.resumables[token]
+}
+
+// cancelResumables cancels the handlers of all resumable streams, including those
+// waiting for their clients to come back.
+func (s *Server) cancelResumables() {
+	s.resumeMu.Lock()
+	streams := make([]*resumableStream, 0, len(s.resumables))
+	for _, r := range s.resumables {
+		streams = append(streams, r)
+	}
+	s.resumeMu.Unlock()
+	for _, r := range streams {
+		r.cancel()
+	}
+}
+
+// send numbers a message of the handler, keeps it for replay and delivers it to the
+// attached stream. A message that cannot be delivered because the client went away is
+// not an error: it is replayed when the client resumes.
+func (r *resumableStream) send(m interface{}) error {
+	data, err := r.handler.getCodec().Marshal(m)
+	if err != nil {
+		if errors.Is(err, errNotProtoMessage) {
+			return err
+		}
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	if err := r.waitForRoom(); err != nil {
+		return err
+	}
+
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+
+	r.mu.Lock()
+	entry := resumeEntry{seq: r.nextSeq, data: data}
+	r.nextSeq++
+	if len(r.buffer) >= r.server.options.ResumeBufferSize {
+		r.buffer[0] = resumeEntry{}
+		r.buffer = r.buffer[1:]
+	}
+	r.buffer = append(r.buffer, entry)
+	attached, ctx := r.attached, r.attachCtx
+	r.mu.Unlock()
+
+	if attached == nil {
+		return nil
+	}
+	if err := r.deliver(attached, ctx, entry); err != nil {
+		if status.Code(err) == codes.ResourceExhausted && ctx.Err() == nil {
+			// Too large for this client; resuming would not help
+			return err
+		}
+		r.detach(attached)
+		return nil
+	}
+	r.markSent(attached, entry.seq)
+	return nil
+}
+
+// waitForRoom blocks while the replay buffer is full of messages that no client has
+// been sent, which only happens while the client is away.
+func (r *resumableStream) waitForRoom() error {
+	for {
+		r.mu.Lock()
+		if len(r.buffer) < r.server.options.ResumeBufferSize || r.buffer[0].seq <= r.sent {
+			r.mu.Unlock()
+			return nil
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-r.handler.ctx.Done():
+			return status.FromContextError(r.handler.ctx.Err()).Err()
+		}
+	}
+}
+
+// markSent records that the messages up to seq were handed to stream.
+func (r *resumableStream) markSent(stream *WebSocketServerStream, seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.attached == stream && seq > r.sent {
+		r.sent = seq
+		close(r.changed)
+		r.changed = make(chan struct{})
+	}
+}
+
+// deliver sends a message as DATA frames of stream, preceded by its sequence number and
+// compressed as negotiated on stream's connection.
+func (r *resumableStream) deliver(stream *WebSocketServerStream, ctx context.Context, entry resumeEntry) error {
+	stream.updateActivity()
+
+	buf := getFrameBuffer(frameHeaderSize + resumeSeqSize + len(entry.data))
+	*buf = binary.BigEndian.AppendUint64((*buf)[:frameHeaderSize], entry.seq)
+	*buf = append(*buf, entry.data...)
+
+	compressed, err := compressFrameBuffer(stream.sendCompressor, buf, r.server.options.CompressionThreshold)
+	if err != nil {
+		putFrameBuffer(buf)
+		return fmt.Errorf("failed to compress message: %w", err)
+	}
+	flags := uint8(FlagDATA)
+	if compressed {
+		flags |= FlagCOMPRESSED
+	}
+	if err := stream.sendHeaderIfPending(); err != nil {
+		putFrameBuffer(buf)
+		return err
+	}
+	size := len(*buf) - frameHeaderSize
+	if limit := stream.conn.peerMaxMessageSize(); limit != 0 && uint64(size) > uint64(limit) {
+		putFrameBuffer(buf)
+		return status.Errorf(codes.ResourceExhausted, "trying to send message larger than max (%d vs. %d)", size, limit)
+	}
+	return stream.sendMessage(ctx, buf, flags, maxQueuedFramesPerStream)
+}
+
+// detach records that stream can no longer deliver messages, because its connection
+// closed or its client went quiet. The handler keeps running for the grace period.
+func (r *resumableStream) detach(stream *WebSocketServerStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.attached == stream {
+		r.detachLocked()
+	}
+}
+
+// detachLocked detaches the attached stream and starts the grace period. r.mu must be
+// held.
+func (r *resumableStream) detachLocked() {
+	if r.server.options.EnableLogging {
+		log.Printf("[wsgrpc] Resumable stream %d detached, waiting %v for the client", r.attached.streamID, r.server.options.ResumeGracePeriod)
+	}
+	r.attached = nil
+	r.attachCancel()
+	r.attachCtx, r.attachCancel = nil, nil
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.server.options.ResumeGracePeriod, r.expire)
+	}
+}
+
+// expire ends a stream whose client did not resume it in time, or which finished and
+// was kept for a late resume.
+func (r *resumableStream) expire() {
+	r.mu.Lock()
+	if r.attached != nil && !r.done {
+		r.mu.Unlock()
+		return
+	}
+	r.timer = nil
+	r.mu.Unlock()
+
+	r.server.resumeMu.Lock()
+	if r.server.resumables[r.token] == r {
+		delete(r.server.resumables, r.token)
+	}
+	r.server.resumeMu.Unlock()
+	if r.stopSession != nil {
+		r.stopSession()
+	}
+	r.cancel()
+}
+
+// resume attaches stream, opened by the client on a new connection with the resume
+// token, in place of the previous one. Messages after lastSeq are replayed before new
+// ones; if the handler already returned, its status follows. An error ends the new
+// stream only: the call can still be resumed.
+func (r *resumableStream) resume(stream *WebSocketServerStream, streamCancel context.CancelFunc, lastSeq uint64) error {
+	// A client may resume before its old connection has noticed it is gone, but an
+	// attempt that fails leaves it attached
+	r.mu.Lock()
+	if err := r.checkResumeLocked(lastSeq); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	previous := r.attached
+	if previous != nil {
+		r.detachLocked()
+	}
+	r.mu.Unlock()
+	if previous != nil {
+		unregisterStream(previous)
+		_ = previous.conn.send(encodeRSTStream(previous.streamID, ErrCodeCancel))
+	}
+
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+
+	r.mu.Lock()
+	if err := r.checkResumeLocked(lastSeq); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	var replay []resumeEntry
+	for _, entry := range r.buffer {
+		if entry.seq > lastSeq {
+			replay = append(replay, entry)
+		}
+	}
+	r.mu.Unlock()
+
+	// The resumed stream announces the handler's headers again, with its own encoding
+	header := r.handler.headerCopy()
+	header.Delete("grpc-encoding")
+	stream.headerMu.Lock()
+	stream.header = metadata.Join(stream.header, header)
+	stream.headerMu.Unlock()
+	if err := stream.SendHeader(nil); err != nil {
+		return status.Errorf(codes.Unavailable, "failed to resume stream: %v", err)
+	}
+
+	// A reset of the resumed stream by the client cancels the call
+	stream.conn.mu.Lock()
+	stream.resume = r
+	stream.cancel = func() {
+		streamCancel()
+		r.cancel()
+	}
+	stream.conn.mu.Unlock()
+
+	for _, entry := range replay {
+		if err := r.deliver(stream, stream.ctx, entry); err != nil {
+			// The call stays resumable; only the new stream ends, with the error
+			stream.conn.mu.Lock()
+			stream.resume = nil
+			stream.cancel = streamCancel
+			stream.conn.mu.Unlock()
+			if _, ok := status.FromError(err); !ok {
+				err = status.Errorf(codes.Unavailable, "failed to replay messages: %v", err)
+			}
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.attached, r.attachCtx, r.attachCancel = stream, stream.ctx, streamCancel
+	if lastSeq > r.sent {
+		r.sent = lastSeq
+	}
+	if n := len(replay); n > 0 && replay[n-1].seq > r.sent {
+		r.sent = replay[n-1].seq
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+	if r.timer != nil && !r.done {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	done, code, msg, details := r.done, r.statusCode, r.statusMsg, r.details
+	r.mu.Unlock()
+
+	context.AfterFunc(stream.ctx, func() { r.detach(stream) })
+	if r.server.options.EnableLogging {
+		log.Printf("[wsgrpc] Stream %d resumed stream %d after sequence %d, replayed %d message(s)", stream.streamID, r.handler.streamID, lastSeq, len(replay))
+	}
+	if done {
+		stream.setTrailerCopy(r.handler)
+		r.server.sendTrailers(stream, code, msg, details)
+	}
+	return nil
+}
+
+// checkResumeLocked reports whether the messages after lastSeq can be replayed. r.mu
+// must be held.
+func (r *resumableStream) checkResumeLocked(lastSeq uint64) error {
+	if lastSeq >= r.nextSeq {
+		return status.Errorf(codes.OutOfRange, "resume sequence %d was never sent", lastSeq)
+	}
+	if len(r.buffer) > 0 && lastSeq+1 < r.buffer[0].seq {
+		return status.Errorf(codes.DataLoss, "messages after sequence %d are no longer buffered", lastSeq)
+	}
+	return nil
+}
+
+// unregisterStream closes a stream that no longer delivers messages of its resumable
+// stream, so that it does not keep its connection from draining.
+func unregisterStream(stream *WebSocketServerStream) {
+	c := stream.conn
+	c.mu.Lock()
+	stream.state = streamClosed
+	if c.streamMap[stream.streamID] == stream {
+		delete(c.streamMap, stream.streamID)
+	}
+	c.mu.Unlock()
+}
+
+// finish records the handler's status and sends it to the attached stream. The stream
+// stays resumable for the grace period, for a client that missed the end.
+func (r *resumableStream) finish(statusCode int, statusMsg string, details []byte) {
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+
+	r.mu.Lock()
+	r.done = true
+	r.statusCode, r.statusMsg, r.details = statusCode, statusMsg, details
+	attached := r.attached
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(r.server.options.ResumeGracePeriod, r.expire)
+	r.mu.Unlock()
+
+	if attached != r.handler {
+		unregisterStream(r.handler)
+	}
+	if attached == nil {
+		return
+	}
+	if attached != r.handler {
+		attached.setTrailerCopy(r.handler)
+	}
+	r.server.sendTrailers(attached, statusCode, statusMsg, details)
+}
+
+// headerCopy returns a copy of the stream's header metadata.
+func (s *WebSocketServerStream) headerCopy() metadata.MD {
+	s.headerMu.Lock()
+	defer s.headerMu.Unlock()
+	return s.header.Copy()
+}
+
+// setTrailerCopy sets the trailer metadata of from on s.
+func (s *WebSocketServerStream) setTrailerCopy(from *WebSocketServerStream) {
+	from.headerMu.Lock()
+	trailer := from.trailer.Copy()
+	from.headerMu.Unlock()
+	s.headerMu.Lock()
+	s.trailer = trailer
+	s.headerMu.Unlock()
+}
+
+// resumeStream serves a stream opened with a resume token: it takes over the
+// resumable stream of that token, or fails with its status.
+func (s *Server) resumeStream(stream *WebSocketServerStream, streamCancel context.CancelFunc, token, lastSeqValue string) {
+	r := s.lookupResumable(token)
+	if r == nil || r.handler.method != stream.method || r.session != SessionFromContext(stream.ctx) {
+		s.sendTrailers(stream, int(codes.NotFound), "unknown or expired resume token", nil)
+		return
+	}
+	var lastSeq uint64
+	if lastSeqValue != "" {
+		var err error
+		if lastSeq, err = strconv.ParseUint(lastSeqValue, 10, 64); err != nil {
+			s.sendTrailers(stream, int(codes.InvalidArgument), "malformed "+resumeSeqKey, nil)
+			return
+		}
+	}
+	if err := r.resume(stream, streamCancel, lastSeq); err != nil {
+		st := status.Convert(err)
+		s.sendTrailers(stream, int(st.Code()), st.Message(), nil)
+	}
+}
@@ -0,0 +1,317 @@
+package wsgrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// feedGreeter streams the ticks the test feeds it, until the feed is closed
+type feedGreeter struct {
+	pb.UnimplementedGreeterServer
+	feed chan int64
+	done chan error // The handler's result
+}
+
+func (g *feedGreeter) InfiniteTicker(_ *pb.Empty, stream grpc.ServerStreamingServer[pb.Tick]) error {
+	err := func() error {
+		for {
+			select {
+			case count, ok := <-g.feed:
+				if !ok {
+					return nil
+				}
+				if err := stream.Send(&pb.Tick{Count: count}); err != nil {
+					return err
+				}
+			case <-stream.Context().Done():
+				return stream.Context().Err()
+			}
+		}
+	}()
+	g.done <- err
+	return err
+}
+
+// newResumeTestServer starts a server hosting feedGreeter with InfiniteTicker resumable
+// and returns the WebSocket URL
+func newResumeTestServer(t *testing.T, opt ServerOption) (*feedGreeter, string) {
+	t.Helper()
+	opt.InsecureSkipVerify = true
+	opt.ResumableMethods = []string{pb.Greeter_InfiniteTicker_FullMethodName}
+	server := NewServer(opt)
+	greeter := &feedGreeter{feed: make(chan int64), done: make(chan error, 1)}
+	pb.RegisterGreeterServer(server, greeter)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	t.Cleanup(httpServer.Close)
+	t.Cleanup(server.Stop)
+	return greeter, "ws" + httpServer.URL[4:]
+}
+
+// dialRaw opens a raw WebSocket connection
+func dialRaw(t *testing.T, ctx context.Context, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") })
+	return conn
+}
+
+// openTicker starts InfiniteTicker on streamID with the given extra metadata. Without a
+// resume token the request message follows.
+func openTicker(t *testing.T, ctx context.Context, conn *websocket.Conn, streamID uint32, kv ...string) {
+	t.Helper()
+	md := metadata.Pairs(append([]string{"path", pb.Greeter_InfiniteTicker_FullMethodName}, kv...)...)
+	writeFrame(t, ctx, conn, encodeFrame(streamID, FlagHEADERS, mustEncodeMetadataBlock(t, md, false)))
+	if len(md.Get(resumeTokenKey)) == 0 {
+		request, _ := proto.Marshal(&pb.Empty{})
+		writeFrame(t, ctx, conn, encodeFrame(streamID, FlagDATA|FlagEOS, request))
+	}
+}
+
+// resumeRead is what readTicks saw on a stream
+type resumeRead struct {
+	token   string   // From the response HEADERS
+	seqs    []uint64 // Sequence numbers of the DATA frames
+	counts  []int64  // Ticks of the DATA frames
+	trailer metadata.MD
+}
+
+// readTicks reads the frames of streamID until n resumable ticks arrived, or until the
+// trailers when n is negative
+func readTicks(t *testing.T, ctx context.Context, conn *websocket.Conn, streamID uint32, n int) resumeRead {
+	t.Helper()
+	var read resumeRead
+	for n < 0 || len(read.seqs) < n {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read frame after %d ticks: %v", len(read.seqs), err)
+		}
+		frame, err := decodeFrame(data, 4*1024*1024)
+		if err != nil || frame.StreamID != streamID {
+			continue
+		}
+		switch {
+		case frame.Flags&FlagHEADERS != 0:
+			if tokens := parseHeaderBlock(frame.Payload).Get(resumeTokenKey); len(tokens) > 0 {
+				read.token = tokens[0]
+			}
+		case frame.Flags&FlagDATA != 0:
+			if len(frame.Payload) < resumeSeqSize {
+				t.Fatalf("DATA frame of %d bytes has no sequence number", len(frame.Payload))
+			}
+			tick := &pb.Tick{}
+			if err := proto.Unmarshal(frame.Payload[resumeSeqSize:], tick); err != nil {
+				t.Fatalf("Failed to unmarshal tick: %v", err)
+			}
+			read.seqs = append(read.seqs, binary.BigEndian.Uint64(frame.Payload))
+			read.counts = append(read.counts, tick.GetCount())
+		case frame.Flags&FlagTRAILERS != 0:
+			read.trailer = parseHeaderBlock(frame.Payload)
+			return read
+		case frame.Flags&FlagRST_STREAM != 0:
+			t.Fatalf("Stream %d was reset with code %d", streamID, decodeErrorCode(frame.Payload))
+		}
+	}
+	return read
+}
+
+// feedTicks hands the ticks from..to-1 to the handler
+func feedTicks(t *testing.T, ctx context.Context, greeter *feedGreeter, from, to int64) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		select {
+		case greeter.feed <- i:
+		case <-ctx.Done():
+			t.Fatalf("Handler did not take tick %d", i)
+		}
+	}
+}
+
+// TestResumableStream verifies that a client reconnecting with the resume token gets
+// every message it missed, in order and exactly once, and then the rest of the stream
+func TestResumableStream(t *testing.T) {
+	greeter, url := newResumeTestServer(t, ServerOption{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first := dialRaw(t, ctx, url)
+	openTicker(t, ctx, first, 1, resumableKey, "1")
+	feedTicks(t, ctx, greeter, 0, 3)
+	read := readTicks(t, ctx, first, 1, 3)
+	t.Logf("Token %s, sequence numbers %v", read.token, read.seqs)
+	if read.token == "" {
+		t.Fatal("Expected a resume token in the response headers")
+	}
+	if read.seqs[0] != 1 || read.seqs[2] != 3 {
+		t.Fatalf("Sequence numbers %v, want 1-3", read.seqs)
+	}
+
+	// Wi-Fi handoff: the connection drops, the handler keeps going
+	_ = first.CloseNow()
+	feedTicks(t, ctx, greeter, 3, 6)
+
+	second := dialRaw(t, ctx, url)
+	openTicker(t, ctx, second, 1, resumeTokenKey, read.token, resumeSeqKey, strconv.FormatUint(read.seqs[2], 10))
+	feedTicks(t, ctx, greeter, 6, 8)
+	close(greeter.feed)
+
+	resumed := readTicks(t, ctx, second, 1, -1)
+	t.Logf("Resumed with sequence numbers %v, ticks %v", resumed.seqs, resumed.counts)
+	if len(resumed.seqs) != 5 {
+		t.Fatalf("Received %d ticks after resuming, want 5", len(resumed.seqs))
+	}
+	for i, seq := range resumed.seqs {
+		if seq != uint64(4+i) || resumed.counts[i] != int64(3+i) {
+			t.Errorf("Tick %d has sequence %d and count %d, want %d and %d", i, seq, resumed.counts[i], 4+i, 3+i)
+		}
+	}
+	if st := resumed.trailer.Get("grpc-status"); len(st) == 0 || st[0] != "0" {
+		t.Errorf("Expected grpc-status 0, got %v", st)
+	}
+	if err := <-greeter.done; err != nil {
+		t.Errorf("Handler failed: %v", err)
+	}
+}
+
+// TestResumeErrors verifies the status of resume attempts that cannot be served
+func TestResumeErrors(t *testing.T) {
+	greeter, url := newResumeTestServer(t, ServerOption{ResumeBufferSize: 2})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn := dialRaw(t, ctx, url)
+	openTicker(t, ctx, conn, 1, resumableKey, "1")
+	feedTicks(t, ctx, greeter, 0, 4)
+	token := readTicks(t, ctx, conn, 1, 4).token
+
+	other := dialRaw(t, ctx, url)
+	for i, tc := range []struct {
+		name   string
+		kv     []string
+		status string
+	}{
+		{name: "unknown token", kv: []string{resumeTokenKey, "0123456789abcdef"}, status: strconv.Itoa(int(codes.NotFound))},
+		{name: "malformed sequence", kv: []string{resumeTokenKey, token, resumeSeqKey, "two"}, status: strconv.Itoa(int(codes.InvalidArgument))},
+		{name: "never sent", kv: []string{resumeTokenKey, token, resumeSeqKey, "9"}, status: strconv.Itoa(int(codes.OutOfRange))},
+		// Only the last two messages are kept
+		{name: "no longer buffered", kv: []string{resumeTokenKey, token, resumeSeqKey, "1"}, status: strconv.Itoa(int(codes.DataLoss))},
+	} {
+		streamID := uint32(2*i + 1)
+		t.Run(tc.name, func(t *testing.T) {
+			openTicker(t, ctx, other, streamID, tc.kv...)
+			read := readTicks(t, ctx, other, streamID, -1)
+			if st := read.trailer.Get("grpc-status"); len(st) == 0 || st[0] != tc.status {
+				t.Errorf("Expected grpc-status %s, got %v (%v)", tc.status, st, read.trailer.Get("grpc-message"))
+			}
+		})
+	}
+
+	// The failed attempts left the original stream attached
+	feedTicks(t, ctx, greeter, 4, 5)
+	if read := readTicks(t, ctx, conn, 1, 1); read.seqs[0] != 5 {
+		t.Errorf("Expected the original stream to continue with sequence 5, got %v", read.seqs)
+	}
+}
+
+// TestResumeGracePeriodExpires verifies that the handler is cancelled when its client
+// does not come back in time, and that the token is forgotten
+func TestResumeGracePeriodExpires(t *testing.T) {
+	greeter, url := newResumeTestServer(t, ServerOption{ResumeGracePeriod: 100 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn := dialRaw(t, ctx, url)
+	openTicker(t, ctx, conn, 1, resumableKey, "1")
+	feedTicks(t, ctx, greeter, 0, 1)
+	token := readTicks(t, ctx, conn, 1, 1).token
+	_ = conn.CloseNow()
+
+	select {
+	case err := <-greeter.done:
+		t.Logf("Handler ended with %v", err)
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Handler was not cancelled after the grace period")
+	}
+
+	other := dialRaw(t, ctx, url)
+	openTicker(t, ctx, other, 1, resumeTokenKey, token, resumeSeqKey, "1")
+	if st := readTicks(t, ctx, other, 1, -1).trailer.Get("grpc-status"); len(st) == 0 || st[0] != strconv.Itoa(int(codes.NotFound)) {
+		t.Errorf("Expected grpc-status %d for an expired token, got %v", codes.NotFound, st)
+	}
+}
+
+// TestResumableIsOptIn verifies that a client that does not ask for a resumable stream
+// gets plain messages and no token
+func TestResumableIsOptIn(t *testing.T) {
+	greeter, url := newResumeTestServer(t, ServerOption{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn := dialRaw(t, ctx, url)
+	openTicker(t, ctx, conn, 1)
+	feedTicks(t, ctx, greeter, 7, 8)
+	close(greeter.feed)
+
+	for _, frame := range readResponseFrames(t, ctx, conn, 1) {
+		switch {
+		case frame.Flags&FlagHEADERS != 0:
+			if tokens := parseHeaderBlock(frame.Payload).Get(resumeTokenKey); len(tokens) > 0 {
+				t.Errorf("Unexpected resume token %v", tokens)
+			}
+		case frame.Flags&FlagDATA != 0:
+			tick := &pb.Tick{}
+			if err := proto.Unmarshal(frame.Payload, tick); err != nil || tick.GetCount() != 7 {
+				t.Errorf("Expected a plain tick 7, got %v (err=%v)", tick, err)
+			}
+		}
+	}
+}
+
+// TestResumeReplayFailure verifies that a resume attempt whose replay fails ends the
+// new stream with the error instead of leaving it open, and keeps the call resumable
+func TestResumeReplayFailure(t *testing.T) {
+	greeter, url := newResumeTestServer(t, ServerOption{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first := dialRaw(t, ctx, url)
+	openTicker(t, ctx, first, 1, resumableKey, "1")
+	feedTicks(t, ctx, greeter, 0, 2)
+	token := readTicks(t, ctx, first, 1, 2).token
+	_ = first.CloseNow()
+
+	// The client of the second connection accepts no message as large as a tick
+	second := dialRaw(t, ctx, url)
+	writeFrame(t, ctx, second, encodeSettings(Settings{MaxMessageSize: 4}, false))
+	openTicker(t, ctx, second, 1, resumeTokenKey, token, resumeSeqKey, "1")
+	read := readTicks(t, ctx, second, 1, -1)
+	t.Logf("Failed resume: %v %v", read.trailer.Get("grpc-status"), read.trailer.Get("grpc-message"))
+	if st := read.trailer.Get("grpc-status"); len(st) == 0 || st[0] != strconv.Itoa(int(codes.ResourceExhausted)) {
+		t.Errorf("Expected grpc-status %d, got %v", codes.ResourceExhausted, st)
+	}
+
+	third := dialRaw(t, ctx, url)
+	openTicker(t, ctx, third, 1, resumeTokenKey, token, resumeSeqKey, "1")
+	if resumed := readTicks(t, ctx, third, 1, 1); resumed.seqs[0] != 2 {
+		t.Errorf("Expected the replay to continue with sequence 2, got %v", resumed.seqs)
+	}
+}
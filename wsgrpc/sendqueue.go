@@ -0,0 +1,336 @@
+package wsgrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Limits of a sendQueue. Senders block once their lane is full, which pushes back on
+// handlers (data) and on the read loop (control) like the former buffered channel did.
+// Stream lanes are bounded individually so that one stream cannot fill the queue and
+// lock the others out.
+const (
+	maxQueuedControlFrames   = 100
+	maxQueuedFramesPerStream = 16
+)
+
+// errSendQueueClosed is returned for frames sent after the connection stopped writing.
+var errSendQueueClosed = errors.New("connection send queue is closed")
+
+// sendQueue holds the frames waiting for a connection's writer loop.
+//
+// Control frames go out before anything else: every frame on stream 0 (PING, PONG,
+// SETTINGS, GOAWAY), WINDOW_UPDATE, and RST_STREAM or TRAILERS of a stream that has
+// nothing else queued. Keepalives, cancellations and completions are therefore not
+// stuck behind bulk DATA of other streams. All other frames wait in a lane per stream,
+// which keeps their order, and the writer takes one frame per stream in round-robin
+// order so that a large download cannot starve interactive RPCs on the same socket.
+//
+// Queued frames belong to the queue: the writer recycles them with putFrameBuffer once
+// they are written, so senders must not touch a frame after queueing it.
+type sendQueue struct {
+	mu      sync.Mutex
+	control []queuedFrame
+	streams map[uint32][]queuedFrame // Stream ID -> queued frames in send order
+	ready   []uint32                 // Streams with queued frames, in round-robin order
+	bytes   int                      // Total size of the queued frames
+	closed  bool
+
+	wake    chan struct{} // Capacity 1: a frame was queued or the queue was closed
+	space   chan struct{} // Closed and replaced when a blocked sender may retry
+	blocked bool          // A sender waits on space
+}
+
+// queuedFrame is a frame waiting in a sendQueue, with the time it was queued.
+type queuedFrame struct {
+	buf      *[]byte
+	queuedAt time.Time
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		streams: make(map[uint32][]queuedFrame),
+		wake:    make(chan struct{}, 1),
+		space:   make(chan struct{}),
+	}
+}
+
+// push queues an encoded frame, blocking while its lane is full. It fails once the
+// queue is closed or ctx is done.
+func (q *sendQueue) push(ctx context.Context, frame []byte) error {
+	return q.pushBuffer(ctx, &frame)
+}
+
+// pushBuffer is push for a frame in a pooled buffer. The queue owns buf even when
+// pushBuffer fails.
+func (q *sendQueue) pushBuffer(ctx context.Context, buf *[]byte) error {
+	return q.pushBufferLimit(ctx, buf, maxQueuedFramesPerStream)
+}
+
+// pushBufferLimit is pushBuffer with a stream lane considered full at laneLimit frames
+// instead of maxQueuedFramesPerStream. Conflated streams use it to keep at most one
+// message waiting in the queue.
+func (q *sendQueue) pushBufferLimit(ctx context.Context, buf *[]byte, laneLimit int) error {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			putFrameBuffer(buf)
+			return errSendQueueClosed
+		}
+		if q.enqueueLocked(buf, laneLimit) {
+			q.mu.Unlock()
+			select {
+			case q.wake <- struct{}{}:
+			default:
+			}
+			return nil
+		}
+		q.blocked = true
+		space := q.space
+		q.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-ctx.Done():
+			putFrameBuffer(buf)
+			return ctx.Err()
+		}
+	}
+}
+
+// tryPushBuffer is pushBufferLimit without blocking: it reports false, leaving buf to
+// the caller, when the lane is full or the queue is closed.
+func (q *sendQueue) tryPushBuffer(buf *[]byte, laneLimit int) bool {
+	q.mu.Lock()
+	ok := !q.closed && q.enqueueLocked(buf, laneLimit)
+	q.mu.Unlock()
+	if ok {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// enqueueLocked adds a frame to its lane, reporting false when the lane already holds
+// laneLimit frames.
+func (q *sendQueue) enqueueLocked(buf *[]byte, laneLimit int) bool {
+	frame := *buf
+	streamID, flags := uint32(0), uint8(0)
+	if len(frame) >= 5 {
+		flags = frame[0]
+		streamID = binary.BigEndian.Uint32(frame[1:5])
+	}
+
+	entry := queuedFrame{buf: buf, queuedAt: time.Now()}
+	if q.isControlLocked(streamID, flags) {
+		if len(q.control) >= maxQueuedControlFrames {
+			return false
+		}
+		q.control = append(q.control, entry)
+		q.bytes += len(frame)
+		return true
+	}
+
+	lane := q.streams[streamID]
+	if len(lane) >= laneLimit {
+		return false
+	}
+	if len(lane) == 0 {
+		q.ready = append(q.ready, streamID)
+	}
+	q.streams[streamID] = append(lane, entry)
+	q.bytes += len(frame)
+	return true
+}
+
+// isControlLocked reports whether a frame may bypass the stream lanes. RST_STREAM and
+// TRAILERS only do so when no frame of their stream is waiting, so that a peer never
+// sees a stream's DATA after its end.
+func (q *sendQueue) isControlLocked(streamID uint32, flags uint8) bool {
+	if streamID == 0 {
+		return true
+	}
+	if flags&FlagDATA != 0 {
+		return false
+	}
+	switch {
+	case flags&FlagWINDOW_UPDATE != 0:
+		return true
+	case flags&(FlagRST_STREAM|FlagTRAILERS) != 0:
+		return len(q.streams[streamID]) == 0
+	default:
+		return false
+	}
+}
+
+// next returns the next frame to write, blocking until there is one. It returns
+// errSendQueueClosed once the queue is closed and every queued frame was taken, or the
+// error of ctx.
+func (q *sendQueue) next(ctx context.Context) (*[]byte, error) {
+	for {
+		frame, closed := q.take(-1)
+		if frame != nil {
+			return frame, nil
+		}
+		if closed {
+			return nil, errSendQueueClosed
+		}
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// nextMessage returns the next WebSocket message to write. With a positive packLimit,
+// the frames queued behind the next one are packed into the same message (PROTOCOL.md
+// Section 2.3) in scheduling order, as long as the message stays within packLimit
+// bytes; otherwise the message is a single frame.
+func (q *sendQueue) nextMessage(ctx context.Context, packLimit int) (*[]byte, error) {
+	first, err := q.next(ctx)
+	if err != nil || packLimit <= 0 {
+		return first, err
+	}
+
+	var msg *[]byte
+	size := len(*first)
+	for {
+		frame, _ := q.take(packLimit - size)
+		if frame == nil {
+			break
+		}
+		if msg == nil {
+			msg = getFrameBuffer(packLimit)
+			*msg = append(*msg, *first...)
+			putFrameBuffer(first)
+		}
+		*msg = append(*msg, *frame...)
+		size = len(*msg)
+		putFrameBuffer(frame)
+	}
+	if msg == nil {
+		return first, nil
+	}
+	return msg, nil
+}
+
+// take removes the next frame if it is at most maxSize bytes long (any size when
+// maxSize is negative). It also reports whether the queue is closed.
+func (q *sendQueue) take(maxSize int) (*[]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	frame := q.takeLocked(maxSize)
+	if frame != nil && q.blocked {
+		q.blocked = false
+		close(q.space)
+		q.space = make(chan struct{})
+	}
+	return frame, q.closed
+}
+
+// takeLocked removes the next frame: the oldest control frame, otherwise the head of
+// the next stream lane in round-robin order. It leaves a frame above maxSize queued.
+func (q *sendQueue) takeLocked(maxSize int) *[]byte {
+	if len(q.control) > 0 {
+		frame := q.control[0].buf
+		if maxSize >= 0 && len(*frame) > maxSize {
+			return nil
+		}
+		q.control[0] = queuedFrame{}
+		q.control = q.control[1:]
+		q.bytes -= len(*frame)
+		return frame
+	}
+	if len(q.ready) == 0 {
+		return nil
+	}
+
+	streamID := q.ready[0]
+	lane := q.streams[streamID]
+	frame := lane[0].buf
+	if maxSize >= 0 && len(*frame) > maxSize {
+		return nil
+	}
+	q.bytes -= len(*frame)
+	q.ready = q.ready[1:]
+	lane[0] = queuedFrame{}
+	if len(lane) == 1 {
+		delete(q.streams, streamID)
+	} else {
+		q.streams[streamID] = lane[1:]
+		q.ready = append(q.ready, streamID)
+	}
+	return frame
+}
+
+// close stops accepting frames. Frames already queued are still returned by next.
+// It reports whether the queue was open.
+func (q *sendQueue) close() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.closed = true
+	close(q.space)
+	q.space = make(chan struct{})
+	q.blocked = false
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// isClosed reports whether close was called.
+func (q *sendQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// stats reports how much is queued on the connection and for streamID, and how long
+// the oldest of those frames have been waiting.
+func (q *sendQueue) stats(streamID uint32) QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	stats := QueueStats{QueuedBytes: q.bytes}
+	if len(q.control) > 0 {
+		stats.QueueDelay = now.Sub(q.control[0].queuedAt)
+	}
+	for _, id := range q.ready {
+		lane := q.streams[id]
+		if delay := now.Sub(lane[0].queuedAt); delay > stats.QueueDelay {
+			stats.QueueDelay = delay
+		}
+		if id == streamID {
+			stats.StreamQueueDelay = now.Sub(lane[0].queuedAt)
+			for _, f := range lane {
+				stats.StreamQueuedBytes += len(*f.buf)
+			}
+		}
+	}
+	return stats
+}
+
+// waitTaken returns a channel that is closed once the writer takes the next frame. It
+// returns false if the queue is closed.
+func (q *sendQueue) waitTaken() (<-chan struct{}, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, false
+	}
+	q.blocked = true
+	return q.space, true
+}
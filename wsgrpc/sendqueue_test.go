@@ -0,0 +1,216 @@
+package wsgrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// nextFrames takes n frames from the queue and decodes them
+func nextFrames(t *testing.T, q *sendQueue, n int) []*Frame {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	frames := make([]*Frame, 0, n)
+	for i := 0; i < n; i++ {
+		data, err := q.next(ctx)
+		if err != nil {
+			t.Fatalf("next failed after %d frames: %v", i, err)
+		}
+		frame, err := decodeFrame(*data, 1024)
+		if err != nil {
+			t.Fatalf("decodeFrame failed: %v", err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// TestSendQueueControlFramesFirst verifies that control frames overtake queued DATA,
+// while a stream's own end never overtakes its DATA
+func TestSendQueueControlFramesFirst(t *testing.T) {
+	q := newSendQueue()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_ = q.push(ctx, encodeFrame(1, FlagDATA, []byte{byte(i)}))
+	}
+	_ = q.push(ctx, encodeFrame(1, FlagTRAILERS, nil))
+	_ = q.push(ctx, encodeFrame(0, FlagPONG, nil))
+	_ = q.push(ctx, encodeRSTStream(3, ErrCodeCancel))
+	_ = q.push(ctx, encodeFrame(5, FlagTRAILERS, nil))
+	_ = q.push(ctx, encodeWindowUpdate(1, 100))
+
+	want := []struct {
+		streamID uint32
+		flags    uint8
+	}{
+		{0, FlagPONG},
+		{3, FlagRST_STREAM},
+		{5, FlagTRAILERS},
+		{1, FlagWINDOW_UPDATE},
+		{1, FlagDATA},
+		{1, FlagDATA},
+		{1, FlagDATA},
+		{1, FlagTRAILERS},
+	}
+	for i, frame := range nextFrames(t, q, len(want)) {
+		if frame.StreamID != want[i].streamID || frame.Flags != want[i].flags {
+			t.Errorf("Frame %d: got stream %d flags 0x%02x, want stream %d flags 0x%02x",
+				i, frame.StreamID, frame.Flags, want[i].streamID, want[i].flags)
+		}
+	}
+}
+
+// TestSendQueueRoundRobin verifies that streams take turns, one frame each
+func TestSendQueueRoundRobin(t *testing.T) {
+	q := newSendQueue()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		_ = q.push(ctx, encodeFrame(1, FlagDATA, []byte{byte(i)}))
+	}
+	_ = q.push(ctx, encodeFrame(3, FlagHEADERS, nil))
+	_ = q.push(ctx, encodeFrame(3, FlagDATA|FlagEOS, nil))
+
+	var order []uint32
+	for _, frame := range nextFrames(t, q, 7) {
+		order = append(order, frame.StreamID)
+	}
+	want := []uint32{1, 3, 1, 3, 1, 1, 1}
+	t.Logf("Write order: %v", order)
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("Write order %v, want %v", order, want)
+		}
+	}
+}
+
+// TestSendQueueBackpressure verifies that a full stream lane blocks only its own sender
+func TestSendQueueBackpressure(t *testing.T) {
+	q := newSendQueue()
+	ctx := context.Background()
+
+	for i := 0; i < maxQueuedFramesPerStream; i++ {
+		if err := q.push(ctx, encodeFrame(1, FlagDATA, nil)); err != nil {
+			t.Fatalf("push failed: %v", err)
+		}
+	}
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- q.push(ctx, encodeFrame(1, FlagDATA, nil)) }()
+
+	// Other streams and control frames are not affected by the full lane
+	if err := q.push(ctx, encodeFrame(3, FlagDATA, nil)); err != nil {
+		t.Fatalf("push on another stream failed: %v", err)
+	}
+	if err := q.push(ctx, encodeFrame(0, FlagPING, nil)); err != nil {
+		t.Fatalf("push of a control frame failed: %v", err)
+	}
+	select {
+	case err := <-blocked:
+		t.Fatalf("push on a full lane returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Taking frames makes room
+	nextFrames(t, q, 3)
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Errorf("Blocked push failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Blocked push did not resume")
+	}
+
+	// A blocked sender gives up with its context
+	shortCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	var err error
+	for err == nil {
+		err = q.push(shortCtx, encodeFrame(1, FlagDATA, nil))
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected DeadlineExceeded from a blocked push, got %v", err)
+	}
+}
+
+// TestSendQueueClose verifies that queued frames are flushed after close and that new
+// frames are refused
+func TestSendQueueClose(t *testing.T) {
+	q := newSendQueue()
+	ctx := context.Background()
+
+	_ = q.push(ctx, encodeFrame(1, FlagDATA, nil))
+	_ = q.push(ctx, encodeFrame(1, FlagTRAILERS, nil))
+	if !q.close() || q.close() {
+		t.Fatal("Expected only the first close to report an open queue")
+	}
+	if err := q.push(ctx, encodeFrame(1, FlagDATA, nil)); !errors.Is(err, errSendQueueClosed) {
+		t.Errorf("Expected errSendQueueClosed, got %v", err)
+	}
+
+	nextFrames(t, q, 2)
+	if _, err := q.next(ctx); !errors.Is(err, errSendQueueClosed) {
+		t.Errorf("Expected errSendQueueClosed once flushed, got %v", err)
+	}
+}
+
+// TestSendQueueLaneLimit verifies the lane limit of conflated streams and that
+// tryPushBuffer leaves a frame it cannot queue to the caller
+func TestSendQueueLaneLimit(t *testing.T) {
+	q := newSendQueue()
+
+	first := encodeFrameBuffer(1, FlagDATA, []byte("first"))
+	if !q.tryPushBuffer(first, 1) {
+		t.Fatal("Expected an empty lane to take a frame")
+	}
+	second := encodeFrameBuffer(1, FlagDATA, []byte("second"))
+	if q.tryPushBuffer(second, 1) {
+		t.Fatal("Expected a lane at its limit to refuse a frame")
+	}
+	if !q.tryPushBuffer(second, maxQueuedFramesPerStream) {
+		t.Fatal("Expected the default limit to take a second frame")
+	}
+	nextFrames(t, q, 2)
+
+	q.close()
+	third := encodeFrameBuffer(1, FlagDATA, []byte("third"))
+	if q.tryPushBuffer(third, 1) {
+		t.Error("Expected a closed queue to refuse a frame")
+	}
+	if string((*third)[frameHeaderSize:]) != "third" {
+		t.Error("Expected a refused frame to be left intact")
+	}
+}
+
+// TestSendQueueStats verifies the queued bytes and delays per connection and stream
+func TestSendQueueStats(t *testing.T) {
+	q := newSendQueue()
+	ctx := context.Background()
+
+	_ = q.push(ctx, encodeFrame(1, FlagDATA, make([]byte, 100)))
+	time.Sleep(20 * time.Millisecond)
+	_ = q.push(ctx, encodeFrame(1, FlagDATA, make([]byte, 50)))
+	_ = q.push(ctx, encodeFrame(3, FlagDATA, make([]byte, 10)))
+	_ = q.push(ctx, encodeFrame(0, FlagPING, nil))
+
+	stats := q.stats(3)
+	if want := 4*frameHeaderSize + 160; stats.QueuedBytes != want {
+		t.Errorf("QueuedBytes = %d, want %d", stats.QueuedBytes, want)
+	}
+	if stats.StreamQueuedBytes != frameHeaderSize+10 {
+		t.Errorf("StreamQueuedBytes = %d, want %d", stats.StreamQueuedBytes, frameHeaderSize+10)
+	}
+	if stats.QueueDelay < 20*time.Millisecond || stats.StreamQueueDelay >= stats.QueueDelay {
+		t.Errorf("Expected the oldest frame of stream 1 to set the connection's delay, got %+v", stats)
+	}
+
+	nextFrames(t, q, 4)
+	if stats := q.stats(1); stats != (QueueStats{}) {
+		t.Errorf("Expected empty stats once everything was taken, got %+v", stats)
+	}
+}
@@ -0,0 +1,150 @@
+package wsgrpc
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultReadHeaderTimeout bounds the request headers of the default HTTP server, so
+// that idle clients cannot hold connections open before the WebSocket handshake.
+const defaultReadHeaderTimeout = 10 * time.Second
+
+// ServeHTTP implements http.Handler, so the Server can be mounted on any mux, e.g. at
+// /rpc next to other routes. Requests are WebSocket handshakes (HandleWebSocket),
+// gRPC-Web calls (HandleGRPCWeb), Connect calls (HandleConnect), or native gRPC calls
+// over HTTP/2 if EnableGRPC or GRPCServer is set. The content-type tells them apart.
+// gRPC-Web and Connect calls take their method from the last two segments of the path,
+// so the Server needs no http.StripPrefix under a prefix such as /rpc/.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if s.grpcServer != nil && isGRPCRequest(r) {
+		s.grpcServer.ServeHTTP(w, r)
+		return
+	}
+	if _, _, ok := parseGRPCWebContentType(contentType); ok {
+		s.HandleGRPCWeb(w, r)
+		return
+	}
+	if _, _, ok := parseConnectContentType(contentType); ok && r.Method == http.MethodPost {
+		s.HandleConnect(w, r)
+		return
+	}
+	s.HandleWebSocket(w, r)
+}
+
+// isRPCRequest reports whether ServeHTTP has a protocol for r other than answering it
+// as a failed WebSocket handshake.
+func (s *Server) isRPCRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if s.grpcServer != nil && isGRPCRequest(r) {
+		return true
+	}
+	if _, _, ok := parseGRPCWebContentType(contentType); ok {
+		return true
+	}
+	if _, _, ok := parseConnectContentType(contentType); ok && r.Method == http.MethodPost {
+		return true
+	}
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveDefault is the handler of an HTTP server without one: RPCs go to the Server and
+// other requests to the routes registered on http.DefaultServeMux, e.g. by
+// net/http/pprof or http.HandleFunc, as with http.ListenAndServe. Requests that match
+// no route get the Server's answer.
+func (s *Server) serveDefault(w http.ResponseWriter, r *http.Request) {
+	if !s.isRPCRequest(r) {
+		if handler, pattern := http.DefaultServeMux.Handler(r); pattern != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	s.ServeHTTP(w, r)
+}
+
+// Serve accepts connections on l with the HTTP server of ServerOption.HTTPServer, or a
+// default one. Unless that server has a Handler, requests other than RPCs are served by
+// http.DefaultServeMux. It returns http.ErrServerClosed after Shutdown or Stop, and can be
+// called for several listeners.
+func (s *Server) Serve(l net.Listener) error {
+	httpServer, err := s.startHTTPServer()
+	if err != nil {
+		_ = l.Close()
+		return err
+	}
+	if s.options.EnableLogging {
+		log.Printf("[wsgrpc] Server listening on %s", l.Addr())
+	}
+	return httpServer.Serve(l)
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve. An empty addr uses
+// the Addr of ServerOption.HTTPServer, otherwise ":http".
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := s.listen(addr, ":http")
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS is ListenAndServe for wss:// clients. certFile and keyFile may be
+// empty if the TLSConfig of ServerOption.HTTPServer provides the certificates. An
+// empty addr defaults to ":https".
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	l, err := s.listen(addr, ":https")
+	if err != nil {
+		return err
+	}
+	httpServer, err := s.startHTTPServer()
+	if err != nil {
+		_ = l.Close()
+		return err
+	}
+	if s.options.EnableLogging {
+		log.Printf("[wsgrpc] Server listening on %s (TLS)", l.Addr())
+	}
+	return httpServer.ServeTLS(l, certFile, keyFile)
+}
+
+// listen opens a TCP listener on addr, the configured address, or defaultAddr.
+func (s *Server) listen(addr, defaultAddr string) (net.Listener, error) {
+	if addr == "" && s.options.HTTPServer != nil {
+		addr = s.options.HTTPServer.Addr
+	}
+	if addr == "" {
+		addr = defaultAddr
+	}
+	return net.Listen("tcp", addr)
+}
+
+// startHTTPServer returns the HTTP server to serve listeners with, creating it on first
+// use. It fails once the server is shutting down.
+func (s *Server) startHTTPServer() (*http.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return nil, http.ErrServerClosed
+	}
+	if s.httpServer == nil {
+		httpServer := s.options.HTTPServer
+		if httpServer == nil {
+			httpServer = &http.Server{ReadHeaderTimeout: defaultReadHeaderTimeout}
+			if s.grpcServer != nil {
+				// gRPC clients without TLS speak HTTP/2 with prior knowledge
+				httpServer.Protocols = new(http.Protocols)
+				httpServer.Protocols.SetHTTP1(true)
+				httpServer.Protocols.SetHTTP2(true)
+				httpServer.Protocols.SetUnencryptedHTTP2(true)
+			}
+		}
+		if httpServer.Handler == nil {
+			httpServer.Handler = http.HandlerFunc(s.serveDefault)
+		}
+		s.httpServer = httpServer
+	}
+	return s.httpServer, nil
+}
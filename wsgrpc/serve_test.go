@@ -0,0 +1,182 @@
+package wsgrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// TestServeHTTPMounted verifies that the Server works as an http.Handler under a path
+// of a mux that serves other routes too
+func TestServeHTTPMounted(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", server)
+	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "static")
+	})
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, "ws"+httpServer.URL[4:]+"/rpc")
+	if err != nil {
+		t.Fatalf("Failed to dial /rpc: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "mux"}); err != nil {
+		t.Errorf("SayHello failed: %v", err)
+	}
+
+	resp, err := http.Get(httpServer.URL + "/index.html")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "static" {
+		t.Errorf("Expected the static route, got %q", body)
+	}
+}
+
+// TestServeAndShutdown verifies that Shutdown also closes the listener of Serve
+func TestServeAndShutdown(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	url := "ws://" + l.Addr().String()
+	conn, err := Dial(ctx, url)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if _, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "serve"}); err != nil {
+		t.Errorf("SayHello failed: %v", err)
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Expected http.ErrServerClosed from Serve, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Serve did not return after Shutdown")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("Expected the listener to be closed")
+	}
+	if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected Serve after Shutdown to fail with http.ErrServerClosed, got %v", err)
+	}
+}
+
+// TestServeDefaultServeMux verifies that the default HTTP server of Serve sends RPCs to
+// the Server and other requests to the routes of http.DefaultServeMux
+func TestServeDefaultServeMux(t *testing.T) {
+	http.HandleFunc("/serve-test/health", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	})
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	defer server.Stop()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() { _ = server.Serve(l) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/serve-test/health")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+		t.Errorf("Expected the route of http.DefaultServeMux, got %d %q", resp.StatusCode, body)
+	}
+
+	// A WebSocket handshake on the same path still reaches the Server
+	conn, err := Dial(ctx, "ws://"+l.Addr().String()+"/serve-test/health")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "mux"}); err != nil {
+		t.Errorf("SayHello failed: %v", err)
+	}
+}
+
+// TestListenAndServeTLS verifies wss:// with a configured http.Server whose TLSConfig
+// provides the certificate
+func TestListenAndServeTLS(t *testing.T) {
+	// Borrow the test certificate of httptest and a client that trusts it
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	certificates, client := certServer.TLS.Certificates, certServer.Client()
+	certServer.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	server := NewServer(ServerOption{
+		InsecureSkipVerify: true,
+		HTTPServer: &http.Server{
+			Addr:              addr,
+			ReadHeaderTimeout: time.Second,
+			TLSConfig:         &tls.Config{Certificates: certificates},
+		},
+	})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServeTLS("", "", "") }()
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var conn *ClientConn
+	for conn == nil {
+		if conn, err = Dial(ctx, "wss://"+addr, ClientOption{HTTPClient: client}); err != nil {
+			select {
+			case err := <-served:
+				t.Fatalf("ListenAndServeTLS failed: %v", err)
+			case <-ctx.Done():
+				t.Fatalf("Failed to dial: %v", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "tls"}); err != nil {
+		t.Errorf("SayHello over TLS failed: %v", err)
+	}
+}
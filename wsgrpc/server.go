@@ -3,18 +3,22 @@ package wsgrpc
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
@@ -31,11 +35,16 @@ const genericCloseReason = "internal error"
 // where the raw error string would otherwise leak internal detail to the client).
 const genericInternalMessage = "internal error"
 
+// statusDetailsKey is the trailer carrying the serialized google.rpc.Status of an error
+// with details, as in gRPC over HTTP/2.
+const statusDetailsKey = "grpc-status-details-bin"
+
 // methodInfo stores the handler and service implementation for a method
 type methodInfo struct {
 	unaryHandler  *grpc.MethodDesc
 	streamHandler *grpc.StreamDesc
 	srv           interface{}
+	raw           bool // Messages are passed to the handler as raw payloads (rawCodec)
 }
 
 // ServerOption configures server behavior
@@ -47,6 +56,9 @@ type ServerOption struct {
 	AllowedOrigins []string
 	// MaxPayloadSize sets the maximum frame payload size (default 4MB)
 	MaxPayloadSize uint32
+	// MaxMessageSize sets the maximum size of a received message, which v3 clients may
+	// fragment across several frames (default 4MB or MaxPayloadSize, whichever is larger)
+	MaxMessageSize uint32
 	// MaxConcurrentStreams sets the maximum number of concurrent streams per connection (default 100)
 	MaxConcurrentStreams uint32
 	// IdleTimeout sets the duration after which idle streams are closed (default 5 minutes)
@@ -59,6 +71,98 @@ type ServerOption struct {
 	// KeepAliveTimeout defines how long the server waits for a PONG after sending a PING
 	// before closing the connection (default 10s). Ignored if KeepAliveInterval is 0.
 	KeepAliveTimeout time.Duration
+	// InitialWindowSize sets the per-stream receive window advertised to clients that opt
+	// into flow control (default 64KB)
+	InitialWindowSize uint32
+	// InitialConnWindowSize sets the connection-level receive window advertised to clients
+	// that opt into flow control (default 1MB)
+	InitialConnWindowSize uint32
+	// Compressor names the registered grpc/encoding compressor (e.g. "gzip") used for
+	// response messages when the client lists it in grpc-accept-encoding (default: none).
+	// Clients that compress their requests always get responses in the same encoding.
+	Compressor string
+	// CompressionThreshold is the message size in bytes below which responses are sent
+	// uncompressed (default 1KB)
+	CompressionThreshold int
+	// ConflatedMethods lists full method names (e.g. "/quotes.Quotes/Watch") whose
+	// server streams only deliver the latest value to slow clients: while a message is
+	// still waiting to be sent, a newer one replaces it instead of blocking the handler.
+	// Handlers can opt in per stream with EnableConflation.
+	ConflatedMethods []string
+	// ResumableMethods lists full method names of server-streaming methods whose streams
+	// clients may resume after reconnecting (PROTOCOL.md Section 6.6). Their handlers
+	// outlive the connection for ResumeGracePeriod, and messages are numbered and kept
+	// for replay.
+	ResumableMethods []string
+	// ResumeGracePeriod is how long the handler of a resumable stream keeps running
+	// while its client is away, and how long a finished stream can still be resumed
+	// (default 30s)
+	ResumeGracePeriod time.Duration
+	// ResumeBufferSize is the number of messages a resumable stream keeps for replay.
+	// While the client is away, the handler blocks once this many messages wait for it
+	// (default 256).
+	ResumeBufferSize int
+	// HTTPServer is the HTTP server that Serve, ListenAndServe and ListenAndServeTLS
+	// run, for timeouts, TLS or logging configuration. If its Handler is nil, the Server
+	// handles RPCs and http.DefaultServeMux other requests; set it to a mux to serve
+	// other routes without the global mux. Default: an http.Server
+	// with a ReadHeaderTimeout of 10s, which also accepts HTTP/2 without TLS for native
+	// gRPC clients if EnableGRPC or GRPCServer is set.
+	HTTPServer *http.Server
+	// EnableSessions issues every connection a session (PROTOCOL.md Section 5.6) that a
+	// client reconnecting within SessionResumeWindow can resume, keeping its principal,
+	// values and resumable streams. Handlers get it with SessionFromContext.
+	EnableSessions bool
+	// SessionStore keeps the records of the sessions; servers sharing a store let clients
+	// resume on any of them (default: a MemorySessionStore)
+	SessionStore SessionStore
+	// SessionResumeWindow is how long a session survives without a connection
+	// (default 30s)
+	SessionResumeWindow time.Duration
+	// MaxQueuedBytes is the size of the frames waiting to be written on a connection
+	// above which its client counts as a slow consumer (default: no limit)
+	MaxQueuedBytes int
+	// MaxStreamQueuedBytes is the size of the frames of a single stream waiting to be
+	// written above which its client counts as a slow consumer (default: no limit)
+	MaxStreamQueuedBytes int
+	// MaxQueueDelay is how long the oldest frame of a connection may wait to be written
+	// before its client counts as a slow consumer (default: no limit)
+	MaxQueueDelay time.Duration
+	// SendTimeout bounds how long SendMsg waits for a client, for flow control credit or
+	// room in the send queue; a client that takes longer is a slow consumer
+	// (default: no limit)
+	SendTimeout time.Duration
+	// OverflowPolicy is applied by SendMsg to slow consumers (default: OverflowBlock)
+	OverflowPolicy OverflowPolicy
+	// OverflowCloseCode is the WebSocket close code of OverflowCloseConnection
+	// (default: 1008 policy violation)
+	OverflowCloseCode websocket.StatusCode
+	// OnSlowConsumer is called from SendMsg when a stream's client becomes a slow
+	// consumer, before the policy is applied. It must not block.
+	OnSlowConsumer func(ctx context.Context, event SlowConsumerEvent)
+	// FramePacking writes frames that are queued at the same time as one WebSocket
+	// message to v3 clients that announce support for it in their SETTINGS. It saves
+	// per-message overhead for streams sending many small messages (default: false).
+	FramePacking bool
+	// UnknownServiceHandler is called for methods that are not registered, as with
+	// grpc.UnknownServiceHandler, e.g. for generic routers, mocks and gateways. Their
+	// streams carry raw payloads: RecvMsg takes a *[]byte and SendMsg a []byte, and
+	// grpc.MethodFromServerStream returns the method. Stream interceptors run for them.
+	// Default: such calls fail with UNIMPLEMENTED.
+	UnknownServiceHandler grpc.StreamHandler
+	// ProxyUpstream forwards the calls of methods that are not registered to an existing
+	// gRPC server, typically through a grpc.ClientConn. It is a shorthand for an
+	// UnknownServiceHandler from NewProxyHandler, and ignored if that is set.
+	ProxyUpstream grpc.ClientConnInterface
+	// EnableGRPC mirrors every RegisterService call onto an internal grpc.Server, so
+	// that backends can call the same services over native gRPC (HTTP/2), with the same
+	// interceptors and shutdown. Serve it with ServeGRPC, or next to WebSocket clients
+	// with Serve or ListenAndServeTLS.
+	EnableGRPC bool
+	// GRPCServer is a grpc.Server to mirror registered services onto in place of the
+	// internal one, e.g. for its own credentials or limits; implies EnableGRPC. Its
+	// interceptors run before the Server's, and Shutdown and Stop stop it as well.
+	GRPCServer *grpc.Server
 	// UnaryInterceptors are called for unary RPCs
 	UnaryInterceptors []grpc.UnaryServerInterceptor
 	// StreamInterceptors are called for streaming RPCs
@@ -74,27 +178,57 @@ type Server struct {
 	options     ServerOption
 	connections map[*wsConnection]struct{} // Track active connections for graceful shutdown
 	shutdown    bool                       // Flag to indicate server is shutting down
+	httpServer  *http.Server               // Started by Serve, ListenAndServe or ListenAndServeTLS
+	unknown     *methodInfo                // Handles unregistered methods, if configured
+	grpcServer  *grpc.Server               // Registered services are mirrored to it, if enabled
+	conflated   atomic.Uint64              // Messages replaced on conflated streams
+	// Resumable streams by resume token, until they expire (guarded by resumeMu)
+	resumeMu   sync.Mutex
+	resumables map[string]*resumableStream
+	// Live sessions by ID, while the server keeps them (guarded by sessionsMu)
+	sessionsMu sync.Mutex
+	sessions   map[string]*Session
 
 	// testConnErrHook, when non-nil, forces handleConnection to return the given error
 	// immediately after connection setup. Used only by tests to exercise the
 	// connection-error close path deterministically. Never set in production.
 	testConnErrHook func() error
+	// testAdvertisementDelay, when non-zero, delays the answer to the client's window
+	// advertisement, as a slow server would. Used only by tests.
+	testAdvertisementDelay time.Duration
 }
 
 // wsConnection manages a single WebSocket connection and its streams
 type wsConnection struct {
-	conn       *websocket.Conn
-	ctx        context.Context
-	cancel     context.CancelFunc
-	sendChan   chan []byte
-	sendClosed bool // Flag to track if sendChan is closed
-	sendMu     sync.Mutex
-	mu         sync.Mutex
-	streamMap  map[uint32]*WebSocketServerStream
-	server     *Server // Reference to server for accessing options
+	conn      *websocket.Conn
+	version   ProtocolVersion // Negotiated with the WebSocket subprotocol
+	ctx       context.Context
+	cancel    context.CancelFunc
+	sendQueue *sendQueue // Frames waiting for the writer loop, control frames first
+	sendMu    sync.Mutex
+	mu        sync.Mutex
+	streamMap map[uint32]*WebSocketServerStream
+	server    *Server // Reference to server for accessing options
 	// Keep-alive tracking
 	lastPong   time.Time
 	lastPongMu sync.Mutex
+	// Per-stream and per-connection flow control (active once the client opts in)
+	flow *connFlowControl
+	// Graceful shutdown: once GOAWAY is sent, streams above lastStreamID are refused
+	lastStreamID uint32 // Highest stream ID accepted (guarded by mu)
+	goAwaySent   bool   // Guarded by mu
+	// maxClientStreamID is the highest stream ID the client has opened, including
+	// rejected streams; lower IDs are closed (guarded by mu)
+	maxClientStreamID uint32
+	// peerSettings are the limits announced by the client's SETTINGS (guarded by mu)
+	peerSettings Settings
+	// session is the client's Session, if the server issues them (guarded by mu)
+	session *Session
+	// Server-initiated close (guarded by sendMu): the writer loop closes the WebSocket
+	// with closeCode once every queued frame has been written
+	closing     bool
+	closeCode   websocket.StatusCode
+	closeReason string
 }
 
 // WebSocketServerStream implements grpc.ServerStream for WebSocket transport
@@ -103,16 +237,44 @@ type WebSocketServerStream struct {
 	cancel         context.CancelFunc // Stream-specific cancel function for RST_STREAM handling
 	conn           *wsConnection
 	streamID       uint32
-	recvChan       chan []byte
+	recvChan       chan recvMessage
 	recvChanClosed bool       // Flag to track if recvChan is closed
 	recvChanMu     sync.Mutex // Mutex to protect recvChan closing
 	method         string
+	codec          encoding.Codec // Selected from the content-type header; nil means proto
+	// Compressors for COMPRESSED DATA frames; nil means identity
+	recvCompressor encoding.Compressor
+	sendCompressor encoding.Compressor
+	binaryMetadata bool // Client sent binary metadata blocks; responses use the same format
 	headerMu       sync.Mutex
 	header         metadata.MD
 	headerSent     bool
 	trailer        metadata.MD
 	lastActivity   time.Time // Last time this stream had activity (for idle timeout)
 	activityMu     sync.Mutex
+	// Flow control windows; nil unless flow control was active when the stream opened
+	sendWindow   *flowWindow
+	recvFlow     *recvFlow
+	recvOverflow []recvMessage // Payloads queued while recvChan is full (guarded by recvChanMu)
+	recvEOS      bool          // EOS received while recvOverflow was non-empty (guarded by recvChanMu)
+	// finishMu serializes DATA frames against the final TRAILERS frame, so nothing is
+	// sent for a stream once it has been finished (e.g. by an expired deadline)
+	finishMu sync.Mutex
+	finished bool
+	state    streamState // Open or half-closed (remote) while registered, closed once finishing (guarded by conn.mu)
+	// reassembly collects the fragments of the client's current message (read loop only)
+	reassembly reassembler
+	// Latest-value conflation: enabled by ConflatedMethods or EnableConflation, with the
+	// flusher started by the first SendMsg (guarded by conflateMu)
+	conflateMu sync.Mutex
+	conflate   bool
+	conflater  *conflater
+	// slowConsumer is set while the client is known to be behind, so that
+	// OnSlowConsumer is called once per episode (SendMsg only)
+	slowConsumer bool
+	// resume is set on the stream of a resumable handler, whose messages go through
+	// it, and on a stream that resumed it (guarded by conn.mu once registered)
+	resume *resumableStream
 }
 
 // updateActivity updates the last activity timestamp for idle timeout tracking
@@ -133,6 +295,81 @@ func (s *WebSocketServerStream) safeCloseRecvChan() {
 	}
 }
 
+// enqueueRecv hands a DATA payload to RecvMsg without blocking the read loop. It is
+// used for flow-controlled streams, where the receive window (not recvChan's capacity)
+// bounds what the client may have outstanding.
+func (s *WebSocketServerStream) enqueueRecv(msg recvMessage) {
+	s.recvChanMu.Lock()
+	defer s.recvChanMu.Unlock()
+
+	if s.recvChanClosed {
+		return
+	}
+
+	if len(s.recvOverflow) == 0 {
+		select {
+		case s.recvChan <- msg:
+			return
+		default:
+		}
+	}
+	s.recvOverflow = append(s.recvOverflow, msg)
+}
+
+// endRecv marks the end of the client's messages. The receive channel is closed once
+// any queued payloads have been handed to RecvMsg.
+func (s *WebSocketServerStream) endRecv() {
+	s.recvChanMu.Lock()
+	defer s.recvChanMu.Unlock()
+
+	if len(s.recvOverflow) > 0 {
+		s.recvEOS = true
+		return
+	}
+	if !s.recvChanClosed {
+		s.recvChanClosed = true
+		close(s.recvChan)
+	}
+}
+
+// releaseRecv is called after RecvMsg consumed a payload of n bytes. It moves queued
+// payloads into the freed slot and returns the consumed bytes to the client's window.
+func (s *WebSocketServerStream) releaseRecv(n int) {
+	s.recvChanMu.Lock()
+refill:
+	for len(s.recvOverflow) > 0 && !s.recvChanClosed {
+		select {
+		case s.recvChan <- s.recvOverflow[0]:
+			s.recvOverflow[0] = recvMessage{}
+			s.recvOverflow = s.recvOverflow[1:]
+		default:
+			break refill
+		}
+	}
+	if len(s.recvOverflow) == 0 && s.recvEOS && !s.recvChanClosed {
+		s.recvChanClosed = true
+		close(s.recvChan)
+	}
+	s.recvChanMu.Unlock()
+
+	if s.recvFlow == nil || s.ctx.Err() != nil {
+		return
+	}
+	if increment := s.recvFlow.onRelease(n); increment > 0 {
+		if err := s.conn.send(encodeWindowUpdate(s.streamID, increment)); err != nil && s.conn.server.options.EnableLogging {
+			log.Printf("[wsgrpc] Failed to send WINDOW_UPDATE for stream %d: %v", s.streamID, err)
+		}
+	}
+}
+
+// getCodec returns the stream's message codec, defaulting to protobuf
+func (s *WebSocketServerStream) getCodec() encoding.Codec {
+	if s.codec == nil {
+		return protoCodec{}
+	}
+	return s.codec
+}
+
 // SetHeader implements grpc.ServerStream
 // Sets the header metadata. Must be called before SendHeader or the first SendMsg.
 func (s *WebSocketServerStream) SetHeader(md metadata.MD) error {
@@ -175,17 +412,13 @@ func (s *WebSocketServerStream) SendHeader(md metadata.MD) error {
 	}
 
 	// Serialize headers to frame payload
-	var headerLines []string
-	for k, values := range s.header {
-		for _, v := range values {
-			headerLines = append(headerLines, fmt.Sprintf("%s: %s", k, v))
-		}
+	block, err := encodeMetadataBlock(s.header, s.binaryMetadata)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to encode headers: %v", err)
 	}
+	headersFrame := encodeFrame(s.streamID, FlagHEADERS, block)
 
-	headersPayload := []byte(strings.Join(headerLines, "\n"))
-	headersFrame := encodeFrame(s.streamID, FlagHEADERS, headersPayload)
-
-	err := s.conn.send(headersFrame)
+	err = s.conn.send(headersFrame)
 	if err != nil {
 		return fmt.Errorf("failed to send headers: %w", err)
 	}
@@ -197,6 +430,18 @@ func (s *WebSocketServerStream) SendHeader(md metadata.MD) error {
 	return nil
 }
 
+// sendHeaderIfPending sends the header metadata set with SetHeader (including the
+// preset grpc-encoding) unless it is empty or has already been sent
+func (s *WebSocketServerStream) sendHeaderIfPending() error {
+	s.headerMu.Lock()
+	pending := !s.headerSent && len(s.header) > 0
+	s.headerMu.Unlock()
+	if !pending {
+		return nil
+	}
+	return s.SendHeader(nil)
+}
+
 // SetTrailer implements grpc.ServerStream
 // Sets the trailer metadata. This will be sent with the final TRAILERS frame.
 func (s *WebSocketServerStream) SetTrailer(md metadata.MD) {
@@ -218,41 +463,190 @@ func (s *WebSocketServerStream) Context() context.Context {
 	return s.ctx
 }
 
+// serverTransportStream exposes a stream to grpc.SetHeader, grpc.SendHeader and
+// grpc.SetTrailer through the handler context. It is a separate type because
+// grpc.ServerTransportStream.SetTrailer returns an error, unlike grpc.ServerStream's.
+type serverTransportStream struct {
+	stream *WebSocketServerStream
+}
+
+// Method implements grpc.ServerTransportStream
+func (t *serverTransportStream) Method() string {
+	return t.stream.method
+}
+
+// SetHeader implements grpc.ServerTransportStream
+func (t *serverTransportStream) SetHeader(md metadata.MD) error {
+	return t.stream.SetHeader(md)
+}
+
+// SendHeader implements grpc.ServerTransportStream
+func (t *serverTransportStream) SendHeader(md metadata.MD) error {
+	return t.stream.SendHeader(md)
+}
+
+// SetTrailer implements grpc.ServerTransportStream
+func (t *serverTransportStream) SetTrailer(md metadata.MD) error {
+	t.stream.finishMu.Lock()
+	finished := t.stream.finished
+	t.stream.finishMu.Unlock()
+	if finished {
+		return fmt.Errorf("trailers already sent")
+	}
+	t.stream.SetTrailer(md)
+	return nil
+}
+
 // SendMsg implements grpc.ServerStream - sends a message to the client
 func (s *WebSocketServerStream) SendMsg(m interface{}) error {
 	// Update activity timestamp
 	s.updateActivity()
 
-	// Marshal the protobuf message
-	msg, ok := m.(proto.Message)
-	if !ok {
-		return fmt.Errorf("message does not implement proto.Message")
+	// Messages of resumable streams are numbered and kept for replay
+	if s.resume != nil {
+		return s.resume.send(m)
 	}
 
-	data, err := proto.Marshal(msg)
+	// Marshal the message with the stream's codec, straight into a pooled frame buffer
+	buf, err := marshalFrameBuffer(s.getCodec(), m)
 	if err != nil {
+		if errors.Is(err, errNotProtoMessage) {
+			return err
+		}
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	// Encode and send DATA frame
-	frame := encodeFrame(s.streamID, FlagDATA, data)
-
-	err = s.conn.send(frame)
+	// Compress messages above the threshold with the negotiated compressor
+	compressed, err := compressFrameBuffer(s.sendCompressor, buf, s.conn.server.options.CompressionThreshold)
 	if err != nil {
-		return fmt.Errorf("failed to send frame: %w", err)
+		putFrameBuffer(buf)
+		return fmt.Errorf("failed to compress message: %w", err)
+	}
+	flags := uint8(FlagDATA)
+	if compressed {
+		flags |= FlagCOMPRESSED
+	}
+	data := (*buf)[frameHeaderSize:]
+
+	// Headers set with SetHeader precede the first DATA frame; this is also how the
+	// client learns the grpc-encoding of COMPRESSED frames
+	if err := s.sendHeaderIfPending(); err != nil {
+		putFrameBuffer(buf)
+		return err
+	}
+
+	if limit := s.conn.peerMaxMessageSize(); limit != 0 && uint64(len(data)) > uint64(limit) {
+		putFrameBuffer(buf)
+		return status.Errorf(codes.ResourceExhausted, "trying to send message larger than max (%d vs. %d)", len(data), limit)
+	}
+
+	// Conflated streams hand the message to their flusher, which replaces a message
+	// still waiting for the client with it instead of blocking the handler
+	if c := s.getConflater(); c != nil {
+		return c.offer(buf, flags)
+	}
+	return s.sendLimited(buf, flags)
+}
+
+// sendMessage sends a marshalled message from a buffer of marshalFrameBuffer as DATA
+// frames, waiting until ctx is done for flow control credit and for room in the
+// stream's lane of the send queue, which is full at laneLimit frames. It takes
+// ownership of buf.
+func (s *WebSocketServerStream) sendMessage(ctx context.Context, buf *[]byte, flags uint8, laneLimit int) error {
+	data := (*buf)[frameHeaderSize:]
+
+	// Messages above the client's frame limit are fragmented on v3 connections; frames
+	// of other streams may be sent between the fragments. A message that fits is sent
+	// in the buffer it was marshalled into.
+	fragments := splitMessage(data, s.conn.maxFragmentSize())
+	if len(fragments) > 1 {
+		defer putFrameBuffer(buf)
+	}
+	for i, fragment := range fragments {
+		fragmentFlags := flags
+		if i < len(fragments)-1 {
+			fragmentFlags |= FlagCONTINUED
+		}
+
+		// Encode the DATA frame
+		frame := buf
+		if len(fragments) > 1 {
+			frame = encodeFrameBuffer(s.streamID, fragmentFlags, fragment)
+		} else {
+			putFrameHeader(*frame, s.streamID, fragmentFlags)
+		}
+
+		// Block only this stream while the client's window is used up. Credit is
+		// needed to start a message, not for each fragment
+		if s.sendWindow != nil {
+			connWindow := s.conn.flow.connSendWindow()
+			if i == 0 {
+				if err := waitForWindows(ctx, s.sendWindow, connWindow); err != nil {
+					putFrameBuffer(frame)
+					return status.FromContextError(err).Err()
+				}
+			}
+			s.sendWindow.consume(int64(len(fragment)))
+			connWindow.consume(int64(len(fragment)))
+		}
+
+		s.finishMu.Lock()
+		if s.finished {
+			s.finishMu.Unlock()
+			putFrameBuffer(frame)
+			if err := s.ctx.Err(); err != nil {
+				return status.FromContextError(err).Err()
+			}
+			return status.Error(codes.Unavailable, "stream already finished")
+		}
+		err := s.conn.sendQueue.pushBufferLimit(ctx, frame, laneLimit)
+		s.finishMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to send frame: %w", err)
+		}
 	}
 
 	if s.conn.server.options.EnableLogging {
-		log.Printf("[wsgrpc] Sent DATA frame for stream %d, size: %d bytes", s.streamID, len(data))
+		log.Printf("[wsgrpc] Sent message for stream %d in %d DATA frame(s), size: %d bytes", s.streamID, len(fragments), len(data))
 	}
 	return nil
 }
 
+// trySendMessage is sendMessage for a message that fits in one frame when it can be
+// sent without waiting: it reports false, leaving buf to the caller, if the message
+// needs fragmenting, the client's window is used up or the stream's lane is full.
+func (s *WebSocketServerStream) trySendMessage(buf *[]byte, flags uint8, laneLimit int) bool {
+	size := len(*buf) - frameHeaderSize
+	if limit := s.conn.maxFragmentSize(); limit > 0 && size > limit {
+		return false
+	}
+	if s.sendWindow != nil {
+		if !s.sendWindow.tryConsume(int64(size)) {
+			return false
+		}
+		if !s.conn.flow.connSendWindow().tryConsume(int64(size)) {
+			s.sendWindow.add(int64(size))
+			return false
+		}
+	}
+
+	putFrameHeader(*buf, s.streamID, flags)
+	s.finishMu.Lock()
+	sent := !s.finished && s.conn.sendQueue.tryPushBuffer(buf, laneLimit)
+	s.finishMu.Unlock()
+	if !sent && s.sendWindow != nil {
+		// Return the credit taken for a frame that was not sent
+		s.sendWindow.add(int64(size))
+		s.conn.flow.connSendWindow().add(int64(size))
+	}
+	return sent
+}
+
 // RecvMsg implements grpc.ServerStream - receives a message from the client
 func (s *WebSocketServerStream) RecvMsg(m interface{}) error {
 	// Wait for data from the read loop or context cancellation
 	select {
-	case data, ok := <-s.recvChan:
+	case msg, ok := <-s.recvChan:
 		if !ok {
 			return io.EOF
 		}
@@ -260,13 +654,26 @@ func (s *WebSocketServerStream) RecvMsg(m interface{}) error {
 		// Update activity timestamp
 		s.updateActivity()
 
-		// Unmarshal into the provided message
-		msg, ok := m.(proto.Message)
-		if !ok {
-			return fmt.Errorf("message does not implement proto.Message")
+		// Return the consumed bytes to the client's flow control window
+		s.releaseRecv(len(msg.data))
+
+		data := msg.data
+		if msg.compressed {
+			if s.recvCompressor == nil {
+				return status.Error(codes.Internal, "compressed message received without grpc-encoding")
+			}
+			var err error
+			data, err = decompressMessage(s.recvCompressor, msg.data, int64(s.conn.server.options.MaxMessageSize))
+			if err != nil {
+				return status.Errorf(codes.ResourceExhausted, "failed to decompress message: %v", err)
+			}
 		}
 
-		if err := proto.Unmarshal(data, msg); err != nil {
+		// Unmarshal into the provided message with the stream's codec
+		if err := s.getCodec().Unmarshal(data, m); err != nil {
+			if errors.Is(err, errNotProtoMessage) {
+				return err
+			}
 			return fmt.Errorf("failed to unmarshal message: %w", err)
 		}
 
@@ -280,45 +687,48 @@ func (s *WebSocketServerStream) RecvMsg(m interface{}) error {
 	}
 }
 
-// send sends a frame to the connection using the actor pattern (channel-based writes)
+// send queues a frame for the writer loop (actor pattern), which owns it from then on.
+// Control frames overtake queued DATA; see sendQueue.
 func (c *wsConnection) send(frame []byte) error {
-	c.sendMu.Lock()
-	defer c.sendMu.Unlock()
-
-	if c.sendClosed {
-		return fmt.Errorf("connection send channel is closed")
-	}
+	return c.sendQueue.push(c.ctx, frame)
+}
 
-	select {
-	case c.sendChan <- frame:
-		return nil
-	case <-c.ctx.Done():
-		return c.ctx.Err()
-	}
+// sendBuffer is send for a frame in a pooled buffer, which the connection owns from
+// then on.
+func (c *wsConnection) sendBuffer(buf *[]byte) error {
+	return c.sendQueue.pushBuffer(c.ctx, buf)
 }
 
 // writerLoop is the actor goroutine that serializes all writes to the WebSocket
 func (c *wsConnection) writerLoop() {
 	for {
-		select {
-		case frame, ok := <-c.sendChan:
-			if !ok {
-				// Channel closed, cancel connection context to unblock read loop
-				if c.server.options.EnableLogging {
-					log.Printf("[wsgrpc] Send channel closed, cancelling connection")
-				}
-				c.cancel()
-				return
+		frame, err := c.sendQueue.nextMessage(c.ctx, c.packLimit())
+		if errors.Is(err, errSendQueueClosed) {
+			// Queue closed and flushed, cancel connection context to unblock read loop
+			if c.server.options.EnableLogging {
+				log.Printf("[wsgrpc] Send queue closed, cancelling connection")
 			}
-			// Write to WebSocket without mutex contention
-			if err := c.conn.Write(c.ctx, websocket.MessageBinary, frame); err != nil {
-				if c.server.options.EnableLogging {
-					log.Printf("[wsgrpc] Write error in writer loop: %v, cancelling connection", err)
-				}
-				c.cancel()
-				return
+			// A drained connection is closed only after its last frames went out
+			c.sendMu.Lock()
+			closing, code, reason := c.closing, c.closeCode, c.closeReason
+			c.sendMu.Unlock()
+			if closing && code != 0 {
+				_ = c.conn.Close(code, reason)
 			}
-		case <-c.ctx.Done():
+			c.cancel()
+			return
+		}
+		if err != nil {
+			return
+		}
+		// Write to WebSocket without mutex contention
+		err = c.conn.Write(c.ctx, websocket.MessageBinary, *frame)
+		putFrameBuffer(frame)
+		if err != nil {
+			if c.server.options.EnableLogging {
+				log.Printf("[wsgrpc] Write error in writer loop: %v, cancelling connection", err)
+			}
+			c.cancel()
 			return
 		}
 	}
@@ -375,31 +785,132 @@ func (c *wsConnection) checkIdleStreams() {
 
 // Close closes the connection and cleans up resources
 func (c *wsConnection) Close() {
+	c.sendQueue.close()
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// closeAfterFlush closes the connection once every frame already queued (e.g. the
+// trailers of the last drained stream) has been written.
+func (c *wsConnection) closeAfterFlush(code websocket.StatusCode, reason string) {
 	c.sendMu.Lock()
 	defer c.sendMu.Unlock()
 
-	if !c.sendClosed {
-		c.sendClosed = true
-		close(c.sendChan)
+	if c.sendQueue.isClosed() {
+		return
 	}
+	c.closing = true
+	c.closeCode = code
+	c.closeReason = reason
+	c.sendQueue.close()
+}
 
-	if c.cancel != nil {
-		c.cancel()
+// isClosing reports whether the server initiated closing this connection
+func (c *wsConnection) isClosing() bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.closing
+}
+
+// goAway sends GOAWAY with the highest accepted stream ID. Streams opened afterwards
+// are refused, while streams up to that ID run to completion. A graceful GOAWAY
+// (NO_ERROR) is sent at most once; one with an error code is always sent.
+func (c *wsConnection) goAway(errCode uint32) {
+	c.mu.Lock()
+	if c.goAwaySent && errCode == ErrCodeNoError {
+		c.mu.Unlock()
+		return
+	}
+	c.goAwaySent = true
+	lastStreamID := c.lastStreamID
+	c.mu.Unlock()
+
+	if c.server.options.EnableLogging {
+		log.Printf("[wsgrpc] Sending GOAWAY (last stream %d, error code %d)", lastStreamID, errCode)
+	}
+	if err := c.send(encodeGoAway(lastStreamID, errCode)); err != nil && c.server.options.EnableLogging {
+		log.Printf("[wsgrpc] Failed to send GOAWAY: %v", err)
 	}
 }
 
+// drain sends GOAWAY, waits for the in-flight streams to finish and then closes the
+// connection with StatusGoingAway. It gives up when ctx is done.
+func (c *wsConnection) drain(ctx context.Context) {
+	c.goAway(ErrCodeNoError)
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		c.mu.Lock()
+		remaining := len(c.streamMap)
+		c.mu.Unlock()
+
+		if remaining == 0 {
+			c.closeAfterFlush(websocket.StatusGoingAway, "server shutting down")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop closes the connection immediately, cancelling all of its streams
+func (c *wsConnection) stop() {
+	c.closeNow(websocket.StatusGoingAway, "server stopped")
+}
+
+// closeNow closes the connection with code without flushing queued frames, cancelling
+// all of its streams
+func (c *wsConnection) closeNow(code websocket.StatusCode, reason string) {
+	c.sendMu.Lock()
+	c.closing = true
+	c.sendMu.Unlock()
+
+	// The connection context ends only once the close frame is out: cancelling it
+	// during a write would drop the socket without a close code
+	c.sendQueue.close()
+	c.mu.Lock()
+	for _, stream := range c.streamMap {
+		// Resumable streams only lose their delivery, with the connection context
+		if stream.cancel != nil && stream.resume == nil {
+			stream.cancel()
+		}
+	}
+	c.mu.Unlock()
+	go func() {
+		_ = c.conn.Close(code, reason)
+		c.cancel()
+	}()
+}
+
 // NewServer creates a new wsgrpc server with optional configuration
 func NewServer(opts ...ServerOption) *Server {
 	// Default options
 	merged := ServerOption{
-		InsecureSkipVerify:   false,           // Secure by default
-		MaxPayloadSize:       4 * 1024 * 1024, // 4MB default
-		MaxConcurrentStreams: 100,             // 100 streams default
-		IdleTimeout:          5 * time.Minute, // 5 minute default idle timeout
-		IdleCheckInterval:    1 * time.Minute, // 1 minute default check interval
-		KeepAliveInterval:    30 * time.Second,
-		KeepAliveTimeout:     10 * time.Second,
-		EnableLogging:        false, // Logging disabled by default
+		InsecureSkipVerify:    false,           // Secure by default
+		MaxPayloadSize:        4 * 1024 * 1024, // 4MB default
+		MaxConcurrentStreams:  100,             // 100 streams default
+		IdleTimeout:           5 * time.Minute, // 5 minute default idle timeout
+		IdleCheckInterval:     1 * time.Minute, // 1 minute default check interval
+		KeepAliveInterval:     30 * time.Second,
+		KeepAliveTimeout:      10 * time.Second,
+		InitialWindowSize:     defaultInitialWindowSize,
+		InitialConnWindowSize: defaultInitialConnWindowSize,
+		CompressionThreshold:  defaultCompressionThreshold,
+		OverflowCloseCode:     websocket.StatusPolicyViolation,
+		ResumeGracePeriod:     defaultResumeGracePeriod,
+		ResumeBufferSize:      defaultResumeBufferSize,
+		SessionResumeWindow:   defaultSessionResumeWindow,
+		EnableLogging:         false, // Logging disabled by default
 	}
 
 	// Merge provided options
@@ -413,6 +924,9 @@ func NewServer(opts ...ServerOption) *Server {
 		if o.MaxPayloadSize != 0 {
 			merged.MaxPayloadSize = o.MaxPayloadSize
 		}
+		if o.MaxMessageSize != 0 {
+			merged.MaxMessageSize = o.MaxMessageSize
+		}
 		if o.MaxConcurrentStreams != 0 {
 			merged.MaxConcurrentStreams = o.MaxConcurrentStreams
 		}
@@ -428,6 +942,78 @@ func NewServer(opts ...ServerOption) *Server {
 		if o.KeepAliveTimeout != 0 {
 			merged.KeepAliveTimeout = o.KeepAliveTimeout
 		}
+		if o.InitialWindowSize != 0 {
+			merged.InitialWindowSize = o.InitialWindowSize
+		}
+		if o.InitialConnWindowSize != 0 {
+			merged.InitialConnWindowSize = o.InitialConnWindowSize
+		}
+		if o.Compressor != "" {
+			merged.Compressor = o.Compressor
+		}
+		if o.CompressionThreshold != 0 {
+			merged.CompressionThreshold = o.CompressionThreshold
+		}
+		if len(o.ResumableMethods) > 0 {
+			merged.ResumableMethods = append(merged.ResumableMethods, o.ResumableMethods...)
+		}
+		if o.ResumeGracePeriod != 0 {
+			merged.ResumeGracePeriod = o.ResumeGracePeriod
+		}
+		if o.ResumeBufferSize != 0 {
+			merged.ResumeBufferSize = o.ResumeBufferSize
+		}
+		if o.HTTPServer != nil {
+			merged.HTTPServer = o.HTTPServer
+		}
+		if o.EnableSessions {
+			merged.EnableSessions = true
+		}
+		if o.SessionStore != nil {
+			merged.SessionStore = o.SessionStore
+		}
+		if o.SessionResumeWindow != 0 {
+			merged.SessionResumeWindow = o.SessionResumeWindow
+		}
+		if o.MaxQueuedBytes != 0 {
+			merged.MaxQueuedBytes = o.MaxQueuedBytes
+		}
+		if o.MaxStreamQueuedBytes != 0 {
+			merged.MaxStreamQueuedBytes = o.MaxStreamQueuedBytes
+		}
+		if o.MaxQueueDelay != 0 {
+			merged.MaxQueueDelay = o.MaxQueueDelay
+		}
+		if o.SendTimeout != 0 {
+			merged.SendTimeout = o.SendTimeout
+		}
+		if o.OverflowPolicy != OverflowBlock {
+			merged.OverflowPolicy = o.OverflowPolicy
+		}
+		if o.OverflowCloseCode != 0 {
+			merged.OverflowCloseCode = o.OverflowCloseCode
+		}
+		if o.OnSlowConsumer != nil {
+			merged.OnSlowConsumer = o.OnSlowConsumer
+		}
+		if len(o.ConflatedMethods) > 0 {
+			merged.ConflatedMethods = append(merged.ConflatedMethods, o.ConflatedMethods...)
+		}
+		if o.FramePacking {
+			merged.FramePacking = true
+		}
+		if o.EnableGRPC {
+			merged.EnableGRPC = true
+		}
+		if o.GRPCServer != nil {
+			merged.GRPCServer = o.GRPCServer
+		}
+		if o.UnknownServiceHandler != nil {
+			merged.UnknownServiceHandler = o.UnknownServiceHandler
+		}
+		if o.ProxyUpstream != nil {
+			merged.ProxyUpstream = o.ProxyUpstream
+		}
 		if len(o.UnaryInterceptors) > 0 {
 			merged.UnaryInterceptors = append(merged.UnaryInterceptors, o.UnaryInterceptors...)
 		}
@@ -439,11 +1025,67 @@ func NewServer(opts ...ServerOption) *Server {
 		}
 	}
 
-	return &Server{
+	merged.MaxMessageSize = maxMessageSizeFor(merged.MaxMessageSize, merged.MaxPayloadSize)
+	if merged.EnableSessions && merged.SessionStore == nil {
+		merged.SessionStore = NewMemorySessionStore()
+	}
+
+	s := &Server{
 		methods:     make(map[string]*methodInfo),
 		options:     merged,
 		connections: make(map[*wsConnection]struct{}),
+		sessions:    make(map[string]*Session),
+	}
+	if merged.GRPCServer != nil {
+		s.grpcServer = merged.GRPCServer
+	} else if merged.EnableGRPC {
+		s.grpcServer = grpc.NewServer()
+	}
+	unknownHandler := merged.UnknownServiceHandler
+	if unknownHandler == nil && merged.ProxyUpstream != nil {
+		unknownHandler = NewProxyHandler(merged.ProxyUpstream)
+	}
+	if unknownHandler != nil {
+		// Like grpc-go, the server cannot tell what kind of call an unknown method is
+		s.unknown = &methodInfo{
+			streamHandler: &grpc.StreamDesc{
+				Handler:       unknownHandler,
+				ServerStreams: true,
+				ClientStreams: true,
+			},
+			raw: true,
+		}
+	}
+	return s
+}
+
+// lookupMethod returns the handler of a method: the registered one, otherwise the
+// UnknownServiceHandler or proxy if configured.
+func (s *Server) lookupMethod(methodPath string) (*methodInfo, bool) {
+	s.mu.RLock()
+	methodInfo, ok := s.methods[methodPath]
+	s.mu.RUnlock()
+	if !ok && s.unknown != nil {
+		return s.unknown, true
+	}
+	return methodInfo, ok
+}
+
+// unimplementedMessage returns the grpc-message for a method that is not registered,
+// worded like grpc-go's.
+func (s *Server) unimplementedMessage(methodPath string) string {
+	service, method, ok := strings.Cut(strings.TrimPrefix(methodPath, "/"), "/")
+	if !ok {
+		return fmt.Sprintf("malformed method name: %q", methodPath)
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for registered := range s.methods {
+		if strings.HasPrefix(registered, "/"+service+"/") {
+			return fmt.Sprintf("unknown method %s for service %s", method, service)
+		}
+	}
+	return fmt.Sprintf("unknown service %s", service)
 }
 
 // WithUnaryInterceptor adds unary interceptors via NewServer options
@@ -456,8 +1098,13 @@ func WithStreamInterceptor(interceptors ...grpc.StreamServerInterceptor) ServerO
 	return ServerOption{StreamInterceptors: interceptors}
 }
 
-// RegisterService registers a gRPC service with its handlers
+// RegisterService registers a gRPC service with its handlers. With native gRPC enabled,
+// it is registered on the grpc.Server as well, which must not be serving yet.
 func (s *Server) RegisterService(sd *grpc.ServiceDesc, ss interface{}) {
+	if s.grpcServer != nil {
+		s.registerGRPCService(sd, ss)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -494,6 +1141,7 @@ func (s *Server) RegisterService(sd *grpc.ServiceDesc, ss interface{}) {
 func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Accept the WebSocket connection
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:       supportedSubprotocols,
 		InsecureSkipVerify: s.options.InsecureSkipVerify,
 		OriginPatterns:     s.options.AllowedOrigins,
 	})
@@ -515,7 +1163,7 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn.SetReadLimit(readLimit + 1024)
 
 	if s.options.EnableLogging {
-		log.Printf("[wsgrpc] WebSocket connection established from %s", r.RemoteAddr)
+		log.Printf("[wsgrpc] WebSocket connection established from %s (%s)", r.RemoteAddr, protocolVersionFor(conn.Subprotocol()))
 	}
 
 	// Start processing frames in a goroutine
@@ -541,18 +1189,24 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 	}
 	s.mu.RUnlock()
 
+	// The protocol revision agreed on in the handshake; handlers can read it from
+	// their context
+	version := protocolVersionFor(conn.Subprotocol())
+
 	// Create cancellable context for the connection
-	connCtx, cancel := context.WithCancel(ctx)
+	connCtx, cancel := context.WithCancel(context.WithValue(ctx, protocolVersionKey{}, version))
 
 	// Create connection state with actor pattern
 	wsConn := &wsConnection{
 		conn:      conn,
+		version:   version,
 		ctx:       connCtx,
 		cancel:    cancel,
-		sendChan:  make(chan []byte, 100), // Buffered channel to reduce blocking
+		sendQueue: newSendQueue(),
 		streamMap: make(map[uint32]*WebSocketServerStream),
 		server:    s, // Reference to server for accessing options
 		lastPong:  time.Now(),
+		flow:      newConnFlowControl(s.options.InitialWindowSize, s.options.InitialConnWindowSize),
 	}
 
 	// Register the connection
@@ -563,6 +1217,8 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 	// Ensure cleanup on exit
 	defer func() {
 		wsConn.Close()
+		// The session waits for the client to come back
+		wsConn.detachSession()
 		// Unregister the connection
 		s.mu.Lock()
 		delete(s.connections, wsConn)
@@ -575,6 +1231,19 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 	// Start the idle timeout monitor goroutine
 	go wsConn.idleTimeoutMonitor()
 
+	// Announce the connection limits before anything else (PROTOCOL.md Section 5.5), so
+	// clients can stay within them instead of learning them from rejections
+	if s.options.EnableSessions {
+		session, err := s.newSession(connCtx, wsConn)
+		if err != nil {
+			log.Printf("[wsgrpc] Connection gets no session: %v", err)
+		}
+		wsConn.session = session
+	}
+	if err := wsConn.send(encodeSettings(wsConn.sessionSettings(false), version.binaryMetadata())); err != nil && s.options.EnableLogging {
+		log.Printf("[wsgrpc] Failed to send SETTINGS: %v", err)
+	}
+
 	// Test-only seam: deterministically exercise the connection-error close path.
 	if s.testConnErrHook != nil {
 		return s.testConnErrHook()
@@ -630,27 +1299,64 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 		}()
 	}
 
+	// packed holds the frames after the current one when a v3 client packs several
+	// frames into one WebSocket message (PROTOCOL.md Section 2.3)
+	var packed []byte
 	for {
-		// Read a message from the WebSocket
-		msgType, data, err := conn.Read(ctx)
-		if err != nil {
-			return fmt.Errorf("read error: %w", err)
-		}
+		var data []byte
+		if len(packed) > 0 {
+			data, packed = nextPackedFrame(packed)
+		} else {
+			// Read a message from the WebSocket
+			msgType, msg, err := conn.Read(ctx)
+			if err != nil {
+				if wsConn.isClosing() {
+					// Closed by Shutdown / Stop, not a connection error
+					return nil
+				}
+				return fmt.Errorf("read error: %w", err)
+			}
 
-		// Ensure we received a binary message
-		if msgType != websocket.MessageBinary {
-			if s.options.EnableLogging {
-				log.Printf("[wsgrpc] Warning: received non-binary message type: %v", msgType)
+			// Ensure we received a binary message
+			if msgType != websocket.MessageBinary {
+				if s.options.EnableLogging {
+					log.Printf("[wsgrpc] Warning: received non-binary message type: %v", msgType)
+				}
+				continue
 			}
+
+			data = msg
+			if version.framePacking() {
+				data, packed = nextPackedFrame(msg)
+			}
+		}
+
+		// After a connection error or the end of a drain, nothing more is processed;
+		// reading continues only until the close handshake completes
+		if wsConn.isClosing() {
+			packed = nil
 			continue
 		}
 
-		// Decode the frame
+		// Decode the frame. An oversized payload on a stream is a stream error; any
+		// other malformed frame leaves the connection in an unknown state.
 		frame, err := decodeFrame(data, s.options.MaxPayloadSize)
 		if err != nil {
 			if s.options.EnableLogging {
 				log.Printf("[wsgrpc] Frame decoding error: %v", err)
 			}
+			if errors.Is(err, errFrameTooLarge) {
+				streamID := binary.BigEndian.Uint32(data[1:5])
+				if streamID != 0 && data[0]&FlagHEADERS == 0 {
+					if state, stream := wsConn.streamState(streamID); state != streamIdle {
+						wsConn.resetStream(streamID, stream, ErrCodeFrameSizeError)
+						continue
+					}
+				}
+				wsConn.connectionError(ErrCodeFrameSizeError, err.Error())
+				continue
+			}
+			wsConn.connectionError(ErrCodeProtocolError, err.Error())
 			continue
 		}
 
@@ -660,8 +1366,9 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 				frame.StreamID, frame.Flags, len(frame.Payload))
 		}
 
-		// Handle PING frames - respond with PONG
-		if frame.Flags&FlagPING != 0 {
+		// Handle PING frames - respond with PONG. The PING bit doubles as COMPRESSED on
+		// DATA frames.
+		if frame.Flags&FlagPING != 0 && frame.Flags&FlagDATA == 0 {
 			if s.options.EnableLogging {
 				log.Printf("[wsgrpc] Received PING, sending PONG")
 			}
@@ -674,8 +1381,9 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 			continue
 		}
 
-		// Handle PONG frames - update lastPong timestamp
-		if frame.Flags&FlagPONG != 0 {
+		// Handle PONG frames - update lastPong timestamp. The PONG bit doubles as
+		// CONTINUED on DATA frames.
+		if frame.Flags&FlagPONG != 0 && frame.Flags&FlagDATA == 0 {
 			wsConn.lastPongMu.Lock()
 			wsConn.lastPong = time.Now()
 			wsConn.lastPongMu.Unlock()
@@ -685,11 +1393,63 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 			continue
 		}
 
+		// Handle WINDOW_UPDATE frames - flow control credit and advertisement
+		if frame.Flags&FlagWINDOW_UPDATE != 0 {
+			wsConn.handleWindowUpdate(frame)
+			continue
+		}
+
+		// Stream 0 only carries the connection-level frames handled above, SETTINGS and
+		// GOAWAY. A client RST_STREAM there is its GOAWAY, which needs no action.
+		if frame.StreamID == 0 {
+			if frame.Flags&FlagRST_STREAM != 0 && len(frame.Payload) == 8 {
+				if s.options.EnableLogging {
+					log.Printf("[wsgrpc] Client sent GOAWAY (error code %d)", decodeErrorCode(frame.Payload[4:]))
+				}
+				continue
+			}
+			if frame.Flags&^FlagACK == FlagHEADERS {
+				wsConn.handleSettings(frame)
+				continue
+			}
+			if frame.Flags != 0 {
+				wsConn.connectionError(ErrCodeProtocolError, fmt.Sprintf("frame with flags 0x%02x on stream 0", frame.Flags))
+			}
+			continue
+		}
+
 		// Process frame based on type
 		if frame.Flags&FlagHEADERS != 0 {
-			// Check concurrent streams limit
+			// Clients open streams with new, increasing odd IDs (PROTOCOL.md Section 4)
+			if frame.StreamID%2 == 0 {
+				wsConn.connectionError(ErrCodeProtocolError, fmt.Sprintf("HEADERS on even stream ID %d", frame.StreamID))
+				continue
+			}
+			wsConn.mu.Lock()
+			state, existing := wsConn.streamStateLocked(frame.StreamID)
+			if state == streamIdle {
+				wsConn.maxClientStreamID = frame.StreamID
+			}
+			wsConn.mu.Unlock()
+			switch state {
+			case streamOpen, streamHalfClosedRemote:
+				// A second HEADERS frame must not replace the running stream
+				wsConn.resetStream(frame.StreamID, existing, ErrCodeProtocolError)
+				continue
+			case streamClosed:
+				wsConn.connectionError(ErrCodeProtocolError, fmt.Sprintf("HEADERS on closed stream %d (stream IDs must increase)", frame.StreamID))
+				continue
+			}
+
+			// Check concurrent streams limit; finished streams that are still being
+			// cleaned up do not count
 			wsConn.mu.Lock()
-			streamCount := len(wsConn.streamMap)
+			streamCount := 0
+			for _, stream := range wsConn.streamMap {
+				if stream.state != streamClosed {
+					streamCount++
+				}
+			}
 			wsConn.mu.Unlock()
 
 			if uint32(streamCount) >= s.options.MaxConcurrentStreams {
@@ -704,96 +1464,296 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 				continue
 			}
 
-			// New stream - parse headers (method path and metadata)
-			headersText := string(frame.Payload)
-
-			// Parse headers to extract method path and metadata
-			md := metadata.New(nil)
-			var methodPath string
-
-			// Split by newlines and parse each line
-			for _, line := range splitLines(headersText) {
-				if len(line) == 0 {
-					continue
+			// New stream - parse headers (method path and metadata). Responses use the
+			// same metadata format as the request.
+			md, binaryMD, err := decodeMetadataBlock(frame.Payload)
+			if err == nil && wsConn.version.binaryMetadata() && !binaryMD {
+				err = fmt.Errorf("text metadata block on a %s connection", wsConn.version)
+			}
+			if err != nil {
+				if s.options.EnableLogging {
+					log.Printf("[wsgrpc] Rejecting stream %d: malformed metadata: %v", frame.StreamID, err)
 				}
-
-				// Split on first colon
-				idx := findFirstColon(line)
-				if idx == -1 {
+				_ = wsConn.send(encodeRSTStream(frame.StreamID, ErrCodeProtocolError))
+				continue
+			}
+			var methodPath string
+			if paths := md.Get("path"); len(paths) > 0 {
+				methodPath = paths[len(paths)-1]
+			}
+			delete(md, "path")
+
+			// grpc-timeout is transport-level: it becomes the stream's deadline rather
+			// than metadata visible to the handler
+			var timeout time.Duration
+			hasTimeout := false
+			if values := md.Get("grpc-timeout"); len(values) > 0 {
+				delete(md, "grpc-timeout")
+				timeout, err = decodeTimeout(values[len(values)-1])
+				if err != nil {
+					if s.options.EnableLogging {
+						log.Printf("[wsgrpc] Rejecting stream %d: %v", frame.StreamID, err)
+					}
+					_ = wsConn.send(encodeRSTStream(frame.StreamID, ErrCodeProtocolError))
 					continue
 				}
+				hasTimeout = true
+			}
 
-				key := trimSpace(line[:idx])
-				value := trimSpace(line[idx+1:])
-
-				if key == "path" {
-					methodPath = value
-				} else {
-					// Add to metadata
-					md.Append(key, value)
+			// Resumable-stream keys are transport-level as well (PROTOCOL.md Section 6.6)
+			var resumeToken, resumeSeq string
+			wantResumable := len(md.Get(resumableKey)) > 0
+			if values := md.Get(resumeTokenKey); len(values) > 0 {
+				resumeToken = values[len(values)-1]
+				if values := md.Get(resumeSeqKey); len(values) > 0 {
+					resumeSeq = values[len(values)-1]
 				}
 			}
+			delete(md, resumableKey)
+			delete(md, resumeTokenKey)
+			delete(md, resumeSeqKey)
+			if resumeToken != "" {
+				// The deadline of the resumed call still applies
+				hasTimeout = false
+			}
 
 			if s.options.EnableLogging {
 				log.Printf("[wsgrpc] New stream %d for method: %s", frame.StreamID, truncateForLog(methodPath))
 			}
 
 			// Look up the method handler
-			s.mu.RLock()
-			methodInfo, ok := s.methods[methodPath]
-			s.mu.RUnlock()
+			methodInfo, ok := s.lookupMethod(methodPath)
 
 			if !ok {
 				if s.options.EnableLogging {
 					log.Printf("[wsgrpc] Method not found: %s", truncateForLog(methodPath))
 				}
-				// Send RST_STREAM with REFUSED_STREAM (6)
-				rstPayload := make([]byte, 4)
-				binary.BigEndian.PutUint32(rstPayload, 6)
-				rstFrame := encodeFrame(frame.StreamID, FlagRST_STREAM, rstPayload)
-				if err := wsConn.send(rstFrame); err != nil {
+				// A status the client can act on, as grpc-go answers unknown methods
+				trailers := encodeTrailerBlock(int(codes.Unimplemented), s.unimplementedMessage(methodPath), nil, binaryMD)
+				if err := wsConn.send(encodeFrame(frame.StreamID, FlagTRAILERS, trailers)); err != nil {
 					if s.options.EnableLogging {
-						log.Printf("[wsgrpc] Failed to send RST_STREAM: %v", err)
+						log.Printf("[wsgrpc] Failed to send TRAILERS: %v", err)
 					}
 				}
 				continue
 			}
 
+			// content-type selects the message codec; it stays visible as metadata.
+			// Forwarded calls keep their payloads as they are, whatever the codec.
+			var contentType string
+			if values := md.Get("content-type"); len(values) > 0 {
+				contentType = values[len(values)-1]
+			}
+			var codec encoding.Codec
+			if methodInfo.raw {
+				var subtype string
+				subtype, err = contentSubtype(contentType)
+				codec = rawCodec{name: subtype}
+			} else {
+				codec, err = codecForContentType(contentType)
+			}
+			if err != nil {
+				if s.options.EnableLogging {
+					log.Printf("[wsgrpc] Rejecting stream %d: %v", frame.StreamID, err)
+				}
+				trailers := encodeTrailerBlock(int(codes.Internal), err.Error(), nil, binaryMD)
+				_ = wsConn.send(encodeFrame(frame.StreamID, FlagTRAILERS, trailers))
+				continue
+			}
+
+			// grpc-encoding names the compressor of the client's COMPRESSED messages
+			var encodingName string
+			if values := md.Get("grpc-encoding"); len(values) > 0 {
+				encodingName = values[len(values)-1]
+				delete(md, "grpc-encoding")
+			}
+			recvCompressor, ok := lookupCompressor(encodingName)
+			if !ok {
+				if s.options.EnableLogging {
+					log.Printf("[wsgrpc] Rejecting stream %d: unsupported grpc-encoding %s", frame.StreamID, truncateForLog(encodingName))
+				}
+				msg := fmt.Sprintf("grpc: Decompressor is not installed for grpc-encoding %q", encodingName)
+				trailers := encodeTrailerBlock(int(codes.Unimplemented), msg, nil, binaryMD)
+				_ = wsConn.send(encodeFrame(frame.StreamID, FlagTRAILERS, trailers))
+				continue
+			}
+			sendCompressor := s.responseCompressor(recvCompressor, md.Get("grpc-accept-encoding"))
+
+			// Resumable streams are server-streaming calls of a method configured for it
+			resumable := resumeToken == "" && wantResumable &&
+				methodInfo.streamHandler != nil && methodInfo.streamHandler.ServerStreams && !methodInfo.streamHandler.ClientStreams &&
+				slices.Contains(s.options.ResumableMethods, methodPath)
+
 			// Create context with metadata derived from connection context
-			// This ensures cancellation propagates when connection closes
-			streamCtx := metadata.NewIncomingContext(wsConn.ctx, md)
+			// This ensures cancellation propagates when connection closes. The handler
+			// of a resumable stream outlives the connection instead; only the delivery
+			// of its messages ends with it.
+			baseCtx := wsConn.ctx
+			if resumable {
+				baseCtx = context.WithoutCancel(wsConn.ctx)
+			}
+			streamCtx := metadata.NewIncomingContext(baseCtx, md)
+			wsConn.mu.Lock()
+			if session := wsConn.session; session != nil {
+				streamCtx = context.WithValue(streamCtx, sessionKey{}, session)
+			}
+			wsConn.mu.Unlock()
 
 			// Create cancellable context for this specific stream
 			// This allows individual stream cancellation via RST_STREAM
-			streamCtx, streamCancel := context.WithCancel(streamCtx)
+			var streamCancel context.CancelFunc
+			if hasTimeout {
+				streamCtx, streamCancel = context.WithTimeout(streamCtx, timeout)
+			} else {
+				streamCtx, streamCancel = context.WithCancel(streamCtx)
+			}
 
 			// Create stream
 			stream := &WebSocketServerStream{
-				ctx:          streamCtx,
-				cancel:       streamCancel,
-				conn:         wsConn,
-				streamID:     frame.StreamID,
-				recvChan:     make(chan []byte, 10),
-				method:       methodPath,
-				lastActivity: time.Now(),
+				ctx:            streamCtx,
+				cancel:         streamCancel,
+				conn:           wsConn,
+				streamID:       frame.StreamID,
+				recvChan:       make(chan recvMessage, 10),
+				method:         methodPath,
+				codec:          codec,
+				recvCompressor: recvCompressor,
+				sendCompressor: sendCompressor,
+				binaryMetadata: binaryMD,
+				lastActivity:   time.Now(),
+				state:          streamOpen,
+				conflate:       resumeToken == "" && slices.Contains(s.options.ConflatedMethods, methodPath),
+			}
+			if resumeToken != "" {
+				// The client sends no messages on a stream that resumes another
+				stream.state = streamHalfClosedRemote
 			}
+			if sendCompressor != nil {
+				stream.header = metadata.Pairs("grpc-encoding", sendCompressor.Name())
+			}
+			var resume *resumableStream
+			if resumable {
+				attachCtx, attachCancel := context.WithCancel(wsConn.ctx)
+				if resume, err = s.newResumableStream(stream, streamCancel, attachCtx, attachCancel); err != nil {
+					attachCancel()
+					streamCancel()
+					log.Printf("[wsgrpc] Refusing resumable stream %d: %v", frame.StreamID, err)
+					trailers := encodeTrailerBlock(int(codes.Internal), genericInternalMessage, nil, binaryMD)
+					_ = wsConn.send(encodeFrame(frame.StreamID, FlagTRAILERS, trailers))
+					continue
+				}
+			}
+			// Let handlers use grpc.SetHeader / SendHeader / SetTrailer on their context
+			stream.ctx = grpc.NewContextWithServerTransportStream(streamCtx, &serverTransportStream{stream: stream})
+			stream.sendWindow, stream.recvFlow = wsConn.flow.newStreamWindows()
 
 			wsConn.mu.Lock()
+			if wsConn.goAwaySent {
+				// Opened after GOAWAY: refuse so the client can retry elsewhere
+				wsConn.mu.Unlock()
+				stream.cancel()
+				if s.options.EnableLogging {
+					log.Printf("[wsgrpc] Refusing stream %d after GOAWAY", frame.StreamID)
+				}
+				_ = wsConn.send(encodeRSTStream(frame.StreamID, ErrCodeRefusedStream))
+				continue
+			}
 			wsConn.streamMap[frame.StreamID] = stream
+			if frame.StreamID > wsConn.lastStreamID {
+				wsConn.lastStreamID = frame.StreamID
+			}
 			wsConn.mu.Unlock()
 
+			if resumeToken != "" {
+				go s.resumeStream(stream, streamCancel, resumeToken, resumeSeq)
+				continue
+			}
+			if resume != nil {
+				resume.register()
+			}
+
+			// End the stream as soon as its deadline expires, even if the handler
+			// ignores its context. Any other cancellation (RST_STREAM, normal
+			// completion, connection close) reports context.Canceled instead. A
+			// resumable stream reports its status when the handler returns.
+			if hasTimeout && resume == nil {
+				context.AfterFunc(streamCtx, func() {
+					if streamCtx.Err() == context.DeadlineExceeded {
+						s.expireStream(stream)
+					}
+				})
+			}
+
 			// Spawn handler goroutine
 			go s.handleStream(stream, methodInfo)
 
 		} else if frame.Flags&FlagDATA != 0 {
+			// Connection-level flow control: every DATA frame counts against the
+			// connection window, even one for a stream that is already gone. The credit
+			// is returned on receipt; the per-stream windows bound buffered memory.
+			if connRecv := wsConn.flow.connRecv(); connRecv != nil {
+				if !connRecv.onReceive(len(frame.Payload)) {
+					wsConn.connectionError(ErrCodeFlowControlError, "connection flow control window exceeded")
+					continue
+				}
+				if increment := connRecv.onRelease(len(frame.Payload)); increment > 0 {
+					_ = wsConn.send(encodeWindowUpdate(0, increment))
+				}
+			}
+
 			// Data frame - route to existing stream
-			wsConn.mu.Lock()
-			stream, ok := wsConn.streamMap[frame.StreamID]
-			wsConn.mu.Unlock()
+			state, stream := wsConn.streamState(frame.StreamID)
+			if state != streamOpen {
+				wsConn.rejectFrame(frame, state, stream)
+				continue
+			}
+			if frame.Flags&FlagCONTINUED != 0 && (frame.Flags&FlagEOS != 0 || !wsConn.version.fragmentation()) {
+				// The stream cannot end in the middle of a message, and fragments
+				// need a v3 connection
+				wsConn.resetStream(frame.StreamID, stream, ErrCodeProtocolError)
+				continue
+			}
+			if frame.Flags&FlagEOS != 0 {
+				wsConn.halfCloseRemote(stream)
+			}
 
-			if !ok {
+			// Only the first fragment of a message needs credit; the whole message is
+			// debited and its credit returned once RecvMsg consumed it
+			if stream.recvFlow != nil {
+				if stream.reassembly.pending {
+					stream.recvFlow.onReceiveFragment(len(frame.Payload))
+				} else if !stream.recvFlow.onReceive(len(frame.Payload)) {
+					if s.options.EnableLogging {
+						log.Printf("[wsgrpc] Stream %d exceeded its flow control window", frame.StreamID)
+					}
+					wsConn.resetStream(frame.StreamID, stream, ErrCodeFlowControlError)
+					continue
+				}
+			}
+
+			// Fragments are collected until the message is complete, bounded by
+			// MaxMessageSize
+			msg, complete, err := stream.reassembly.add(frame, s.options.MaxMessageSize)
+			if err != nil {
 				if s.options.EnableLogging {
-					log.Printf("[wsgrpc] Stream %d not found for DATA frame", frame.StreamID)
+					log.Printf("[wsgrpc] Resetting stream %d: %v", frame.StreamID, err)
+				}
+				wsConn.resetStream(frame.StreamID, stream, ErrCodeResourceExhausted)
+				continue
+			}
+			if !complete {
+				continue
+			}
+
+			if stream.recvFlow != nil {
+				// Flow-controlled stream: the client may only have a window's worth of
+				// data outstanding, so the payload is queued without blocking the read
+				// pump. A slow handler now only stalls its own stream.
+				if stream.ctx.Err() == nil {
+					stream.enqueueRecv(msg)
+				}
+				if frame.Flags&FlagEOS != 0 {
+					stream.endRecv()
 				}
 				continue
 			}
@@ -811,10 +1771,10 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 			// the trailers are out, which is what releases us here.
 			//
 			// This is deadlock-safety, NOT flow control: a handler that is merely
-			// SLOW still applies backpressure to the whole connection, because the
-			// protocol has no per-stream windowing. That limitation is unchanged.
+			// SLOW still applies backpressure to the whole connection. Clients that
+			// opt into flow control take the non-blocking path above instead.
 			select {
-			case stream.recvChan <- frame.Payload:
+			case stream.recvChan <- msg:
 			case <-stream.ctx.Done():
 				if s.options.EnableLogging {
 					log.Printf("[wsgrpc] Stream %d finished; dropping late DATA frame", frame.StreamID)
@@ -827,10 +1787,17 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 				stream.safeCloseRecvChan()
 			}
 		} else if frame.Flags&FlagRST_STREAM != 0 {
-			// RST_STREAM frame - client is cancelling the stream
+			// RST_STREAM frame - client is cancelling the stream. A reset of an idle
+			// stream is a connection error; one for a closed stream crossed our trailers.
 			wsConn.mu.Lock()
-			stream, ok := wsConn.streamMap[frame.StreamID]
-			if ok {
+			state, stream := wsConn.streamStateLocked(frame.StreamID)
+			if state == streamIdle {
+				wsConn.mu.Unlock()
+				wsConn.connectionError(ErrCodeProtocolError, fmt.Sprintf("RST_STREAM on idle stream %d", frame.StreamID))
+				continue
+			}
+			if stream != nil {
+				stream.state = streamClosed
 				if s.options.EnableLogging {
 					log.Printf("[wsgrpc] Stream %d context cancelled by RST_STREAM", frame.StreamID)
 				}
@@ -848,12 +1815,132 @@ func (s *Server) handleConnection(ctx context.Context, conn *websocket.Conn) err
 				}
 			}
 			wsConn.mu.Unlock()
+		} else if frame.Flags&FlagTRAILERS != 0 {
+			// Only the server ends a stream with TRAILERS
+			state, stream := wsConn.streamState(frame.StreamID)
+			if state == streamIdle {
+				wsConn.connectionError(ErrCodeProtocolError, fmt.Sprintf("TRAILERS on idle stream %d", frame.StreamID))
+				continue
+			}
+			wsConn.resetStream(frame.StreamID, stream, ErrCodeProtocolError)
+		} else if frame.Flags&FlagEOS != 0 {
+			// Bare EOS frame - the client half-closes without a final message
+			// (e.g. CloseSend on a client-streaming call from the Go client)
+			state, stream := wsConn.streamState(frame.StreamID)
+			if state != streamOpen {
+				wsConn.rejectFrame(frame, state, stream)
+				continue
+			}
+			wsConn.halfCloseRemote(stream)
+			stream.endRecv()
 		}
 	}
 }
 
+// responseCompressor picks the compressor for a stream's response messages: the one the
+// client compressed its request with, otherwise the configured Compressor if the client
+// accepts it.
+func (s *Server) responseCompressor(recvCompressor encoding.Compressor, acceptEncoding []string) encoding.Compressor {
+	if recvCompressor != nil {
+		return recvCompressor
+	}
+	if s.options.Compressor == "" || !acceptsEncoding(acceptEncoding, s.options.Compressor) {
+		return nil
+	}
+	return encoding.GetCompressor(s.options.Compressor)
+}
+
+// handleWindowUpdate processes a WINDOW_UPDATE frame from the client. An 8-byte
+// payload on stream 0 is the client's window advertisement, which opts the connection
+// into flow control and is answered with the server's own advertisement. Zero windows
+// withdraw from flow control: the client gave up waiting for our answer.
+func (c *wsConnection) handleWindowUpdate(frame *Frame) {
+	if frame.StreamID == 0 && len(frame.Payload) == 8 {
+		streamWindow := binary.BigEndian.Uint32(frame.Payload[0:4])
+		connWindow := binary.BigEndian.Uint32(frame.Payload[4:8])
+		if streamWindow == 0 && connWindow == 0 {
+			// Streams keep the windows they were opened with, so a late withdrawal is
+			// ignored
+			c.mu.Lock()
+			opened := c.maxClientStreamID != 0
+			c.mu.Unlock()
+			if !opened {
+				c.flow.withdraw()
+			}
+			if c.server.options.EnableLogging {
+				log.Printf("[wsgrpc] Client withdrew from flow control (ignored: %v)", opened)
+			}
+			return
+		}
+		if c.flow.enable(streamWindow, connWindow) {
+			if c.server.options.EnableLogging {
+				log.Printf("[wsgrpc] Flow control enabled (client windows: stream %d, connection %d)", streamWindow, connWindow)
+			}
+			if d := c.server.testAdvertisementDelay; d > 0 {
+				time.Sleep(d)
+			}
+			if err := c.send(c.flow.advertisement()); err != nil && c.server.options.EnableLogging {
+				log.Printf("[wsgrpc] Failed to send window advertisement: %v", err)
+			}
+		}
+		return
+	}
+
+	if len(frame.Payload) != 4 {
+		if c.server.options.EnableLogging {
+			log.Printf("[wsgrpc] Ignoring malformed WINDOW_UPDATE for stream %d", frame.StreamID)
+		}
+		return
+	}
+	increment := int64(binary.BigEndian.Uint32(frame.Payload))
+
+	if frame.StreamID == 0 {
+		if w := c.flow.connSendWindow(); w != nil {
+			w.add(increment)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	stream, ok := c.streamMap[frame.StreamID]
+	c.mu.Unlock()
+	if ok && stream.sendWindow != nil {
+		stream.sendWindow.add(increment)
+	}
+}
+
 // handleStream invokes the gRPC method handler
 func (s *Server) handleStream(stream *WebSocketServerStream, methodInfo *methodInfo) {
+	statusCode, statusMsg, statusDetails := s.runHandler(stream.ctx, stream.method, stream, methodInfo, fmt.Sprintf("stream %d", stream.streamID))
+
+	// The latest value of a conflated stream goes out before the trailers
+	stream.stopConflater()
+
+	// A resumable stream ends on whichever stream its client resumed it with, or
+	// keeps its status for a client that is away
+	if stream.resume != nil {
+		if stream.ctx.Err() == context.DeadlineExceeded {
+			statusCode, statusMsg, statusDetails = int(codes.DeadlineExceeded), "context deadline exceeded", nil
+		}
+		stream.resume.finish(statusCode, statusMsg, statusDetails)
+		return
+	}
+
+	// A handler that returns because its deadline expired must not replace the
+	// DEADLINE_EXCEEDED status with its own (usually a bare ctx.Err(), scrubbed to
+	// Internal above)
+	if stream.ctx.Err() == context.DeadlineExceeded {
+		s.expireStream(stream)
+		return
+	}
+
+	s.sendTrailers(stream, statusCode, statusMsg, statusDetails)
+}
+
+// runHandler calls the handler of a method, through the interceptor chain, and returns
+// the status for the client: the code and message, and the serialized google.rpc.Status
+// of errors with details. call names the call in the server-side log, e.g. "stream 5".
+func (s *Server) runHandler(ctx context.Context, method string, stream grpc.ServerStream, methodInfo *methodInfo, call string) (statusCode int, statusMsg string, statusDetails []byte) {
 	var err error
 
 	// Recover from any panic in the handler / interceptor chain so a single buggy
@@ -863,25 +1950,25 @@ func (s *Server) handleStream(stream *WebSocketServerStream, methodInfo *methodI
 	func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("[wsgrpc] PANIC recovered in handler for stream %d: %v\n%s",
-					stream.streamID, r, debug.Stack())
+				log.Printf("[wsgrpc] PANIC recovered in handler for %s: %v\n%s",
+					call, r, debug.Stack())
 				// status.Error keeps a real gRPC code; the message is generic so no
 				// internal detail reaches the client. The status-extraction below will
 				// read codes.Internal from this and use the generic message.
 				err = status.Error(codes.Internal, genericInternalMessage)
 			}
 		}()
-		err = s.invokeHandler(stream, methodInfo)
+		err = s.invokeHandler(ctx, method, stream, methodInfo)
 	}()
 
 	// Default status OK
-	statusCode := 0
-	statusMsg := "OK"
+	statusCode = 0
+	statusMsg = "OK"
 
 	if err != nil {
 		// Always log the full internal error detail server-side (operators need it),
 		// regardless of EnableLogging — but never put raw internal detail on the wire.
-		log.Printf("[wsgrpc] Handler error for stream %d: %v", stream.streamID, err)
+		log.Printf("[wsgrpc] Handler error for %s: %v", call, err)
 
 		// Extract the gRPC status. The CODE is always preserved and forwarded to the
 		// client. The human-facing MESSAGE is scrubbed for any error that does NOT
@@ -890,6 +1977,14 @@ func (s *Server) handleStream(stream *WebSocketServerStream, methodInfo *methodI
 		if st, ok := statusFromErr(err); ok {
 			statusCode = int(st.Code())
 			statusMsg = st.Message()
+			// Details (BadRequest, RetryInfo, ErrorInfo, ...) were attached explicitly
+			// with status.WithDetails, so they are as safe to forward as the message
+			if len(st.Details()) > 0 {
+				if statusDetails, err = proto.Marshal(st.Proto()); err != nil {
+					log.Printf("[wsgrpc] Failed to marshal status details for %s: %v", call, err)
+					statusDetails = nil
+				}
+			}
 		} else {
 			// No explicit gRPC status on this error => treat as an internal failure and
 			// scrub the message. (Previously this leaked err.Error() to the browser.)
@@ -897,8 +1992,21 @@ func (s *Server) handleStream(stream *WebSocketServerStream, methodInfo *methodI
 			statusMsg = genericInternalMessage
 		}
 	}
+	return statusCode, statusMsg, statusDetails
+}
 
-	s.sendTrailers(stream, statusCode, statusMsg)
+// expireStream ends a stream whose grpc-timeout deadline has passed: the client gets a
+// DEADLINE_EXCEEDED trailer followed by RST_STREAM (CANCEL). It is a no-op if the
+// stream has already been finished.
+func (s *Server) expireStream(stream *WebSocketServerStream) {
+	if !s.sendTrailers(stream, int(codes.DeadlineExceeded), "context deadline exceeded", nil) {
+		return
+	}
+	if err := stream.conn.send(encodeRSTStream(stream.streamID, ErrCodeCancel)); err != nil && s.options.EnableLogging {
+		log.Printf("[wsgrpc] Failed to send RST_STREAM for stream %d: %v", stream.streamID, err)
+	}
+	// Unblock a handler still waiting in RecvMsg
+	stream.safeCloseRecvChan()
 }
 
 // statusFromErr returns the gRPC status only when err carries an explicit gRPC status
@@ -918,26 +2026,57 @@ func statusFromErr(err error) (*status.Status, bool) {
 	return nil, false
 }
 
-// sendTrailers serializes and sends the final TRAILERS frame (grpc-status / grpc-message
-// plus any handler-set trailer metadata) and cleans up the stream.
-func (s *Server) sendTrailers(stream *WebSocketServerStream, statusCode int, statusMsg string) {
-	// Build trailers payload with grpc-status and grpc-message
-	var trailerLines []string
-	trailerLines = append(trailerLines, fmt.Sprintf("grpc-status:%d", statusCode))
-	trailerLines = append(trailerLines, fmt.Sprintf("grpc-message:%s", statusMsg))
+// sendTrailers serializes and sends the final TRAILERS frame (grpc-status / grpc-message,
+// grpc-status-details-bin when statusDetails is set, plus any handler-set trailer
+// metadata) and cleans up the stream. statusDetails is a serialized google.rpc.Status.
+// Only the first call for a stream has any effect; it reports whether this call finished
+// the stream.
+func (s *Server) sendTrailers(stream *WebSocketServerStream, statusCode int, statusMsg string, statusDetails []byte) bool {
+	stream.finishMu.Lock()
+	defer stream.finishMu.Unlock()
+	if stream.finished {
+		return false
+	}
+	stream.finished = true
 
-	// Add any custom trailer metadata set by the handler
+	// Build trailers payload with grpc-status, grpc-message and any custom trailer
+	// metadata set by the handler. Headers that were set but never sent (e.g. by a
+	// unary handler returning an error) still go out first, as in grpc-go.
 	stream.headerMu.Lock()
-	if stream.trailer != nil {
-		for k, values := range stream.trailer {
-			for _, v := range values {
-				trailerLines = append(trailerLines, fmt.Sprintf("%s: %s", k, v))
-			}
+	var headersFrame []byte
+	if !stream.headerSent && len(stream.header) > 0 {
+		if block, err := encodeMetadataBlock(stream.header, stream.binaryMetadata); err == nil {
+			headersFrame = encodeFrame(stream.streamID, FlagHEADERS, block)
+		} else {
+			statusCode, statusMsg, statusDetails = int(codes.Internal), "failed to encode headers: "+err.Error(), nil
 		}
 	}
+	stream.headerSent = true
+	trailer := stream.trailer
+	if len(statusDetails) > 0 {
+		trailer = trailer.Copy()
+		trailer.Set(statusDetailsKey, string(statusDetails))
+	}
+	trailersPayload := encodeTrailerBlock(statusCode, statusMsg, trailer, stream.binaryMetadata)
 	stream.headerMu.Unlock()
 
-	trailersPayload := []byte(strings.Join(trailerLines, "\n"))
+	// A finished stream no longer counts against MaxConcurrentStreams: a client may
+	// open its next stream as soon as the trailers arrive, before the cleanup below.
+	// A stream that was reset already ended with its RST_STREAM.
+	stream.conn.mu.Lock()
+	reset := stream.state == streamClosed
+	stream.state = streamClosed
+	stream.conn.mu.Unlock()
+	if reset {
+		return false
+	}
+
+	if headersFrame != nil {
+		if err := stream.conn.send(headersFrame); err != nil && s.options.EnableLogging {
+			log.Printf("[wsgrpc] Failed to send headers for stream %d: %v", stream.streamID, err)
+		}
+	}
+
 	trailersFrame := encodeFrame(stream.streamID, FlagTRAILERS, trailersPayload)
 
 	// Only send trailers if connection is still active
@@ -965,44 +2104,24 @@ func (s *Server) sendTrailers(stream *WebSocketServerStream, statusCode int, sta
 	stream.conn.mu.Lock()
 	delete(stream.conn.streamMap, stream.streamID)
 	stream.conn.mu.Unlock()
+	return true
 }
 
 // invokeHandler dispatches to the registered unary or streaming handler (with the
 // interceptor chain) and returns the handler error, if any. It is called from within a
-// panic-recovering wrapper in handleStream.
-func (s *Server) invokeHandler(stream *WebSocketServerStream, methodInfo *methodInfo) error {
+// panic-recovering wrapper in runHandler.
+func (s *Server) invokeHandler(ctx context.Context, method string, stream grpc.ServerStream, methodInfo *methodInfo) error {
 	var err error
 
 	// Invoke the appropriate handler based on method type
 	if methodInfo.unaryHandler != nil {
-		// Unary method handler with interceptor chain (if any)
-		info := &grpc.UnaryServerInfo{
-			Server:     methodInfo.srv,
-			FullMethod: stream.method,
-		}
-
-		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-			dec := func(m interface{}) error { return stream.RecvMsg(m) }
-			return methodInfo.unaryHandler.Handler(methodInfo.srv, ctx, dec, nil)
-		}
-
-		// Chain interceptors from server options
-		finalHandler := handler
-		if len(s.options.UnaryInterceptors) > 0 {
-			// Apply in reverse order so the first in the slice is outermost
-			for i := len(s.options.UnaryInterceptors) - 1; i >= 0; i-- {
-				interceptor := s.options.UnaryInterceptors[i]
-				next := finalHandler
-				finalHandler = func(ctx context.Context, req interface{}) (interface{}, error) {
-					return interceptor(ctx, req, info, next)
-				}
-			}
-		}
+		// Unary method handler, dispatched like grpc-go: the generated handler decodes
+		// the request through dec and then runs the interceptor chain with the decoded
+		// message, so interceptors see the real req rather than nil.
+		dec := func(m interface{}) error { return stream.RecvMsg(m) }
 
-		// For unary we don't have a pre-decoded request object; the handler uses RecvMsg internally.
-		// We pass nil as req since dec() will populate inside the original handler.
 		var resp interface{}
-		resp, err = finalHandler(stream.ctx, nil)
+		resp, err = methodInfo.unaryHandler.Handler(methodInfo.srv, ctx, dec, chainUnaryInterceptors(s.options.UnaryInterceptors))
 
 		// Send the response message if handler succeeded
 		if err == nil && resp != nil {
@@ -1023,27 +2142,12 @@ func (s *Server) invokeHandler(stream *WebSocketServerStream, methodInfo *method
 		// — so a hard-coded value silently produces wrong observability data and
 		// wrong behaviour in any interceptor that branches on the RPC kind.
 		info := &grpc.StreamServerInfo{
-			FullMethod:     stream.method,
+			FullMethod:     method,
 			IsClientStream: methodInfo.streamHandler.ClientStreams,
 			IsServerStream: methodInfo.streamHandler.ServerStreams,
 		}
 
-		h := func(srv interface{}, ss grpc.ServerStream) error {
-			return methodInfo.streamHandler.Handler(srv, ss)
-		}
-
-		final := h
-		if len(s.options.StreamInterceptors) > 0 {
-			for i := len(s.options.StreamInterceptors) - 1; i >= 0; i-- {
-				interceptor := s.options.StreamInterceptors[i]
-				next := final
-				final = func(srv interface{}, ss grpc.ServerStream) error {
-					return interceptor(srv, ss, info, next)
-				}
-			}
-		}
-
-		err = final(methodInfo.srv, stream)
+		err = chainStreamInterceptors(s.options.StreamInterceptors, info, methodInfo.streamHandler.Handler)(methodInfo.srv, stream)
 	} else {
 		err = fmt.Errorf("no handler found for method")
 	}
@@ -1051,17 +2155,48 @@ func (s *Server) invokeHandler(stream *WebSocketServerStream, methodInfo *method
 	return err
 }
 
-// ListenAndServe starts an HTTP server that handles WebSocket connections
-func (s *Server) ListenAndServe(addr string) error {
-	http.HandleFunc("/", s.HandleWebSocket)
-	if s.options.EnableLogging {
-		log.Printf("[wsgrpc] Server listening on %s", addr)
+// chainUnaryInterceptors combines interceptors into the single interceptor expected by
+// generated unary handlers. The first interceptor is the outermost; nil means none.
+func chainUnaryInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		// Apply in reverse order so the first in the slice is outermost
+		next := handler
+		for i := len(interceptors) - 1; i > 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return interceptors[0](ctx, req, info, next)
+	}
+}
+
+// chainStreamInterceptors wraps handler in interceptors, the first in the slice
+// outermost.
+func chainStreamInterceptors(interceptors []grpc.StreamServerInterceptor, info *grpc.StreamServerInfo, handler grpc.StreamHandler) grpc.StreamHandler {
+	final := handler
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], final
+		final = func(srv interface{}, ss grpc.ServerStream) error {
+			return interceptor(srv, ss, info, next)
+		}
 	}
-	return http.ListenAndServe(addr, nil)
+	return final
 }
 
-// Shutdown gracefully shuts down the server by signaling all active streams with RST_STREAM
-// and waiting for connections to close. It respects the provided context's deadline.
+// Shutdown gracefully shuts down the server. New connections are rejected and every
+// connection is drained in parallel: the client receives GOAWAY, new streams are
+// refused, and in-flight RPCs may finish until ctx is done. Connections that are still
+// busy at that point are closed as with Stop, and ctx.Err() is returned. The HTTP
+// server started by Serve, ListenAndServe or ListenAndServeTLS closes its listeners and
+// is shut down alongside, and so is the grpc.Server of EnableGRPC or GRPCServer.
+// Sessions end once the connections are gone.
 func (s *Server) Shutdown(ctx context.Context) error {
 	if s.options.EnableLogging {
 		log.Printf("[wsgrpc] Server shutdown initiated")
@@ -1074,52 +2209,31 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	for conn := range s.connections {
 		connectionsCopy = append(connectionsCopy, conn)
 	}
+	httpServer := s.httpServer
 	s.mu.Unlock()
 
-	// Send RST_STREAM to all active streams on all connections
-	for _, conn := range connectionsCopy {
-		conn.mu.Lock()
-		for streamID, stream := range conn.streamMap {
-			if s.options.EnableLogging {
-				log.Printf("[wsgrpc] Sending RST_STREAM to stream %d during shutdown", streamID)
-			}
-
-			// Build RST_STREAM frame with error code 0 (graceful shutdown)
-			rstPayload := make([]byte, 4)
-			// Error code 0 indicates graceful shutdown
-			rstPayload[0] = 0
-			rstPayload[1] = 0
-			rstPayload[2] = 0
-			rstPayload[3] = 0
-
-			rstFrame := encodeFrame(streamID, FlagRST_STREAM, rstPayload)
-
-			// Send RST_STREAM frame (non-blocking attempt)
-			select {
-			case conn.sendChan <- rstFrame:
-				// Frame queued successfully
-			case <-time.After(100 * time.Millisecond):
-				if s.options.EnableLogging {
-					log.Printf("[wsgrpc] Timeout sending RST_STREAM for stream %d", streamID)
-				}
-			}
-
-			// Cancel the stream's context
-			if stream.cancel != nil {
-				stream.cancel()
-			}
-		}
-		conn.mu.Unlock()
-
-		// Give the writer loop time to send queued RST_STREAM frames
-		time.Sleep(200 * time.Millisecond)
+	// WebSocket connections are hijacked, so the HTTP server only waits for its other
+	// requests
+	var httpDone chan error
+	if httpServer != nil {
+		httpDone = make(chan error, 1)
+		go func() { httpDone <- httpServer.Shutdown(ctx) }()
+	}
+	var grpcDone chan struct{}
+	if s.grpcServer != nil {
+		grpcDone = make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(grpcDone)
+		}()
+	}
 
-		// Cancel the connection context to trigger cleanup
-		conn.cancel()
+	for _, conn := range connectionsCopy {
+		go conn.drain(ctx)
 	}
 
 	// Wait for all connections to clean up or context to expire
-	ticker := time.NewTicker(100 * time.Millisecond)
+	ticker := time.NewTicker(50 * time.Millisecond)
 	defer ticker.Stop()
 
 	for {
@@ -1131,14 +2245,32 @@ func (s *Server) Shutdown(ctx context.Context) error {
 			if s.options.EnableLogging {
 				log.Printf("[wsgrpc] All connections closed, shutdown complete")
 			}
+			// Nobody can resume a stream or session any more
+			s.cancelResumables()
+			s.endSessions()
+			if httpDone != nil {
+				if err := <-httpDone; err != nil {
+					s.Stop()
+					return err
+				}
+			}
+			if grpcDone != nil {
+				select {
+				case <-grpcDone:
+				case <-ctx.Done():
+					s.Stop()
+					return ctx.Err()
+				}
+			}
 			return nil
 		}
 
 		select {
 		case <-ctx.Done():
 			if s.options.EnableLogging {
-				log.Printf("[wsgrpc] Shutdown context expired with %d connections remaining", remaining)
+				log.Printf("[wsgrpc] Shutdown context expired with %d connections remaining, stopping", remaining)
 			}
+			s.Stop()
 			return ctx.Err()
 		case <-ticker.C:
 			// Continue waiting
@@ -1146,6 +2278,38 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	}
 }
 
+// Stop closes all connections immediately and rejects new ones. The contexts of all
+// in-flight RPCs are cancelled; Stop does not wait for their handlers to return. The
+// HTTP server started by Serve, ListenAndServe or ListenAndServeTLS is closed, and the
+// grpc.Server of EnableGRPC or GRPCServer is stopped. Sessions end as well.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	s.shutdown = true
+	connectionsCopy := make([]*wsConnection, 0, len(s.connections))
+	for conn := range s.connections {
+		connectionsCopy = append(connectionsCopy, conn)
+	}
+	httpServer := s.httpServer
+	s.mu.Unlock()
+
+	if httpServer != nil {
+		_ = httpServer.Close()
+	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+
+	if s.options.EnableLogging {
+		log.Printf("[wsgrpc] Stopping server, closing %d connections", len(connectionsCopy))
+	}
+	for _, conn := range connectionsCopy {
+		conn.stop()
+	}
+	// Resumable handlers and sessions outlive their connections
+	s.cancelResumables()
+	s.endSessions()
+}
+
 // Helper functions for parsing headers
 
 // truncateForLog truncates a string for logging if it's longer than 20 characters
@@ -1171,3 +2335,64 @@ func findFirstColon(s string) int {
 func trimSpace(s string) string {
 	return strings.TrimSpace(s)
 }
+
+// parseHeaderBlock parses a "key: value" line-oriented HEADERS/TRAILERS payload into
+// metadata. Lines without a colon are skipped; keys are lower-cased by metadata.MD.
+func parseHeaderBlock(payload []byte) metadata.MD {
+	md := metadata.New(nil)
+	for _, line := range splitLines(string(payload)) {
+		if len(line) == 0 {
+			continue
+		}
+
+		// Split on first colon
+		idx := findFirstColon(line)
+		if idx == -1 {
+			continue
+		}
+
+		key := trimSpace(line[:idx])
+		md.Append(key, decodeTextValue(strings.ToLower(key), trimSpace(line[idx+1:])))
+	}
+	return md
+}
+
+// encodeTrailerBlock serializes the grpc-status / grpc-message keys followed by any
+// custom trailer metadata into a TRAILERS payload, in the binary or the text format.
+// Custom trailer metadata that the binary format cannot carry turns the status into
+// INTERNAL without it.
+func encodeTrailerBlock(statusCode int, statusMsg string, trailer metadata.MD, binaryFormat bool) []byte {
+	if binaryFormat {
+		md := trailer.Copy()
+		md.Set("grpc-status", fmt.Sprintf("%d", statusCode))
+		md.Set("grpc-message", statusMsg)
+		block, err := encodeMetadataBlock(md, true)
+		if err != nil {
+			return encodeTrailerBlock(int(codes.Internal), "failed to encode trailers: "+err.Error(), nil, true)
+		}
+		return block
+	}
+
+	var trailerLines []string
+	trailerLines = append(trailerLines, fmt.Sprintf("grpc-status:%d", statusCode))
+	trailerLines = append(trailerLines, fmt.Sprintf("grpc-message:%s", encodeTextValue("grpc-message", statusMsg)))
+	for k, values := range trailer {
+		for _, v := range values {
+			trailerLines = append(trailerLines, fmt.Sprintf("%s: %s", encodeTextValue("", k), encodeTextValue(k, v)))
+		}
+	}
+	return []byte(strings.Join(trailerLines, "\n"))
+}
+
+// encodeHeaderBlock serializes metadata into the "key: value" line-oriented format
+// understood by parseHeaderBlock. Line breaks in keys and values are replaced and -bin
+// values are base64 encoded.
+func encodeHeaderBlock(md metadata.MD) []byte {
+	var lines []string
+	for k, values := range md {
+		for _, v := range values {
+			lines = append(lines, fmt.Sprintf("%s: %s", encodeTextValue("", k), encodeTextValue(k, v)))
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
@@ -33,7 +33,7 @@ func TestTruncateForLog(t *testing.T) {
 func TestRecvMsgInvalidType(t *testing.T) {
 	// Setup a mock stream
 	stream := &WebSocketServerStream{
-		recvChan: make(chan []byte, 1),
+		recvChan: make(chan recvMessage, 1),
 		ctx:      context.Background(),
 		conn: &wsConnection{
 			server: &Server{options: ServerOption{EnableLogging: true}},
@@ -41,7 +41,7 @@ func TestRecvMsgInvalidType(t *testing.T) {
 		streamID: 1,
 	}
 
-	stream.recvChan <- []byte("data")
+	stream.recvChan <- recvMessage{data: []byte("data")}
 
 	// Pass a string instead of proto.Message
 	err := stream.RecvMsg("not a proto message")
@@ -55,7 +55,7 @@ func TestRecvMsgInvalidType(t *testing.T) {
 
 func TestRecvMsgUnmarshalError(t *testing.T) {
 	stream := &WebSocketServerStream{
-		recvChan: make(chan []byte, 1),
+		recvChan: make(chan recvMessage, 1),
 		ctx:      context.Background(),
 		conn: &wsConnection{
 			server: &Server{options: ServerOption{EnableLogging: true}},
@@ -64,7 +64,7 @@ func TestRecvMsgUnmarshalError(t *testing.T) {
 	}
 
 	// Inject invalid proto data
-	stream.recvChan <- []byte("invalid proto data")
+	stream.recvChan <- recvMessage{data: []byte("invalid proto data")}
 
 	// Use a valid proto message to pass type check
 	msg := &pb.HelloRequest{}
@@ -79,22 +79,22 @@ func TestRecvMsgUnmarshalError(t *testing.T) {
 	}
 }
 
-func TestWriterLoop_SendChanClosed(t *testing.T) {
+func TestWriterLoop_SendQueueClosed(t *testing.T) {
 	// Create a dummy server and connection
 	server := NewServer(ServerOption{EnableLogging: true})
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// We need a real websocket connection or it will panic when calling Write
-	// But we can test the sendChan closed path which returns BEFORE calling Write
+	// But we can test the closed send queue path which returns BEFORE calling Write
 
 	// Create a partially initialized connection
 	conn := &wsConnection{
-		server:   server,
-		ctx:      ctx,
-		cancel:   cancel,
-		sendChan: make(chan []byte),
-		// conn field is nil, but writerLoop shouldn't touch it if sendChan is closed
+		server:    server,
+		ctx:       ctx,
+		cancel:    cancel,
+		sendQueue: newSendQueue(),
+		// conn field is nil, but writerLoop shouldn't touch it if the queue is closed
 	}
 
 	// Start writerLoop in a goroutine
@@ -104,15 +104,15 @@ func TestWriterLoop_SendChanClosed(t *testing.T) {
 		close(done)
 	}()
 
-	// Close sendChan
-	close(conn.sendChan)
+	// Close the send queue
+	conn.sendQueue.close()
 
 	// Wait for writerLoop to exit
 	select {
 	case <-done:
 		// Success
 	case <-time.After(1 * time.Second):
-		t.Fatal("writerLoop did not exit after sendChan closed")
+		t.Fatal("writerLoop did not exit after the send queue closed")
 	}
 }
 
@@ -145,11 +145,11 @@ func TestWriterLoop_WriteError(t *testing.T) {
 	connCtx, cancel := context.WithCancel(context.Background())
 
 	c := &wsConnection{
-		conn:     wsConn,
-		server:   server,
-		ctx:      connCtx,
-		cancel:   cancel,
-		sendChan: make(chan []byte, 1),
+		conn:      wsConn,
+		server:    server,
+		ctx:       connCtx,
+		cancel:    cancel,
+		sendQueue: newSendQueue(),
 	}
 
 	// Close the underlying connection to force write error
@@ -164,7 +164,9 @@ func TestWriterLoop_WriteError(t *testing.T) {
 	}()
 
 	// Send a frame
-	c.sendChan <- []byte("test")
+	if err := c.sendQueue.push(ctx, []byte("test")); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
 
 	// writerLoop should try to write, fail, and exit
 	select {
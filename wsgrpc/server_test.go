@@ -2,6 +2,7 @@ package wsgrpc
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -588,8 +589,8 @@ func TestRejectedClientStreamDoesNotWedgeConnection(t *testing.T) {
 	}
 }
 
-// TestGracefulShutdown verifies that Server.Shutdown sends RST_STREAM to active streams
-// and waits for connections to close gracefully
+// TestGracefulShutdown verifies that Server.Shutdown sends GOAWAY (RST_STREAM on stream 0)
+// naming the last accepted stream and waits for connections to close gracefully
 func TestGracefulShutdown(t *testing.T) {
 	// Create a test server
 	server := NewServer(ServerOption{
@@ -668,7 +669,7 @@ func TestGracefulShutdown(t *testing.T) {
 		shutdownDone <- server.Shutdown(shutdownCtx)
 	}()
 
-	// Client should receive RST_STREAM frame
+	// Client should receive GOAWAY frame
 	readCtx, readCancel := context.WithTimeout(ctx, 2*time.Second)
 	defer readCancel()
 
@@ -693,7 +694,10 @@ func TestGracefulShutdown(t *testing.T) {
 		if frame.Flags&FlagRST_STREAM != 0 {
 			receivedRstStream = true
 			t.Logf("Received RST_STREAM for stream %d during shutdown", frame.StreamID)
-			// Close the connection gracefully after receiving RST_STREAM to allow server shutdown to complete
+			if frame.StreamID != 0 || len(frame.Payload) != 8 || binary.BigEndian.Uint32(frame.Payload[0:4]) != streamID {
+				t.Errorf("Expected GOAWAY with last stream %d, got stream %d payload %v", streamID, frame.StreamID, frame.Payload)
+			}
+			// Close the connection gracefully after receiving GOAWAY to allow server shutdown to complete
 			if err := conn.Close(websocket.StatusNormalClosure, "shutdown acknowledged"); err != nil {
 				t.Logf("Failed to close connection: %v", err)
 			}
@@ -702,7 +706,7 @@ func TestGracefulShutdown(t *testing.T) {
 	}
 
 	if !receivedRstStream {
-		t.Error("Expected to receive RST_STREAM frame during shutdown")
+		t.Error("Expected to receive GOAWAY frame during shutdown")
 	}
 
 	// Wait for shutdown to complete
@@ -1065,6 +1069,9 @@ func TestOversizedHeadersFrame(t *testing.T) {
 		}
 	}()
 
+	// The server announces its limits before anything else
+	readSettings(t, ctx, conn)
+
 	// Create oversized HEADERS payload (2KB, exceeds 1KB limit)
 	oversizedHeaders := "path: /test.Service/TestMethod\n"
 	// Pad with many header fields to exceed limit
@@ -1291,6 +1298,9 @@ func TestPingPongHandling(t *testing.T) {
 		}
 	}()
 
+	// Skip the SETTINGS frame the server sends first
+	readSettings(t, ctx, conn)
+
 	// Send a PING frame
 	pingFrame := encodeFrame(0, FlagPING, []byte{})
 	if err := conn.Write(ctx, websocket.MessageBinary, pingFrame); err != nil {
@@ -1578,13 +1588,8 @@ func TestSendChannelClosed(t *testing.T) {
 		t.Fatal("Timeout waiting for stream")
 	}
 
-	// Close the send channel directly to simulate closed channel scenario
-	wsStream.conn.mu.Lock()
-	if !wsStream.conn.sendClosed {
-		close(wsStream.conn.sendChan)
-		wsStream.conn.sendClosed = true
-	}
-	wsStream.conn.mu.Unlock()
+	// Close the send queue directly to simulate closed channel scenario
+	wsStream.conn.sendQueue.close()
 
 	// Try to send a message - should get error
 	resp := &pb.HelloResponse{Message: "test"}
@@ -1766,11 +1771,13 @@ func TestServerInitiatedKeepAliveTimeout(t *testing.T) {
 func TestUnaryInterceptor(t *testing.T) {
 	interceptorCalled := false
 	var capturedMethod string
+	var capturedReq interface{}
 
 	// Create an interceptor that sets a flag
 	testInterceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		interceptorCalled = true
 		capturedMethod = info.FullMethod
+		capturedReq = req
 		t.Logf("Interceptor called for method: %s", info.FullMethod)
 		return handler(ctx, req)
 	}
@@ -1790,12 +1797,20 @@ func TestUnaryInterceptor(t *testing.T) {
 		Methods: []grpc.MethodDesc{
 			{
 				MethodName: "SayHello",
+				// Shaped like a protoc-gen-go-grpc handler: decode, then run the interceptor
 				Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-					req := &pb.HelloRequest{}
-					if err := dec(req); err != nil {
+					in := &pb.HelloRequest{}
+					if err := dec(in); err != nil {
 						return nil, err
 					}
-					return &pb.HelloResponse{Message: "Hello, " + req.Name}, nil
+					handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+						return &pb.HelloResponse{Message: "Hello, " + req.(*pb.HelloRequest).Name}, nil
+					}
+					if interceptor == nil {
+						return handler(ctx, in)
+					}
+					info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/greeter.Greeter/SayHello"}
+					return interceptor(ctx, in, info, handler)
 				},
 			},
 		},
@@ -1867,6 +1882,10 @@ func TestUnaryInterceptor(t *testing.T) {
 		t.Errorf("Interceptor received wrong method: got %s, want /greeter.Greeter/SayHello", capturedMethod)
 	}
 
+	if req, ok := capturedReq.(*pb.HelloRequest); !ok || req.GetName() != "World" {
+		t.Errorf("Interceptor received wrong request: got %#v, want decoded HelloRequest{Name: World}", capturedReq)
+	}
+
 	t.Log("Unary interceptor test completed")
 }
 
@@ -1904,12 +1923,18 @@ func TestUnaryInterceptorChaining(t *testing.T) {
 			{
 				MethodName: "SayHello",
 				Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-					callOrder = append(callOrder, "handler")
-					req := &pb.HelloRequest{}
-					if err := dec(req); err != nil {
+					in := &pb.HelloRequest{}
+					if err := dec(in); err != nil {
 						return nil, err
 					}
-					return &pb.HelloResponse{Message: "Hello"}, nil
+					handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+						callOrder = append(callOrder, "handler")
+						return &pb.HelloResponse{Message: "Hello"}, nil
+					}
+					if interceptor == nil {
+						return handler(ctx, in)
+					}
+					return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/greeter.Greeter/SayHello"}, handler)
 				},
 			},
 		},
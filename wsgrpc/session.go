@@ -0,0 +1,421 @@
+package wsgrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// defaultSessionResumeWindow is how long a session survives without a connection when
+// ServerOption leaves SessionResumeWindow unset.
+const defaultSessionResumeWindow = 30 * time.Second
+
+// Session is the logical state of a client that survives reconnects (PROTOCOL.md
+// Section 5.6): the authenticated principal and other connection-scoped values set by
+// handlers or interceptors, and the resumable streams opened on it. The server issues
+// it at connect; a client that reconnects within SessionResumeWindow and presents its
+// ID and secret is attached to it again.
+//
+// The Session lives in the server that issued or resumed it. The SessionStore only
+// keeps its SessionRecord, so a server sharing the store can resume it as well: the
+// client keeps its session ID and metadata there, while principal, values and
+// resumable streams stay behind.
+type Session struct {
+	id     string
+	secret string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	principal interface{}
+	values    map[interface{}]interface{}
+	metadata  map[string]string
+	conn      *wsConnection // The connection attached to the session; nil while away
+	timer     *time.Timer   // Resume window while detached
+	expires   time.Time     // ExpiresAt of the record last put by this server
+}
+
+// ID returns the session ID, which is also its key in the SessionStore.
+func (s *Session) ID() string { return s.id }
+
+// Context returns a context that is done once the session ended, i.e. its client did
+// not come back within the resume window or the server stopped.
+func (s *Session) Context() context.Context { return s.ctx }
+
+// Principal returns the value set with SetPrincipal, or nil.
+func (s *Session) Principal() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.principal
+}
+
+// SetPrincipal records who the client authenticated as, typically from an interceptor
+// on the first call, so that later calls and reconnects need not authenticate again.
+func (s *Session) SetPrincipal(principal interface{}) {
+	s.mu.Lock()
+	s.principal = principal
+	s.mu.Unlock()
+}
+
+// Value returns the session value for key, or nil.
+func (s *Session) Value(key interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+// SetValue stores a session value. Keys should be of an unexported type, as with
+// context.WithValue.
+func (s *Session) SetValue(key, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[interface{}]interface{})
+	}
+	s.values[key] = value
+}
+
+// Metadata returns the session metadata for key, or "".
+func (s *Session) Metadata(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metadata[key]
+}
+
+// SetMetadata stores session metadata. Unlike values, metadata is part of the
+// SessionRecord, so it reaches the SessionStore once the client connects or goes away
+// and survives a resume on another server sharing the store.
+func (s *Session) SetMetadata(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.metadata == nil {
+		s.metadata = make(map[string]string)
+	}
+	s.metadata[key] = value
+}
+
+// putRecordLocked puts the SessionRecord of the session, expiring at expires, in the
+// store. The caller holds mu, so that records of the session are put in order.
+func (s *Session) putRecordLocked(ctx context.Context, store SessionStore, expires time.Time) error {
+	record := &SessionRecord{ID: s.id, SecretHash: hashSecret(s.secret), ExpiresAt: expires}
+	if len(s.metadata) > 0 {
+		record.Metadata = make(map[string]string, len(s.metadata))
+		for k, v := range s.metadata {
+			record.Metadata[k] = v
+		}
+	}
+	s.expires = expires
+	return store.Put(ctx, record)
+}
+
+// sessionKey is the context key of a stream's Session.
+type sessionKey struct{}
+
+// SessionFromContext returns the session of the connection a call arrived on, or nil
+// when the server does not issue sessions. Calls opened after the client resumed a
+// session see the resumed one.
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+// SessionRecord is what a SessionStore keeps of a session: enough to verify a client
+// resuming it, but not the secret itself.
+type SessionRecord struct {
+	ID string
+	// SecretHash is the SHA-256 hash of the session secret
+	SecretHash []byte
+	// ExpiresAt is when the session ends unless a client resumes it; zero while a
+	// client is connected. Stores may drop expired records, and must otherwise return
+	// it as put: a server tells from it whether another one resumed the session.
+	ExpiresAt time.Time
+	// Metadata is the session metadata set with Session.SetMetadata
+	Metadata map[string]string
+}
+
+// verify reports whether secret is the secret of the session.
+func (r *SessionRecord) verify(secret string) bool {
+	return subtle.ConstantTimeCompare(r.SecretHash, hashSecret(secret)) == 1
+}
+
+// expired reports whether the record expired at now.
+func (r *SessionRecord) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// hashSecret returns the SHA-256 hash of a session secret.
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// SessionStore keeps the records of the sessions clients may resume. The server puts
+// a record when it issues a session and whenever a client connects to it or goes away,
+// and deletes it when the session ends; lookups happen when a client presents a
+// session ID. Servers sharing a store let clients resume on any of them.
+// Implementations must be safe for concurrent use.
+type SessionStore interface {
+	// Put adds or replaces the record of a session.
+	Put(ctx context.Context, record *SessionRecord) error
+	// Get returns the record of the session with the given ID, or nil if there is none.
+	Get(ctx context.Context, id string) (*SessionRecord, error)
+	// Delete removes the record of the session with the given ID. Deleting an unknown
+	// session is not an error.
+	Delete(ctx context.Context, id string) error
+}
+
+// MemorySessionStore is a SessionStore that keeps session records in memory. It is the
+// default when sessions are enabled without a store.
+type MemorySessionStore struct {
+	mu      sync.Mutex
+	records map[string]*SessionRecord
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{records: make(map[string]*SessionRecord)}
+}
+
+// Put adds or replaces the record of a session.
+func (m *MemorySessionStore) Put(_ context.Context, record *SessionRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[record.ID] = record
+	return nil
+}
+
+// Get returns the record of the session with the given ID, or nil.
+func (m *MemorySessionStore) Get(_ context.Context, id string) (*SessionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.records[id], nil
+}
+
+// Delete removes the record of the session with the given ID.
+func (m *MemorySessionStore) Delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, id)
+	return nil
+}
+
+// Len returns the number of stored records.
+func (m *MemorySessionStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.records)
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newSession issues a session for a new connection and puts its record in the store.
+func (s *Server) newSession(ctx context.Context, conn *wsConnection) (*Session, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session secret: %w", err)
+	}
+	session := &Session{id: id, secret: secret, conn: conn}
+	session.ctx, session.cancel = context.WithCancel(context.Background())
+	if err := session.putRecordLocked(ctx, s.options.SessionStore, time.Time{}); err != nil {
+		session.cancel()
+		return nil, fmt.Errorf("failed to store session: %w", err)
+	}
+	s.sessionsMu.Lock()
+	s.sessions[id] = session
+	s.sessionsMu.Unlock()
+	return session, nil
+}
+
+// lookupSession returns the live session of a stored record, creating it from the
+// record if another server sharing the store issued the session. It returns nil if the
+// session is ending.
+func (s *Server) lookupSession(record *SessionRecord, secret string) *Session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if session := s.sessions[record.ID]; session != nil {
+		if session.ctx.Err() != nil {
+			return nil
+		}
+		return session
+	}
+	session := &Session{id: record.ID, secret: secret}
+	for k, v := range record.Metadata {
+		session.SetMetadata(k, v)
+	}
+	session.ctx, session.cancel = context.WithCancel(context.Background())
+	s.sessions[record.ID] = session
+	return session
+}
+
+// resumeSession attaches the connection to the session the client presented in its
+// SETTINGS, in place of the one issued at connect. It reports false, leaving the
+// connection's session alone, if the session is unknown, ended, or the secret is wrong.
+func (c *wsConnection) resumeSession(id, secret string) bool {
+	s := c.server
+	record, err := s.options.SessionStore.Get(c.ctx, id)
+	if err != nil {
+		log.Printf("[wsgrpc] Failed to look up session: %v", err)
+		return false
+	}
+	var session *Session
+	if record != nil && record.verify(secret) && !record.expired(time.Now()) {
+		session = s.lookupSession(record, secret)
+	}
+	if session == nil {
+		if s.options.EnableLogging {
+			log.Printf("[wsgrpc] Refusing to resume session %s", truncateForLog(id))
+		}
+		return false
+	}
+
+	c.mu.Lock()
+	issued := c.session
+	c.session = session
+	c.mu.Unlock()
+	if issued == session {
+		return true
+	}
+
+	session.mu.Lock()
+	previous := session.conn
+	session.conn = c
+	if session.timer != nil {
+		session.timer.Stop()
+		session.timer = nil
+	}
+	// Under mu, so that the record of a concurrent detach cannot overtake this one
+	if err := session.putRecordLocked(c.ctx, s.options.SessionStore, time.Time{}); err != nil {
+		log.Printf("[wsgrpc] Failed to store session: %v", err)
+	}
+	session.mu.Unlock()
+
+	// The client may come back before its old connection noticed it was gone
+	if previous != nil {
+		previous.closeNow(websocket.StatusGoingAway, "session resumed on another connection")
+	}
+	if issued != nil {
+		s.endSession(issued)
+	}
+	if s.options.EnableLogging {
+		log.Printf("[wsgrpc] Resumed session %s", session.id)
+	}
+	return true
+}
+
+// detachSession starts the resume window of the connection's session once the
+// connection is gone.
+func (c *wsConnection) detachSession() {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if session == nil {
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.conn != c || session.ctx.Err() != nil {
+		return
+	}
+	session.conn = nil
+	window := c.server.options.SessionResumeWindow
+	if err := session.putRecordLocked(context.Background(), c.server.options.SessionStore, time.Now().Add(window)); err != nil {
+		log.Printf("[wsgrpc] Failed to store session: %v", err)
+	}
+	session.timer = time.AfterFunc(window, func() {
+		session.mu.Lock()
+		expired := session.conn == nil
+		session.mu.Unlock()
+		if expired {
+			c.server.retireSession(session)
+		}
+	})
+}
+
+// endSession removes a session from the server and the store and cancels its context.
+func (s *Server) endSession(session *Session) {
+	if err := s.options.SessionStore.Delete(context.Background(), session.id); err != nil {
+		log.Printf("[wsgrpc] Failed to delete session: %v", err)
+	}
+	s.dropSession(session)
+}
+
+// retireSession ends a session this server is done with, unless a server sharing the
+// store resumed it meanwhile: then the session only leaves this server.
+func (s *Server) retireSession(session *Session) {
+	session.mu.Lock()
+	expires := session.expires
+	session.mu.Unlock()
+	record, err := s.options.SessionStore.Get(context.Background(), session.id)
+	if err == nil && record != nil && !record.ExpiresAt.Equal(expires) {
+		s.dropSession(session)
+		return
+	}
+	s.endSession(session)
+}
+
+// dropSession removes a session from the server and cancels its context.
+func (s *Server) dropSession(session *Session) {
+	s.sessionsMu.Lock()
+	if s.sessions[session.id] == session {
+		delete(s.sessions, session.id)
+	}
+	s.sessionsMu.Unlock()
+	session.mu.Lock()
+	if session.timer != nil {
+		session.timer.Stop()
+		session.timer = nil
+	}
+	session.mu.Unlock()
+	session.cancel()
+	if s.options.EnableLogging {
+		log.Printf("[wsgrpc] Session %s ended", session.id)
+	}
+}
+
+// endSessions retires every live session of the server when it stops.
+func (s *Server) endSessions() {
+	s.sessionsMu.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessionsMu.Unlock()
+	for _, session := range sessions {
+		s.retireSession(session)
+	}
+}
+
+// sessionSettings returns the SETTINGS announcing the connection's session in addition
+// to the server's limits.
+func (c *wsConnection) sessionSettings(resumed bool) Settings {
+	settings := c.server.settings(c.version)
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if session != nil {
+		settings.SessionID = session.id
+		settings.SessionSecret = session.secret
+		settings.SessionResumed = resumed
+	}
+	return settings
+}
@@ -0,0 +1,277 @@
+package wsgrpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// callCountKey is the session value counting the calls of a session
+type callCountKey struct{}
+
+// sessionGreeter remembers the caller's principal and counts its calls in the session
+type sessionGreeter struct {
+	pb.UnimplementedGreeterServer
+}
+
+func (g *sessionGreeter) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	session := SessionFromContext(ctx)
+	if session == nil {
+		return &pb.HelloResponse{Message: "no session"}, nil
+	}
+	if md, _ := metadata.FromIncomingContext(ctx); len(md.Get("user")) > 0 {
+		session.SetPrincipal(md.Get("user")[0])
+		session.SetMetadata("user", md.Get("user")[0])
+	}
+	calls, _ := session.Value(callCountKey{}).(int)
+	session.SetValue(callCountKey{}, calls+1)
+	return &pb.HelloResponse{Message: fmt.Sprintf("%v #%d", session.Principal(), calls+1)}, nil
+}
+
+// newSessionTestServer starts a server with sessions and returns it with its URL
+func newSessionTestServer(t *testing.T, opt ServerOption) (*Server, string) {
+	t.Helper()
+	opt.InsecureSkipVerify = true
+	opt.EnableSessions = true
+	server := NewServer(opt)
+	pb.RegisterGreeterServer(server, &sessionGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	t.Cleanup(httpServer.Close)
+	return server, "ws" + httpServer.URL[4:]
+}
+
+// liveSession returns the live session of the server with the given ID, or nil
+func liveSession(server *Server, id string) *Session {
+	server.sessionsMu.Lock()
+	defer server.sessionsMu.Unlock()
+	return server.sessions[id]
+}
+
+// sayHello calls SayHello on a new connection with the given options and returns the
+// connection's settings and the response
+func sayHello(t *testing.T, ctx context.Context, url string, opt ClientOption, kv ...string) (*ClientConn, Settings, string) {
+	t.Helper()
+	conn, err := Dial(ctx, url, opt)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	settings, _ := conn.ServerSettings()
+
+	resp, err := pb.NewGreeterClient(conn).SayHello(metadata.AppendToOutgoingContext(ctx, kv...), &pb.HelloRequest{Name: "session"})
+	if err != nil {
+		t.Fatalf("SayHello failed: %v", err)
+	}
+	return conn, settings, resp.GetMessage()
+}
+
+// TestSessionResumption verifies that a client reconnecting with its session ID and
+// secret gets its principal and session values back, and that a wrong secret gets a
+// fresh session
+func TestSessionResumption(t *testing.T) {
+	_, url := newSessionTestServer(t, ServerOption{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, settings, msg := sayHello(t, ctx, url, ClientOption{}, "user", "alice")
+	t.Logf("Session %s: %s", settings.SessionID, msg)
+	if settings.SessionID == "" || settings.SessionSecret == "" || settings.SessionResumed {
+		t.Fatalf("Expected a new session in the SETTINGS, got %+v", settings)
+	}
+	if msg != "alice #1" {
+		t.Errorf("Response %q, want %q", msg, "alice #1")
+	}
+	_ = first.Close()
+
+	for _, textMetadata := range []bool{false, true} {
+		opt := ClientOption{SessionID: settings.SessionID, SessionSecret: settings.SessionSecret, TextMetadata: textMetadata}
+		conn, resumed, msg := sayHello(t, ctx, url, opt)
+		t.Logf("Resumed (text=%v): %s", textMetadata, msg)
+		if !resumed.SessionResumed || resumed.SessionID != settings.SessionID {
+			t.Errorf("Expected session %s to be resumed, got %+v", settings.SessionID, resumed)
+		}
+		if resumed.MaxConcurrentStreams == 0 {
+			t.Error("Expected the connection limits in the SETTINGS that resume the session")
+		}
+		_ = conn.Close()
+	}
+	if _, _, msg := sayHello(t, ctx, url, ClientOption{SessionID: settings.SessionID, SessionSecret: settings.SessionSecret}); msg != "alice #4" {
+		t.Errorf("Expected the fourth call of alice's session, got %q", msg)
+	}
+
+	_, other, msg := sayHello(t, ctx, url, ClientOption{SessionID: settings.SessionID, SessionSecret: "wrong"})
+	if other.SessionResumed || other.SessionID == settings.SessionID {
+		t.Errorf("Expected a wrong secret to get a new session, got %+v", other)
+	}
+	if msg != "<nil> #1" {
+		t.Errorf("Expected a fresh session without principal, got %q", msg)
+	}
+}
+
+// TestSessionResumeWindow verifies that a session ends when its client does not come
+// back in time
+func TestSessionResumeWindow(t *testing.T) {
+	store := NewMemorySessionStore()
+	server, url := newSessionTestServer(t, ServerOption{SessionStore: store, SessionResumeWindow: 50 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, settings, _ := sayHello(t, ctx, url, ClientOption{})
+	record, _ := store.Get(ctx, settings.SessionID)
+	if record == nil || !record.ExpiresAt.IsZero() {
+		t.Fatalf("Expected the record of a connected session in the store, got %+v", record)
+	}
+	if string(record.SecretHash) == settings.SessionSecret || !record.verify(settings.SessionSecret) {
+		t.Error("Expected the store to keep the hash of the secret")
+	}
+	session := liveSession(server, settings.SessionID)
+	if session == nil {
+		t.Fatal("Expected the session to be live")
+	}
+	_ = conn.Close()
+
+	select {
+	case <-session.Context().Done():
+	case <-ctx.Done():
+		t.Fatal("Session did not end after the resume window")
+	}
+	if store.Len() != 0 {
+		t.Errorf("Expected the ended session to be deleted, %d left", store.Len())
+	}
+
+	_, resumed, _ := sayHello(t, ctx, url, ClientOption{SessionID: settings.SessionID, SessionSecret: settings.SessionSecret})
+	if resumed.SessionResumed {
+		t.Error("Expected an ended session not to be resumed")
+	}
+}
+
+// TestSessionsAreOptIn verifies that no session is issued by default
+func TestSessionsAreOptIn(t *testing.T) {
+	_, client, conn := newTestClientWith(t, &sessionGreeter{}, nil, ClientOption{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if settings, _ := conn.ServerSettings(); settings.SessionID != "" {
+		t.Errorf("Unexpected session %s", settings.SessionID)
+	}
+	if resp, err := client.SayHello(ctx, &pb.HelloRequest{}); err != nil || resp.GetMessage() != "no session" {
+		t.Errorf("Expected no session in the handler, got %v (err=%v)", resp, err)
+	}
+}
+
+// TestResumableStreamBelongsToSession verifies that with sessions enabled only the
+// session a resumable stream was opened in can resume it
+func TestResumableStreamBelongsToSession(t *testing.T) {
+	greeter, url := newResumeTestServer(t, ServerOption{EnableSessions: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn := dialRaw(t, ctx, url)
+	settings := readSettings(t, ctx, conn)
+	openTicker(t, ctx, conn, 1, resumableKey, "1")
+	feedTicks(t, ctx, greeter, 0, 1)
+	token := readTicks(t, ctx, conn, 1, 1).token
+
+	// Another session cannot take the stream over
+	other := dialRaw(t, ctx, url)
+	openTicker(t, ctx, other, 1, resumeTokenKey, token, resumeSeqKey, "1")
+	if st := readTicks(t, ctx, other, 1, -1).trailer.Get("grpc-status"); len(st) == 0 || st[0] != "5" {
+		t.Errorf("Expected grpc-status 5 from another session, got %v", st)
+	}
+
+	// The same session on a new connection can
+	resumed := dialRaw(t, ctx, url)
+	writeFrame(t, ctx, resumed, encodeSettings(Settings{SessionID: settings.SessionID, SessionSecret: settings.SessionSecret}, false))
+	openTicker(t, ctx, resumed, 1, resumeTokenKey, token, resumeSeqKey, "1")
+	feedTicks(t, ctx, greeter, 1, 2)
+	if read := readTicks(t, ctx, resumed, 1, 1); read.seqs[0] != 2 {
+		t.Errorf("Expected the stream to continue with sequence 2, got %v", read.seqs)
+	}
+}
+
+// TestSessionsEndOnStop verifies that Stop and Shutdown end the sessions of connected
+// and of detached clients
+func TestSessionsEndOnStop(t *testing.T) {
+	for _, name := range []string{"Stop", "Shutdown"} {
+		t.Run(name, func(t *testing.T) {
+			store := NewMemorySessionStore()
+			server, url := newSessionTestServer(t, ServerOption{SessionStore: store, SessionResumeWindow: time.Minute})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			detached, first, _ := sayHello(t, ctx, url, ClientOption{})
+			_, second, _ := sayHello(t, ctx, url, ClientOption{})
+			sessions := []*Session{liveSession(server, first.SessionID), liveSession(server, second.SessionID)}
+			_ = detached.Close()
+
+			if name == "Stop" {
+				server.Stop()
+			} else if err := server.Shutdown(ctx); err != nil {
+				t.Fatalf("Shutdown failed: %v", err)
+			}
+			for i, session := range sessions {
+				select {
+				case <-session.Context().Done():
+				case <-ctx.Done():
+					t.Fatalf("Session %d did not end", i)
+				}
+			}
+			if store.Len() != 0 {
+				t.Errorf("Expected the ended sessions to be deleted, %d left", store.Len())
+			}
+		})
+	}
+}
+
+// TestSessionSharedStore verifies that a client resumes its session on another server
+// sharing the store, with its metadata, and that the first server then lets go of it
+func TestSessionSharedStore(t *testing.T) {
+	store := NewMemorySessionStore()
+	first, firstURL := newSessionTestServer(t, ServerOption{SessionStore: store, SessionResumeWindow: 50 * time.Millisecond})
+	second, secondURL := newSessionTestServer(t, ServerOption{SessionStore: store, SessionResumeWindow: 50 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, settings, _ := sayHello(t, ctx, firstURL, ClientOption{}, "user", "alice")
+	session := liveSession(first, settings.SessionID)
+	_ = conn.Close()
+	for {
+		if record, _ := store.Get(ctx, settings.SessionID); record != nil && !record.ExpiresAt.IsZero() {
+			t.Logf("Detached session expires at %v with metadata %v", record.ExpiresAt, record.Metadata)
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("Session was not detached")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	_, resumed, msg := sayHello(t, ctx, secondURL, ClientOption{SessionID: settings.SessionID, SessionSecret: settings.SessionSecret})
+	t.Logf("Resumed on the second server: %s", msg)
+	if !resumed.SessionResumed || resumed.SessionID != settings.SessionID {
+		t.Fatalf("Expected the session to be resumed, got %+v", resumed)
+	}
+	moved := liveSession(second, settings.SessionID)
+	if moved == nil || moved.Metadata("user") != "alice" || moved.Principal() != nil {
+		t.Errorf("Expected the metadata but not the principal to move to the second server")
+	}
+
+	// The first server's resume window passes without deleting the resumed session
+	select {
+	case <-session.Context().Done():
+	case <-ctx.Done():
+		t.Fatal("Session did not leave the first server")
+	}
+	if record, _ := store.Get(ctx, settings.SessionID); record == nil || moved.Context().Err() != nil {
+		t.Error("Expected the session to live on on the second server")
+	}
+}
@@ -0,0 +1,244 @@
+package wsgrpc
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Keys of the SETTINGS metadata block (PROTOCOL.md Section 5.5). Durations are sent in
+// milliseconds; receivers ignore keys they do not know.
+const (
+	settingMaxPayloadSize        = "max-payload-size"
+	settingMaxMessageSize        = "max-message-size"
+	settingMaxConcurrentStreams  = "max-concurrent-streams"
+	settingKeepAliveInterval     = "keepalive-interval-ms"
+	settingIdleTimeout           = "idle-timeout-ms"
+	settingInitialWindowSize     = "initial-window-size"
+	settingInitialConnWindowSize = "initial-conn-window-size"
+	settingCodecs                = "codecs"
+	settingCompressors           = "compressors"
+	settingFramePacking          = "frame-packing"
+	settingSessionID             = "session-id"
+	settingSessionSecret         = "session-secret"
+	settingSessionResumed        = "session-resumed"
+)
+
+// Settings are the connection limits a peer announces in its SETTINGS frame right after
+// the WebSocket handshake. Zero values mean the limit was not announced (or, for
+// KeepAliveInterval, that keepalive PINGs are disabled).
+type Settings struct {
+	// MaxPayloadSize is the largest frame payload the sender accepts
+	MaxPayloadSize uint32
+	// MaxMessageSize is the largest message, possibly fragmented, the sender accepts
+	MaxMessageSize uint32
+	// MaxConcurrentStreams is the number of streams the sender serves at once; streams
+	// above it are rejected with RST_STREAM RESOURCE_EXHAUSTED
+	MaxConcurrentStreams uint32
+	// KeepAliveInterval is how often the sender PINGs an otherwise quiet connection
+	KeepAliveInterval time.Duration
+	// IdleTimeout is how long a stream may be inactive before the sender closes it
+	IdleTimeout time.Duration
+	// InitialWindowSize and InitialConnWindowSize are the receive windows used once
+	// flow control is enabled (PROTOCOL.md Section 7.2)
+	InitialWindowSize     uint32
+	InitialConnWindowSize uint32
+	// Codecs are the content-subtypes the sender understands (e.g. "proto", "json")
+	Codecs []string
+	// Compressors are the grpc-encoding values the sender can decompress (e.g. "gzip")
+	Compressors []string
+	// FramePacking reports that the sender reads WebSocket messages packing several
+	// frames (PROTOCOL.md Section 2.3)
+	FramePacking bool
+	// SessionID and SessionSecret identify the session of the connection (PROTOCOL.md
+	// Section 5.6). The server announces the session it issued or resumed; a client
+	// sends those of an earlier connection to resume that session.
+	SessionID     string
+	SessionSecret string
+	// SessionResumed reports that the server attached the connection to the session
+	// the client presented
+	SessionResumed bool
+}
+
+// encodeSettings encodes a SETTINGS frame: HEADERS on stream 0 carrying the settings as
+// a metadata block in the given format.
+func encodeSettings(s Settings, binaryFormat bool) []byte {
+	md := metadata.MD{}
+	setUint := func(key string, v uint64) {
+		if v != 0 {
+			md.Set(key, strconv.FormatUint(v, 10))
+		}
+	}
+	setUint(settingMaxPayloadSize, uint64(s.MaxPayloadSize))
+	setUint(settingMaxMessageSize, uint64(s.MaxMessageSize))
+	setUint(settingMaxConcurrentStreams, uint64(s.MaxConcurrentStreams))
+	md.Set(settingKeepAliveInterval, strconv.FormatInt(s.KeepAliveInterval.Milliseconds(), 10))
+	setUint(settingIdleTimeout, uint64(s.IdleTimeout.Milliseconds()))
+	setUint(settingInitialWindowSize, uint64(s.InitialWindowSize))
+	setUint(settingInitialConnWindowSize, uint64(s.InitialConnWindowSize))
+	if len(s.Codecs) > 0 {
+		md.Set(settingCodecs, s.Codecs...)
+	}
+	if len(s.Compressors) > 0 {
+		md.Set(settingCompressors, s.Compressors...)
+	}
+	if s.FramePacking {
+		md.Set(settingFramePacking, "1")
+	}
+	if s.SessionID != "" {
+		md.Set(settingSessionID, s.SessionID)
+		md.Set(settingSessionSecret, s.SessionSecret)
+	}
+	if s.SessionResumed {
+		md.Set(settingSessionResumed, "1")
+	}
+	// The keys are the setting names, far below the limits of the binary format
+	block, _ := encodeMetadataBlock(md, binaryFormat)
+	return encodeFrame(0, FlagHEADERS, block)
+}
+
+// encodeSettingsAck encodes the acknowledgement of a received SETTINGS frame.
+func encodeSettingsAck() []byte {
+	return encodeFrame(0, FlagHEADERS|FlagACK, nil)
+}
+
+// decodeSettings parses the payload of a SETTINGS frame. Unknown keys are skipped so
+// that future settings do not break older peers; a malformed number is an error.
+func decodeSettings(payload []byte) (Settings, error) {
+	md, _, err := decodeMetadataBlock(payload)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	var s Settings
+	var parseErr error
+	parseUint := func(key string) uint32 {
+		values := md.Get(key)
+		if len(values) == 0 || parseErr != nil {
+			return 0
+		}
+		v, err := strconv.ParseUint(values[0], 10, 32)
+		if err != nil {
+			parseErr = fmt.Errorf("invalid setting %s: %w", key, err)
+		}
+		return uint32(v)
+	}
+	s.MaxPayloadSize = parseUint(settingMaxPayloadSize)
+	s.MaxMessageSize = parseUint(settingMaxMessageSize)
+	s.MaxConcurrentStreams = parseUint(settingMaxConcurrentStreams)
+	s.KeepAliveInterval = time.Duration(parseUint(settingKeepAliveInterval)) * time.Millisecond
+	s.IdleTimeout = time.Duration(parseUint(settingIdleTimeout)) * time.Millisecond
+	s.InitialWindowSize = parseUint(settingInitialWindowSize)
+	s.InitialConnWindowSize = parseUint(settingInitialConnWindowSize)
+	s.Codecs = md.Get(settingCodecs)
+	s.Compressors = md.Get(settingCompressors)
+	s.FramePacking = parseUint(settingFramePacking) != 0
+	if values := md.Get(settingSessionID); len(values) > 0 {
+		s.SessionID = values[0]
+	}
+	if values := md.Get(settingSessionSecret); len(values) > 0 {
+		s.SessionSecret = values[0]
+	}
+	s.SessionResumed = parseUint(settingSessionResumed) != 0
+	if parseErr != nil {
+		return Settings{}, parseErr
+	}
+	return s, nil
+}
+
+// settings returns the limits the server announces to a new connection.
+func (s *Server) settings(version ProtocolVersion) Settings {
+	compressors := []string{"gzip"}
+	if s.options.Compressor != "" && s.options.Compressor != "gzip" {
+		compressors = append(compressors, s.options.Compressor)
+	}
+	return Settings{
+		MaxPayloadSize:        s.options.MaxPayloadSize,
+		MaxMessageSize:        s.options.MaxMessageSize,
+		MaxConcurrentStreams:  s.options.MaxConcurrentStreams,
+		KeepAliveInterval:     s.options.KeepAliveInterval,
+		IdleTimeout:           s.options.IdleTimeout,
+		InitialWindowSize:     s.options.InitialWindowSize,
+		InitialConnWindowSize: s.options.InitialConnWindowSize,
+		Codecs:                []string{"proto", "json"},
+		Compressors:           compressors,
+		FramePacking:          version.framePacking(),
+	}
+}
+
+// handleSettings processes a SETTINGS frame or the acknowledgement of the server's own.
+// Client settings bound the messages sent to the client (see maxFragmentSize).
+func (c *wsConnection) handleSettings(frame *Frame) {
+	if frame.Flags&FlagACK != 0 {
+		if len(frame.Payload) != 0 {
+			c.connectionError(ErrCodeFrameSizeError, "SETTINGS acknowledgement with a payload")
+			return
+		}
+		if c.server.options.EnableLogging {
+			log.Printf("[wsgrpc] Client acknowledged SETTINGS")
+		}
+		return
+	}
+
+	settings, err := decodeSettings(frame.Payload)
+	if err != nil {
+		c.connectionError(ErrCodeProtocolError, fmt.Sprintf("malformed SETTINGS: %v", err))
+		return
+	}
+	if c.server.options.EnableLogging {
+		log.Printf("[wsgrpc] Received client SETTINGS: %+v", settings)
+	}
+	c.mu.Lock()
+	c.peerSettings = settings
+	c.mu.Unlock()
+	if err := c.send(encodeSettingsAck()); err != nil && c.server.options.EnableLogging {
+		log.Printf("[wsgrpc] Failed to acknowledge SETTINGS: %v", err)
+	}
+
+	// A client presenting a session learns from new SETTINGS which session it is in
+	if settings.SessionID != "" && c.server.options.EnableSessions {
+		resumed := c.resumeSession(settings.SessionID, settings.SessionSecret)
+		if err := c.send(encodeSettings(c.sessionSettings(resumed), c.version.binaryMetadata())); err != nil && c.server.options.EnableLogging {
+			log.Printf("[wsgrpc] Failed to send SETTINGS: %v", err)
+		}
+	}
+}
+
+// maxFragmentSize returns the largest DATA payload to send to the client: the
+// max-payload-size from its SETTINGS, otherwise the server's own limit. It is 0 on v1
+// connections, which cannot reassemble fragments.
+func (c *wsConnection) maxFragmentSize() int {
+	if !c.version.fragmentation() {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peerSettings.MaxPayloadSize != 0 {
+		return int(c.peerSettings.MaxPayloadSize)
+	}
+	return int(c.server.options.MaxPayloadSize)
+}
+
+// packLimit returns the size up to which the writer loop packs frames into one
+// WebSocket message, or 0 when frames are written one per message.
+func (c *wsConnection) packLimit() int {
+	if !c.server.options.FramePacking || !c.version.framePacking() {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.peerSettings.FramePacking {
+		return 0
+	}
+	return packLimitFor(c.peerSettings.MaxPayloadSize)
+}
+
+// peerMaxMessageSize returns the max-message-size from the client's SETTINGS, or 0.
+func (c *wsConnection) peerMaxMessageSize() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerSettings.MaxMessageSize
+}
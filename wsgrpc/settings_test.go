@@ -0,0 +1,203 @@
+package wsgrpc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// readSettings reads the SETTINGS frame every server sends first on a new connection
+func readSettings(t *testing.T, ctx context.Context, conn *websocket.Conn) Settings {
+	t.Helper()
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("Expected SETTINGS: %v", err)
+	}
+	frame, err := decodeFrame(data, 4*1024*1024)
+	if err != nil || frame.StreamID != 0 || frame.Flags != FlagHEADERS {
+		t.Fatalf("Expected SETTINGS frame, got %+v (err=%v)", frame, err)
+	}
+	settings, err := decodeSettings(frame.Payload)
+	if err != nil {
+		t.Fatalf("Malformed SETTINGS: %v", err)
+	}
+	return settings
+}
+
+// TestSettingsRoundTrip verifies both metadata formats and that unknown keys are skipped
+func TestSettingsRoundTrip(t *testing.T) {
+	want := Settings{
+		MaxPayloadSize:        1 << 20,
+		MaxConcurrentStreams:  7,
+		KeepAliveInterval:     15 * time.Second,
+		IdleTimeout:           time.Minute,
+		InitialWindowSize:     1024,
+		InitialConnWindowSize: 4096,
+		Codecs:                []string{"proto", "json"},
+		Compressors:           []string{"gzip"},
+		SessionID:             "0123abcd",
+		SessionSecret:         "s3cr3t",
+		SessionResumed:        true,
+	}
+	for _, binaryFormat := range []bool{false, true} {
+		frame, err := decodeFrame(encodeSettings(want, binaryFormat), 4*1024*1024)
+		if err != nil {
+			t.Fatalf("decodeFrame failed: %v", err)
+		}
+		got, err := decodeSettings(frame.Payload)
+		if err != nil {
+			t.Fatalf("decodeSettings failed (binary=%v): %v", binaryFormat, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Round trip (binary=%v) = %+v, want %+v", binaryFormat, got, want)
+		}
+	}
+
+	got, err := decodeSettings([]byte("max-concurrent-streams: 3\nfuture-setting: 42"))
+	if err != nil || got.MaxConcurrentStreams != 3 {
+		t.Errorf("Expected unknown keys to be skipped, got %+v (err=%v)", got, err)
+	}
+	if _, err := decodeSettings([]byte("max-payload-size: lots")); err == nil {
+		t.Error("Expected an error for a malformed number")
+	}
+}
+
+// TestServerSendsSettingsFirst verifies that the SETTINGS frame is the first frame on a
+// new connection, reflects the server options and can be acknowledged
+func TestServerSendsSettingsFirst(t *testing.T) {
+	server := NewServer(ServerOption{
+		InsecureSkipVerify:   true,
+		MaxPayloadSize:       64 * 1024,
+		MaxConcurrentStreams: 5,
+		KeepAliveInterval:    time.Hour,
+		IdleTimeout:          2 * time.Minute,
+	})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	settings := readSettings(t, ctx, conn)
+	t.Logf("Server settings: %+v", settings)
+	if settings.MaxPayloadSize != 64*1024 || settings.MaxConcurrentStreams != 5 ||
+		settings.KeepAliveInterval != time.Hour || settings.IdleTimeout != 2*time.Minute {
+		t.Errorf("SETTINGS do not match the server options: %+v", settings)
+	}
+	if settings.InitialWindowSize != defaultInitialWindowSize || settings.InitialConnWindowSize != defaultInitialConnWindowSize {
+		t.Errorf("Unexpected windows in SETTINGS: %+v", settings)
+	}
+	if !reflect.DeepEqual(settings.Codecs, []string{"proto", "json"}) || !reflect.DeepEqual(settings.Compressors, []string{"gzip"}) {
+		t.Errorf("Unexpected codecs/compressors in SETTINGS: %+v", settings)
+	}
+
+	// The acknowledgement is accepted silently; client SETTINGS are acknowledged
+	writeFrame(t, ctx, conn, encodeSettingsAck())
+	writeFrame(t, ctx, conn, encodeSettings(Settings{MaxPayloadSize: 1024}, false))
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("Expected SETTINGS acknowledgement: %v", err)
+	}
+	if frame, err := decodeFrame(data, 4*1024*1024); err != nil || frame.StreamID != 0 || frame.Flags != FlagHEADERS|FlagACK || len(frame.Payload) != 0 {
+		t.Errorf("Expected SETTINGS acknowledgement, got %+v (err=%v)", frame, err)
+	}
+	expectAlive(t, ctx, conn)
+}
+
+// TestMalformedSettingsAreConnectionErrors verifies that bad SETTINGS frames from the
+// client close the connection
+func TestMalformedSettingsAreConnectionErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		errCode uint32
+	}{
+		{name: "malformed value", frame: encodeFrame(0, FlagHEADERS, []byte("max-payload-size: -1")), errCode: ErrCodeProtocolError},
+		{name: "acknowledgement with payload", frame: encodeFrame(0, FlagHEADERS|FlagACK, []byte{1}), errCode: ErrCodeFrameSizeError},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, conn, ctx := newStateTestConn(t)
+			writeFrame(t, ctx, conn, tc.frame)
+			expectConnectionError(t, ctx, conn, tc.errCode)
+		})
+	}
+}
+
+// TestClientLearnsServerSettings verifies that Dial returns with the server's SETTINGS
+// already applied
+func TestClientLearnsServerSettings(t *testing.T) {
+	_, _, conn := newTestClientWith(t, &testGreeter{}, []ServerOption{{MaxConcurrentStreams: 3}}, ClientOption{})
+
+	settings, ok := conn.ServerSettings()
+	if !ok {
+		t.Fatal("Expected SETTINGS to be known after Dial")
+	}
+	if settings.MaxConcurrentStreams != 3 {
+		t.Errorf("Expected MaxConcurrentStreams 3, got %d", settings.MaxConcurrentStreams)
+	}
+}
+
+// TestClientQueuesCallsAboveMaxConcurrentStreams verifies that the Go client waits for a
+// free stream instead of failing with RESOURCE_EXHAUSTED when the server's limit is reached
+func TestClientQueuesCallsAboveMaxConcurrentStreams(t *testing.T) {
+	const limit = 2
+	server, client, _ := newTestClientWith(t, &testGreeter{}, []ServerOption{{MaxConcurrentStreams: limit}}, ClientOption{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Occupy every stream the server allows with blocked calls
+	blockedCtx, unblock := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = client.SayHello(blockedCtx, &pb.HelloRequest{Name: "block"})
+		}()
+	}
+	waitForActiveStreams(t, server, limit)
+
+	// A call with a short deadline waits for a free stream and gives up in time
+	shortCtx, shortCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer shortCancel()
+	if _, err := client.SayHello(shortCtx, &pb.HelloRequest{Name: "late"}); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded while waiting for a stream, got %v", err)
+	}
+
+	// A queued call proceeds once a stream is released
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "queued"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Queued call finished before a stream was free: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unblock()
+	wg.Wait()
+	if err := <-done; err != nil {
+		t.Errorf("Queued call failed: %v", err)
+	}
+}
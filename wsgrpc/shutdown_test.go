@@ -0,0 +1,251 @@
+package wsgrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// waitForActiveStreams polls until the server has n registered streams
+func waitForActiveStreams(t *testing.T, server *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if activeStreamCount(server) == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d active streams, got %d", n, activeStreamCount(server))
+}
+
+// TestShutdownDrainsInFlightRPCs verifies that an RPC in flight when Shutdown starts
+// completes normally while new calls on the draining connection are refused
+func TestShutdownDrainsInFlightRPCs(t *testing.T) {
+	impl := &deadlineGreeter{release: make(chan struct{})}
+	server, client, _ := newTestClientWith(t, impl, nil, ClientOption{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	inFlight := make(chan error, 1)
+	go func() {
+		resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: "ignore"})
+		if err == nil && resp.GetMessage() != "too late" {
+			err = errors.New("unexpected response " + resp.GetMessage())
+		}
+		inFlight <- err
+	}()
+	waitForActiveStreams(t, server, 1)
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- server.Shutdown(ctx) }()
+
+	// Once GOAWAY arrived the client refuses to open new streams
+	deadline := time.Now().Add(2 * time.Second)
+	var err error
+	for time.Now().Before(deadline) {
+		_, err = client.SayHello(ctx, &pb.HelloRequest{Name: "new"})
+		if status.Code(err) == codes.Unavailable {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected Unavailable for a call after GOAWAY, got %v", err)
+	}
+
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("Shutdown returned while an RPC was in flight: %v", err)
+	default:
+	}
+
+	// Let the handler finish: the in-flight call succeeds and the drain completes
+	close(impl.release)
+	if err := <-inFlight; err != nil {
+		t.Errorf("In-flight RPC failed during drain: %v", err)
+	}
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Errorf("Shutdown returned error: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown did not complete after the last RPC finished")
+	}
+}
+
+// TestShutdownRefusesStreamsAfterGoAway verifies on the wire that GOAWAY names the last
+// accepted stream and that streams opened afterwards get RST_STREAM REFUSED_STREAM
+func TestShutdownRefusesStreamsAfterGoAway(t *testing.T) {
+	impl := &deadlineGreeter{release: make(chan struct{})}
+	defer close(impl.release)
+
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, impl)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	readSettings(t, ctx, conn)
+
+	headers := []byte("path: /greeter.Greeter/SayHello\n")
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(1, FlagHEADERS, headers)); err != nil {
+		t.Fatalf("Failed to send HEADERS: %v", err)
+	}
+	waitForActiveStreams(t, server, 1)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer shutdownCancel()
+	go func() { _ = server.Shutdown(shutdownCtx) }()
+
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("Expected GOAWAY: %v", err)
+	}
+	frame, err := decodeFrame(data, 4*1024*1024)
+	if err != nil || frame.StreamID != 0 || frame.Flags != FlagRST_STREAM || len(frame.Payload) != 8 {
+		t.Fatalf("Expected GOAWAY frame, got %+v (err=%v)", frame, err)
+	}
+	if last := binary.BigEndian.Uint32(frame.Payload[0:4]); last != 1 {
+		t.Errorf("Expected last stream ID 1, got %d", last)
+	}
+
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(3, FlagHEADERS, headers)); err != nil {
+		t.Fatalf("Failed to send HEADERS after GOAWAY: %v", err)
+	}
+	_, data, err = conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("Expected RST_STREAM for stream 3: %v", err)
+	}
+	frame, err = decodeFrame(data, 4*1024*1024)
+	if err != nil || frame.StreamID != 3 || frame.Flags&FlagRST_STREAM == 0 {
+		t.Fatalf("Expected RST_STREAM for stream 3, got %+v (err=%v)", frame, err)
+	}
+	if code := decodeErrorCode(frame.Payload); code != ErrCodeRefusedStream {
+		t.Errorf("Expected REFUSED_STREAM, got code %d", code)
+	}
+}
+
+// TestShutdownDeadlineStopsConnections verifies that handlers still running when the
+// Shutdown context expires are cut off and the connection is closed
+func TestShutdownDeadlineStopsConnections(t *testing.T) {
+	impl := &deadlineGreeter{release: make(chan struct{})}
+	defer close(impl.release)
+	server, client, _ := newTestClientWith(t, impl, nil, ClientOption{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "ignore"})
+		inFlight <- err
+	}()
+	waitForActiveStreams(t, server, 1)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected DeadlineExceeded from Shutdown, got %v", err)
+	}
+
+	select {
+	case err := <-inFlight:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected Unavailable for the cut-off RPC, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("In-flight RPC did not end after the shutdown deadline")
+	}
+}
+
+// TestShutdownDrainsConnectionsInParallel verifies that idle connections are closed
+// together rather than one after another
+func TestShutdownDrainsConnectionsInParallel(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const connections = 8
+	for i := 0; i < connections; i++ {
+		conn, err := Dial(ctx, "ws"+httpServer.URL[4:])
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+	}
+
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown of %d idle connections took %v", connections, elapsed)
+	}
+	t.Logf("Drained %d connections in %v", connections, time.Since(start))
+}
+
+// TestStop verifies that Stop closes connections immediately, cancelling in-flight
+// RPCs
+func TestStop(t *testing.T) {
+	server, client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "block"})
+		inFlight <- err
+	}()
+	waitForActiveStreams(t, server, 1)
+
+	server.Stop()
+
+	select {
+	case err := <-inFlight:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected Unavailable after Stop, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("In-flight RPC did not end after Stop")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		server.mu.RLock()
+		remaining := len(server.connections)
+		server.mu.RUnlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Connections still registered after Stop")
+}
@@ -0,0 +1,188 @@
+package wsgrpc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OverflowPolicy is what SendMsg does when the client of a stream is a slow consumer:
+// it exceeds one of the queue limits of ServerOption or does not take a message within
+// SendTimeout.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes SendMsg wait until the client is back within the limits, for
+	// at most SendTimeout, and then fail with RESOURCE_EXHAUSTED.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowFail makes SendMsg fail with RESOURCE_EXHAUSTED right away, leaving it to
+	// the handler to skip the message, retry later or give up.
+	OverflowFail
+	// OverflowResetStream resets the stream with RST_STREAM (RESOURCE_EXHAUSTED) and
+	// fails SendMsg. Other streams of the client are not affected.
+	OverflowResetStream
+	// OverflowCloseConnection closes the client's connection with OverflowCloseCode,
+	// cancelling all of its streams.
+	OverflowCloseConnection
+)
+
+// String returns the policy name used in logs.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowFail:
+		return "fail"
+	case OverflowResetStream:
+		return "reset-stream"
+	case OverflowCloseConnection:
+		return "close-connection"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// QueueStats describes the frames waiting to be written to a client.
+type QueueStats struct {
+	QueuedBytes       int           // Queued on the connection, all streams included
+	QueueDelay        time.Duration // Age of the oldest frame queued on the connection
+	StreamQueuedBytes int           // Queued for the stream
+	StreamQueueDelay  time.Duration // Age of the oldest frame queued for the stream
+}
+
+// SlowConsumerEvent is passed to ServerOption.OnSlowConsumer.
+type SlowConsumerEvent struct {
+	Method   string
+	StreamID uint32
+	Stats    QueueStats
+	// TimedOut is set when a SendMsg waited for SendTimeout, as opposed to a queue limit
+	// being exceeded
+	TimedOut bool
+	Policy   OverflowPolicy
+}
+
+// SendQueueStats returns the queue statistics of the stream of a handler context. It
+// reports false if ctx does not belong to a wsgrpc server stream.
+func SendQueueStats(ctx context.Context) (QueueStats, bool) {
+	t, ok := grpc.ServerTransportStreamFromContext(ctx).(*serverTransportStream)
+	if !ok {
+		return QueueStats{}, false
+	}
+	return t.stream.conn.sendQueue.stats(t.stream.streamID), true
+}
+
+// exceedsQueueLimits reports whether stats are beyond the configured queue limits.
+func (o *ServerOption) exceedsQueueLimits(stats QueueStats) bool {
+	return (o.MaxQueuedBytes > 0 && stats.QueuedBytes > o.MaxQueuedBytes) ||
+		(o.MaxStreamQueuedBytes > 0 && stats.StreamQueuedBytes > o.MaxStreamQueuedBytes) ||
+		(o.MaxQueueDelay > 0 && stats.QueueDelay > o.MaxQueueDelay)
+}
+
+// limitsSlowConsumers reports whether any slow consumer limit is configured.
+func (o *ServerOption) limitsSlowConsumers() bool {
+	return o.MaxQueuedBytes > 0 || o.MaxStreamQueuedBytes > 0 || o.MaxQueueDelay > 0 || o.SendTimeout > 0
+}
+
+// sendLimited is sendMessage for SendMsg, applying the OverflowPolicy when the client
+// is a slow consumer. It takes ownership of buf.
+func (s *WebSocketServerStream) sendLimited(buf *[]byte, flags uint8) error {
+	opts := &s.conn.server.options
+	if !opts.limitsSlowConsumers() {
+		return s.sendMessage(s.ctx, buf, flags, maxQueuedFramesPerStream)
+	}
+
+	ctx := s.ctx
+	if opts.SendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(s.ctx, opts.SendTimeout)
+		defer cancel()
+	}
+
+	stats := s.conn.sendQueue.stats(s.streamID)
+	if opts.exceedsQueueLimits(stats) {
+		if !s.slowConsumer {
+			s.slowConsumer = true
+			s.notifySlowConsumer(stats, false)
+		}
+		if opts.OverflowPolicy != OverflowBlock {
+			putFrameBuffer(buf)
+			return s.applyOverflowPolicy()
+		}
+		if err := s.waitForQueueLimits(ctx); err != nil {
+			putFrameBuffer(buf)
+			return s.sendFailed(ctx, err)
+		}
+	}
+	s.slowConsumer = false
+
+	if err := s.sendMessage(ctx, buf, flags, maxQueuedFramesPerStream); err != nil {
+		return s.sendFailed(ctx, err)
+	}
+	return nil
+}
+
+// waitForQueueLimits blocks until the client is back within the queue limits, the
+// queue is closed or ctx is done.
+func (s *WebSocketServerStream) waitForQueueLimits(ctx context.Context) error {
+	q := s.conn.sendQueue
+	for {
+		taken, open := q.waitTaken()
+		if !open || !s.conn.server.options.exceedsQueueLimits(q.stats(s.streamID)) {
+			return nil
+		}
+		select {
+		case <-taken:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// sendFailed turns a send that ran into SendTimeout into the OverflowPolicy, and
+// returns other errors as they are.
+func (s *WebSocketServerStream) sendFailed(ctx context.Context, err error) error {
+	if ctx.Err() != context.DeadlineExceeded || s.ctx.Err() != nil {
+		return err
+	}
+	s.slowConsumer = true
+	s.notifySlowConsumer(s.conn.sendQueue.stats(s.streamID), true)
+	return s.applyOverflowPolicy()
+}
+
+// notifySlowConsumer logs a slow consumer and calls OnSlowConsumer.
+func (s *WebSocketServerStream) notifySlowConsumer(stats QueueStats, timedOut bool) {
+	opts := &s.conn.server.options
+	if opts.EnableLogging {
+		log.Printf("[wsgrpc] Slow consumer on stream %d (%s): %d bytes queued (%d for the stream), oldest frame %v, timed out: %v, policy %s",
+			s.streamID, s.method, stats.QueuedBytes, stats.StreamQueuedBytes, stats.QueueDelay, timedOut, opts.OverflowPolicy)
+	}
+	if opts.OnSlowConsumer != nil {
+		opts.OnSlowConsumer(s.ctx, SlowConsumerEvent{
+			Method:   s.method,
+			StreamID: s.streamID,
+			Stats:    stats,
+			TimedOut: timedOut,
+			Policy:   opts.OverflowPolicy,
+		})
+	}
+}
+
+// applyOverflowPolicy acts on a slow consumer and returns the error for SendMsg.
+func (s *WebSocketServerStream) applyOverflowPolicy() error {
+	server := s.conn.server
+	switch server.options.OverflowPolicy {
+	case OverflowResetStream:
+		s.conn.resetStream(s.streamID, s, ErrCodeResourceExhausted)
+		return status.Error(codes.ResourceExhausted, "stream reset: client is not keeping up")
+	case OverflowCloseConnection:
+		s.conn.closeNow(server.options.OverflowCloseCode, "slow consumer")
+		return status.Error(codes.ResourceExhausted, "connection closed: client is not keeping up")
+	default:
+		return status.Error(codes.ResourceExhausted, "client is not keeping up")
+	}
+}
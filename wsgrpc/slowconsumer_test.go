@@ -0,0 +1,163 @@
+package wsgrpc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// floodGreeter streams large responses until SendMsg fails, and reports the error
+type floodGreeter struct {
+	pb.UnimplementedGreeterServer
+	errs chan error
+}
+
+func (g *floodGreeter) SayHelloStream(_ *pb.HelloRequest, stream grpc.ServerStreamingServer[pb.HelloResponse]) error {
+	resp := &pb.HelloResponse{Message: strings.Repeat("x", 16*1024)}
+	for i := 0; i < 100000; i++ {
+		if err := stream.Send(resp); err != nil {
+			g.errs <- err
+			return err
+		}
+	}
+	g.errs <- nil
+	return nil
+}
+
+// slowConsumerEvents collects the events of OnSlowConsumer
+func slowConsumerEvents() (chan SlowConsumerEvent, func(context.Context, SlowConsumerEvent)) {
+	events := make(chan SlowConsumerEvent, 10)
+	return events, func(_ context.Context, event SlowConsumerEvent) { events <- event }
+}
+
+// TestSlowConsumerSendTimeout verifies that SendTimeout bounds a SendMsg waiting for
+// flow control credit of a client that does not read
+func TestSlowConsumerSendTimeout(t *testing.T) {
+	greeter := &floodGreeter{errs: make(chan error, 1)}
+	events, hook := slowConsumerEvents()
+	_, client, _ := newTestClientWith(t, greeter,
+		[]ServerOption{{SendTimeout: 100 * time.Millisecond, OnSlowConsumer: hook}}, ClientOption{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := client.SayHelloStream(ctx, &pb.HelloRequest{Name: "slow"}); err != nil {
+		t.Fatalf("SayHelloStream failed: %v", err)
+	}
+	// The client never calls Recv, so its window runs out
+	select {
+	case err := <-greeter.errs:
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("Expected ResourceExhausted from SendMsg, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("SendMsg blocked beyond SendTimeout")
+	}
+	event := <-events
+	t.Logf("Slow consumer event: %+v", event)
+	if !event.TimedOut || event.Method != pb.Greeter_SayHelloStream_FullMethodName || event.Policy != OverflowBlock {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+// TestSlowConsumerQueueLimits verifies each policy for a client without flow control
+// that stops reading, so that frames pile up in the send queue
+func TestSlowConsumerQueueLimits(t *testing.T) {
+	const queueLimit = 256 * 1024
+	for _, policy := range []OverflowPolicy{OverflowFail, OverflowResetStream, OverflowCloseConnection} {
+		t.Run(policy.String(), func(t *testing.T) {
+			greeter := &floodGreeter{errs: make(chan error, 1)}
+			events, hook := slowConsumerEvents()
+			server := NewServer(ServerOption{
+				InsecureSkipVerify: true,
+				MaxQueuedBytes:     queueLimit,
+				OverflowPolicy:     policy,
+				OverflowCloseCode:  4008,
+				OnSlowConsumer:     hook,
+			})
+			pb.RegisterGreeterServer(server, greeter)
+
+			httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+			defer httpServer.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+			if err != nil {
+				t.Fatalf("Failed to dial WebSocket: %v", err)
+			}
+			defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+			request, _ := proto.Marshal(&pb.HelloRequest{Name: "slow"})
+			writeFrame(t, ctx, conn, encodeFrame(1, FlagHEADERS, mustEncodeMetadataBlock(t, metadata.Pairs("path", pb.Greeter_SayHelloStream_FullMethodName), false)))
+			writeFrame(t, ctx, conn, encodeFrame(1, FlagDATA|FlagEOS, request))
+
+			select {
+			case err := <-greeter.errs:
+				if status.Code(err) != codes.ResourceExhausted {
+					t.Fatalf("Expected ResourceExhausted from SendMsg, got %v", err)
+				}
+			case <-ctx.Done():
+				t.Fatal("The handler was never stopped")
+			}
+			event := <-events
+			t.Logf("Slow consumer event: %+v", event)
+			if event.TimedOut || event.Stats.QueuedBytes <= queueLimit || event.Policy != policy {
+				t.Errorf("Unexpected event %+v", event)
+			}
+
+			// Catch up on the queued responses to see how the stream ended
+			for {
+				_, data, err := conn.Read(ctx)
+				if err != nil {
+					if policy != OverflowCloseConnection {
+						t.Fatalf("Read failed: %v", err)
+					}
+					if code := websocket.CloseStatus(err); code != 4008 {
+						t.Errorf("Expected close code 4008, got %v (err=%v)", code, err)
+					}
+					return
+				}
+				frame, err := decodeFrame(data, 4*1024*1024)
+				if err != nil || frame.StreamID != 1 {
+					continue
+				}
+				switch {
+				case frame.Flags&FlagRST_STREAM != 0:
+					if policy != OverflowResetStream || decodeErrorCode(frame.Payload) != ErrCodeResourceExhausted {
+						t.Errorf("Unexpected RST_STREAM with code %d", decodeErrorCode(frame.Payload))
+					}
+					return
+				case frame.Flags&FlagTRAILERS != 0:
+					if policy != OverflowFail {
+						t.Errorf("Unexpected trailers with policy %s", policy)
+					}
+					if st := parseHeaderBlock(frame.Payload).Get("grpc-status"); len(st) == 0 || st[0] != "8" {
+						t.Errorf("Expected grpc-status 8, got %v", st)
+					}
+					return
+				}
+			}
+		})
+	}
+}
+
+// TestSendQueueStatsFromContext verifies the stats helper outside a stream
+func TestSendQueueStatsFromContext(t *testing.T) {
+	if _, ok := SendQueueStats(context.Background()); ok {
+		t.Error("Expected no stats without a wsgrpc stream")
+	}
+}
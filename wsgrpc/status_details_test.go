@@ -0,0 +1,118 @@
+package wsgrpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// detailsGreeter fails with a BadRequest field violation for an empty name and with a
+// plain (non-status) error for "internal"
+type detailsGreeter struct {
+	testGreeter
+}
+
+func (g *detailsGreeter) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	switch req.GetName() {
+	case "":
+		st, err := status.New(codes.InvalidArgument, "invalid request").WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "name", Description: "must not be empty"},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, st.Err()
+	case "internal":
+		return nil, errors.New("SECRET-db-password=hunter2")
+	}
+	return &pb.HelloResponse{Message: "Hello " + req.GetName()}, nil
+}
+
+// TestStatusDetailsReachClient verifies that details attached with status.WithDetails
+// arrive at the Go client intact
+func TestStatusDetailsReachClient(t *testing.T) {
+	_, client, _ := newTestClientWith(t, &detailsGreeter{}, nil, ClientOption{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.SayHello(ctx, &pb.HelloRequest{})
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument || st.Message() != "invalid request" {
+		t.Fatalf("Unexpected status %v", st)
+	}
+	details := st.Details()
+	if len(details) != 1 {
+		t.Fatalf("Expected 1 detail, got %v", details)
+	}
+	badRequest, ok := details[0].(*errdetails.BadRequest)
+	if !ok || len(badRequest.GetFieldViolations()) != 1 || badRequest.GetFieldViolations()[0].GetField() != "name" {
+		t.Errorf("Unexpected detail %v", details[0])
+	}
+}
+
+// TestStatusDetailsOnTheWire verifies the grpc-status-details-bin trailer in the text
+// format used by the Angular client, and that scrubbed errors carry no details
+func TestStatusDetailsOnTheWire(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &detailsGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	call := func(streamID uint32, name string) *Frame {
+		if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagHEADERS, []byte("path: /greeter.Greeter/SayHello\n"))); err != nil {
+			t.Fatalf("Failed to send HEADERS: %v", err)
+		}
+		payload, _ := proto.Marshal(&pb.HelloRequest{Name: name})
+		if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagDATA|FlagEOS, payload)); err != nil {
+			t.Fatalf("Failed to send DATA: %v", err)
+		}
+		frames := readResponseFrames(t, ctx, conn, streamID)
+		return frames[len(frames)-1]
+	}
+
+	trailer := parseHeaderBlock(call(1, "").Payload)
+	values := trailer.Get(statusDetailsKey)
+	if len(values) != 1 {
+		t.Fatalf("Expected %s trailer, got %v", statusDetailsKey, trailer)
+	}
+	st := &spb.Status{}
+	if err := proto.Unmarshal([]byte(values[0]), st); err != nil {
+		t.Fatalf("Failed to unmarshal google.rpc.Status: %v", err)
+	}
+	if codes.Code(st.GetCode()) != codes.InvalidArgument || len(st.GetDetails()) != 1 {
+		t.Errorf("Unexpected google.rpc.Status %v", st)
+	}
+
+	trailer = parseHeaderBlock(call(3, "internal").Payload)
+	if len(trailer.Get(statusDetailsKey)) != 0 {
+		t.Errorf("Expected no details for a scrubbed error, got %v", trailer)
+	}
+	if msg := trailer.Get("grpc-message"); len(msg) != 1 || msg[0] != genericInternalMessage {
+		t.Errorf("Expected scrubbed message, got %v", msg)
+	}
+}
@@ -0,0 +1,113 @@
+package wsgrpc
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/coder/websocket"
+)
+
+// streamState is the lifecycle state of a client-initiated stream (PROTOCOL.md
+// Section 4.3). The server never sends before the client's HEADERS, so there is no
+// reserved or half-closed (local) state.
+type streamState uint8
+
+const (
+	// streamIdle: the stream ID is above every ID the client has used so far
+	streamIdle streamState = iota
+	// streamOpen: HEADERS received; the client may send DATA
+	streamOpen
+	// streamHalfClosedRemote: the client sent EOS; only the server may still send
+	streamHalfClosedRemote
+	// streamClosed: finished, reset or rejected; the ID can never be used again
+	streamClosed
+)
+
+func (s streamState) String() string {
+	switch s {
+	case streamIdle:
+		return "idle"
+	case streamOpen:
+		return "open"
+	case streamHalfClosedRemote:
+		return "half-closed (remote)"
+	default:
+		return "closed"
+	}
+}
+
+// streamStateLocked returns the state of streamID and the stream if it is still
+// registered. Streams leave streamMap when they close, so any ID at or below the
+// highest one the client has opened that is not in the map is closed. c.mu must be held.
+func (c *wsConnection) streamStateLocked(streamID uint32) (streamState, *WebSocketServerStream) {
+	if stream, ok := c.streamMap[streamID]; ok {
+		return stream.state, stream
+	}
+	if streamID > c.maxClientStreamID {
+		return streamIdle, nil
+	}
+	return streamClosed, nil
+}
+
+// streamState is streamStateLocked for callers that do not hold c.mu.
+func (c *wsConnection) streamState(streamID uint32) (streamState, *WebSocketServerStream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streamStateLocked(streamID)
+}
+
+// halfCloseRemote records that the client sent EOS on an open stream.
+func (c *wsConnection) halfCloseRemote(stream *WebSocketServerStream) {
+	c.mu.Lock()
+	if stream.state == streamOpen {
+		stream.state = streamHalfClosedRemote
+	}
+	c.mu.Unlock()
+}
+
+// resetStream answers a stream error: RST_STREAM with errCode goes to the client and
+// the stream is closed, cancelling its handler. A nil stream (already closed) only gets
+// the RST_STREAM.
+func (c *wsConnection) resetStream(streamID uint32, stream *WebSocketServerStream, errCode uint32) {
+	if c.server.options.EnableLogging {
+		log.Printf("[wsgrpc] Resetting stream %d with error code %d", streamID, errCode)
+	}
+	_ = c.send(encodeRSTStream(streamID, errCode))
+	if stream == nil {
+		return
+	}
+
+	c.mu.Lock()
+	stream.state = streamClosed
+	if stream.cancel != nil {
+		stream.cancel()
+	}
+	stream.safeCloseRecvChan()
+	if c.streamMap[streamID] == stream {
+		delete(c.streamMap, streamID)
+	}
+	c.mu.Unlock()
+}
+
+// rejectFrame answers DATA or EOS on a stream that is not open. On an idle stream it is
+// a connection error; otherwise the stream is reset with STREAM_CLOSED, including a
+// half-closed (remote) stream whose client kept sending after its own EOS.
+func (c *wsConnection) rejectFrame(frame *Frame, state streamState, stream *WebSocketServerStream) {
+	if state == streamIdle {
+		c.connectionError(ErrCodeProtocolError, fmt.Sprintf("frame with flags 0x%02x on idle stream %d", frame.Flags, frame.StreamID))
+		return
+	}
+	if c.server.options.EnableLogging {
+		log.Printf("[wsgrpc] Frame with flags 0x%02x on %s stream %d", frame.Flags, state, frame.StreamID)
+	}
+	c.resetStream(frame.StreamID, stream, ErrCodeStreamClosed)
+}
+
+// connectionError answers a connection-level protocol violation: GOAWAY carries errCode
+// and the WebSocket is closed with StatusProtocolError once queued frames are written.
+// Violations are always logged so misbehaving clients can be detected.
+func (c *wsConnection) connectionError(errCode uint32, detail string) {
+	log.Printf("[wsgrpc] Closing connection after protocol violation (error code %d): %s", errCode, detail)
+	c.goAway(errCode)
+	c.closeAfterFlush(websocket.StatusProtocolError, "protocol error")
+}
@@ -0,0 +1,260 @@
+package wsgrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// newStateTestConn starts a server hosting testGreeter and dials it with a raw
+// WebSocket, so tests can send frames that violate the stream state machine
+func newStateTestConn(t *testing.T, opts ...ServerOption) (*Server, *websocket.Conn, context.Context) {
+	t.Helper()
+	server := NewServer(append([]ServerOption{{InsecureSkipVerify: true}}, opts...)...)
+	pb.RegisterGreeterServer(server, &testGreeter{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	t.Cleanup(httpServer.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") })
+	return server, conn, ctx
+}
+
+// writeFrame sends a raw frame
+func writeFrame(t *testing.T, ctx context.Context, conn *websocket.Conn, data []byte) {
+	t.Helper()
+	if err := conn.Write(ctx, websocket.MessageBinary, data); err != nil {
+		t.Fatalf("Failed to send frame: %v", err)
+	}
+}
+
+// openBlockedStream opens streamID with a request the handler blocks on until the
+// stream is cancelled. With halfClose the request ends with EOS.
+func openBlockedStream(t *testing.T, ctx context.Context, conn *websocket.Conn, streamID uint32, halfClose bool) {
+	t.Helper()
+	writeFrame(t, ctx, conn, encodeFrame(streamID, FlagHEADERS, []byte("path: /greeter.Greeter/SayHello\n")))
+	if halfClose {
+		payload, _ := proto.Marshal(&pb.HelloRequest{Name: "block"})
+		writeFrame(t, ctx, conn, encodeFrame(streamID, FlagDATA|FlagEOS, payload))
+	}
+}
+
+// expectRST reads until a RST_STREAM for streamID arrives and checks its error code
+func expectRST(t *testing.T, ctx context.Context, conn *websocket.Conn, streamID uint32, errCode uint32) {
+	t.Helper()
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Expected RST_STREAM on stream %d: %v", streamID, err)
+		}
+		frame, err := decodeFrame(data, 4*1024*1024)
+		if err != nil || frame.StreamID != streamID || frame.Flags&FlagRST_STREAM == 0 {
+			continue
+		}
+		if code := decodeErrorCode(frame.Payload); code != errCode {
+			t.Errorf("Expected RST_STREAM error code %d on stream %d, got %d", errCode, streamID, code)
+		}
+		return
+	}
+}
+
+// expectConnectionError reads until GOAWAY arrives, checks its error code and verifies
+// that the server then closes the WebSocket with StatusProtocolError
+func expectConnectionError(t *testing.T, ctx context.Context, conn *websocket.Conn, errCode uint32) {
+	t.Helper()
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Expected GOAWAY before close: %v", err)
+		}
+		frame, err := decodeFrame(data, 4*1024*1024)
+		if err != nil || frame.StreamID != 0 || frame.Flags != FlagRST_STREAM || len(frame.Payload) != 8 {
+			continue
+		}
+		if code := binary.BigEndian.Uint32(frame.Payload[4:8]); code != errCode {
+			t.Errorf("Expected GOAWAY error code %d, got %d", errCode, code)
+		}
+		break
+	}
+	for {
+		_, _, err := conn.Read(ctx)
+		if err == nil {
+			continue
+		}
+		if status := websocket.CloseStatus(err); status != websocket.StatusProtocolError {
+			t.Errorf("Expected close status %v, got %v (err=%v)", websocket.StatusProtocolError, status, err)
+		}
+		return
+	}
+}
+
+// expectAlive verifies with a PING that the connection still processes frames
+func expectAlive(t *testing.T, ctx context.Context, conn *websocket.Conn) {
+	t.Helper()
+	writeFrame(t, ctx, conn, encodeFrame(0, FlagPING, nil))
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Expected PONG: %v", err)
+		}
+		if frame, err := decodeFrame(data, 4*1024*1024); err == nil && frame.Flags&FlagPONG != 0 {
+			return
+		}
+	}
+}
+
+// TestDuplicateHeadersResetsStream verifies that a second HEADERS frame on an open
+// stream resets it instead of replacing the running handler
+func TestDuplicateHeadersResetsStream(t *testing.T) {
+	server, conn, ctx := newStateTestConn(t)
+
+	openBlockedStream(t, ctx, conn, 1, false)
+	waitForActiveStreams(t, server, 1)
+
+	writeFrame(t, ctx, conn, encodeFrame(1, FlagHEADERS, []byte("path: /greeter.Greeter/SayHello\n")))
+	expectRST(t, ctx, conn, 1, ErrCodeProtocolError)
+	waitForActiveStreams(t, server, 0)
+	expectAlive(t, ctx, conn)
+}
+
+// TestDataAfterEOSIsStreamClosed verifies that DATA on a half-closed (remote) stream is
+// answered with STREAM_CLOSED and ends the stream
+func TestDataAfterEOSIsStreamClosed(t *testing.T) {
+	server, conn, ctx := newStateTestConn(t)
+
+	openBlockedStream(t, ctx, conn, 1, true)
+	waitForActiveStreams(t, server, 1)
+
+	writeFrame(t, ctx, conn, encodeFrame(1, FlagDATA, []byte{}))
+	expectRST(t, ctx, conn, 1, ErrCodeStreamClosed)
+	waitForActiveStreams(t, server, 0)
+
+	// A bare EOS on the now closed stream gets the same answer
+	writeFrame(t, ctx, conn, encodeFrame(1, FlagEOS, nil))
+	expectRST(t, ctx, conn, 1, ErrCodeStreamClosed)
+
+	// A late RST_STREAM for a closed stream is tolerated
+	writeFrame(t, ctx, conn, encodeRSTStream(1, ErrCodeCancel))
+	expectAlive(t, ctx, conn)
+}
+
+// TestOversizedDataResetsOnlyItsStream verifies that a DATA payload above
+// MaxPayloadSize is a stream error (FRAME_SIZE_ERROR), not a connection error
+func TestOversizedDataResetsOnlyItsStream(t *testing.T) {
+	server, conn, ctx := newStateTestConn(t, ServerOption{MaxPayloadSize: 1024})
+
+	openBlockedStream(t, ctx, conn, 1, false)
+	waitForActiveStreams(t, server, 1)
+
+	// Still within the WebSocket read limit, which allows for frame overhead
+	writeFrame(t, ctx, conn, encodeFrame(1, FlagDATA, make([]byte, 1500)))
+	expectRST(t, ctx, conn, 1, ErrCodeFrameSizeError)
+	waitForActiveStreams(t, server, 0)
+	expectAlive(t, ctx, conn)
+}
+
+// TestConnectionLevelViolations verifies that violations which leave the connection
+// state unknown are answered with GOAWAY and a StatusProtocolError close
+func TestConnectionLevelViolations(t *testing.T) {
+	headers := []byte("path: /greeter.Greeter/SayHello\n")
+
+	tests := []struct {
+		name    string
+		frames  func(t *testing.T, ctx context.Context, conn *websocket.Conn)
+		errCode uint32
+	}{
+		{
+			name: "even stream ID",
+			frames: func(t *testing.T, ctx context.Context, conn *websocket.Conn) {
+				writeFrame(t, ctx, conn, encodeFrame(2, FlagHEADERS, headers))
+			},
+			errCode: ErrCodeProtocolError,
+		},
+		{
+			name: "non-monotonic stream ID",
+			frames: func(t *testing.T, ctx context.Context, conn *websocket.Conn) {
+				writeFrame(t, ctx, conn, encodeFrame(5, FlagHEADERS, headers))
+				writeFrame(t, ctx, conn, encodeFrame(3, FlagHEADERS, headers))
+			},
+			errCode: ErrCodeProtocolError,
+		},
+		{
+			name: "DATA on stream 0",
+			frames: func(t *testing.T, ctx context.Context, conn *websocket.Conn) {
+				writeFrame(t, ctx, conn, encodeFrame(0, FlagDATA, []byte{}))
+			},
+			errCode: ErrCodeProtocolError,
+		},
+		{
+			name: "DATA on idle stream",
+			frames: func(t *testing.T, ctx context.Context, conn *websocket.Conn) {
+				writeFrame(t, ctx, conn, encodeFrame(7, FlagDATA|FlagEOS, []byte{}))
+			},
+			errCode: ErrCodeProtocolError,
+		},
+		{
+			name: "RST_STREAM on idle stream",
+			frames: func(t *testing.T, ctx context.Context, conn *websocket.Conn) {
+				writeFrame(t, ctx, conn, encodeRSTStream(9, ErrCodeCancel))
+			},
+			errCode: ErrCodeProtocolError,
+		},
+		{
+			name: "frame shorter than its header",
+			frames: func(t *testing.T, ctx context.Context, conn *websocket.Conn) {
+				writeFrame(t, ctx, conn, []byte{FlagDATA, 0, 0, 0, 1})
+			},
+			errCode: ErrCodeProtocolError,
+		},
+		{
+			name: "oversized payload on stream 0",
+			frames: func(t *testing.T, ctx context.Context, conn *websocket.Conn) {
+				writeFrame(t, ctx, conn, encodeFrame(0, FlagPING, make([]byte, 1500)))
+			},
+			errCode: ErrCodeFrameSizeError,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, conn, ctx := newStateTestConn(t, ServerOption{MaxPayloadSize: 1024})
+			tc.frames(t, ctx, conn)
+			expectConnectionError(t, ctx, conn, tc.errCode)
+		})
+	}
+}
+
+// TestStreamStateOf verifies how stream states are derived from the stream map and the
+// highest client stream ID
+func TestStreamStateOf(t *testing.T) {
+	open := &WebSocketServerStream{state: streamOpen}
+	halfClosed := &WebSocketServerStream{state: streamHalfClosedRemote}
+	c := &wsConnection{
+		streamMap:         map[uint32]*WebSocketServerStream{3: open, 5: halfClosed},
+		maxClientStreamID: 5,
+	}
+
+	for id, want := range map[uint32]streamState{1: streamClosed, 3: streamOpen, 5: streamHalfClosedRemote, 7: streamIdle} {
+		if got, _ := c.streamState(id); got != want {
+			t.Errorf("streamState(%d) = %v, want %v", id, got, want)
+		}
+	}
+	if _, stream := c.streamState(1); stream != nil {
+		t.Error("Expected no stream for a closed ID")
+	}
+}
@@ -0,0 +1,74 @@
+package wsgrpc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// maxTimeoutValue is the largest TimeoutValue allowed by the gRPC wire format
+// (at most 8 ASCII digits).
+const maxTimeoutValue = 99999999
+
+// timeoutUnits lists the grpc-timeout units from finest to coarsest.
+var timeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// encodeTimeout encodes d in the grpc-timeout format ("100m", "5S", ...), using the
+// finest unit whose value fits in 8 digits. Values are rounded up so the server never
+// sees a shorter budget than the caller has left.
+func encodeTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	for _, u := range timeoutUnits {
+		value := (d + u.d - 1) / u.d
+		if value <= maxTimeoutValue {
+			return strconv.FormatInt(int64(value), 10) + string(u.unit)
+		}
+	}
+	return strconv.Itoa(maxTimeoutValue) + "H"
+}
+
+// decodeTimeout parses a grpc-timeout header value ("100m", "5S", ...) into a duration.
+func decodeTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("malformed grpc-timeout %q", s)
+	}
+	unit := s[len(s)-1]
+	var d time.Duration
+	for _, u := range timeoutUnits {
+		if u.unit == unit {
+			d = u.d
+			break
+		}
+	}
+	if d == 0 {
+		return 0, fmt.Errorf("malformed grpc-timeout %q: unknown unit", s)
+	}
+	digits := s[:len(s)-1]
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, fmt.Errorf("malformed grpc-timeout %q", s)
+		}
+	}
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed grpc-timeout %q: %w", s, err)
+	}
+	// Clamp instead of overflowing: 99999999H does not fit in a time.Duration
+	if value > int64(math.MaxInt64/d) {
+		return time.Duration(math.MaxInt64), nil
+	}
+	return time.Duration(value) * d, nil
+}
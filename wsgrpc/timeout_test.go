@@ -0,0 +1,184 @@
+package wsgrpc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// deadlineGreeter reports the deadline seen by the handler, or ignores its context
+// entirely until release is closed
+type deadlineGreeter struct {
+	testGreeter
+	release chan struct{}
+}
+
+func (g *deadlineGreeter) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	if req.GetName() == "ignore" {
+		<-g.release
+		return &pb.HelloResponse{Message: "too late"}, nil
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return &pb.HelloResponse{Message: "no deadline"}, nil
+	}
+	return &pb.HelloResponse{Message: time.Until(deadline).Round(time.Second).String()}, nil
+}
+
+// TestDecodeTimeout verifies parsing of the grpc-timeout wire format
+func TestDecodeTimeout(t *testing.T) {
+	valid := map[string]time.Duration{
+		"100m":      100 * time.Millisecond,
+		"5S":        5 * time.Second,
+		"2M":        2 * time.Minute,
+		"1H":        time.Hour,
+		"250u":      250 * time.Microsecond,
+		"7n":        7 * time.Nanosecond,
+		"99999999S": 99999999 * time.Second,
+	}
+	for in, want := range valid {
+		got, err := decodeTimeout(in)
+		if err != nil || got != want {
+			t.Errorf("decodeTimeout(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "S", "10", "10s", "-5S", "1.5S", "123456789S", " 5S"} {
+		if _, err := decodeTimeout(in); err == nil {
+			t.Errorf("decodeTimeout(%q) succeeded; want error", in)
+		}
+	}
+
+	if got, err := decodeTimeout("99999999H"); err != nil || got <= 0 {
+		t.Errorf("Expected huge timeout to be clamped, got %v (err=%v)", got, err)
+	}
+}
+
+// TestEncodeTimeout verifies that encoded timeouts fit the 8-digit limit and never
+// shorten the budget
+func TestEncodeTimeout(t *testing.T) {
+	for _, d := range []time.Duration{time.Nanosecond, 1500 * time.Microsecond, 3 * time.Second, 90 * time.Minute, 1000 * time.Hour} {
+		encoded := encodeTimeout(d)
+		if len(encoded) > 9 {
+			t.Errorf("encodeTimeout(%v) = %q exceeds 8 digits", d, encoded)
+		}
+		decoded, err := decodeTimeout(encoded)
+		if err != nil {
+			t.Errorf("encodeTimeout(%v) = %q does not decode: %v", d, encoded, err)
+			continue
+		}
+		if decoded < d {
+			t.Errorf("encodeTimeout(%v) = %q shortens the budget to %v", d, encoded, decoded)
+		}
+	}
+	if got := encodeTimeout(-time.Second); got != "0n" {
+		t.Errorf("Expected expired budget to encode as 0n, got %q", got)
+	}
+}
+
+// TestClientDeadlinePropagation verifies that the Go client's context deadline reaches
+// the handler's context through grpc-timeout
+func TestClientDeadlinePropagation(t *testing.T) {
+	_, client, _ := newTestClientWith(t, &deadlineGreeter{}, nil, ClientOption{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := client.SayHello(ctx, &pb.HelloRequest{Name: "Go"})
+	if err != nil {
+		t.Fatalf("SayHello failed: %v", err)
+	}
+	if resp.GetMessage() != "30s" {
+		t.Errorf("Expected handler deadline of ~30s, got %q", resp.GetMessage())
+	}
+
+	resp, err = client.SayHello(context.Background(), &pb.HelloRequest{Name: "Go"})
+	if err != nil {
+		t.Fatalf("SayHello without deadline failed: %v", err)
+	}
+	if resp.GetMessage() != "no deadline" {
+		t.Errorf("Expected no handler deadline, got %q", resp.GetMessage())
+	}
+}
+
+// TestDeadlineExceededEndsStream verifies that an expired grpc-timeout ends the stream
+// with a DEADLINE_EXCEEDED trailer and RST_STREAM even when the handler ignores its
+// context
+func TestDeadlineExceededEndsStream(t *testing.T) {
+	impl := &deadlineGreeter{release: make(chan struct{})}
+	defer close(impl.release)
+
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, impl)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+httpServer.URL[4:], nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "test complete") }()
+
+	streamID := uint32(1)
+	headers := "path: /greeter.Greeter/SayHello\ngrpc-timeout: 100m\n"
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagHEADERS, []byte(headers))); err != nil {
+		t.Fatalf("Failed to send HEADERS: %v", err)
+	}
+	payload, _ := proto.Marshal(&pb.HelloRequest{Name: "ignore"})
+	if err := conn.Write(ctx, websocket.MessageBinary, encodeFrame(streamID, FlagDATA|FlagEOS, payload)); err != nil {
+		t.Fatalf("Failed to send DATA: %v", err)
+	}
+
+	start := time.Now()
+	statusCode, _, ok := readUntilTrailers(t, ctx, conn)
+	if !ok {
+		t.Fatal("Did not receive TRAILERS before the test timeout")
+	}
+	if statusCode != intToStr(int(codes.DeadlineExceeded)) {
+		t.Errorf("Expected grpc-status %d, got %s", codes.DeadlineExceeded, statusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Deadline enforced too late: %v", elapsed)
+	}
+
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("Expected RST_STREAM after trailers: %v", err)
+	}
+	frame, err := decodeFrame(data, 4*1024*1024)
+	if err != nil || frame.Flags&FlagRST_STREAM == 0 || frame.StreamID != streamID {
+		t.Fatalf("Expected RST_STREAM for stream %d, got %+v (err=%v)", streamID, frame, err)
+	}
+	if code := decodeErrorCode(frame.Payload); code != ErrCodeCancel {
+		t.Errorf("Expected CANCEL error code, got %d", code)
+	}
+	if n := activeStreamCount(server); n != 0 {
+		t.Errorf("Expected expired stream to be removed, %d still active", n)
+	}
+}
+
+// TestMalformedTimeoutRefusesStream verifies that an unparsable grpc-timeout is
+// rejected instead of silently running the call without a deadline
+func TestMalformedTimeoutRefusesStream(t *testing.T) {
+	_, _, conn := newTestClientWith(t, &deadlineGreeter{}, nil, ClientOption{})
+
+	// Smuggle a malformed value through outgoing metadata of a call without a deadline
+	mdCtx := metadata.AppendToOutgoingContext(context.Background(), "grpc-timeout", "soon")
+	err := conn.Invoke(mdCtx, "/greeter.Greeter/SayHello", &pb.HelloRequest{Name: "Go"}, &pb.HelloResponse{})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("Expected Internal for malformed grpc-timeout, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package wsgrpc
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/helios57/NgGoRPC/wsgrpc/generated"
+)
+
+// dialTestServer serves server and returns a client connected to it
+func dialTestServer(t *testing.T, server *Server) *ClientConn {
+	t.Helper()
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	t.Cleanup(server.Stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, "ws"+httpServer.URL[4:])
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// TestUnimplementedMethod verifies that methods without a handler fail with
+// UNIMPLEMENTED and grpc-go's messages rather than a bare reset
+func TestUnimplementedMethod(t *testing.T) {
+	server := NewServer(ServerOption{InsecureSkipVerify: true})
+	pb.RegisterGreeterServer(server, &testGreeter{})
+	conn := dialTestServer(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		method  string
+		message string
+	}{
+		{method: "/other.Other/Call", message: "unknown service other.Other"},
+		{method: "/greeter.Greeter/SayGoodbye", message: "unknown method SayGoodbye for service greeter.Greeter"},
+	} {
+		err := conn.Invoke(ctx, tc.method, &pb.HelloRequest{}, &pb.HelloResponse{})
+		st := status.Convert(err)
+		t.Logf("%s: %v", tc.method, err)
+		if st.Code() != codes.Unimplemented || st.Message() != tc.message {
+			t.Errorf("%s: expected UNIMPLEMENTED %q, got %v", tc.method, tc.message, err)
+		}
+	}
+
+	// The connection is still usable
+	if _, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "after"}); err != nil {
+		t.Errorf("SayHello failed after an unknown method: %v", err)
+	}
+}
+
+// TestUnknownServiceHandler verifies that unregistered methods reach the handler as
+// streams of raw payloads, after the stream interceptors
+func TestUnknownServiceHandler(t *testing.T) {
+	var intercepted *grpc.StreamServerInfo
+	server := NewServer(ServerOption{
+		InsecureSkipVerify: true,
+		StreamInterceptors: []grpc.StreamServerInterceptor{
+			func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				intercepted = info
+				return handler(srv, ss)
+			},
+		},
+		// A mock that greets every name it receives, whatever the method
+		UnknownServiceHandler: func(_ interface{}, stream grpc.ServerStream) error {
+			method, _ := grpc.MethodFromServerStream(stream)
+			for {
+				var payload []byte
+				if err := stream.RecvMsg(&payload); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				req := &pb.HelloRequest{}
+				if err := proto.Unmarshal(payload, req); err != nil {
+					return status.Errorf(codes.InvalidArgument, "bad request: %v", err)
+				}
+				resp, _ := proto.Marshal(&pb.HelloResponse{Message: method + " " + req.GetName()})
+				if err := stream.SendMsg(resp); err != nil {
+					return err
+				}
+			}
+		},
+	})
+	conn := dialTestServer(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp := &pb.HelloResponse{}
+	if err := conn.Invoke(ctx, "/mock.Mock/Greet", &pb.HelloRequest{Name: "unary"}, resp); err != nil {
+		t.Fatalf("Invoke failed: %v", err)
+	}
+	if resp.GetMessage() != "/mock.Mock/Greet unary" {
+		t.Errorf("Expected the mock's greeting, got %q", resp.GetMessage())
+	}
+	if intercepted == nil || intercepted.FullMethod != "/mock.Mock/Greet" || !intercepted.IsClientStream || !intercepted.IsServerStream {
+		t.Errorf("Expected the interceptor to see a bidirectional /mock.Mock/Greet, got %+v", intercepted)
+	}
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, "/mock.Mock/Chat")
+	if err != nil {
+		t.Fatalf("NewStream failed: %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := stream.SendMsg(&pb.HelloRequest{Name: name}); err != nil {
+			t.Fatalf("SendMsg failed: %v", err)
+		}
+		if err := stream.RecvMsg(resp); err != nil {
+			t.Fatalf("RecvMsg failed: %v", err)
+		}
+		if resp.GetMessage() != "/mock.Mock/Chat "+name {
+			t.Errorf("Expected the mock's greeting for %s, got %q", name, resp.GetMessage())
+		}
+	}
+	_ = stream.CloseSend()
+	if err := stream.RecvMsg(resp); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}